@@ -0,0 +1,477 @@
+package cronmon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArtifactManifest is the name of the manifest file in the scripts directory
+// that declares scripts to be fetched rather than written into the directory,
+// such as binaries built by CI. It maps script names to Artifacts:
+//
+//	{
+//	    "backup": {"url": "https://example.com/backup", "digest": "sha256:..."},
+//	    "agent":  {"oci": "ghcr.io/me/agent", "digest": "sha256:..."}
+//	}
+//
+// Each artifact is fetched into ArtifactCacheDir and verified against its
+// digest, and the script is then a symlink to the cached file, so it's
+// supervised like any other script. Changing the manifest fetches the changed
+// artifacts and restarts their scripts.
+const ArtifactManifest = ".artifacts.json"
+
+// ArtifactCacheDir is the name of the directory in the scripts directory that
+// artifacts are cached in, named by their digests.
+const ArtifactCacheDir = ".artifacts"
+
+// ArtifactFetchTimeout is the maximum duration of fetching a single artifact.
+var ArtifactFetchTimeout = 10 * time.Minute
+
+// ArtifactRetryInterval is the interval at which artifacts that failed to be
+// fetched are retried.
+var ArtifactRetryInterval = time.Minute
+
+// Artifact describes where the artifact of a script is fetched from. Exactly one
+// of URL and OCI must be set.
+type Artifact struct {
+	// URL is the HTTP or HTTPS URL of the artifact.
+	URL string `json:"url,omitempty"`
+	// OCI is the repository in an OCI registry, such as "ghcr.io/me/agent",
+	// that has the artifact as a blob, such as one pushed with "oras push".
+	// The blob is fetched by its digest, so the repository has no tag.
+	OCI string `json:"oci,omitempty"`
+	// Digest is the digest of the artifact in the "sha256:<hex>" form. It is
+	// required, so that a compromised source can't run anything else.
+	Digest string `json:"digest"`
+}
+
+var artifactDigestRe = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// Validate validates the artifact.
+func (a Artifact) Validate() error {
+	if (a.URL == "") == (a.OCI == "") {
+		return errors.New("exactly one of url and oci is required")
+	}
+	if !artifactDigestRe.MatchString(a.Digest) {
+		return errors.Errorf("invalid digest %q", a.Digest)
+	}
+	if a.URL != "" {
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.Errorf("invalid url %q", a.URL)
+		}
+	}
+	if a.OCI != "" {
+		if _, _, err := parseOCIRepository(a.OCI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// source returns the human-readable source of the artifact.
+func (a Artifact) source() string {
+	if a.URL != "" {
+		return a.URL
+	}
+	return a.OCI + "@" + a.Digest
+}
+
+// LoadArtifacts loads the artifact manifest in the given scripts directory. A
+// nil map is returned if there is no manifest.
+func LoadArtifacts(dir string) (map[string]Artifact, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ArtifactManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read artifact manifest")
+	}
+
+	var artifacts map[string]Artifact
+	if err := json.Unmarshal(b, &artifacts); err != nil {
+		return nil, errors.Wrap(err, "failed to parse artifact manifest")
+	}
+
+	for name, a := range artifacts {
+		if name == "" || !isScriptName(name) || strings.ContainsAny(name, "/\x00") {
+			return nil, errors.Errorf("invalid artifact script name %q", name)
+		}
+		if err := a.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid artifact %q", name)
+		}
+	}
+
+	return artifacts, nil
+}
+
+// parseOCIRepository parses a repository reference into its registry host and
+// repository path. References without a registry are on Docker Hub.
+func parseOCIRepository(ref string) (host, repo string, err error) {
+	if strings.ContainsAny(ref, "@") || strings.Contains(ref[strings.LastIndexByte(ref, '/')+1:], ":") {
+		return "", "", errors.Errorf("oci repository %q must not have a tag or digest", ref)
+	}
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, repo = parts[0], parts[1]
+	} else {
+		host, repo = "registry-1.docker.io", ref
+		if len(parts) == 1 {
+			repo = "library/" + ref
+		}
+	}
+
+	if repo == "" || strings.HasSuffix(repo, "/") {
+		return "", "", errors.Errorf("invalid oci repository %q", ref)
+	}
+
+	return host, repo, nil
+}
+
+// artifactSyncer fetches the artifacts of a scripts directory and points their
+// scripts to them.
+type artifactSyncer struct {
+	dir    string
+	j      Journaler
+	client *http.Client
+}
+
+// run syncs the artifacts whenever the manifest changes, as signaled by
+// changed, until the context is canceled. Failed syncs are retried every
+// ArtifactRetryInterval.
+func (s *artifactSyncer) run(ctx context.Context, changed <-chan struct{}) {
+	for {
+		var timer *time.Timer
+		var retry <-chan time.Time
+
+		if !s.sync(ctx) {
+			timer = time.NewTimer(ArtifactRetryInterval)
+			retry = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-retry:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// sync fetches the missing artifacts of the manifest and updates the links of
+// their scripts. Links of artifacts that were removed from the manifest are
+// removed. False is returned if anything failed, which is journaled.
+func (s *artifactSyncer) sync(ctx context.Context) bool {
+	artifacts, err := LoadArtifacts(s.dir)
+	if err != nil {
+		s.warn(err.Error())
+		return false
+	}
+
+	ok := true
+
+	names := make([]string, 0, len(artifacts))
+	for name := range artifacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := s.syncArtifact(ctx, name, artifacts[name]); err != nil {
+			s.warn(fmt.Sprintf("artifact %q: %v", name, err))
+			ok = false
+		}
+	}
+
+	if err := s.prune(artifacts); err != nil {
+		s.warn(err.Error())
+		ok = false
+	}
+
+	return ok
+}
+
+func (s *artifactSyncer) warn(msg string) {
+	s.j.Write(&EventWarning{Component: "artifacts", Error: msg})
+}
+
+// artifactLink returns the symlink target of the script of the given digest,
+// relative to the scripts directory.
+func artifactLink(digest string) string {
+	return filepath.Join(ArtifactCacheDir, strings.TrimPrefix(digest, "sha256:"))
+}
+
+// isArtifactLink returns true if the file at the given path is a symlink to a
+// cached artifact, which means that it's managed by the syncer.
+func isArtifactLink(path string) bool {
+	target, err := os.Readlink(path)
+	return err == nil && filepath.Dir(target) == ArtifactCacheDir
+}
+
+func (s *artifactSyncer) syncArtifact(ctx context.Context, name string, a Artifact) error {
+	path := filepath.Join(s.dir, name)
+	link := artifactLink(a.Digest)
+
+	if target, err := os.Readlink(path); err == nil && target == link {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+	} else if _, err := os.Lstat(path); err == nil && !isArtifactLink(path) {
+		return errors.New("a script with the same name already exists")
+	}
+
+	cached := filepath.Join(s.dir, link)
+	if _, err := os.Stat(cached); os.IsNotExist(err) {
+		if err := s.fetch(ctx, a, cached); err != nil {
+			return err
+		}
+
+		s.j.Write(&EventArtifactFetched{
+			File:   name,
+			Source: a.source(),
+			Digest: a.Digest,
+		})
+	}
+
+	// Replace the link atomically, so that the script is updated rather than
+	// removed and added.
+	tmp := filepath.Join(s.dir, "."+name+".link")
+	os.Remove(tmp)
+
+	if err := os.Symlink(link, tmp); err != nil {
+		return errors.Wrap(err, "failed to link script")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to link script")
+	}
+
+	return nil
+}
+
+// fetch fetches the artifact into the given path once its digest is verified.
+func (s *artifactSyncer) fetch(ctx context.Context, a Artifact, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, ArtifactFetchTimeout)
+	defer cancel()
+
+	body, err := s.open(ctx, a)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return errors.Wrap(err, "failed to create cache")
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".fetch-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create cache file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), body); err != nil {
+		return errors.Wrap(err, "failed to download")
+	}
+
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != a.Digest {
+		return errors.Errorf("digest mismatch: got %s", digest)
+	}
+
+	if err := f.Chmod(0755); err != nil {
+		return errors.Wrap(err, "failed to make artifact executable")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write cache file")
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to write cache file")
+	}
+
+	return nil
+}
+
+// open returns the body of the artifact.
+func (s *artifactSyncer) open(ctx context.Context, a Artifact) (io.ReadCloser, error) {
+	if a.URL != "" {
+		return s.get(ctx, a.URL, "")
+	}
+
+	host, repo, err := parseOCIRepository(a.OCI)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, repo, a.Digest)
+
+	body, err := s.get(ctx, blob, "")
+	if err == nil {
+		return body, nil
+	}
+
+	// Public registries require an anonymous token even for public blobs.
+	var authErr *registryAuthError
+	if !errors.As(err, &authErr) {
+		return nil, err
+	}
+
+	token, err := s.registryToken(ctx, authErr.challenge)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate to registry")
+	}
+
+	return s.get(ctx, blob, token)
+}
+
+// registryAuthError is returned by get for a 401 with a bearer challenge.
+type registryAuthError struct {
+	challenge string
+}
+
+func (err *registryAuthError) Error() string {
+	return "unauthorized"
+}
+
+// get sends a GET request to the URL and returns the body of a successful
+// response.
+func (s *artifactSyncer) get(ctx context.Context, u, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode == http.StatusUnauthorized && token == "" && strings.HasPrefix(challenge, "Bearer ") {
+		return nil, &registryAuthError{challenge}
+	}
+
+	return nil, errors.Errorf("unexpected status %s", resp.Status)
+}
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryToken requests an anonymous token for the given bearer challenge, as
+// described by the Docker registry token authentication specification.
+func (s *artifactSyncer) registryToken(ctx context.Context, challenge string) (string, error) {
+	params := map[string]string{}
+	for _, m := range challengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return "", errors.Errorf("invalid realm %q", params["realm"])
+	}
+
+	q := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if v := params[key]; v != "" {
+			q.Set(key, v)
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	body, err := s.get(ctx, realm.String(), "")
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var reply struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&reply); err != nil {
+		return "", errors.Wrap(err, "failed to decode token")
+	}
+
+	if reply.Token != "" {
+		return reply.Token, nil
+	}
+	if reply.AccessToken != "" {
+		return reply.AccessToken, nil
+	}
+	return "", errors.New("no token returned")
+}
+
+// prune removes the links of scripts that are no longer in the manifest and
+// the cached artifacts that are no longer linked. Processes of removed
+// artifacts keep running from their removed files until they're stopped.
+func (s *artifactSyncer) prune(artifacts map[string]Artifact) error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to scan directory")
+	}
+
+	linked := map[string]bool{}
+
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.Name())
+		if !isScriptName(file.Name()) || !isArtifactLink(path) {
+			continue
+		}
+
+		if _, ok := artifacts[file.Name()]; !ok {
+			os.Remove(path)
+			continue
+		}
+
+		target, _ := os.Readlink(path)
+		linked[filepath.Base(target)] = true
+	}
+
+	cached, err := os.ReadDir(filepath.Join(s.dir, ArtifactCacheDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to scan artifact cache")
+	}
+
+	for _, file := range cached {
+		if !linked[file.Name()] {
+			os.Remove(filepath.Join(s.dir, ArtifactCacheDir, file.Name()))
+		}
+	}
+
+	return nil
+}
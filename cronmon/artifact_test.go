@@ -0,0 +1,177 @@
+package cronmon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func artifactDigest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestArtifactSync(t *testing.T) {
+	v1 := []byte("#!/bin/sh\necho v1\n")
+	v2 := []byte("#!/bin/sh\necho v2\n")
+
+	var tokens int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1", func(w http.ResponseWriter, r *http.Request) { w.Write(v1) })
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "repository:me/agent:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"token":"t"}`))
+	})
+	mux.HandleFunc("/v2/me/agent/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://`+r.Host+`/token",`+
+				`service="registry",scope="repository:me/agent:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.TrimPrefix(r.URL.Path, "/v2/me/agent/blobs/") != artifactDigest(v2) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(v2)
+	})
+
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	dir := t.TempDir()
+	j := &mockJournal{}
+	s := &artifactSyncer{dir: dir, j: j, client: srv.Client()}
+
+	writeManifest := func(manifest string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, ArtifactManifest), []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readScript := func(name string) string {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal("failed to read script:", err)
+		}
+		return string(b)
+	}
+
+	writeManifest(`{
+		"a": {"url": "` + srv.URL + `/v1", "digest": "` + artifactDigest(v1) + `"},
+		"b": {"oci": "` + host + `/me/agent", "digest": "` + artifactDigest(v2) + `"}
+	}`)
+
+	if !s.sync(context.Background()) {
+		t.Fatalf("sync failed: %#v", j.Journals())
+	}
+
+	if got := readScript("a"); got != string(v1) {
+		t.Errorf("unexpected script a: %q", got)
+	}
+	if got := readScript("b"); got != string(v2) {
+		t.Errorf("unexpected script b: %q", got)
+	}
+	if tokens != 1 {
+		t.Errorf("expected 1 token request, got %d", tokens)
+	}
+
+	j.Verify(t, true, []Event{
+		&EventArtifactFetched{File: "a", Source: srv.URL + "/v1", Digest: artifactDigest(v1)},
+		&EventArtifactFetched{File: "b", Source: host + "/me/agent@" + artifactDigest(v2), Digest: artifactDigest(v2)},
+	})
+
+	// Point a to v2 and remove b. The cached v2 is reused, and v1 is pruned.
+	writeManifest(`{"a": {"oci": "` + host + `/me/agent", "digest": "` + artifactDigest(v2) + `"}}`)
+
+	if !s.sync(context.Background()) {
+		t.Fatalf("sync failed: %#v", j.Journals())
+	}
+
+	if got := readScript("a"); got != string(v2) {
+		t.Errorf("unexpected updated script a: %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Error("removed artifact b still exists:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, artifactLink(artifactDigest(v1)))); !os.IsNotExist(err) {
+		t.Error("unused artifact v1 is still cached:", err)
+	}
+
+	j.Verify(t, true, nil)
+
+	// A wrong digest is never linked, and neither is a script clobbered.
+	if err := os.WriteFile(filepath.Join(dir, "c"), v1, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeManifest(`{
+		"a": {"url": "` + srv.URL + `/v1", "digest": "` + artifactDigest([]byte("v3")) + `"},
+		"c": {"url": "` + srv.URL + `/v1", "digest": "` + artifactDigest(v1) + `"}
+	}`)
+
+	if s.sync(context.Background()) {
+		t.Fatal("sync with a mismatched digest succeeded")
+	}
+
+	if got := readScript("a"); got != string(v2) {
+		t.Errorf("script a changed to %q", got)
+	}
+
+	warnings := j.Journals()
+	if len(warnings) != 2 ||
+		!strings.Contains(warnings[0].(*EventWarning).Error, "digest mismatch") ||
+		!strings.Contains(warnings[1].(*EventWarning).Error, "already exists") {
+		t.Errorf("unexpected warnings: %#v", warnings)
+	}
+}
+
+func TestLoadArtifacts(t *testing.T) {
+	digest := artifactDigest(nil)
+
+	tests := []struct {
+		manifest string
+		fail     bool
+	}{
+		{`{"a": {"url": "https://example.com/a", "digest": "` + digest + `"}}`, false},
+		{`{"a": {"oci": "ghcr.io/me/a", "digest": "` + digest + `"}}`, false},
+		{`{"a": {"oci": "alpine", "digest": "` + digest + `"}}`, false},
+		{`{"a": {"oci": "ghcr.io/me/a:v1", "digest": "` + digest + `"}}`, true},
+		{`{"a": {"url": "file:///bin/sh", "digest": "` + digest + `"}}`, true},
+		{`{"a": {"url": "https://example.com/a", "digest": "md5:00"}}`, true},
+		{`{"a": {"digest": "` + digest + `"}}`, true},
+		{`{".a": {"url": "https://example.com/a", "digest": "` + digest + `"}}`, true},
+		{`{"a/b": {"url": "https://example.com/a", "digest": "` + digest + `"}}`, true},
+	}
+
+	dir := t.TempDir()
+
+	for _, test := range tests {
+		if err := os.WriteFile(filepath.Join(dir, ArtifactManifest), []byte(test.manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := LoadArtifacts(dir)
+		if test.fail && err == nil {
+			t.Errorf("manifest %s: expected error", test.manifest)
+		}
+		if !test.fail && err != nil {
+			t.Errorf("manifest %s: unexpected error: %v", test.manifest, err)
+		}
+	}
+}
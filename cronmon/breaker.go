@@ -0,0 +1,78 @@
+package cronmon
+
+import (
+	"sync"
+	"time"
+)
+
+// MonitorRestartLimit is the default number of automatic restarts per minute
+// across all processes above which the monitor is throttled. A storm of
+// restarts usually means that a dependency shared by every script, such as a
+// database or the network, is down, so restarting them as fast as their
+// backoffs allow only adds load to the host. See MonitorOptions.RestartLimit.
+var MonitorRestartLimit = 30
+
+// MonitorThrottleCooldown is how long the monitor stays throttled after the
+// last time the restart limit was exceeded.
+var MonitorThrottleCooldown = 5 * time.Minute
+
+// MonitorThrottledBackoff is the minimum delay of every automatic restart
+// while the monitor is throttled. Longer backoffs are kept.
+var MonitorThrottledBackoff = time.Minute
+
+// restartBreaker counts the automatic restarts of all processes of a monitor
+// and throttles them once there are too many. It is safe to use concurrently.
+type restartBreaker struct {
+	j     Journaler
+	limit int
+
+	mut      sync.Mutex
+	restarts []time.Time // within the last minute, oldest to newest
+	until    time.Time   // the end of the cool-down, if throttled
+}
+
+func newRestartBreaker(j Journaler, limit int) *restartBreaker {
+	return &restartBreaker{j: j, limit: limit}
+}
+
+// restart records an automatic restart at the given time that is delayed by
+// the given backoff, and returns the delay to use instead. EventMonitorThrottled
+// is journaled if the monitor becomes throttled.
+func (b *restartBreaker) restart(now time.Time, backoff time.Duration) time.Duration {
+	if b == nil || b.limit <= 0 {
+		return backoff
+	}
+
+	b.mut.Lock()
+
+	since := now.Add(-time.Minute)
+	for len(b.restarts) > 0 && b.restarts[0].Before(since) {
+		b.restarts = b.restarts[1:]
+	}
+	b.restarts = append(b.restarts, now)
+
+	var tripped *EventMonitorThrottled
+	if len(b.restarts) > b.limit {
+		if !now.Before(b.until) {
+			tripped = &EventMonitorThrottled{
+				Restarts: len(b.restarts),
+				Limit:    b.limit,
+				Until:    now.Add(MonitorThrottleCooldown),
+			}
+		}
+		b.until = now.Add(MonitorThrottleCooldown)
+	}
+
+	throttled := now.Before(b.until)
+
+	b.mut.Unlock()
+
+	if tripped != nil {
+		b.j.Write(tripped)
+	}
+
+	if throttled && backoff < MonitorThrottledBackoff {
+		return MonitorThrottledBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,51 @@
+package cronmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartBreaker(t *testing.T) {
+	var j mockJournal
+	b := newRestartBreaker(&j, 3)
+
+	now := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if wait := b.restart(now, time.Second); wait != time.Second {
+			t.Fatalf("restart %d throttled to %v", i, wait)
+		}
+	}
+
+	// The 4th restart within a minute trips the breaker.
+	if wait := b.restart(now, time.Second); wait != MonitorThrottledBackoff {
+		t.Fatalf("restart over the limit delayed by %v", wait)
+	}
+
+	// Longer backoffs are kept.
+	if wait := b.restart(now, time.Hour); wait != time.Hour {
+		t.Fatalf("long backoff changed to %v", wait)
+	}
+
+	j.Verify(t, true, []Event{
+		&EventMonitorThrottled{Restarts: 4, Limit: 3, Until: now.Add(MonitorThrottleCooldown)},
+	})
+
+	// Restarts under the limit are still throttled during the cool-down.
+	now = now.Add(2 * time.Minute)
+	if wait := b.restart(now, time.Second); wait != MonitorThrottledBackoff {
+		t.Fatalf("restart during cool-down delayed by %v", wait)
+	}
+
+	now = now.Add(MonitorThrottleCooldown)
+	if wait := b.restart(now, time.Second); wait != time.Second {
+		t.Fatalf("restart after cool-down delayed by %v", wait)
+	}
+
+	if wait := (*restartBreaker)(nil).restart(now, time.Second); wait != time.Second {
+		t.Fatalf("nil breaker delayed restart by %v", wait)
+	}
+	if wait := newRestartBreaker(&j, -1).restart(now, time.Second); wait != time.Second {
+		t.Fatalf("disabled breaker delayed restart by %v", wait)
+	}
+}
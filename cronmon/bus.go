@@ -0,0 +1,105 @@
+package cronmon
+
+import (
+	"sync"
+	"time"
+)
+
+// EventBusBuffer is the number of events that each subscriber of an EventBus
+// may fall behind by before it misses events.
+var EventBusBuffer = 256
+
+// EventBus is a Journaler that fans the events written into it out to
+// subscribers, such as live event streams. Subscribers that fall behind miss
+// events instead of blocking the journal. It is safe for concurrent use.
+type EventBus struct {
+	mutex sync.Mutex
+	subs  map[*Subscription]struct{}
+}
+
+var _ TimedJournaler = (*EventBus)(nil)
+
+// NewEventBus creates a new EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: map[*Subscription]struct{}{}}
+}
+
+// ID returns "bus".
+func (b *EventBus) ID() string { return "bus" }
+
+// Write sends the event to the subscribers that want it. It never fails.
+func (b *EventBus) Write(ev Event) error {
+	return b.WriteAt(ev, time.Now())
+}
+
+// WriteAt sends the event to the subscribers like Write with the given time.
+func (b *EventBus) WriteAt(ev Event, t time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subs {
+		if sub.filter != nil && !sub.filter(ev) {
+			continue
+		}
+
+		select {
+		case sub.events <- JournalEntry{Time: t, Event: ev}:
+		default:
+			sub.dropped++
+		}
+	}
+
+	return nil
+}
+
+// Subscribe subscribes to the events that filter returns true for, or to all
+// events if it's nil. The filter is called while writing into the journal, so
+// it must be fast. The subscription must be closed once it's no longer used.
+func (b *EventBus) Subscribe(filter func(Event) bool) *Subscription {
+	sub := &Subscription{
+		bus:    b,
+		filter: filter,
+		events: make(chan JournalEntry, EventBusBuffer),
+	}
+
+	b.mutex.Lock()
+	b.subs[sub] = struct{}{}
+	b.mutex.Unlock()
+
+	return sub
+}
+
+// Subscription is a subscription to an EventBus.
+type Subscription struct {
+	bus     *EventBus
+	filter  func(Event) bool
+	events  chan JournalEntry
+	dropped int
+}
+
+// Events returns the channel that the events are sent into. It is closed once
+// the subscription is closed.
+func (s *Subscription) Events() <-chan JournalEntry {
+	return s.events
+}
+
+// Dropped returns the number of events that were missed because the
+// subscriber fell behind.
+func (s *Subscription) Dropped() int {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	return s.dropped
+}
+
+// Close unsubscribes and closes the channel of events. It may be called more
+// than once.
+func (s *Subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,51 @@
+package cronmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+
+	all := bus.Subscribe(nil)
+	defer all.Close()
+
+	exits := bus.Subscribe(func(ev Event) bool {
+		_, ok := ev.(*EventProcessExited)
+		return ok
+	})
+	defer exits.Close()
+
+	now := time.Now()
+	bus.WriteAt(&EventProcessSpawned{File: "a", PID: 1}, now)
+	bus.WriteAt(&EventProcessExited{File: "a", PID: 1}, now)
+
+	if got := len(all.Events()); got != 2 {
+		t.Errorf("unfiltered subscriber got %d events, expected 2", got)
+	}
+
+	if entry := <-exits.Events(); entry.Time != now || entry.Event.Type() != eventProcessExited {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if got := len(exits.Events()); got != 0 {
+		t.Errorf("filtered subscriber got %d more events", got)
+	}
+
+	// A full subscriber misses events without blocking.
+	for i := 0; i < EventBusBuffer; i++ {
+		bus.Write(&EventProcessExited{File: "a", PID: 1})
+	}
+	if dropped := all.Dropped(); dropped != 2 {
+		t.Errorf("dropped %d events, expected 2", dropped)
+	}
+
+	// Closing twice is fine, and closed subscribers aren't written to. The
+	// buffered events are drained until the channel is closed.
+	exits.Close()
+	exits.Close()
+	bus.Write(&EventProcessExited{File: "a", PID: 1})
+
+	for range exits.Events() {
+	}
+}
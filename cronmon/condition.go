@@ -0,0 +1,233 @@
+package cronmon
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConditionCheckInterval is the interval at which the start conditions of a
+// waiting process are re-evaluated. They are also re-evaluated whenever another
+// process is spawned.
+var ConditionCheckInterval = 5 * time.Second
+
+// ConditionDialTimeout is the timeout for checking whether a host in a "tcp:"
+// start condition is reachable.
+var ConditionDialTimeout = 2 * time.Second
+
+// waiterSet contains the processes of a monitor that are waiting for their
+// start conditions, so that only they are made to re-evaluate them whenever
+// another process is spawned. It is safe to use concurrently.
+type waiterSet struct {
+	mut   sync.Mutex
+	procs map[*Process]struct{}
+}
+
+func newWaiterSet() *waiterSet {
+	return &waiterSet{procs: map[*Process]struct{}{}}
+}
+
+// set adds the process to the set if it's waiting or removes it otherwise.
+func (s *waiterSet) set(proc *Process, waiting bool) {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if waiting {
+		s.procs[proc] = struct{}{}
+	} else {
+		delete(s.procs, proc)
+	}
+}
+
+// recheck makes all waiting processes re-evaluate their start conditions.
+func (s *waiterSet) recheck() {
+	if s == nil {
+		return
+	}
+
+	s.mut.Lock()
+	procs := make([]*Process, 0, len(s.procs))
+	for proc := range s.procs {
+		procs = append(procs, proc)
+	}
+	s.mut.Unlock()
+
+	for _, proc := range procs {
+		proc.RecheckConditions()
+	}
+}
+
+// conditionKind is the kind of a start condition in ScriptConfig.Conditions.
+type conditionKind string
+
+const (
+	conditionPath   conditionKind = "path"
+	conditionTCP    conditionKind = "tcp"
+	conditionEnv    conditionKind = "env"
+	conditionScript conditionKind = "script"
+	conditionRoute  conditionKind = "route"
+	conditionDNS    conditionKind = "dns"
+	conditionIface  conditionKind = "iface"
+)
+
+// networkCondition is the start condition implied by ScriptConfig.WaitNetwork.
+const networkCondition = "route:default"
+
+func parseCondition(cond string) (conditionKind, string, error) {
+	i := strings.IndexByte(cond, ':')
+	if i < 0 || i == len(cond)-1 {
+		return "", "", errors.Errorf("invalid condition %q", cond)
+	}
+
+	kind, arg := conditionKind(cond[:i]), cond[i+1:]
+
+	switch kind {
+	case conditionPath, conditionEnv, conditionScript, conditionDNS, conditionIface:
+		return kind, arg, nil
+	case conditionRoute:
+		if arg != "default" {
+			return "", "", errors.Errorf("invalid condition %q, only route:default is supported", cond)
+		}
+		return kind, arg, nil
+	case conditionTCP:
+		if _, _, err := net.SplitHostPort(arg); err != nil {
+			return "", "", errors.Wrapf(err, "invalid condition %q", cond)
+		}
+		return kind, arg, nil
+	default:
+		return "", "", errors.Errorf("unknown condition kind %q", kind)
+	}
+}
+
+// unmetCondition returns the first condition in conds that is not met, or an
+// empty string if all of them are met. isRunning is used to check whether
+// another script is running; if it's nil, then "script:" conditions are never
+// met.
+func unmetCondition(dir string, conds []string, isRunning func(string) bool) string {
+	for _, cond := range conds {
+		kind, arg, err := parseCondition(cond)
+		if err != nil {
+			return cond
+		}
+
+		var met bool
+
+		switch kind {
+		case conditionPath:
+			_, err := os.Stat(resolvePath(dir, arg))
+			met = err == nil
+		case conditionTCP:
+			conn, err := net.DialTimeout("tcp", arg, ConditionDialTimeout)
+			if err == nil {
+				conn.Close()
+				met = true
+			}
+		case conditionEnv:
+			_, met = os.LookupEnv(arg)
+		case conditionScript:
+			met = isRunning != nil && isRunning(arg)
+		case conditionRoute:
+			met = hasDefaultRoute()
+		case conditionDNS:
+			ctx, cancel := context.WithTimeout(context.Background(), ConditionDialTimeout)
+			addrs, err := net.DefaultResolver.LookupHost(ctx, arg)
+			cancel()
+			met = err == nil && len(addrs) > 0
+		case conditionIface:
+			met = isInterfaceUp(arg)
+		}
+
+		if !met {
+			return cond
+		}
+	}
+
+	return ""
+}
+
+// hasDefaultRoute returns true if the system has an IPv4 or IPv6 default route
+// that is up. It is Linux-only.
+func hasDefaultRoute() bool {
+	for _, path := range []string{"/proc/net/route", "/proc/net/ipv6_route"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		ok := parseDefaultRoute(f, path == "/proc/net/ipv6_route")
+		f.Close()
+
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseDefaultRoute returns true if the given routing table in the format of
+// /proc/net/route, or /proc/net/ipv6_route if ipv6 is true, has a default route
+// that is up. Routes over the loopback interface are ignored.
+func parseDefaultRoute(r io.Reader, ipv6 bool) bool {
+	const rtfUp = 0x1
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		var iface, dest, flags string
+
+		if ipv6 {
+			// dest, dest prefix, src, src prefix, next hop, metric, refcnt,
+			// use, flags, iface
+			if len(fields) < 10 || fields[1] != "00" {
+				continue
+			}
+			iface, dest, flags = fields[9], fields[0], fields[8]
+			if strings.Trim(dest, "0") != "" {
+				continue
+			}
+		} else {
+			// iface, dest, gateway, flags, ...; the first line is a header.
+			if len(fields) < 4 || fields[1] != "00000000" {
+				continue
+			}
+			iface, flags = fields[0], fields[3]
+		}
+
+		if iface == "lo" {
+			continue
+		}
+
+		f, err := strconv.ParseUint(flags, 16, 32)
+		if err == nil && f&rtfUp != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isInterfaceUp returns true if the network interface with the given name is
+// up and has an address.
+func isInterfaceUp(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return false
+	}
+
+	addrs, err := iface.Addrs()
+	return err == nil && len(addrs) > 0
+}
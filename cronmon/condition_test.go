@@ -0,0 +1,77 @@
+package cronmon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnmetCondition(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "exists"), nil, 0600); err != nil {
+		t.Fatal("failed to create file:", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	defer l.Close()
+
+	os.Setenv("CRONMON_TEST_CONDITION", "1")
+	defer os.Unsetenv("CRONMON_TEST_CONDITION")
+
+	isRunning := func(file string) bool { return file == "db.sh" }
+
+	tests := []struct {
+		conds  []string
+		expect string
+	}{
+		{nil, ""},
+		{[]string{"path:exists", "path:" + filepath.Join(dir, "exists")}, ""},
+		{[]string{"path:exists", "path:missing"}, "path:missing"},
+		{[]string{"tcp:" + l.Addr().String()}, ""},
+		{[]string{"env:CRONMON_TEST_CONDITION", "env:CRONMON_TEST_UNSET"}, "env:CRONMON_TEST_UNSET"},
+		{[]string{"script:db.sh", "script:web.sh"}, "script:web.sh"},
+	}
+
+	for _, test := range tests {
+		if cond := unmetCondition(dir, test.conds, isRunning); cond != test.expect {
+			t.Errorf("conditions %q: got unmet %q, expected %q", test.conds, cond, test.expect)
+		}
+	}
+}
+
+func TestParseDefaultRoute(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\n"
+
+	tests := []struct {
+		table  string
+		ipv6   bool
+		expect bool
+	}{
+		{header, false, false},
+		{header + "eth0\t00000000\t0100A8C0\t0003\t0\t0\t100\t00000000\n", false, true},
+		{header + "eth0\t0000A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\n", false, false},
+		{header + "eth0\t00000000\t0100A8C0\t0002\t0\t0\t100\t00000000\n", false, false},
+		{
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 " +
+				"fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0\n",
+			true, true,
+		},
+		{
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 " +
+				"00000000000000000000000000000000 ffffffff 00000001 00000000 00200200 lo\n",
+			true, false,
+		},
+	}
+
+	for i, test := range tests {
+		if ok := parseDefaultRoute(strings.NewReader(test.table), test.ipv6); ok != test.expect {
+			t.Errorf("table %d: got %v, expected %v", i, ok, test.expect)
+		}
+	}
+}
@@ -0,0 +1,715 @@
+package cronmon
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ScriptConfig is the optional per-script configuration. It is read from a
+// hidden JSON file next to the script named ".<script>.json", and it is
+// reloaded every time the process is started. Changing the file restarts the
+// process.
+type ScriptConfig struct {
+	// Stdin describes what the process' stdin is connected to. It is one of:
+	//
+	//    "" or "null"   /dev/null
+	//    "pipe"         a pipe that can be written to over the control API
+	//    "fifo:<path>"  a named pipe, created if needed, that can also be
+	//                   written to over the control API
+	//    "file:<path>"  a file
+	//
+	// Relative paths are relative to the scripts directory.
+	Stdin string `json:"stdin,omitempty"`
+	// Log is the path to a file that the process' stdout and stderr are
+	// appended to. The output is discarded if it's empty. Relative paths are
+	// relative to the scripts directory.
+	Log string `json:"log,omitempty"`
+	// LogMaxSize is the size in bytes at which the log file is rotated. The
+	// log is never rotated if it's 0.
+	LogMaxSize int64 `json:"log_max_size,omitempty"`
+	// LogMaxFiles is the number of rotated log files to keep. It defaults to
+	// DefaultLogMaxFiles.
+	LogMaxFiles int `json:"log_max_files,omitempty"`
+	// LogCompress, if true, compresses rotated log files with gzip.
+	LogCompress bool `json:"log_compress,omitempty"`
+	// Dir is the working directory of the process. It defaults to the
+	// scripts directory, and relative paths are relative to it.
+	Dir string `json:"dir,omitempty"`
+	// Umask is the octal file mode creation mask of the process, such as
+	// "027". The process inherits cronmon's umask if it's empty.
+	//
+	// Dir, Umask, Groups, ClearGroups, Seccomp and CoreDump only apply to
+	// processes that run locally, not to containers, remote processes or other
+	// spawners.
+	Umask string `json:"umask,omitempty"`
+	// Groups, if not empty, replaces the supplementary groups of the process
+	// with the given group names or IDs. Changing them requires cronmon to run
+	// as root or with CAP_SETGID.
+	Groups []string `json:"groups,omitempty"`
+	// ClearGroups, if true, drops all supplementary groups of the process, so
+	// that it doesn't inherit cronmon's. It is mutually exclusive with Groups,
+	// and it also requires root or CAP_SETGID.
+	ClearGroups bool `json:"clear_groups,omitempty"`
+	// Seccomp, if not empty, is the seccomp filter that is applied to the
+	// process, so that it can't make the syscalls that the filter denies. It
+	// is one of:
+	//
+	//    "default"      deny syscalls that administer the system, such as
+	//                   mounting or loading kernel modules, or that trace
+	//                   other processes
+	//    "no-network"   "default", and deny sockets other than Unix sockets
+	//    "file:<path>"  a compiled filter, such as one exported by libseccomp
+	//
+	// Relative paths are relative to the scripts directory.
+	Seccomp string `json:"seccomp,omitempty"`
+	// PTY, if true, runs the process under a pseudo-terminal, for programs
+	// that buffer their output or behave differently without one. The
+	// terminal's output is written to Log, and it is also the process' stdin
+	// unless Stdin is set.
+	PTY bool `json:"pty,omitempty"`
+	// LastWords is the number of bytes of the process' last output that are
+	// journaled with EventProcessExited if it exits with a nonzero code, so
+	// that the cause of a crash is visible from the journal. Since stdout
+	// and stderr are the same pipe, this is their combined output. It is cut
+	// to MaxEventFieldSize, and nothing is kept if it's 0.
+	LastWords int `json:"last_words,omitempty"`
+	// CoreDump, if not nil, enables core dumps of the process and collects
+	// them when it crashes. See CoreDumpConfig.
+	CoreDump *CoreDumpConfig `json:"core_dump,omitempty"`
+	// Syslog, if not empty, is the syslog facility, such as "user" or
+	// "local0", that the process' stdout and stderr are also written to with
+	// the script name as the tag. On systems with journald, the output then
+	// ends up in the journal as well.
+	Syslog string `json:"syslog,omitempty"`
+	// Events, if true, makes output lines prefixed with ProcessEventPrefix be
+	// journaled as events reported by the process, such as its progress,
+	// health or metrics.
+	Events bool `json:"events,omitempty"`
+	// WaitReady, if true, makes the process only be considered started once it
+	// reports an event with "ready" set to true. It requires Events.
+	WaitReady bool `json:"wait_ready,omitempty"`
+	// StartTimeout is the duration that a process has to become ready within.
+	// Otherwise, the process is killed, and it is restarted after a backoff
+	// like a crashed one. It requires WaitReady. There is no timeout if it's
+	// 0.
+	StartTimeout Duration `json:"start_timeout,omitempty"`
+	// MaxRuntime is the duration after which the process is terminated, such
+	// as for batch scripts that sometimes hang. There is no limit if it's 0.
+	MaxRuntime Duration `json:"max_runtime,omitempty"`
+	// StopTimeout is the duration that the process has to exit within after
+	// SIGTERM before it's killed, such as for databases that take long to
+	// shut down cleanly. It defaults to ProcessWaitTimeout.
+	StopTimeout Duration `json:"stop_timeout,omitempty"`
+	// MinUptime is the duration that the process must be up for, counted from
+	// when it's ready if WaitReady is true, to be considered stably started.
+	// Its restart backoff is only reset then. It defaults to
+	// ProcessMinUptime.
+	MinUptime Duration `json:"min_uptime,omitempty"`
+	// RestartEvery is the duration after which a running process is gracefully
+	// restarted, such as for leaky daemons that need periodic recycling.
+	RestartEvery Duration `json:"restart_every,omitempty"`
+	// RestartAt is the local time of day in the "15:04" format at which a
+	// running process is gracefully restarted every day. If RestartEvery is
+	// also set, then whichever comes first is used.
+	RestartAt string `json:"restart_at,omitempty"`
+	// Conditions are the conditions that must all be met before the process
+	// is started. Until then, the process is waiting. Each condition is one
+	// of:
+	//
+	//    "path:<path>"       the path exists
+	//    "tcp:<host>:<port>" the host accepts TCP connections on the port
+	//    "env:<name>"        the environment variable is set
+	//    "script:<script>"   the other script is running
+	//    "route:default"     the system has a default route
+	//    "dns:<host>"        the host name can be resolved
+	//    "iface:<name>"      the network interface is up and has an address
+	//
+	// Relative paths are relative to the scripts directory.
+	Conditions []string `json:"conditions,omitempty"`
+	// WaitNetwork, if true, adds the "route:default" start condition, so that
+	// network daemons aren't started before networking is up, such as when
+	// cronmon is started on boot.
+	WaitNetwork bool `json:"wait_network,omitempty"`
+	// EnvAllow is the list of environment variables, in addition to
+	// DefaultEnvAllow, that are passed from cronmon to the process. Each entry
+	// may be a pattern as described by path.Match, such as "AWS_*".
+	EnvAllow []string `json:"env_allow,omitempty"`
+	// EnvInherit, if true, passes cronmon's whole environment to the process.
+	EnvInherit bool `json:"env_inherit,omitempty"`
+	// StandardEnv, if true, sets PATH to DefaultPath and HOME, USER and
+	// LOGNAME to those of the user that cronmon runs as, instead of passing
+	// them from cronmon, so that the process gets the same environment
+	// whether cronmon was started by cron, systemd or an interactive shell.
+	// Env still overrides them.
+	StandardEnv bool `json:"standard_env,omitempty"`
+	// Env is the environment variables that are set for the process. They
+	// override the ones passed from cronmon.
+	Env map[string]string `json:"env,omitempty"`
+	// Secrets maps environment variables to secrets that are resolved every
+	// time the process is spawned, so that they don't have to be hardcoded in
+	// scripts. The values are never journaled. Each reference is one of:
+	//
+	//    "file:<path>"     the contents of the file
+	//    "exec:<command>"  the output of the shell command
+	//
+	// Trailing newlines are trimmed. Relative paths are relative to the
+	// scripts directory, which is also where commands are run in.
+	Secrets map[string]string `json:"secrets,omitempty"`
+	// WatchPaths are the paths of external files, such as configuration
+	// files or certificates, that restart the process when they change. The
+	// parent directory of each file is watched, so files that are replaced
+	// by renaming another file over them are caught as well. If a path is a
+	// directory, then a change of any file directly inside it restarts the
+	// process. Relative paths are relative to the scripts directory.
+	WatchPaths []string `json:"watch_paths,omitempty"`
+	// ReloadSignal, if not empty, is the signal, such as "SIGHUP", that is
+	// sent to the running process instead of restarting it when its watched
+	// paths or this configuration change. A changed configuration is only
+	// fully applied once the process is next restarted, such as its
+	// environment, but the script itself changing always restarts it.
+	ReloadSignal string `json:"reload_signal,omitempty"`
+	// Group is the name of the group that the script belongs to, so that the
+	// scripts of a group can be started, stopped and restarted together.
+	Group string `json:"group,omitempty"`
+	// Priority controls the order in which scripts are started when the
+	// scripts directory is scanned, from the lowest to the highest. It
+	// overrides the priority prefix of the script's file name. See
+	// ParseScriptName.
+	Priority *int `json:"priority,omitempty"`
+	// Container, if not nil, runs the process inside a container instead of
+	// directly on the host. See ContainerConfig.
+	Container *ContainerConfig `json:"container,omitempty"`
+	// Remote, if not nil, runs the process on another host over SSH instead
+	// of locally. See RemoteConfig.
+	Remote *RemoteConfig `json:"remote,omitempty"`
+	// Spawner, if not empty, is the name of the Spawner, such as one provided
+	// by a plugin, that starts the process instead of running it locally.
+	Spawner string `json:"spawner,omitempty"`
+	// SpawnerConfig is passed as-is to the Spawner.
+	SpawnerConfig json.RawMessage `json:"spawner_config,omitempty"`
+}
+
+// ContainerConfig describes the container that a script runs in. The container
+// is run through the CLI of its runtime, which cronmon supervises like any
+// other process, so it's restarted and journaled the same way.
+type ContainerConfig struct {
+	// Image is the image to run. It is required.
+	Image string `json:"image"`
+	// Runtime is the container CLI, which must be compatible with "docker
+	// run", such as "docker" or "podman". The default is "docker".
+	Runtime string `json:"runtime,omitempty"`
+	// Args are the extra arguments to the run command, such as "--volume" or
+	// "--network" flags.
+	Args []string `json:"args,omitempty"`
+	// Command is the command to run in the image. If it's empty, then the
+	// script is mounted read-only into the container and run, in which case
+	// its interpreter must exist in the image.
+	Command []string `json:"command,omitempty"`
+}
+
+// RemoteConfig describes the host that a script runs on. The script is
+// uploaded and run through ssh, which cronmon supervises like any other
+// process, so nothing has to be installed on the host other than a POSIX shell
+// and the script's interpreter.
+type RemoteConfig struct {
+	// Host is the destination passed to ssh, such as "user@host" or the name
+	// of a host in ~/.ssh/config. It is required.
+	Host string `json:"host"`
+	// Args are the extra arguments to ssh, such as "-p" or "-i" flags.
+	Args []string `json:"args,omitempty"`
+}
+
+// DefaultContainerRuntime is the container runtime used by scripts that don't
+// configure one.
+var DefaultContainerRuntime = "docker"
+
+// DefaultScriptPriority is the priority of scripts that have neither a
+// priority prefix nor a configured priority.
+const DefaultScriptPriority = 50
+
+// ParseScriptName parses the given script file name. If the file name has a
+// numeric priority prefix followed by a dash, such as "10-web.sh", then the
+// name without the prefix and the priority are returned. Otherwise, the file
+// name itself and DefaultScriptPriority are returned.
+//
+// The returned name is the one that the script's process appears as in the
+// journal and in the control API.
+func ParseScriptName(file string) (name string, priority int) {
+	i := strings.IndexByte(file, '-')
+	if i < 1 || i == len(file)-1 {
+		return file, DefaultScriptPriority
+	}
+
+	p, err := strconv.Atoi(file[:i])
+	if err != nil || p < 0 || strings.IndexFunc(file[:i], isNotDigit) >= 0 {
+		return file, DefaultScriptPriority
+	}
+
+	return file[i+1:], p
+}
+
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+// scriptPriority returns the priority of the given script, which is either its
+// configured priority or the one from its file name.
+func scriptPriority(dir, file string, u *user.User) int {
+	_, priority := ParseScriptName(file)
+
+	cfg, err := loadScriptConfig(dir, file, u)
+	if err == nil && cfg.Priority != nil {
+		priority = *cfg.Priority
+	}
+
+	return priority
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string, such as
+// "1m30s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "duration must be a string")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultLogMaxFiles is the default number of rotated log files to keep. See
+// ScriptConfig.LogMaxFiles.
+const DefaultLogMaxFiles = 5
+
+func (cfg ScriptConfig) logMaxFiles() int {
+	if cfg.LogMaxFiles == 0 {
+		return DefaultLogMaxFiles
+	}
+	return cfg.LogMaxFiles
+}
+
+// conditions returns the start conditions of the script, including the ones
+// implied by other options.
+func (cfg ScriptConfig) conditions() []string {
+	if !cfg.WaitNetwork {
+		return cfg.Conditions
+	}
+
+	conds := make([]string, 0, len(cfg.Conditions)+1)
+	conds = append(conds, networkCondition)
+	conds = append(conds, cfg.Conditions...)
+	return conds
+}
+
+// nextRestart returns the time after now at which a process started at now
+// should be restarted, or a zero time if it's never restarted.
+func (cfg ScriptConfig) nextRestart(now time.Time) time.Time {
+	var next time.Time
+
+	if cfg.RestartEvery > 0 {
+		next = now.Add(time.Duration(cfg.RestartEvery))
+	}
+
+	if at, err := time.Parse("15:04", cfg.RestartAt); err == nil {
+		y, m, d := now.Date()
+		daily := time.Date(y, m, d, at.Hour(), at.Minute(), 0, 0, now.Location())
+		if !daily.After(now) {
+			daily = daily.AddDate(0, 0, 1)
+		}
+
+		if next.IsZero() || daily.Before(next) {
+			next = daily
+		}
+	}
+
+	return next
+}
+
+// ScriptConfigPath returns the path to the configuration file of the given
+// script.
+func ScriptConfigPath(dir, file string) string {
+	return filepath.Join(dir, "."+file+".json")
+}
+
+// scriptOfConfig returns the script name of the given configuration file name,
+// or an empty string if the name is not a configuration file.
+func scriptOfConfig(name string) string {
+	if len(name) <= len("..json") || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "."), ".json")
+}
+
+// ignoredScriptSuffixes are the suffixes of backup, swap and temporary files
+// left by editors and deploy tools, which are never scripts.
+var ignoredScriptSuffixes = []string{"~", ".swp", ".swo", ".swx", ".tmp", ".bak"}
+
+// isScriptName returns true if the given file name in the scripts directory
+// may be a script. Hidden files, including configuration files and editor lock
+// files such as .#foo, are not, and neither are backup and temporary files.
+func isScriptName(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	if len(name) > 1 && strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#") {
+		return false // Emacs auto-save file
+	}
+	for _, suffix := range ignoredScriptSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// isScriptMode returns true if a file with the given mode may be a script. Named
+// pipes, sockets and devices, such as a FIFO used for a script's stdin, are not.
+func isScriptMode(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice) == 0
+}
+
+// LoadScriptConfig loads the configuration of the given script. A zero-value
+// configuration is returned if the script has no configuration file.
+func LoadScriptConfig(dir, file string) (ScriptConfig, error) {
+	return loadScriptConfig(dir, file, nil)
+}
+
+// loadScriptConfig loads the configuration like LoadScriptConfig. If u isn't
+// nil, then the file is read as the user. See openScriptFile.
+func loadScriptConfig(dir, file string, u *user.User) (ScriptConfig, error) {
+	var cfg ScriptConfig
+
+	b, err := readScriptFile(ScriptConfigPath(dir, file), u)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, errors.Wrap(err, "failed to read config")
+	}
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "failed to parse config")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, errors.Wrap(err, "invalid config")
+	}
+
+	return cfg, nil
+}
+
+// Validate validates the configuration.
+func (cfg ScriptConfig) Validate() error {
+	if _, _, err := parseStdin(cfg.Stdin); err != nil {
+		return err
+	}
+	if _, err := parseSyslogFacility(cfg.Syslog); err != nil {
+		return err
+	}
+	if _, err := parseUmask(cfg.Umask); err != nil {
+		return err
+	}
+	if _, _, err := parseSeccomp(cfg.Seccomp); err != nil {
+		return err
+	}
+	if cfg.ClearGroups && len(cfg.Groups) > 0 {
+		return errors.New("groups and clear_groups are mutually exclusive")
+	}
+	for _, group := range cfg.Groups {
+		if group == "" {
+			return errors.New("groups must not contain empty names")
+		}
+	}
+	if cfg.LogMaxSize < 0 {
+		return errors.New("log_max_size must not be negative")
+	}
+	if cfg.CoreDump != nil && cfg.CoreDump.MaxFiles < 0 {
+		return errors.New("core_dump.max_files must not be negative")
+	}
+	if cfg.LastWords < 0 {
+		return errors.New("last_words must not be negative")
+	}
+	if cfg.LogMaxFiles < 0 {
+		return errors.New("log_max_files must not be negative")
+	}
+	if cfg.WaitReady && !cfg.Events {
+		return errors.New("wait_ready requires events")
+	}
+	if cfg.StartTimeout < 0 {
+		return errors.New("start_timeout must not be negative")
+	}
+	if cfg.StartTimeout > 0 && !cfg.WaitReady {
+		return errors.New("start_timeout requires wait_ready")
+	}
+	if cfg.MaxRuntime < 0 {
+		return errors.New("max_runtime must not be negative")
+	}
+	if cfg.StopTimeout < 0 {
+		return errors.New("stop_timeout must not be negative")
+	}
+	if cfg.MinUptime < 0 {
+		return errors.New("min_uptime must not be negative")
+	}
+	for _, cond := range cfg.Conditions {
+		if _, _, err := parseCondition(cond); err != nil {
+			return err
+		}
+	}
+	for _, path := range cfg.WatchPaths {
+		if path == "" {
+			return errors.New("watch_paths must not contain empty paths")
+		}
+	}
+	if _, err := parseSignal(cfg.ReloadSignal); err != nil {
+		return err
+	}
+	if strings.ContainsAny(cfg.Group, "/\x00") {
+		return errors.Errorf("invalid group %q", cfg.Group)
+	}
+	if err := validateEnv(cfg); err != nil {
+		return err
+	}
+	if cfg.Container != nil && cfg.Container.Image == "" {
+		return errors.New("container requires an image")
+	}
+	if cfg.Remote != nil {
+		if cfg.Remote.Host == "" || strings.HasPrefix(cfg.Remote.Host, "-") {
+			return errors.Errorf("invalid remote host %q", cfg.Remote.Host)
+		}
+		if cfg.Container != nil {
+			return errors.New("remote and container are mutually exclusive")
+		}
+	}
+	if cfg.Spawner != "" && (cfg.Container != nil || cfg.Remote != nil) {
+		return errors.New("spawner is mutually exclusive with container and remote")
+	}
+	if cfg.SpawnerConfig != nil && cfg.Spawner == "" {
+		return errors.New("spawner_config requires a spawner")
+	}
+	if cfg.RestartEvery < 0 {
+		return errors.New("restart_every must not be negative")
+	}
+	if cfg.RestartAt != "" {
+		if _, err := time.Parse("15:04", cfg.RestartAt); err != nil {
+			return errors.Errorf("invalid restart_at %q", cfg.RestartAt)
+		}
+	}
+	return nil
+}
+
+// validateAsUser validates that the configuration doesn't use the options
+// that cronmon acts on with its own privileges, such as by opening files or
+// running commands, since they aren't allowed for scripts in dir that are run
+// as the user. Paths that cronmon only watches or checks for must be in the
+// user's home directory. See MonitorOptions.User.
+func (cfg ScriptConfig) validateAsUser(dir string, u *user.User) error {
+	for _, path := range cfg.WatchPaths {
+		if err := checkUserPath(resolvePath(dir, path), u); err != nil {
+			return errors.Wrap(err, "invalid watch_paths")
+		}
+	}
+
+	for _, cond := range cfg.Conditions {
+		if kind, arg, _ := parseCondition(cond); kind == conditionPath {
+			if err := checkUserPath(resolvePath(dir, arg), u); err != nil {
+				return errors.Wrap(err, "invalid conditions")
+			}
+		}
+	}
+
+	var option string
+
+	switch {
+	case cfg.Stdin != "" && cfg.Stdin != "null" && cfg.Stdin != "pipe":
+		option = "stdin"
+	case cfg.Log != "":
+		option = "log"
+	case strings.HasPrefix(cfg.Seccomp, "file:"):
+		option = "seccomp"
+	case len(cfg.Groups) > 0:
+		option = "groups"
+	case cfg.CoreDump != nil:
+		option = "core_dump"
+	case cfg.EnvInherit:
+		option = "env_inherit"
+	case len(cfg.Secrets) > 0:
+		option = "secrets"
+	case cfg.Container != nil:
+		option = "container"
+	case cfg.Remote != nil:
+		option = "remote"
+	case cfg.Spawner != "":
+		option = "spawner"
+	default:
+		return nil
+	}
+
+	return errors.Errorf("%s is not allowed for scripts run as another user", option)
+}
+
+// stdinMode is the mode of ScriptConfig.Stdin.
+type stdinMode string
+
+const (
+	stdinNull stdinMode = "null"
+	stdinPipe stdinMode = "pipe"
+	stdinFIFO stdinMode = "fifo"
+	stdinFile stdinMode = "file"
+)
+
+func parseStdin(stdin string) (stdinMode, string, error) {
+	switch stdin {
+	case "", "null":
+		return stdinNull, "", nil
+	case "pipe":
+		return stdinPipe, "", nil
+	}
+
+	i := strings.IndexByte(stdin, ':')
+	if i < 0 || i == len(stdin)-1 {
+		return "", "", errors.Errorf("invalid stdin %q", stdin)
+	}
+
+	mode, path := stdinMode(stdin[:i]), stdin[i+1:]
+
+	switch mode {
+	case stdinFIFO, stdinFile:
+		return mode, path, nil
+	default:
+		return "", "", errors.Errorf("unknown stdin mode %q", mode)
+	}
+}
+
+// resolvePath resolves the given path relative to dir if it's not absolute.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// parseUmask parses ScriptConfig.Umask. Nil is returned if it's empty.
+func parseUmask(umask string) (*os.FileMode, error) {
+	if umask == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || v > 0777 {
+		return nil, errors.Errorf("invalid umask %q", umask)
+	}
+
+	mode := os.FileMode(v)
+	return &mode, nil
+}
+
+// parseSeccomp parses ScriptConfig.Seccomp into either a preset or the path of
+// a filter file.
+func parseSeccomp(seccomp string) (preset, path string, err error) {
+	if strings.HasPrefix(seccomp, "file:") {
+		if path = strings.TrimPrefix(seccomp, "file:"); path == "" {
+			return "", "", errors.Errorf("invalid seccomp %q", seccomp)
+		}
+		return "", path, nil
+	}
+
+	if _, ok := exec.SeccompPresets[seccomp]; seccomp != "" && !ok {
+		return "", "", errors.Errorf("unknown seccomp preset %q", seccomp)
+	}
+
+	return seccomp, "", nil
+}
+
+// loadSeccomp loads the seccomp filter of the configuration. Nil is returned
+// if there is none.
+func loadSeccomp(dir string, cfg ScriptConfig) ([]unix.SockFilter, error) {
+	preset, path, err := parseSeccomp(cfg.Seccomp)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case preset != "":
+		return exec.SeccompPreset(preset)
+	case path != "":
+		b, err := os.ReadFile(resolvePath(dir, path))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read seccomp filter")
+		}
+		return exec.ParseSeccompFilter(b)
+	default:
+		return nil, nil
+	}
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// parseSyslogFacility parses ScriptConfig.Syslog. The returned facility is 0
+// if syslog is disabled.
+// parseSignal parses the given signal name, such as "SIGHUP" or "HUP". Zero is
+// returned if the name is empty.
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+
+	sig := unix.SignalNum(upper)
+	if sig == 0 {
+		return 0, errors.Errorf("unknown signal %q", name)
+	}
+
+	return sig, nil
+}
+
+func parseSyslogFacility(facility string) (syslog.Priority, error) {
+	if facility == "" {
+		return 0, nil
+	}
+
+	p, ok := syslogFacilities[facility]
+	if !ok {
+		return 0, errors.Errorf("unknown syslog facility %q", facility)
+	}
+
+	return p, nil
+}
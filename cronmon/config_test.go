@@ -0,0 +1,245 @@
+package cronmon
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadScriptConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg, err := LoadScriptConfig(dir, "a")
+	if err != nil {
+		t.Fatal("unexpected error loading missing config:", err)
+	}
+	if !reflect.DeepEqual(cfg, ScriptConfig{}) {
+		t.Fatalf("unexpected config %#v for missing file", cfg)
+	}
+
+	tests := []struct {
+		config string
+		expect ScriptConfig
+		fail   bool
+	}{
+		{`{}`, ScriptConfig{}, false},
+		{`{"stdin":"null"}`, ScriptConfig{Stdin: "null"}, false},
+		{`{"stdin":"pipe"}`, ScriptConfig{Stdin: "pipe"}, false},
+		{`{"stdin":"fifo:a.fifo"}`, ScriptConfig{Stdin: "fifo:a.fifo"}, false},
+		{`{"stdin":"file:/etc/hosts"}`, ScriptConfig{Stdin: "file:/etc/hosts"}, false},
+		{`{"log":"a.log","pty":true}`, ScriptConfig{Log: "a.log", PTY: true}, false},
+		{`{"syslog":"local0"}`, ScriptConfig{Syslog: "local0"}, false},
+		{`{"syslog":"kern"}`, ScriptConfig{}, true},
+		{`{"env_allow":["AWS_*"],"env":{"A":"1"}}`, ScriptConfig{
+			EnvAllow: []string{"AWS_*"},
+			Env:      map[string]string{"A": "1"},
+		}, false},
+		{`{"env_allow":["["]}`, ScriptConfig{}, true},
+		{`{"group":"web"}`, ScriptConfig{Group: "web"}, false},
+		{`{"group":"web/api"}`, ScriptConfig{}, true},
+		{`{"env":{"A=B":"1"}}`, ScriptConfig{}, true},
+		{`{"secrets":{"TOKEN":"file:token"}}`, ScriptConfig{
+			Secrets: map[string]string{"TOKEN": "file:token"},
+		}, false},
+		{`{"secrets":{"TOKEN":"vault:token"}}`, ScriptConfig{}, true},
+		{`{"events":true,"wait_ready":true,"start_timeout":"1m"}`, ScriptConfig{
+			Events:       true,
+			WaitReady:    true,
+			StartTimeout: Duration(time.Minute),
+		}, false},
+		{`{"conditions":["path:/mnt/data","tcp:db:5432","env:TOKEN","script:db.sh"]}`, ScriptConfig{
+			Conditions: []string{"path:/mnt/data", "tcp:db:5432", "env:TOKEN", "script:db.sh"},
+		}, false},
+		{`{"conditions":["tcp:db"]}`, ScriptConfig{}, true},
+		{`{"conditions":["ping:db"]}`, ScriptConfig{}, true},
+		{`{"wait_ready":true}`, ScriptConfig{}, true},
+		{`{"events":true,"start_timeout":"1m"}`, ScriptConfig{}, true},
+		{`{"container":{"image":"alpine","args":["--network=host"]}}`, ScriptConfig{
+			Container: &ContainerConfig{Image: "alpine", Args: []string{"--network=host"}},
+		}, false},
+		{`{"container":{"runtime":"podman"}}`, ScriptConfig{}, true},
+		{`{"remote":{"host":"pi@backup","args":["-p","2222"]}}`, ScriptConfig{
+			Remote: &RemoteConfig{Host: "pi@backup", Args: []string{"-p", "2222"}},
+		}, false},
+		{`{"remote":{"host":"-oProxyCommand=x"}}`, ScriptConfig{}, true},
+		{`{"remote":{"host":"a"},"container":{"image":"alpine"}}`, ScriptConfig{}, true},
+		{`{"spawner":"nomad","spawner_config":{"dc":"home"}}`, ScriptConfig{
+			Spawner:       "nomad",
+			SpawnerConfig: json.RawMessage(`{"dc":"home"}`),
+		}, false},
+		{`{"spawner_config":{}}`, ScriptConfig{}, true},
+		{`{"spawner":"nomad","remote":{"host":"a"}}`, ScriptConfig{}, true},
+		{`{"dir":"/srv/app","umask":"027"}`, ScriptConfig{Dir: "/srv/app", Umask: "027"}, false},
+		{`{"umask":"0777"}`, ScriptConfig{Umask: "0777"}, false},
+		{`{"umask":"1777"}`, ScriptConfig{}, true},
+		{`{"standard_env":true,"groups":["video","44"]}`, ScriptConfig{
+			StandardEnv: true,
+			Groups:      []string{"video", "44"},
+		}, false},
+		{`{"clear_groups":true}`, ScriptConfig{ClearGroups: true}, false},
+		{`{"clear_groups":true,"groups":["video"]}`, ScriptConfig{}, true},
+		{`{"groups":[""]}`, ScriptConfig{}, true},
+		{`{"seccomp":"no-network"}`, ScriptConfig{Seccomp: "no-network"}, false},
+		{`{"seccomp":"file:filter.bpf"}`, ScriptConfig{Seccomp: "file:filter.bpf"}, false},
+		{`{"last_words":4096}`, ScriptConfig{LastWords: 4096}, false},
+		{`{"last_words":-1}`, ScriptConfig{}, true},
+		{`{"core_dump":{"max_files":2}}`, ScriptConfig{CoreDump: &CoreDumpConfig{MaxFiles: 2}}, false},
+		{`{"core_dump":{"max_files":-1}}`, ScriptConfig{}, true},
+		{`{"seccomp":"strict"}`, ScriptConfig{}, true},
+		{`{"seccomp":"file:"}`, ScriptConfig{}, true},
+		{`{"umask":"22a"}`, ScriptConfig{}, true},
+		{`{"restart_at":"3am"}`, ScriptConfig{}, true},
+		{`{"start_timeout":60}`, ScriptConfig{}, true},
+		{`{"stop_timeout":"30s"}`, ScriptConfig{StopTimeout: Duration(30 * time.Second)}, false},
+		{`{"stop_timeout":"-1s"}`, ScriptConfig{}, true},
+		{`{"stdin":"file:"}`, ScriptConfig{}, true},
+		{`{"stdin":"socket:/tmp/a"}`, ScriptConfig{}, true},
+		{`{`, ScriptConfig{}, true},
+	}
+
+	for _, test := range tests {
+		writeConfig(t, ScriptConfigPath(dir, "a"), test.config)
+
+		cfg, err := LoadScriptConfig(dir, "a")
+		if test.fail {
+			if err == nil {
+				t.Errorf("config %s: expected error, got %#v", test.config, cfg)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("config %s: unexpected error: %v", test.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, test.expect) {
+			t.Errorf("config %s: got %#v, expected %#v", test.config, cfg, test.expect)
+		}
+	}
+}
+
+func TestScriptOfConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	name := filepath.Base(ScriptConfigPath(dir, "backup.sh"))
+	if file := scriptOfConfig(name); file != "backup.sh" {
+		t.Fatalf("unexpected script %q of config %q", file, name)
+	}
+
+	if file := scriptOfConfig(".swp"); file != "" {
+		t.Fatalf("unexpected script %q of non-config", file)
+	}
+}
+
+func TestIsScriptName(t *testing.T) {
+	tests := map[string]bool{
+		"bot.sh":         true,
+		"example":        true,
+		"#":              true,
+		".bot.sh.json":   false,
+		".hidden":        false,
+		".#bot.sh":       false,
+		"#bot.sh#":       false,
+		"bot.sh~":        false,
+		".bot.sh.swp":    false,
+		"bot.sh.swp":     false,
+		"bot.sh.tmp":     false,
+		"bot.sh.bak":     false,
+		"bot.sh.tmp.new": true,
+	}
+
+	for name, expect := range tests {
+		if got := isScriptName(name); got != expect {
+			t.Errorf("isScriptName(%q) = %v, expected %v", name, got, expect)
+		}
+	}
+}
+
+func TestScriptConfigNextRestart(t *testing.T) {
+	now := time.Date(2021, 4, 3, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		cfg    ScriptConfig
+		expect time.Time
+	}{
+		{ScriptConfig{}, time.Time{}},
+		{ScriptConfig{RestartEvery: Duration(time.Hour)}, now.Add(time.Hour)},
+		{ScriptConfig{RestartAt: "03:00"}, time.Date(2021, 4, 4, 3, 0, 0, 0, time.UTC)},
+		{ScriptConfig{RestartAt: "12:30"}, time.Date(2021, 4, 3, 12, 30, 0, 0, time.UTC)},
+		{
+			ScriptConfig{RestartAt: "12:30", RestartEvery: Duration(time.Minute)},
+			now.Add(time.Minute),
+		},
+	}
+
+	for _, test := range tests {
+		if next := test.cfg.nextRestart(now); !next.Equal(test.expect) {
+			t.Errorf("config %#v: got next restart %v, expected %v", test.cfg, next, test.expect)
+		}
+	}
+}
+
+func TestScriptConfigValidateAsUser(t *testing.T) {
+	home := t.TempDir()
+	dir := filepath.Join(home, "scripts")
+	u := &user.User{Username: "alice", HomeDir: home}
+
+	if err := os.Symlink("/etc", filepath.Join(home, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cfg   ScriptConfig
+		valid bool
+	}{
+		{ScriptConfig{}, true},
+		{ScriptConfig{Stdin: "pipe", Seccomp: "strict", ClearGroups: true}, true},
+		{ScriptConfig{Stdin: "file:/etc/shadow"}, false},
+		{ScriptConfig{Log: "/etc/cron.d/evil"}, false},
+		{ScriptConfig{Seccomp: "file:filter.bpf"}, false},
+		{ScriptConfig{Groups: []string{"wheel"}}, false},
+		{ScriptConfig{Secrets: map[string]string{"TOKEN": "exec:id"}}, false},
+		{ScriptConfig{Spawner: "docker"}, false},
+		{ScriptConfig{WatchPaths: []string{"../notes.txt"}}, true},
+		{ScriptConfig{WatchPaths: []string{"/etc/shadow"}}, false},
+		{ScriptConfig{WatchPaths: []string{"../etc/shadow"}}, false},
+		{ScriptConfig{Conditions: []string{"path:../mnt/ready"}}, true},
+		{ScriptConfig{Conditions: []string{"path:/etc/shadow"}}, false},
+		{ScriptConfig{Conditions: []string{"env:HOME"}}, true},
+	}
+
+	for _, test := range tests {
+		err := test.cfg.validateAsUser(dir, u)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("config %#v: got valid %v, expected %v (%v)", test.cfg, valid, test.valid, err)
+		}
+	}
+}
+
+func TestParseScriptName(t *testing.T) {
+	tests := []struct {
+		file     string
+		name     string
+		priority int
+	}{
+		{"web.sh", "web.sh", DefaultScriptPriority},
+		{"10-web.sh", "web.sh", 10},
+		{"010-web.sh", "web.sh", 10},
+		{"10-", "10-", DefaultScriptPriority},
+		{"-web.sh", "-web.sh", DefaultScriptPriority},
+		{"+1-web.sh", "+1-web.sh", DefaultScriptPriority},
+		{"my-web.sh", "my-web.sh", DefaultScriptPriority},
+	}
+
+	for _, test := range tests {
+		name, priority := ParseScriptName(test.file)
+		if name != test.name || priority != test.priority {
+			t.Errorf("file %q: got (%q, %d), expected (%q, %d)",
+				test.file, name, priority, test.name, test.priority)
+		}
+	}
+}
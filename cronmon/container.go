@@ -0,0 +1,67 @@
+package cronmon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+)
+
+// containerOf returns the container that the script at the given path runs in
+// with the given configuration. Only the variables set by the configuration
+// and its secrets are passed into the container; the ones passed from cronmon,
+// such as $PATH, describe the host instead.
+func containerOf(path string, cfg ScriptConfig, secrets map[string]string) *exec.Container {
+	runtime := cfg.Container.Runtime
+	if runtime == "" {
+		runtime = DefaultContainerRuntime
+	}
+
+	env := make([]string, 0, len(cfg.Env)+len(secrets))
+	for k := range cfg.Env {
+		if _, ok := secrets[k]; !ok {
+			env = append(env, k)
+		}
+	}
+	for k := range secrets {
+		env = append(env, k)
+	}
+	sort.Strings(env)
+
+	return &exec.Container{
+		Runtime: runtime,
+		Name:    instanceName(path),
+		Image:   cfg.Container.Image,
+		Args:    cfg.Container.Args,
+		Command: cfg.Container.Command,
+		Env:     env,
+	}
+}
+
+// containerName returns the name of the container of the script at the given
+// path. The name is unique to the path, so that instances of cronmon with
+// different scripts directories don't share containers.
+func instanceName(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	sum := sha256.Sum256([]byte(path))
+
+	// Container names may only contain [a-zA-Z0-9_.-].
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case r == '_', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, filepath.Base(path))
+
+	return "cronmon-" + name + "-" + hex.EncodeToString(sum[:4])
+}
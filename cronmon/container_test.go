@@ -0,0 +1,41 @@
+package cronmon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+)
+
+func TestContainerOf(t *testing.T) {
+	cfg := ScriptConfig{
+		Env:     map[string]string{"B": "1", "TOKEN": "x"},
+		Secrets: map[string]string{"TOKEN": "file:token"},
+		Container: &ContainerConfig{
+			Image: "alpine",
+			Args:  []string{"--network=host"},
+		},
+	}
+
+	c := containerOf("/scripts/10 web.sh", cfg, map[string]string{"TOKEN": "secret"})
+
+	name := c.Name
+	if !strings.HasPrefix(name, "cronmon-10_web.sh-") {
+		t.Errorf("unexpected container name %q", name)
+	}
+	if other := instanceName("/other/10 web.sh"); other == name {
+		t.Errorf("containers of different paths share the name %q", name)
+	}
+
+	c.Name = ""
+	expect := &exec.Container{
+		Runtime: DefaultContainerRuntime,
+		Image:   "alpine",
+		Args:    []string{"--network=host"},
+		Env:     []string{"B", "TOKEN"},
+	}
+	if !reflect.DeepEqual(c, expect) {
+		t.Errorf("got %#v, expected %#v", c, expect)
+	}
+}
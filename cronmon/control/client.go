@@ -0,0 +1,257 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// Client is a client of the control API of a running cronmon.
+type Client struct {
+	http http.Client
+}
+
+// NewClient creates a new client that connects to the Unix socket at the given
+// path.
+func NewClient(path string) *Client {
+	return &Client{
+		http: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Processes returns the status of all processes.
+func (c *Client) Processes(ctx context.Context) ([]cronmon.ProcessStatus, error) {
+	var statuses []cronmon.ProcessStatus
+	return statuses, c.do(ctx, http.MethodGet, "/processes", nil, &statuses)
+}
+
+// ProcessesWhere returns the status of the processes that the query selects.
+// The next page starts after the last process of a full page.
+func (c *Client) ProcessesWhere(ctx context.Context, q ProcessQuery) ([]cronmon.ProcessStatus, error) {
+	var statuses []cronmon.ProcessStatus
+	return statuses, c.do(ctx, http.MethodGet, "/processes?"+q.Values().Encode(), nil, &statuses)
+}
+
+// ResetStats resets the statistics of the given script.
+func (c *Client) ResetStats(ctx context.Context, file string) error {
+	return c.processAction(ctx, file, "reset-stats", nil)
+}
+
+// WriteStdin writes the given line to the stdin of the given script's process.
+// The script must be configured with a pipe or FIFO stdin.
+func (c *Client) WriteStdin(ctx context.Context, file, line string) error {
+	return c.processAction(ctx, file, "stdin", StdinBody{Line: line})
+}
+
+// WaitExit blocks until the given script's process next exits, then returns
+// its exit event.
+func (c *Client) WaitExit(ctx context.Context, file string) (*cronmon.EventProcessExited, error) {
+	var ev cronmon.EventProcessExited
+	path := "/processes/" + url.PathEscape(file) + "/wait"
+
+	if err := c.do(ctx, http.MethodPost, path, nil, &ev); err != nil {
+		return nil, err
+	}
+
+	return &ev, nil
+}
+
+// Uptime returns the uptime of the given script over the last window, or over
+// cronmon.UptimeWindow if it's 0.
+func (c *Client) Uptime(ctx context.Context, file string, window time.Duration) (*cronmon.UptimeReport, error) {
+	var u cronmon.UptimeReport
+	path := "/processes/" + url.PathEscape(file) + "/uptime"
+	if window > 0 {
+		path += "?window=" + url.QueryEscape(window.String())
+	}
+
+	if err := c.do(ctx, http.MethodGet, path, nil, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// StartProcess starts the given manually stopped script.
+func (c *Client) StartProcess(ctx context.Context, file string) error {
+	return c.processAction(ctx, file, "start", nil)
+}
+
+// StopProcess manually stops the given script until it's started again.
+func (c *Client) StopProcess(ctx context.Context, file string) error {
+	return c.processAction(ctx, file, "stop", nil)
+}
+
+// RestartProcess restarts the given script's process.
+func (c *Client) RestartProcess(ctx context.Context, file string) error {
+	return c.processAction(ctx, file, "restart", nil)
+}
+
+// KickProcess starts the given script's process immediately if it's down,
+// skipping its restart backoff.
+func (c *Client) KickProcess(ctx context.Context, file string) error {
+	return c.processAction(ctx, file, "kick", nil)
+}
+
+// Groups returns the rolled up status of all groups.
+func (c *Client) Groups(ctx context.Context) ([]cronmon.GroupStatus, error) {
+	var statuses []cronmon.GroupStatus
+	return statuses, c.do(ctx, http.MethodGet, "/groups", nil, &statuses)
+}
+
+// GroupAction does the given action, which is one of "start", "stop" and
+// "restart", on all scripts in the given group.
+func (c *Client) GroupAction(ctx context.Context, group, action string) error {
+	return c.do(ctx, http.MethodPost, "/groups/"+url.PathEscape(group)+"/"+action, nil, nil)
+}
+
+// Reconcile reconciles the processes with the scripts directory from scratch
+// and returns the summary. See cronmon.Monitor.Reconcile.
+func (c *Client) Reconcile(ctx context.Context) (*cronmon.EventProcessListReconciled, error) {
+	var ev cronmon.EventProcessListReconciled
+	if err := c.do(ctx, http.MethodPost, "/reconcile", nil, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// ExportState returns a snapshot of the monitor's state.
+func (c *Client) ExportState(ctx context.Context) (*cronmon.StateSnapshot, error) {
+	var snap cronmon.StateSnapshot
+	if err := c.do(ctx, http.MethodGet, "/state", nil, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// ImportState validates the given snapshot against the live system and, unless
+// dryRun is true, imports it. See cronmon.Monitor.ImportState.
+func (c *Client) ImportState(
+	ctx context.Context, snap *cronmon.StateSnapshot, dryRun bool) (*cronmon.ImportReport, error) {
+
+	path := "/state"
+	if dryRun {
+		path += "?dry_run=true"
+	}
+
+	var report cronmon.ImportReport
+	if err := c.do(ctx, http.MethodPost, path, snap, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Health returns the health of the monitor. See cronmon.Monitor.Health.
+func (c *Client) Health(ctx context.Context) (*cronmon.Health, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://cronmon/healthz", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to cronmon")
+	}
+	defer resp.Body.Close()
+
+	// An unhealthy monitor responds with 503 but still has the same body.
+	var health cronmon.Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return &health, nil
+}
+
+// Dump writes the debugging dump of the monitor into w. The control server must
+// have the debugging endpoints enabled. See Server.EnableDebug.
+func (c *Client) Dump(ctx context.Context, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://cronmon/debug/dump", nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to cronmon")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.New("debugging endpoints are not enabled")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var body errorBody
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return errors.New(body.Error)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (c *Client) processAction(ctx context.Context, file, action string, body interface{}) error {
+	return c.do(ctx, http.MethodPost, "/processes/"+url.PathEscape(file)+"/"+action, body, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, dst interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode request")
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://cronmon"+path, r)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to cronmon")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var body errorBody
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return errors.New(body.Error)
+	}
+
+	if dst == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
+
+	return nil
+}
@@ -0,0 +1,739 @@
+// Package control provides the control API of a running cronmon monitor. The
+// API is served as HTTP with JSON bodies over a Unix socket, which is only
+// accessible by the user running cronmon by default.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"path"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Server is the HTTP handler of the control API.
+type Server struct {
+	m       *cronmon.Monitor
+	mux     *http.ServeMux
+	journal JournalOpener
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// NewServer creates a new control API handler for the given monitor.
+func NewServer(m *cronmon.Monitor) *Server {
+	s := &Server{
+		m:   m,
+		mux: http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/processes", s.processes)
+	s.mux.HandleFunc("/processes/", s.process)
+	s.mux.HandleFunc("/groups", s.groups)
+	s.mux.HandleFunc("/groups/", s.group)
+	s.mux.HandleFunc("/state", s.state)
+	s.mux.HandleFunc("/reconcile", s.reconcile)
+	s.mux.HandleFunc("/events", s.events)
+	s.mux.HandleFunc("/events/recent", s.recentEvents)
+	s.mux.Handle("/healthz", healthHandler{m, cronmon.Health.Healthy})
+	s.mux.Handle("/readyz", healthHandler{m, cronmon.Health.Ready})
+
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the given handler over the Unix socket at the given
+// path until the context is canceled. An existing socket file at the path is
+// removed, so the caller must ensure that no other instance is using it, such
+// as by holding the journal lock.
+func ListenAndServe(ctx context.Context, path string, h http.Handler) error {
+	return ListenAndServeAs(ctx, path, -1, -1, h)
+}
+
+// ListenAndServeAs serves like ListenAndServe, except that the socket is owned
+// by the given user and group IDs, so that a cronmon running as root may serve
+// it to another user. An ID of -1 leaves it unchanged.
+func ListenAndServeAs(ctx context.Context, path string, uid, gid int, h http.Handler) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove old socket")
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+	defer os.Remove(path)
+
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return errors.Wrap(err, "failed to chmod socket")
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return errors.Wrap(err, "failed to chown socket")
+		}
+	}
+
+	srv := http.Server{
+		Handler:     h,
+		ConnContext: withPeer,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// EnableDebug adds the debugging endpoints to the server: net/http/pprof under
+// /debug/pprof/ and /debug/dump, which dumps the status of all processes and
+// the stacks of all goroutines. They're meant to debug a wedged cronmon without
+// killing it, and they're only served to clients running as the same user as
+// cronmon or as root.
+func (s *Server) EnableDebug() {
+	s.mux.Handle("/debug/pprof/", debugGuard(http.HandlerFunc(pprof.Index)))
+	s.mux.Handle("/debug/pprof/cmdline", debugGuard(http.HandlerFunc(pprof.Cmdline)))
+	s.mux.Handle("/debug/pprof/profile", debugGuard(http.HandlerFunc(pprof.Profile)))
+	s.mux.Handle("/debug/pprof/symbol", debugGuard(http.HandlerFunc(pprof.Symbol)))
+	s.mux.Handle("/debug/pprof/trace", debugGuard(http.HandlerFunc(pprof.Trace)))
+	s.mux.Handle("/debug/dump", debugGuard(http.HandlerFunc(s.dump)))
+}
+
+// JournalReadCloser is a journal reader that is closed once it's read.
+type JournalReadCloser interface {
+	cronmon.JournalReader
+	io.Closer
+}
+
+// JournalOpener opens the journal that has the events of the given script for
+// reading.
+type JournalOpener func(file string) (JournalReadCloser, error)
+
+// EnableJournal adds the endpoints that read the journal, which is opened with
+// the given function for every request: /processes/{file}/uptime, which
+// computes the uptime of the script over the window given by the "window"
+// query parameter. See cronmon.ComputeUptime.
+func (s *Server) EnableJournal(open JournalOpener) {
+	s.journal = open
+}
+
+// debugGuard only lets clients running as the same user as cronmon or as root
+// through to h. Clients whose credentials are unknown are refused.
+func debugGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := peerFromContext(r.Context())
+		if peer == nil || (peer.UID != 0 && peer.UID != os.Getuid()) {
+			writeError(w, http.StatusForbidden, errors.New("forbidden"))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dump handles dumping the status of all processes and the stacks of all
+// goroutines as plain text. The status is read without going through the
+// monitor goroutine, and it's skipped if it can't be read in time.
+func (s *Server) dump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	ctx, cancel := context.WithTimeout(r.Context(), HealthTimeout)
+	defer cancel()
+
+	fmt.Fprintln(w, "# health")
+	b, _ := json.MarshalIndent(s.m.Health(ctx), "", "\t")
+	fmt.Fprintf(w, "%s\n\n", b)
+
+	// Reading the status may block on a wedged process, so don't wait for
+	// it forever.
+	statuses := make(chan []cronmon.ProcessStatus, 1)
+	go func() { statuses <- s.m.DebugSnapshot() }()
+
+	fmt.Fprintln(w, "# processes")
+	select {
+	case snap := <-statuses:
+		b, _ := json.MarshalIndent(snap, "", "\t")
+		fmt.Fprintf(w, "%s\n\n", b)
+	case <-ctx.Done():
+		fmt.Fprintf(w, "unavailable: %v\n\n", ctx.Err())
+	}
+
+	fmt.Fprintln(w, "# goroutines")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// EventsKeepAlive is how often an idle event stream is sent a comment, so
+// that proxies don't close it.
+var EventsKeepAlive = 30 * time.Second
+
+// streamEvent is an event sent by /events.
+type streamEvent struct {
+	Time time.Time     `json:"time"`
+	Type string        `json:"type"`
+	Data cronmon.Event `json:"data"`
+}
+
+// events streams the events written from now on as Server-Sent Events, such
+// as for a live dashboard. The "type" query parameter only streams events of
+// the given comma-separated types, and "script" only streams the events of
+// the scripts matching the given glob pattern. Events that are missed because
+// the client fell behind are counted in a "dropped" event.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sub := s.m.Subscribe(filter)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EventsKeepAlive)
+	defer keepAlive.Stop()
+
+	var dropped int
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case entry := <-sub.Events():
+			if n := sub.Dropped(); n > dropped {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n-dropped)
+				dropped = n
+			}
+
+			b, err := json.Marshal(streamEvent{entry.Time, entry.Event.Type(), entry.Event})
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", entry.Event.Type(), b)
+		}
+
+		flusher.Flush()
+	}
+}
+
+// recentEvents handles /events/recent, which returns the recent events kept in
+// memory from oldest to newest. It takes the same parameters as /events.
+func (s *Server) recentEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	events := []streamEvent{}
+	for _, entry := range s.m.RecentEvents() {
+		if filter(entry.Event) {
+			events = append(events, streamEvent{entry.Time, entry.Event.Type(), entry.Event})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+// parseEventFilter parses the "type" and "script" parameters of /events into
+// a filter.
+func parseEventFilter(v url.Values) (func(cronmon.Event) bool, error) {
+	var types []string
+	if q := v.Get("type"); q != "" {
+		types = strings.Split(q, ",")
+	}
+
+	script := v.Get("script")
+	if script != "" {
+		if _, err := path.Match(script, ""); err != nil {
+			return nil, errors.Errorf("invalid script pattern %q", script)
+		}
+	}
+
+	return func(ev cronmon.Event) bool {
+		if len(types) > 0 && !containsString(types, ev.Type()) {
+			return false
+		}
+		if script != "" {
+			pev, ok := ev.(cronmon.ProcessEvent)
+			if !ok {
+				return false
+			}
+			if ok, _ := path.Match(script, pev.ProcessFile()); !ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthTimeout is how long the health endpoints wait for the monitor to
+// respond before reporting it as unresponsive.
+var HealthTimeout = 2 * time.Second
+
+// NewHealthServer creates a handler that only serves the health endpoints of
+// the control API, /healthz and /readyz, such as for a load balancer. Unlike
+// the rest of the API, they're read-only, so they may be served over TCP.
+func NewHealthServer(m *cronmon.Monitor) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthHandler{m, cronmon.Health.Healthy})
+	mux.Handle("/readyz", healthHandler{m, cronmon.Health.Ready})
+	return mux
+}
+
+// ListenAndServeTCP serves the given handler over TCP at the given address
+// until the context is canceled.
+func ListenAndServeTCP(ctx context.Context, addr string, h http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+
+	srv := http.Server{Handler: h}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// healthHandler responds with the monitor's health. The status is 200 if ok
+// returns true for it and 503 otherwise.
+type healthHandler struct {
+	m  *cronmon.Monitor
+	ok func(cronmon.Health) bool
+}
+
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), HealthTimeout)
+	defer cancel()
+
+	health := h.m.Health(ctx)
+
+	code := http.StatusOK
+	if !h.ok(health) {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, health)
+}
+
+func (s *Server) processes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q, err := ParseProcessQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	statuses, err := s.m.Snapshot()
+	if err != nil {
+		writeMonitorError(w, err)
+		return
+	}
+
+	page, more := q.apply(statuses)
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if more {
+		next := q
+		next.After = page[len(page)-1].File
+		w.Header().Set("Link", fmt.Sprintf(`</processes?%s>; rel="next"`, next.Values().Encode()))
+	}
+
+	// Dashboards polling the list only need to download it again once it
+	// changes.
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+
+	if etagMatch(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// process handles /processes/{file}/{action}.
+func (s *Server) process(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/processes/")
+
+	i := strings.LastIndexByte(path, '/')
+	if i < 1 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	file, action := path[:i], path[i+1:]
+
+	if action == "uptime" {
+		s.uptime(w, r, file)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	if action == "wait" {
+		ev, err := s.m.WaitExit(r.Context(), file)
+		if err != nil {
+			writeMonitorError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, ev)
+		return
+	}
+
+	var err error
+
+	switch action {
+	case "reset-stats":
+		err = s.m.ResetStats(file)
+	case "start":
+		err = s.m.StartProcess(file)
+	case "stop":
+		err = s.m.StopProcess(file)
+	case "restart":
+		err = s.m.RestartProcess(file)
+	case "kick":
+		err = s.m.KickProcess(file)
+	case "stdin":
+		var body StdinBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+			return
+		}
+		err = s.m.WriteStdin(file, body.Line)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown action "+action))
+		return
+	}
+
+	s.audit(r, action, file, err)
+
+	if err != nil {
+		writeMonitorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uptime handles /processes/{file}/uptime.
+func (s *Server) uptime(w http.ResponseWriter, r *http.Request, file string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	if s.journal == nil {
+		writeError(w, http.StatusNotFound, errors.New("journal is unavailable"))
+		return
+	}
+
+	window := cronmon.UptimeWindow
+	if q := r.URL.Query().Get("window"); q != "" {
+		d, err := time.ParseDuration(q)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, errors.Errorf("invalid window %q", q))
+			return
+		}
+		window = d
+	}
+
+	j, err := s.journal(file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to open journal"))
+		return
+	}
+	defer j.Close()
+
+	u, err := cronmon.ComputeUptime(j, file, window)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to compute uptime"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+// audit journals the given action requested by r.
+func (s *Server) audit(r *http.Request, action, file string, err error) {
+	ev := cronmon.EventControlAction{
+		Action: action,
+		File:   file,
+		Actor:  peerFromContext(r.Context()),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	s.m.JournalControlAction(&ev)
+}
+
+type peerKey struct{}
+
+// withPeer adds the credentials of the Unix socket peer of conn, if any, to
+// the context.
+func withPeer(ctx context.Context, conn net.Conn) context.Context {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	raw, err := uconn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerKey{}, &cronmon.ControlActor{
+		UID: int(cred.Uid),
+		GID: int(cred.Gid),
+		PID: int(cred.Pid),
+	})
+}
+
+// peerFromContext returns the peer added by withPeer, or nil if there's none.
+func peerFromContext(ctx context.Context) *cronmon.ControlActor {
+	actor, _ := ctx.Value(peerKey{}).(*cronmon.ControlActor)
+	return actor
+}
+
+func (s *Server) groups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	statuses, err := s.m.GroupSnapshot()
+	if err != nil {
+		writeMonitorError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// group handles /groups/{group}/{action}.
+func (s *Server) group(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/groups/")
+
+	i := strings.LastIndexByte(path, '/')
+	if i < 1 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	group, action := path[:i], path[i+1:]
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var err error
+
+	switch action {
+	case "start":
+		err = s.m.StartGroup(group)
+	case "stop":
+		err = s.m.StopGroup(group)
+	case "restart":
+		err = s.m.RestartGroup(group)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown action "+action))
+		return
+	}
+
+	s.audit(r, "group "+action, group+"/", err)
+
+	if err != nil {
+		writeMonitorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reconcile handles reconciling the processes with the scripts directory from
+// scratch. See cronmon.Monitor.Reconcile.
+func (s *Server) reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	ev, err := s.m.Reconcile()
+	s.audit(r, "reconcile", "", err)
+
+	if err != nil {
+		writeMonitorError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ev)
+}
+
+// state handles exporting the monitor state with GET and importing it with
+// POST. An import is only validated if the dry_run query parameter is true.
+func (s *Server) state(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		snap, err := s.m.ExportState()
+		if err != nil {
+			writeMonitorError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, snap)
+
+	case http.MethodPost:
+		var snap cronmon.StateSnapshot
+		if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+			return
+		}
+
+		dryRun := r.URL.Query().Get("dry_run") == "true"
+
+		report, err := s.m.ImportState(&snap, dryRun)
+		if !dryRun {
+			s.audit(r, "import state", "", err)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// StdinBody is the JSON body of the stdin action.
+type StdinBody struct {
+	Line string `json:"line"`
+}
+
+// errorBody is the JSON body of an error response.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func writeMonitorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cronmon.ErrUnknownProcess), errors.Is(err, cronmon.ErrUnknownGroup):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, cronmon.ErrNoStdin):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, cronmon.ErrMonitorStopped), errors.Is(err, cronmon.ErrProcessStopped):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorBody{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,85 @@
+package control
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+// auditJournal keeps the control actions written into it.
+type auditJournal struct {
+	mut     sync.Mutex
+	actions []cronmon.EventControlAction
+}
+
+func (j *auditJournal) ID() string { return "audit" }
+
+func (j *auditJournal) Write(ev cronmon.Event) error {
+	if ev, ok := ev.(*cronmon.EventControlAction); ok {
+		j.mut.Lock()
+		j.actions = append(j.actions, *ev)
+		j.mut.Unlock()
+	}
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var j auditJournal
+
+	m, err := cronmon.NewMonitorWithOptions(ctx, t.TempDir(), &j, cronmon.MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	served := make(chan error, 1)
+	go func() { served <- ListenAndServe(ctx, path, NewServer(m)) }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("socket was never created")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Failed actions are journaled as well, along with why they failed.
+	if err := NewClient(path).StopProcess(ctx, "a"); err == nil {
+		t.Fatal("stopped an unknown script")
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal("failed to serve:", err)
+	}
+
+	j.mut.Lock()
+	defer j.mut.Unlock()
+
+	if len(j.actions) != 1 {
+		t.Fatalf("unexpected control actions %+v", j.actions)
+	}
+
+	action := j.actions[0]
+	if action.Action != "stop" || action.File != "a" || action.Error == "" {
+		t.Errorf("unexpected control action %+v", action)
+	}
+
+	// The client is in this process.
+	expect := cronmon.ControlActor{UID: os.Getuid(), GID: os.Getgid(), PID: os.Getpid()}
+	if action.Actor == nil || *action.Actor != expect {
+		t.Errorf("unexpected actor %+v, expected %+v", action.Actor, expect)
+	}
+}
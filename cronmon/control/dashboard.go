@@ -0,0 +1,105 @@
+package control
+
+import (
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// DashboardHeader is the header that the dashboard sends with every request
+// that changes something. Browsers don't let other sites send custom headers
+// without asking the server first, which the dashboard never allows, so
+// requiring it keeps other sites from acting through the visitor's browser.
+const DashboardHeader = "X-Cronmon-Dashboard"
+
+// NewDashboard creates a handler that serves a minimal web dashboard of the
+// given control API server, which shows the status of the processes and the
+// recent events and can restart, stop and start them. The parts of the API
+// that it uses are served under /api/, see dashboardAPI. Since anyone who can
+// reach the dashboard can act on the processes, it should only be served on a
+// trusted address or behind an authenticating proxy.
+//
+// The dashboard is served on the given TCP address. Requests for other hosts
+// are refused, see hostGuard.
+func NewDashboard(s *Server, addr string) http.Handler {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.Handle("/api/", http.StripPrefix("/api", dashboardGuard(dashboardAPI(s))))
+	return hostGuard(addr, mux)
+}
+
+// dashboardActions are the process actions that the dashboard may request.
+var dashboardActions = []string{"start", "stop", "restart"}
+
+// dashboardAPI returns the parts of the control API that the dashboard uses:
+// the status of the processes, the recent and live events, and the
+// dashboardActions. The rest of the API, such as importing state, is only
+// served on the control socket, whose peers are known.
+func dashboardAPI(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/processes", s.processes)
+	mux.HandleFunc("/events", s.events)
+	mux.HandleFunc("/events/recent", s.recentEvents)
+	mux.HandleFunc("/processes/", func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		if !containsString(dashboardActions, action) {
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+
+		s.process(w, r)
+	})
+	return mux
+}
+
+// hostGuard refuses requests whose Host header is neither the host of the
+// given address, localhost nor an IP address. Other sites can make their own
+// domain resolve to the dashboard's address to read it through the visitor's
+// browser, which is called DNS rebinding, but the browser still sends their
+// domain as the Host.
+func hostGuard(addr string, h http.Handler) http.Handler {
+	allowed, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		allowed = addr
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		host = strings.TrimSuffix(host, ".")
+
+		if !strings.EqualFold(host, allowed) && !strings.EqualFold(host, "localhost") && net.ParseIP(host) == nil {
+			writeError(w, http.StatusForbidden, errors.Errorf("unexpected host %q", r.Host))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dashboardGuard refuses requests other than GET and HEAD that don't have the
+// DashboardHeader.
+func dashboardGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(DashboardHeader) == "" {
+			writeError(w, http.StatusForbidden, errors.New("missing "+DashboardHeader+" header"))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
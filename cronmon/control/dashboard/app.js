@@ -0,0 +1,151 @@
+"use strict";
+
+// The number of events that are kept on the page.
+const maxEvents = 100;
+
+// How often the processes are refreshed. The list carries an ETag, so this is
+// cheap while nothing changes.
+const refreshInterval = 2000;
+
+const processes = document.getElementById("processes");
+const events = document.getElementById("events");
+const summary = document.getElementById("summary");
+const error = document.getElementById("error");
+
+function element(tag, props, ...children) {
+	const el = document.createElement(tag);
+	Object.assign(el, props);
+	el.append(...children);
+	return el;
+}
+
+function note(status) {
+	if (status.stopped) return "stopped";
+	if (status.spawn_failing) return "spawn failing: " + status.spawn_failing;
+	if (status.next_restart) return "restarts at " + new Date(status.next_restart).toLocaleTimeString();
+	if (status.waiting) return "waiting for " + status.waiting;
+	if (status.restart_needed) return "restart needed";
+	return "";
+}
+
+async function act(file, action) {
+	try {
+		const resp = await fetch(`api/processes/${encodeURIComponent(file)}/${action}`, {
+			method: "POST",
+			headers: { "X-Cronmon-Dashboard": "1" },
+		});
+		if (!resp.ok) {
+			const body = await resp.json().catch(() => ({}));
+			throw new Error(body.error || resp.statusText);
+		}
+		error.textContent = "";
+	} catch (err) {
+		error.textContent = `failed to ${action} ${file}: ${err.message}`;
+	}
+
+	refresh();
+}
+
+function renderProcesses(statuses) {
+	const running = statuses.filter((s) => s.pid).length;
+	summary.textContent = `${statuses.length} scripts, ${running} running`;
+
+	processes.replaceChildren(...statuses.map((status) => {
+		const button = (action) =>
+			element("button", { textContent: action, onclick: () => act(status.file, action) });
+
+		return element("tr", {},
+			element("td", { textContent: status.file }),
+			element("td", { textContent: status.state || "-", className: "state-" + status.state }),
+			element("td", { textContent: status.pid || "-" }),
+			element("td", { textContent: status.restarts }),
+			element("td", { textContent: note(status) }),
+			element("td", {},
+				status.stopped ? button("start") : button("restart"),
+				status.stopped ? "" : button("stop")),
+		);
+	}));
+}
+
+async function refresh() {
+	try {
+		// Revalidate with the ETag instead of downloading the list again.
+		const resp = await fetch("api/processes", { cache: "no-cache" });
+		if (!resp.ok) throw new Error(resp.statusText);
+		renderProcesses(await resp.json());
+	} catch (err) {
+		error.textContent = "failed to get processes: " + err.message;
+	}
+}
+
+function addEvent(ev) {
+	const data = JSON.stringify(ev.data);
+	events.prepend(element("li", { title: data },
+		element("time", { textContent: new Date(ev.time).toLocaleTimeString() }),
+		` ${ev.type}: ${data}`,
+	));
+
+	while (events.children.length > maxEvents) {
+		events.lastChild.remove();
+	}
+}
+
+// streamEvents shows the recent events, then the live ones. The stream is read
+// by hand instead of with an EventSource, since its events are named after
+// their types, which an EventSource can only listen to one by one.
+async function streamEvents() {
+	try {
+		const resp = await fetch("api/events/recent");
+		(await resp.json()).slice(-maxEvents).forEach(addEvent);
+	} catch (err) {
+		error.textContent = "failed to get events: " + err.message;
+	}
+
+	for (;;) {
+		try {
+			await readStream();
+		} catch (err) {
+			error.textContent = "event stream disconnected: " + err.message;
+		}
+		await new Promise((resolve) => setTimeout(resolve, refreshInterval));
+	}
+}
+
+async function readStream() {
+	const resp = await fetch("api/events");
+	if (!resp.ok) throw new Error(resp.statusText);
+
+	const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+	let buffer = "";
+
+	for (;;) {
+		const { value, done } = await reader.read();
+		if (done) throw new Error("stream ended");
+
+		buffer += value;
+
+		// Messages are separated by blank lines.
+		let end;
+		while ((end = buffer.indexOf("\n\n")) >= 0) {
+			const message = buffer.slice(0, end);
+			buffer = buffer.slice(end + 2);
+
+			let name = "message";
+			let data = "";
+			for (const line of message.split("\n")) {
+				if (line.startsWith("event: ")) name = line.slice(7);
+				if (line.startsWith("data: ")) data += line.slice(6);
+			}
+
+			if (name === "dropped") {
+				addEvent({ time: new Date(), type: "dropped events", data: JSON.parse(data) });
+			} else if (data) {
+				addEvent(JSON.parse(data));
+			}
+		}
+	}
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
+streamEvents();
@@ -0,0 +1,139 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+func TestDashboard(t *testing.T) {
+	h := NewDashboard(NewServer(nil), "localhost:8080")
+
+	for _, file := range []string{"/", "/app.js", "/style.css"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080"+file, nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: unexpected status %d", file, w.Code)
+		}
+	}
+
+	// Actions from other sites, which can't send the header, are refused
+	// before they reach the API.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost:8080/api/processes/a/stop", nil))
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), DashboardHeader) {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestDashboardAPI(t *testing.T) {
+	h := NewDashboard(NewServer(nil), "localhost:8080")
+
+	// Only the control socket serves the rest of the API.
+	requests := []struct{ method, path string }{
+		{http.MethodPost, "/api/state"},
+		{http.MethodGet, "/api/state"},
+		{http.MethodPost, "/api/reconcile"},
+		{http.MethodPost, "/api/processes/a/stdin"},
+		{http.MethodPost, "/api/processes/a/reset-stats"},
+		{http.MethodPost, "/api/processes/a/kick"},
+		{http.MethodPost, "/api/processes/a/wait"},
+		{http.MethodGet, "/api/processes/a/uptime"},
+		{http.MethodPost, "/api/groups/web/stop"},
+		{http.MethodGet, "/api/groups"},
+		{http.MethodGet, "/api/healthz"},
+	}
+
+	for _, req := range requests {
+		r := httptest.NewRequest(req.method, "http://localhost:8080"+req.path, nil)
+		r.Header.Set(DashboardHeader, "1")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: unexpected status %d", req.method, req.path, w.Code)
+		}
+	}
+}
+
+func TestDashboardActions(t *testing.T) {
+	var j auditJournal
+
+	m, err := cronmon.NewMonitorWithOptions(context.Background(), t.TempDir(), &j, cronmon.MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	h := NewDashboard(NewServer(m), "localhost:8080")
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		r.Header.Set(DashboardHeader, "1")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, path := range []string{"/api/processes", "/api/events/recent"} {
+		if w := serve(http.MethodGet, path); w.Code != http.StatusOK {
+			t.Errorf("GET %s: unexpected status %d: %s", path, w.Code, w.Body)
+		}
+	}
+
+	// The actions reach the monitor, which doesn't know the script.
+	for _, action := range dashboardActions {
+		w := serve(http.MethodPost, "/api/processes/a/"+action)
+		if !strings.Contains(w.Body.String(), cronmon.ErrUnknownProcess.Error()) {
+			t.Errorf("%s: unexpected response %d: %s", action, w.Code, w.Body)
+		}
+	}
+
+	j.mut.Lock()
+	defer j.mut.Unlock()
+
+	if len(j.actions) != len(dashboardActions) {
+		t.Errorf("unexpected control actions %+v", j.actions)
+	}
+}
+
+func TestDashboardHost(t *testing.T) {
+	tests := []struct {
+		addr   string
+		host   string
+		status int
+	}{
+		{"localhost:8080", "localhost:8080", http.StatusOK},
+		{"localhost:8080", "127.0.0.1:8080", http.StatusOK},
+		{"localhost:8080", "[::1]:8080", http.StatusOK},
+		{":8080", "192.168.1.2:8080", http.StatusOK},
+		{"cronmon.lan:8080", "CRONMON.lan.:8080", http.StatusOK},
+		// Other sites' domains resolving to the dashboard through DNS
+		// rebinding.
+		{"localhost:8080", "evil.example:8080", http.StatusForbidden},
+		{":8080", "evil.example", http.StatusForbidden},
+		{"cronmon.lan:8080", "localhost.evil.example:8080", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		h := NewDashboard(NewServer(nil), test.addr)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = test.host
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s on %s: unexpected status %d, expected %d", test.host, test.addr, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package control
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// ProcessQuery filters and paginates the process list. Processes are listed in
+// the order of their names. The zero value lists all processes.
+type ProcessQuery struct {
+	// States only lists processes in any of the given states.
+	States []cronmon.ProcessState
+	// Group only lists processes in the given group.
+	Group string
+	// Name only lists processes whose names match the given glob pattern, as
+	// in path.Match.
+	Name string
+	// Limit is the maximum number of processes listed, or 0 for all of them.
+	Limit int
+	// After only lists processes after the one with the given name, which is
+	// the last one of the previous page.
+	After string
+}
+
+// ParseProcessQuery parses the query from the parameters of a request to
+// /processes: state (comma-separated), group, name, limit and after.
+func ParseProcessQuery(v url.Values) (ProcessQuery, error) {
+	q := ProcessQuery{
+		Group: v.Get("group"),
+		Name:  v.Get("name"),
+		After: v.Get("after"),
+	}
+
+	if states := v.Get("state"); states != "" {
+		for _, state := range strings.Split(states, ",") {
+			q.States = append(q.States, cronmon.ProcessState(state))
+		}
+	}
+
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return q, errors.Errorf("invalid name pattern %q", q.Name)
+		}
+	}
+
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return q, errors.Errorf("invalid limit %q", limit)
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
+
+// Values returns the query as the parameters of a request to /processes.
+func (q ProcessQuery) Values() url.Values {
+	v := url.Values{}
+
+	if len(q.States) > 0 {
+		states := make([]string, len(q.States))
+		for i, state := range q.States {
+			states[i] = string(state)
+		}
+		v.Set("state", strings.Join(states, ","))
+	}
+	if q.Group != "" {
+		v.Set("group", q.Group)
+	}
+	if q.Name != "" {
+		v.Set("name", q.Name)
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.After != "" {
+		v.Set("after", q.After)
+	}
+
+	return v
+}
+
+// Match returns true if the process matches the filters of the query.
+// Pagination isn't considered.
+func (q ProcessQuery) Match(status cronmon.ProcessStatus) bool {
+	if q.Group != "" && status.Group != q.Group {
+		return false
+	}
+
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, status.File); !ok {
+			return false
+		}
+	}
+
+	if len(q.States) > 0 {
+		for _, state := range q.States {
+			if status.State == state {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// apply returns the page of the sorted statuses that the query selects. more
+// is true if there are more processes after the page.
+func (q ProcessQuery) apply(statuses []cronmon.ProcessStatus) (page []cronmon.ProcessStatus, more bool) {
+	page = make([]cronmon.ProcessStatus, 0, len(statuses))
+
+	for _, status := range statuses {
+		if q.After != "" && status.File <= q.After {
+			continue
+		}
+		if !q.Match(status) {
+			continue
+		}
+		if q.Limit > 0 && len(page) == q.Limit {
+			return page, true
+		}
+		page = append(page, status)
+	}
+
+	return page, false
+}
+
+// etag returns the strong entity tag of the given response body.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch returns true if the If-None-Match header matches the given entity
+// tag.
+func etagMatch(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package control
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+func TestProcessQuery(t *testing.T) {
+	statuses := []cronmon.ProcessStatus{
+		{File: "api.sh", State: cronmon.ProcessRunning, Group: "web"},
+		{File: "backup.sh", State: cronmon.ProcessBackoff},
+		{File: "bot.sh", State: cronmon.ProcessRunning},
+		{File: "db.sh", State: cronmon.ProcessFailed},
+		{File: "proxy.sh", State: cronmon.ProcessRunning, Group: "web"},
+	}
+
+	files := func(statuses []cronmon.ProcessStatus) []string {
+		files := make([]string, len(statuses))
+		for i, status := range statuses {
+			files[i] = status.File
+		}
+		return files
+	}
+
+	tests := []struct {
+		query  string
+		expect []string
+		more   bool
+	}{
+		{"", []string{"api.sh", "backup.sh", "bot.sh", "db.sh", "proxy.sh"}, false},
+		{"state=running", []string{"api.sh", "bot.sh", "proxy.sh"}, false},
+		{"state=backoff,failed", []string{"backup.sh", "db.sh"}, false},
+		{"group=web", []string{"api.sh", "proxy.sh"}, false},
+		{"name=b*", []string{"backup.sh", "bot.sh"}, false},
+		{"state=running&limit=2", []string{"api.sh", "bot.sh"}, true},
+		{"state=running&limit=2&after=bot.sh", []string{"proxy.sh"}, false},
+	}
+
+	for _, test := range tests {
+		v, _ := url.ParseQuery(test.query)
+
+		q, err := ParseProcessQuery(v)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.query, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(q.Values(), v) {
+			t.Errorf("%q: query round-tripped to %q", test.query, q.Values().Encode())
+		}
+
+		page, more := q.apply(statuses)
+		if got := files(page); !reflect.DeepEqual(got, test.expect) || more != test.more {
+			t.Errorf("%q: got %v (more: %v), expected %v (more: %v)",
+				test.query, got, more, test.expect, test.more)
+		}
+	}
+
+	for _, invalid := range []string{"limit=-1", "limit=a", "name=["} {
+		v, _ := url.ParseQuery(invalid)
+		if _, err := ParseProcessQuery(v); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tag := etag([]byte("[]"))
+
+	for _, header := range []string{tag, "W/" + tag, `"a", ` + tag, "*"} {
+		if !etagMatch(header, tag) {
+			t.Errorf("%q doesn't match %s", header, tag)
+		}
+	}
+
+	for _, header := range []string{"", `"a"`, etag([]byte("[{}]"))} {
+		if etagMatch(header, tag) {
+			t.Errorf("%q matches %s", header, tag)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package cronmon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CoreDumpConfig describes how the core dumps of a script are collected. Core
+// dumps are enabled by raising the process' core file size limit; where the
+// kernel writes them is still decided by /proc/sys/kernel/core_pattern. Dumps
+// that are written to files are moved into Dir, while dumps that are piped to
+// a handler, such as systemd-coredump, are left to it.
+type CoreDumpConfig struct {
+	// Dir is the directory that core dumps are moved into. It defaults to
+	// DefaultCoreDumpDir, and relative paths are relative to the scripts
+	// directory. Dumps on another filesystem are left where they are.
+	Dir string `json:"dir,omitempty"`
+	// MaxFiles is the number of the script's core dumps to keep in Dir. Older
+	// ones are removed. It defaults to DefaultCoreDumpMaxFiles.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// DefaultCoreDumpDir is the default directory in the scripts directory that
+// core dumps are collected into. See CoreDumpConfig.
+const DefaultCoreDumpDir = ".cores"
+
+// DefaultCoreDumpMaxFiles is the default number of core dumps kept per script.
+const DefaultCoreDumpMaxFiles = 3
+
+// CorePatternPath is the path to the kernel's core pattern.
+var CorePatternPath = "/proc/sys/kernel/core_pattern"
+
+// coreUsesPIDPath is the path to the kernel's setting of whether the PID is
+// appended to core files whose pattern doesn't contain it.
+var coreUsesPIDPath = "/proc/sys/kernel/core_uses_pid"
+
+// collectCoreDump finds the core dump of the process with the given PID that
+// exited after starting at the given time, moves it into the configured
+// directory and removes old dumps. The path to the dump is returned, or an
+// empty string if it's not written to a file.
+func collectCoreDump(dir, name string, cfg CoreDumpConfig, procDir string, pid int, since time.Time) (string, error) {
+	b, err := os.ReadFile(CorePatternPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read core pattern")
+	}
+
+	pattern := strings.TrimSpace(string(b))
+	if pattern == "" || strings.HasPrefix(pattern, "|") {
+		return "", nil
+	}
+
+	glob := corePatternGlob(pattern, pid)
+	if !filepath.IsAbs(glob) {
+		glob = filepath.Join(procDir, glob)
+	}
+
+	// Modification times may be coarser than the start time.
+	core := newestFile(glob, since.Add(-time.Second))
+	if core == "" {
+		return "", errors.Errorf("core dump matching %s not found", glob)
+	}
+
+	coreDir := resolvePath(dir, cfg.Dir)
+	if cfg.Dir == "" {
+		coreDir = filepath.Join(dir, DefaultCoreDumpDir)
+	}
+
+	if err := os.MkdirAll(coreDir, 0750); err != nil {
+		return core, errors.Wrap(err, "failed to create core dump directory")
+	}
+
+	dst := filepath.Join(coreDir, fmt.Sprintf("%s.%d.%d.core", name, pid, time.Now().Unix()))
+	if err := os.Rename(core, dst); err != nil {
+		// Core dumps are too large to copy, so they're left where they are.
+		return core, nil
+	}
+
+	maxFiles := cfg.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultCoreDumpMaxFiles
+	}
+
+	pruneCoreDumps(coreDir, name, maxFiles)
+	return dst, nil
+}
+
+// corePatternGlob turns the core pattern into a glob that matches the core dump
+// of the process with the given PID.
+func corePatternGlob(pattern string, pid int) string {
+	var glob strings.Builder
+	var hasPID bool
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case c == '%' && i+1 < len(pattern):
+			i++
+			switch pattern[i] {
+			case '%':
+				glob.WriteByte('%')
+			case 'p', 'P':
+				glob.WriteString(strconv.Itoa(pid))
+				hasPID = true
+			default:
+				glob.WriteByte('*')
+			}
+		default:
+			if strings.IndexByte(`*?[\`, c) >= 0 {
+				glob.WriteByte('\\')
+			}
+			glob.WriteByte(c)
+		}
+	}
+
+	if !hasPID {
+		if b, err := os.ReadFile(coreUsesPIDPath); err == nil && strings.TrimSpace(string(b)) == "1" {
+			glob.WriteString("." + strconv.Itoa(pid))
+		}
+	}
+
+	return glob.String()
+}
+
+// newestFile returns the most recently modified file matching the glob that
+// was modified after the given time.
+func newestFile(glob string, since time.Time) string {
+	matches, _ := filepath.Glob(glob)
+
+	var newest string
+	var newestTime time.Time
+
+	for _, match := range matches {
+		s, err := os.Lstat(match)
+		if err != nil || !s.Mode().IsRegular() || s.ModTime().Before(since) {
+			continue
+		}
+		if newest == "" || s.ModTime().After(newestTime) {
+			newest = match
+			newestTime = s.ModTime()
+		}
+	}
+
+	return newest
+}
+
+// pruneCoreDumps removes all but the newest maxFiles core dumps of the script
+// in the directory.
+func pruneCoreDumps(coreDir, name string, maxFiles int) {
+	matches, _ := filepath.Glob(filepath.Join(coreDir, globEscape(name)+".*.core"))
+
+	type dump struct {
+		path string
+		time time.Time
+	}
+
+	var dumps []dump
+	for _, match := range matches {
+		// Only count the script's own dumps, not those of scripts whose names
+		// start with its name and a dot.
+		rest := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), name+"."), ".core")
+		if strings.Count(rest, ".") != 1 {
+			continue
+		}
+
+		if s, err := os.Stat(match); err == nil {
+			dumps = append(dumps, dump{match, s.ModTime()})
+		}
+	}
+
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].time.After(dumps[j].time) })
+
+	for i := maxFiles; i < len(dumps); i++ {
+		os.Remove(dumps[i].path)
+	}
+}
+
+// globEscape escapes the glob metacharacters in s.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
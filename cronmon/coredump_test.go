@@ -0,0 +1,121 @@
+package cronmon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorePatternGlob(t *testing.T) {
+	coreUsesPIDPath = filepath.Join(t.TempDir(), "core_uses_pid")
+	t.Cleanup(func() { coreUsesPIDPath = "/proc/sys/kernel/core_uses_pid" })
+
+	tests := []struct {
+		pattern string
+		usesPID bool
+		glob    string
+	}{
+		{"core", false, "core"},
+		{"core", true, "core.42"},
+		{"/var/crash/core.%e.%p", true, "/var/crash/core.*.42"},
+		{"core.%P.%t", false, "core.42.*"},
+		{"core%%[x]?", false, `core%\[x]\?`},
+		{"core.%", false, "core.%"},
+	}
+
+	for _, test := range tests {
+		usesPID := "0\n"
+		if test.usesPID {
+			usesPID = "1\n"
+		}
+		if err := os.WriteFile(coreUsesPIDPath, []byte(usesPID), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if glob := corePatternGlob(test.pattern, 42); glob != test.glob {
+			t.Errorf("pattern %q: got glob %q, expected %q", test.pattern, glob, test.glob)
+		}
+	}
+}
+
+func TestCollectCoreDump(t *testing.T) {
+	dir := t.TempDir()
+	procDir := t.TempDir()
+
+	CorePatternPath = filepath.Join(t.TempDir(), "core_pattern")
+	t.Cleanup(func() { CorePatternPath = "/proc/sys/kernel/core_pattern" })
+
+	writePattern := func(pattern string) {
+		t.Helper()
+		if err := os.WriteFile(CorePatternPath, []byte(pattern+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writePattern("|/usr/lib/systemd/systemd-coredump %P")
+
+	core, err := collectCoreDump(dir, "a", CoreDumpConfig{}, procDir, 42, time.Now())
+	if err != nil || core != "" {
+		t.Fatalf("piped core dump: got %q, %v", core, err)
+	}
+
+	writePattern("core.%p")
+
+	if _, err := collectCoreDump(dir, "a", CoreDumpConfig{}, procDir, 42, time.Now()); err == nil {
+		t.Fatal("expected error for missing core dump")
+	}
+
+	path := filepath.Join(procDir, "core.42")
+	if err := os.WriteFile(path, []byte("core"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	core, err = collectCoreDump(dir, "a", CoreDumpConfig{}, procDir, 42, time.Now())
+	if err != nil {
+		t.Fatal("failed to collect core dump:", err)
+	}
+
+	coreDir := filepath.Join(dir, DefaultCoreDumpDir)
+	if filepath.Dir(core) != coreDir || !strings.HasPrefix(filepath.Base(core), "a.42.") {
+		t.Errorf("unexpected core dump path %q", core)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("core dump was not moved")
+	}
+}
+
+func TestPruneCoreDumps(t *testing.T) {
+	dir := t.TempDir()
+
+	// The dumps of script a from oldest to newest, and one of script a.b.
+	names := []string{"a.1.100.core", "a.2.200.core", "a.3.300.core", "a.b.4.400.core"}
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := time.Now().Add(time.Duration(i-len(names)) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneCoreDumps(dir, "a", 2)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+
+	if got := strings.Join(left, " "); got != "a.2.200.core a.3.300.core a.b.4.400.core" {
+		t.Errorf("unexpected core dumps left: %s", got)
+	}
+}
@@ -17,7 +17,18 @@
 //
 // Note that when a regular editor writes to one of the scripts, it may perform
 // multiple operations for atomicity, which may interfere and cause cronmon to
-// restart the process multiple times rapidly. This is to be expected.
+// restart the process multiple times rapidly. The common pattern of renaming a
+// new file over the script (or renaming the script away and creating a new one
+// in its place) is detected and treated as a single update, but other patterns
+// may still cause multiple restarts.
+//
+// Scripts may also be symlinks. The link is resolved every time the process is
+// spawned, and the target file is watched as well, so updating the target will
+// restart the process. A dangling symlink is reported as a spawn error.
+//
+// Each script may have a hidden configuration file next to it, which is
+// described by ScriptConfig. Hidden files and special files such as FIFOs are
+// never treated as scripts.
 //
 // Interruption
 //
@@ -0,0 +1,169 @@
+// Package cronmontest provides test doubles for programs that embed cronmon,
+// so that they can test against the Journaler and exec.Process interfaces
+// without spawning real processes.
+package cronmontest
+
+import (
+	"io"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+)
+
+// Forever is a duration long enough to never pass within a test. It can be
+// given to NewSleepProcess for a process that only exits when signaled.
+const Forever time.Duration = math.MaxInt64
+
+// Journal is an in-memory storage of journals. A zero-value instance is a
+// valid instance.
+type Journal struct {
+	mutex    sync.Mutex
+	finalize bool
+	journals []cronmon.Event
+}
+
+var _ cronmon.Journaler = (*Journal)(nil)
+
+// ID returns "mock".
+func (j *Journal) ID() string { return "mock" }
+
+// Finalize locks the memory store. Future writes will cause a panic.
+func (j *Journal) Finalize() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.finalize = true
+}
+
+// Write appends a journal event into the internal store.
+func (j *Journal) Write(ev cronmon.Event) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.finalize {
+		panic("log write when finalized")
+	}
+
+	j.journals = append(j.journals, ev)
+	return nil
+}
+
+// States returns the process state changes out of the journaled events.
+func (j *Journal) States() []*cronmon.EventProcessStateChanged {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var states []*cronmon.EventProcessStateChanged
+	for _, ev := range j.journals {
+		if ev, ok := ev.(*cronmon.EventProcessStateChanged); ok {
+			states = append(states, ev)
+		}
+	}
+	return states
+}
+
+// Journals returns a copy of the journal slice.
+func (j *Journal) Journals() []cronmon.Event {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return append([]cronmon.Event(nil), j.journals...)
+}
+
+// Verify verifies that the given journals slice is equal to the one stored
+// internally. If strict is true, then a length check is performed, otherwise,
+// the unmatched events are returned.
+//
+// Consecutive calls to Verify will match the remaining unmatched events.
+func (j *Journal) Verify(t testing.TB, strict bool, journals []cronmon.Event) []cronmon.Event {
+	t.Helper()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if strict && len(journals) != len(j.journals) {
+		t.Errorf("mismatch journal length, got %d, expected %d", len(j.journals), len(journals))
+		return nil
+	}
+
+	if len(journals) > len(j.journals) {
+		t.Errorf("too few journals, got %d, expected at least %d", len(j.journals), len(journals))
+		return nil
+	}
+
+	for i, ev := range journals {
+		if !reflect.DeepEqual(j.journals[i], ev) {
+			t.Errorf("journal %d mismatch, got %#v, expected %#v", i, j.journals[i], ev)
+		}
+	}
+
+	j.journals = j.journals[len(journals):]
+	return j.journals
+}
+
+// Reader reads events from a slice. It can be given to functions such as
+// cronmon.ReadPreviousState in place of a journal file.
+type Reader struct {
+	Events []ReaderEvent
+	cursor int
+}
+
+var _ cronmon.JournalReader = (*Reader)(nil)
+
+// ReaderEvent is an event read by Reader.
+type ReaderEvent struct {
+	Event cronmon.Event
+	Time  time.Time
+}
+
+// NewReader creates a new reader that reads the given events, all of which
+// are timestamped with the given time.
+func NewReader(t time.Time, events ...cronmon.Event) *Reader {
+	r := &Reader{Events: make([]ReaderEvent, len(events))}
+	for i, ev := range events {
+		r.Events[i] = ReaderEvent{Event: ev, Time: t}
+	}
+	return r
+}
+
+// Read reads the next event. It returns io.EOF once all events are read.
+func (r *Reader) Read() (cronmon.Event, time.Time, error) {
+	if r.cursor >= len(r.Events) {
+		return nil, time.Time{}, io.EOF
+	}
+
+	ev := r.Events[r.cursor]
+	r.cursor++
+
+	return ev.Event, ev.Time, nil
+}
+
+// NewSleepProcess creates a process that only idles for dura before exiting
+// with code 0. SIGINT and SIGTERM make it exit with code 0 after delay, and
+// SIGKILL makes it exit with code -1 right away. SIGHUP, SIGUSR1 and SIGUSR2
+// are ignored.
+func NewSleepProcess(dura, delay time.Duration, pid int) exec.Process {
+	return exec.NewSleepProcess(dura, delay, pid)
+}
+
+// Spawner returns a function that spawns sleep processes with incrementing
+// PIDs starting from 1. It can be used as cronmon.Process.Spawn.
+func Spawner(dura, delay time.Duration) func(exec.Options) (exec.Process, error) {
+	nextPID := NewPIDCounter()
+	return func(exec.Options) (exec.Process, error) {
+		return NewSleepProcess(dura, delay, nextPID()), nil
+	}
+}
+
+// NewPIDCounter returns a function that returns incrementing PIDs starting
+// from 1. It is safe to call concurrently.
+func NewPIDCounter() func() int {
+	var pid uint32
+	return func() int { return int(atomic.AddUint32(&pid, 1)) }
+}
@@ -0,0 +1,52 @@
+package cronmontest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/cronmontest"
+)
+
+func TestProcess(t *testing.T) {
+	var j cronmontest.Journal
+
+	proc := cronmon.NewProcess(context.Background(), "", "sleep", &j)
+	proc.RetryBackoff = []time.Duration{0} // no backoff
+	proc.Spawn = cronmontest.Spawner(cronmontest.Forever, 0)
+	proc.Start(false)
+
+	if err := proc.Stop(); err != nil {
+		t.Error("failed to stop process:", err)
+	}
+
+	j.Verify(t, true, []cronmon.Event{
+		&cronmon.EventProcessStateChanged{File: "sleep", From: cronmon.ProcessIdle, To: cronmon.ProcessStarting},
+		&cronmon.EventProcessSpawned{PID: 1, File: "sleep"},
+		&cronmon.EventProcessStateChanged{File: "sleep", From: cronmon.ProcessStarting, To: cronmon.ProcessRunning},
+		&cronmon.EventProcessStateChanged{File: "sleep", From: cronmon.ProcessRunning, To: cronmon.ProcessStopping},
+		&cronmon.EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+		&cronmon.EventProcessStateChanged{File: "sleep", From: cronmon.ProcessStopping, To: cronmon.ProcessStopped},
+	})
+}
+
+func TestReader(t *testing.T) {
+	d := time.Date(2020, 04, 01, 00, 00, 00, 00, time.UTC)
+	r := cronmontest.NewReader(d,
+		&cronmon.EventProcessSpawned{PID: 2, File: "a"},
+		&cronmon.EventAcquired{},
+	)
+
+	state, err := cronmon.ReadPreviousState(r)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if pid := state.Processes["a"]; pid != 2 {
+		t.Errorf("unexpected PID of a: %d", pid)
+	}
+	if !state.StartedAt.Equal(d) {
+		t.Errorf("unexpected start time: %v", state.StartedAt)
+	}
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BinaryCheckInterval is the interval at which the daemon's own binary is
+// checked for changes if Config.WatchBinary is true.
+var BinaryCheckInterval = 10 * time.Second
+
+// ErrBinaryChanged is returned by Run once it has stopped because its own
+// binary changed, such as after a package upgrade. The caller should then
+// execute the new binary to restart the daemon.
+var ErrBinaryChanged = errors.New("cronmon binary changed")
+
+// binaryStat identifies a version of a file.
+type binaryStat struct {
+	ino   uint64
+	size  int64
+	mtime time.Time
+}
+
+func statBinary(path string) (binaryStat, error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return binaryStat{}, err
+	}
+
+	bs := binaryStat{size: s.Size(), mtime: s.ModTime()}
+	if sys, ok := s.Sys().(*syscall.Stat_t); ok {
+		bs.ino = sys.Ino
+	}
+
+	return bs, nil
+}
+
+// watchBinary returns a channel that is closed once the file at the given path
+// changes and then stays unchanged for another interval, so that a binary that
+// is still being written isn't executed.
+func watchBinary(ctx context.Context, path string, interval time.Duration) (<-chan struct{}, error) {
+	orig, err := statBinary(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat binary")
+	}
+
+	changed := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := orig
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			curr, err := statBinary(path)
+			if err != nil {
+				// The binary may be in the middle of being replaced.
+				last = binaryStat{}
+				continue
+			}
+
+			if curr != orig && curr == last {
+				close(changed)
+				return
+			}
+
+			last = curr
+		}
+	}()
+
+	return changed, nil
+}
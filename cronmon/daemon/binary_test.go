@@ -0,0 +1,46 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cronmon")
+
+	if err := os.WriteFile(path, []byte("v1"), 0755); err != nil {
+		t.Fatal("failed to write binary:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed, err := watchBinary(ctx, path, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal("failed to watch binary:", err)
+	}
+
+	select {
+	case <-changed:
+		t.Fatal("unexpected change of unchanged binary")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Replace the binary the way package managers do.
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, []byte("v2!"), 0755); err != nil {
+		t.Fatal("failed to write new binary:", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal("failed to replace binary:", err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("binary change was not detected")
+	}
+}
@@ -0,0 +1,598 @@
+// Package daemon provides the complete cronmon daemon as a library, wiring
+// together the journal lock, the journal writers, the monitor and the control
+// socket. It allows other Go programs to embed cronmon-style supervision of a
+// directory of scripts or plugins.
+//
+// For finer control, the components may also be used on their own; see
+// packages cronmon, journal and control.
+package daemon
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/control"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/gitsync"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/leader"
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of a cronmon daemon.
+type Config struct {
+	// JournalFile is the path to the journal file, which is also locked to
+	// ensure that only one daemon runs with it. It is required.
+	JournalFile string
+	// ScriptsDir is the path to the scripts directory, which is created if it
+	// doesn't exist. It is required.
+	ScriptsDir string
+	// SocketFile, if not empty, is the path to the control socket to serve.
+	SocketFile string
+	// HealthAddr, if not empty, is the TCP address to serve the health
+	// endpoints of the control API on, such as for load balancer checks. See
+	// control.NewHealthServer.
+	HealthAddr string
+	// DashboardAddr, if not empty, is the TCP address to serve the web
+	// dashboard and the control API under /api/ on. Anyone who can reach it
+	// can act on the scripts. See control.NewDashboard.
+	DashboardAddr string
+	// Debug, if true, serves the debugging endpoints on the control socket.
+	// See control.Server.EnableDebug.
+	Debug bool
+	// SplitJournal, if true, writes the events of each script into its own
+	// journal file in SplitJournalDir.
+	SplitJournal bool
+	// Log, if not nil, receives the journal in a human-friendly format.
+	Log io.Writer
+	// Stream, if not nil, receives the journal as line-delimited JSON like
+	// the journal file, such as for a supervisor that collects cronmon's
+	// output.
+	Stream io.Writer
+	// Output, if not nil, receives the output of all scripts prefixed with
+	// their names. See cronmon.MonitorOptions.
+	Output *cronmon.LogMux
+	// DryRun, if true, only writes what would be spawned into Log instead of
+	// spawning anything. The journal file is neither locked nor written to,
+	// and the control socket is not served, so a dry run may be done while
+	// another daemon is running. Run returns once every script was
+	// considered. See cronmon.MonitorOptions.
+	DryRun bool
+	// Mirror, if true, runs the full daemon without spawning anything: the
+	// journal is locked and written, and the control socket is served, but
+	// scripts are only validated and journaled as they would be spawned,
+	// such as for a staged rollout on a host whose scripts aren't trusted
+	// yet. Plugins are started, but their spawners are never used.
+	Mirror bool
+	// StealLock, if true, breaks the journal lock if it's held by a process
+	// that no longer exists, as validated by the lock's metadata. The takeover
+	// is journaled. See journal.StealLock.
+	StealLock bool
+	// LeaseFile, if not empty, is the path to a lease file on storage shared
+	// by several hosts. Only the host that is elected as the leader through
+	// the lease runs the scripts, and another host takes over once the leader
+	// stops renewing it. See package leader.
+	LeaseFile string
+	// Locker, if not nil, is used to lock the journal instead of a flock on
+	// the journal file, such as for clustered deployments. StealLock is then
+	// not supported. See journal.Locker.
+	Locker journal.Locker
+	// WatchBinary, if true, stops the daemon once its own binary changes,
+	// such as after a package upgrade, so that it can be restarted with the
+	// new binary. Run then returns ErrBinaryChanged.
+	WatchBinary bool
+	// Dedup, if true, collapses runs of identical events into a single
+	// event before they're journaled. See journal.DedupJournaler.
+	Dedup bool
+	// Middleware are the middlewares that events go through, in order, before
+	// they're journaled. See cronmon.JournalMiddleware.
+	Middleware []cronmon.JournalMiddleware
+	// Host, if not nil, is written alongside every event in the journal and
+	// the stream, so that journals of several hosts can be aggregated. See
+	// journal.CurrentHost.
+	Host *journal.Host
+	// Settle is the duration that changes in the scripts directory must be
+	// quiet for before they're applied together. See
+	// cronmon.MonitorOptions.Settle.
+	Settle time.Duration
+	// RestartLimit is the number of automatic restarts per minute across all
+	// scripts above which restarts are throttled. See
+	// cronmon.MonitorOptions.RestartLimit.
+	RestartLimit int
+	// SpawnConcurrency is the number of scripts that may be spawned at the
+	// same time. See cronmon.MonitorOptions.SpawnConcurrency.
+	SpawnConcurrency int
+	// Pressure are the limits of the host's pressure above which the restarts
+	// of crashed scripts are deferred. See cronmon.PressureLimits.
+	Pressure cronmon.PressureLimits
+	// Sync is when journaled events are synced to disk. The zero value syncs
+	// every event. See journal.SyncPolicy.
+	Sync journal.SyncPolicy
+	// JournalMaxSize, if not zero, is the size in bytes above which the
+	// journal is compressed into a rotated segment, as checked every
+	// JournalCheckInterval. The journal is still read across its segments.
+	// The split journals of each script are not rotated. See
+	// journal.FileLockJournaler.Rotate.
+	JournalMaxSize int64
+	// JournalKeep is the number of rotated journal segments that are kept. It
+	// defaults to DefaultJournalKeep.
+	JournalKeep int
+	// JournalPolicy is when a write into the journal and its copies, such as
+	// the log, the stream and plugins, fails. The zero value fails if any of
+	// them failed. See journal.ErrorPolicy.
+	JournalPolicy journal.ErrorPolicy
+	// PluginsDir, if not empty, is a directory of plugins to start. Every
+	// executable file in it is started as a plugin, which may add journalers,
+	// notifiers and spawners. See package plugin.
+	PluginsDir string
+	// QuietFlapping, if true, doesn't send notifier plugins the events of
+	// scripts that are flapping, which they would otherwise be alerted about
+	// on every restart. See cronmon.FlapThreshold.
+	QuietFlapping bool
+	// GitSync, if not nil, keeps the scripts directory in sync with a git
+	// repository. See package gitsync.
+	GitSync *gitsync.Config
+	// Digest, if not nil, sends a daily digest of the scripts. See
+	// DigestConfig.
+	Digest *DigestConfig
+	// Users, if true, also supervises the scripts of every user whose scripts
+	// directory matches UserScriptsGlob, running them as that user. Each user
+	// gets their own journal and control socket; see UserJournalFile and
+	// UserSocketFile. The daemon must run as root.
+	Users bool
+}
+
+// ErrAlreadyRunning is returned by Run if another daemon holds the lock on the
+// journal file.
+var ErrAlreadyRunning = journal.ErrLockedElsewhere
+
+// SplitJournalDir returns the directory that the per-script journal files are
+// written into if Config.SplitJournal is true.
+func SplitJournalDir(journalFile string) string {
+	return filepath.Join(filepath.Dir(journalFile), "journal.d")
+}
+
+// newControlServer creates the control API server of the monitor, which reads
+// the journal of the given configuration.
+func newControlServer(cfg Config, m *cronmon.Monitor) *control.Server {
+	srv := control.NewServer(m)
+	srv.EnableJournal(func(file string) (control.JournalReadCloser, error) {
+		path := cfg.JournalFile
+		if cfg.SplitJournal {
+			path = journal.SplitJournalPath(SplitJournalDir(cfg.JournalFile), file)
+		}
+		return journal.OpenReadOnly(path)
+	})
+	return srv
+}
+
+// Run runs the daemon until the context is canceled, after which all processes
+// are stopped. ErrAlreadyRunning is returned if another daemon is already
+// running with the same journal file, and ErrBinaryChanged is returned if the
+// daemon stopped because its binary changed.
+func Run(ctx context.Context, cfg Config) error {
+	if cfg.JournalFile == "" {
+		return errors.New("missing journal file")
+	}
+	if cfg.ScriptsDir == "" {
+		return errors.New("missing scripts directory")
+	}
+	if cfg.Digest != nil {
+		if err := cfg.Digest.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DryRun {
+		if cfg.Mirror {
+			return errors.New("dry run and mirror are mutually exclusive")
+		}
+		return dryRun(ctx, cfg)
+	}
+
+	j, stolen, err := openJournal(cfg)
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	if stolen != nil {
+		j.Write(&cronmon.EventLockStolen{
+			PID:   stolen.PID,
+			Host:  stolen.Host,
+			Since: stolen.Since,
+		})
+	}
+
+	// Record monotonic times so that the journal stays sane across clock
+	// jumps on boards without a real-time clock.
+	j.Monotonic = true
+	j.Host = cfg.Host
+
+	if cfg.Sync != "" {
+		if err := j.SetSyncPolicy(cfg.Sync); err != nil {
+			return errors.Wrap(err, "failed to sync journal")
+		}
+	}
+
+	var fileJournaler cronmon.Journaler = j
+
+	if cfg.SplitJournal {
+		split, err := journal.NewSplitJournaler(j, SplitJournalDir(cfg.JournalFile))
+		if err != nil {
+			return errors.Wrap(err, "failed to create split journal")
+		}
+		defer split.Close()
+
+		split.Monotonic = true
+		split.Host = cfg.Host
+		split.Format = j.Format()
+		fileJournaler = split
+	}
+
+	// Beware: changing the combination of these writers will break existing
+	// status directories.
+	multiOpts := journal.MultiWriterOptions{Policy: cfg.JournalPolicy}
+
+	journaler := fileJournaler
+	if cfg.Log != nil {
+		journaler = journal.MultiWriterWithOptions(multiOpts, journaler, journal.NewHumanWriter("stderr", cfg.Log))
+	}
+	if cfg.Stream != nil {
+		journaler = journal.MultiWriterWithOptions(multiOpts, journaler, newStreamWriter(cfg))
+	}
+
+	var spawners map[string]cronmon.Spawner
+	var flaps flapFilter
+
+	if cfg.PluginsDir != "" {
+		plugins, err := startPlugins(cfg.PluginsDir)
+		if err != nil {
+			return err
+		}
+		defer plugins.close()
+
+		if spawners, err = plugins.spawners(); err != nil {
+			return err
+		}
+
+		var keep func(cronmon.Event) bool
+		if cfg.QuietFlapping {
+			keep = flaps.keep
+		}
+
+		journaler = plugins.journaler(journaler, multiOpts, keep)
+	}
+
+	if cfg.Dedup {
+		dedup := journal.NewDedupJournaler(journaler)
+		defer dedup.Flush()
+
+		journaler = dedup
+	}
+
+	journaler = cronmon.ChainJournaler(journaler, cfg.Middleware...)
+
+	// Restore the statistics of the last cronmon. An error is expected if the
+	// journal is new. The journal may have been rotated since the last cronmon
+	// started, so its segments are read as well.
+	state, err := readPreviousStateFile(cfg)
+	if err != nil {
+		state = nil
+	}
+
+	if cfg.JournalMaxSize > 0 {
+		rotateCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go rotateJournal(rotateCtx, j, cfg.JournalFile, cfg.JournalMaxSize, cfg.JournalKeep, journaler)
+	}
+
+	var binaryChanged <-chan struct{}
+
+	if cfg.WatchBinary {
+		exe, err := os.Executable()
+		if err != nil {
+			return errors.Wrap(err, "failed to find binary")
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		changed, err := watchBinary(ctx, exe, BinaryCheckInterval)
+		if err != nil {
+			return err
+		}
+
+		stopped := make(chan struct{})
+		binaryChanged = stopped
+
+		go func() {
+			select {
+			case <-changed:
+				journaler.Write(&cronmon.EventBinaryChanged{Path: exe})
+				close(stopped)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	if cfg.GitSync != nil {
+		syncer, err := gitsync.NewSyncer(cfg.ScriptsDir, *cfg.GitSync, journaler)
+		if err != nil {
+			return errors.Wrap(err, "invalid git sync")
+		}
+
+		syncCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go syncer.Run(syncCtx)
+	}
+
+	if err := supervise(ctx, cfg, journaler, state, spawners, &flaps); err != nil {
+		return err
+	}
+
+	select {
+	case <-binaryChanged:
+		return ErrBinaryChanged
+	default:
+		return nil
+	}
+}
+
+// supervise runs the monitor until the context is canceled. If a lease file is
+// configured, the monitor only runs while this daemon is the leader.
+func supervise(
+	ctx context.Context, cfg Config, journaler cronmon.Journaler,
+	state *cronmon.PreviousState, spawners map[string]cronmon.Spawner, flaps *flapFilter) error {
+
+	if cfg.LeaseFile == "" {
+		return serve(ctx, cfg, journaler, state, spawners, flaps, 0)
+	}
+
+	elector := leader.NewElector(cfg.LeaseFile)
+
+	for {
+		term, err := elector.Acquire(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "failed to acquire leadership")
+		}
+
+		journaler.Write(&cronmon.EventLeaderElected{
+			Holder: elector.ID,
+			Token:  term.Token(),
+		})
+
+		termCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-term.Lost():
+				cancel()
+			case <-termCtx.Done():
+			}
+		}()
+
+		err = serve(termCtx, cfg, journaler, state, spawners, flaps, term.Token())
+		cancel()
+
+		if err != nil || ctx.Err() != nil {
+			term.Resign()
+			return err
+		}
+
+		journaler.Write(&cronmon.EventLeaderLost{Token: term.Token()})
+
+		// Carry the statistics over to the next term.
+		if newState, err := readPreviousStateFile(cfg); err == nil {
+			state = newState
+		}
+	}
+}
+
+// readPreviousState reads the previous state from the reader of the journal
+// file, merged with the journals of each script if the journal is split.
+func readPreviousState(cfg Config, r cronmon.JournalReader) (*cronmon.PreviousState, error) {
+	if !cfg.SplitJournal {
+		return cronmon.ReadPreviousState(r)
+	}
+
+	split, err := journal.NewSplitReader(r, SplitJournalDir(cfg.JournalFile))
+	if err != nil {
+		return nil, err
+	}
+	defer split.Close()
+
+	return cronmon.ReadPreviousState(split)
+}
+
+// readPreviousStateFile is like readPreviousState, except that it opens the
+// journal file itself.
+func readPreviousStateFile(cfg Config) (*cronmon.PreviousState, error) {
+	r, err := journal.OpenReadOnly(cfg.JournalFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readPreviousState(cfg, r)
+}
+
+// serve runs the monitor and the control socket until the context is canceled.
+// The monitor is set as the one that flaps asks. Fence is the fencing token of
+// the leadership term, if any.
+func serve(
+	ctx context.Context, cfg Config, journaler cronmon.Journaler,
+	state *cronmon.PreviousState, spawners map[string]cronmon.Spawner, flaps *flapFilter,
+	fence uint64) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m, err := cronmon.NewMonitorWithOptions(ctx, cfg.ScriptsDir, journaler, cronmon.MonitorOptions{
+		State:    state,
+		Output:   cfg.Output,
+		Settle:   cfg.Settle,
+		Spawners: spawners,
+		DryRun:   cfg.Mirror,
+		Fence:    fence,
+
+		RestartLimit:     cfg.RestartLimit,
+		SpawnConcurrency: cfg.SpawnConcurrency,
+		Pressure:         cfg.Pressure,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create monitor")
+	}
+	defer m.Stop()
+
+	flaps.set(m)
+	defer flaps.set(nil)
+
+	if cfg.SocketFile != "" {
+		go func() {
+			srv := newControlServer(cfg, m)
+			if cfg.Debug {
+				srv.EnableDebug()
+			}
+
+			if err := os.MkdirAll(filepath.Dir(cfg.SocketFile), 0700); err != nil {
+				journaler.Write(&cronmon.EventWarning{
+					Component: "control",
+					Error:     "failed to create control socket directory: " + err.Error(),
+				})
+				return
+			}
+
+			if err := control.ListenAndServe(ctx, cfg.SocketFile, srv); err != nil {
+				journaler.Write(&cronmon.EventWarning{
+					Component: "control",
+					Error:     "failed to serve control socket: " + err.Error(),
+				})
+			}
+		}()
+	}
+
+	if cfg.DashboardAddr != "" {
+		go func() {
+			dashboard := control.NewDashboard(newControlServer(cfg, m), cfg.DashboardAddr)
+			if err := control.ListenAndServeTCP(ctx, cfg.DashboardAddr, dashboard); err != nil {
+				journaler.Write(&cronmon.EventWarning{
+					Component: "control",
+					Error:     "failed to serve dashboard: " + err.Error(),
+				})
+			}
+		}()
+	}
+
+	if cfg.HealthAddr != "" {
+		go func() {
+			if err := control.ListenAndServeTCP(ctx, cfg.HealthAddr, control.NewHealthServer(m)); err != nil {
+				journaler.Write(&cronmon.EventWarning{
+					Component: "control",
+					Error:     "failed to serve health endpoints: " + err.Error(),
+				})
+			}
+		}()
+	}
+
+	if cfg.Digest != nil {
+		go runDigests(ctx, cfg, m, journaler)
+	}
+
+	if cfg.Users {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			superviseUsers(ctx, cfg, journaler)
+		}()
+		// Stop the users' processes before returning.
+		defer func() { <-done }()
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// openJournal opens the journal file, stealing its lock if configured to. The
+// metadata of the stolen lock is returned if it was stolen.
+func openJournal(cfg Config) (*journal.FileLockJournaler, *journal.LockInfo, error) {
+	locker := cfg.Locker
+	if locker == nil {
+		locker = journal.NewFileLocker(cfg.JournalFile)
+	}
+
+	j, err := journal.NewLockedJournaler(cfg.JournalFile, locker)
+	if err == nil {
+		return j, nil, nil
+	}
+
+	if !errors.Is(err, journal.ErrLockedElsewhere) {
+		return nil, nil, errors.Wrap(err, "failed to acquire journal lock")
+	}
+
+	if !cfg.StealLock || cfg.Locker != nil {
+		if holder, _ := locker.Holder(); holder != "" {
+			return nil, nil, errors.Wrapf(ErrAlreadyRunning, "lock held by %s", holder)
+		}
+		return nil, nil, ErrAlreadyRunning
+	}
+
+	stolen, err := journal.StealLock(cfg.JournalFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to steal journal lock")
+	}
+
+	j, err = journal.NewFileLockJournaler(cfg.JournalFile)
+	if err != nil {
+		if errors.Is(err, journal.ErrLockedElsewhere) {
+			return nil, nil, ErrAlreadyRunning
+		}
+		return nil, nil, errors.Wrap(err, "failed to acquire journal lock")
+	}
+
+	return j, stolen, nil
+}
+
+// newStreamWriter creates the writer of the JSON stream.
+func newStreamWriter(cfg Config) *journal.Writer {
+	w := journal.NewWriter("stdout", cfg.Stream)
+	w.Host = cfg.Host
+	return w
+}
+
+// dryRun writes what would be spawned into the log and returns once every
+// script in the directory was considered.
+func dryRun(ctx context.Context, cfg Config) error {
+	w := cfg.Log
+	if w == nil {
+		w = io.Discard
+	}
+
+	var j cronmon.Journaler = journal.NewHumanWriter("dry-run", w)
+	if cfg.Stream != nil {
+		j = journal.MultiWriter(j, newStreamWriter(cfg))
+	}
+
+	m, err := cronmon.NewMonitorWithOptions(ctx, cfg.ScriptsDir, j,
+		cronmon.MonitorOptions{DryRun: true},
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to create monitor")
+	}
+	select {
+	case <-m.Scanned():
+	case <-ctx.Done():
+	}
+
+	m.Stop()
+	return nil
+}
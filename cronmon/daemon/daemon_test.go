@@ -0,0 +1,260 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+)
+
+func TestReadPreviousStateSplit(t *testing.T) {
+	cfg := Config{
+		JournalFile:  filepath.Join(t.TempDir(), "journal.json"),
+		SplitJournal: true,
+	}
+
+	j, err := journal.NewFileLockJournaler(cfg.JournalFile)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer j.Close()
+
+	split, err := journal.NewSplitJournaler(j, SplitJournalDir(cfg.JournalFile))
+	if err != nil {
+		t.Fatal("failed to create split journal:", err)
+	}
+
+	events := []cronmon.Event{
+		&cronmon.EventAcquired{JournalID: "test"},
+		&cronmon.EventProcessSpawned{PID: 1, File: "a"},
+		&cronmon.EventProcessExited{PID: 1, File: "a", ExitCode: 1},
+		&cronmon.EventProcessSpawned{PID: 2, File: "a"},
+	}
+	for _, ev := range events {
+		if err := split.Write(ev); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+	}
+	split.Close()
+
+	// Both the locked journal of a starting daemon and the read-only journal
+	// of the next leader term must see the process events.
+	state, err := readPreviousState(cfg, &j.Reader)
+	if err != nil {
+		t.Fatal("failed to read previous state:", err)
+	}
+	if state.Processes["a"] != 2 {
+		t.Errorf("unexpected previous processes %v", state.Processes)
+	}
+
+	state, err = readPreviousStateFile(cfg)
+	if err != nil {
+		t.Fatal("failed to read previous state from file:", err)
+	}
+	if state.Processes["a"] != 2 {
+		t.Errorf("unexpected previous processes %v", state.Processes)
+	}
+}
+
+func TestFlapFilter(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal("failed to write script:", err)
+		}
+	}
+
+	// a restarted every few seconds over the last few minutes.
+	now := time.Now()
+	spawns := make([]time.Time, 200)
+	for i := range spawns {
+		spawns[i] = now.Add(time.Duration(i-len(spawns)) * time.Second)
+	}
+
+	// The monitor restores the spawns of a before it journals anything about
+	// it, so its first event means that it's known to be flapping.
+	bus := cronmon.NewEventBus()
+	sub := bus.Subscribe(func(ev cronmon.Event) bool {
+		pe, ok := ev.(cronmon.ProcessEvent)
+		return ok && pe.ProcessFile() == "a"
+	})
+	defer sub.Close()
+
+	m, err := cronmon.NewMonitorWithOptions(context.Background(), dir, bus, cronmon.MonitorOptions{
+		DryRun: true,
+		State: &cronmon.PreviousState{
+			RecentSpawns: map[string][]time.Time{"a": spawns},
+		},
+	})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	var flaps flapFilter
+
+	exited := &cronmon.EventProcessExited{File: "a", ExitCode: 1}
+	if !flaps.keep(exited) {
+		t.Error("event was left out without a monitor")
+	}
+
+	flaps.set(m)
+
+	select {
+	case <-sub.Events():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a to be started")
+	}
+
+	if !m.IsFlapping("a") {
+		t.Fatal("a isn't flapping")
+	}
+
+	if flaps.keep(exited) {
+		t.Error("event of a flapping script was kept")
+	}
+	if !flaps.keep(&cronmon.EventProcessExited{File: "b", ExitCode: 1}) {
+		t.Error("event of a stable script was left out")
+	}
+	if !flaps.keep(&cronmon.EventWarning{Component: "monitor", Error: "a"}) {
+		t.Error("event of no script was left out")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"10-a", "20-b"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal("failed to write script:", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var log bytes.Buffer
+	cfg := Config{
+		JournalFile: filepath.Join(t.TempDir(), "journal.json"),
+		ScriptsDir:  dir,
+		Log:         &log,
+		DryRun:      true,
+	}
+	if err := Run(ctx, cfg); err != nil {
+		t.Fatal("failed to dry run:", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("dry run didn't return on its own")
+	}
+	if _, err := os.Stat(cfg.JournalFile); !os.IsNotExist(err) {
+		t.Error("dry run touched the journal:", err)
+	}
+
+	for _, file := range []string{"10-a", "20-b"} {
+		if !strings.Contains(log.String(), filepath.Join(dir, file)) {
+			t.Errorf("dry run log is missing %s:\n%s", file, log.String())
+		}
+	}
+}
+
+func TestDryRunStream(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"10-a", "20-b"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal("failed to write script:", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var stream bytes.Buffer
+	cfg := Config{
+		JournalFile: filepath.Join(t.TempDir(), "journal.json"),
+		ScriptsDir:  dir,
+		Stream:      &stream,
+		DryRun:      true,
+	}
+	if err := Run(ctx, cfg); err != nil {
+		t.Fatal("failed to dry run:", err)
+	}
+
+	// The stream is a journal of its own.
+	var spawns []string
+	r := journal.NewReader(bytes.NewReader(stream.Bytes()), int64(stream.Len()))
+	err := r.ReadAll(ctx, func(ev cronmon.Event, _ time.Time) error {
+		if ev, ok := ev.(*cronmon.EventDryRunSpawn); ok {
+			spawns = append(spawns, ev.File)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read stream: %v\n%s", err, stream.String())
+	}
+
+	if len(spawns) != 2 {
+		t.Errorf("unexpected dry run spawns %q in stream:\n%s", spawns, stream.String())
+	}
+}
+
+func TestRotateJournal(t *testing.T) {
+	interval := JournalCheckInterval
+	t.Cleanup(func() { JournalCheckInterval = interval })
+	JournalCheckInterval = time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := journal.NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to create journal:", err)
+	}
+	defer j.Close()
+
+	j.Write(&cronmon.EventAcquired{})
+	for i := 0; i < 50; i++ {
+		j.Write(&cronmon.EventProcessSpawned{File: "a", PID: i + 1})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warnings := cronmon.NewRingJournal(10)
+	go rotateJournal(ctx, j, path, 1024, 2, warnings)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if _, err := os.Stat(journal.SegmentPath(path, 1)); err == nil {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the rotation")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cancel()
+
+	if s, err := os.Stat(path); err != nil || s.Size() >= 1024 {
+		t.Errorf("journal was not truncated: %v", err)
+	}
+	if entries := warnings.Snapshot(); len(entries) > 0 {
+		t.Errorf("unexpected warnings %#v", entries)
+	}
+
+	// The statistics are still restored from the rotated segment.
+	state, err := readPreviousStateFile(Config{JournalFile: path})
+	if err != nil {
+		t.Fatal("failed to read previous state:", err)
+	}
+	if spawns := state.RecentSpawns["a"]; len(spawns) != 50 {
+		t.Errorf("expected 50 previous spawns, got %d", len(spawns))
+	}
+}
@@ -0,0 +1,254 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"github.com/pkg/errors"
+)
+
+// DigestSendmail is the sendmail-compatible command that digests are mailed
+// with. It's given the message on stdin with the "-t" flag.
+var DigestSendmail = "sendmail"
+
+// DigestTimeout is the time that sending a digest to a single destination may
+// take.
+var DigestTimeout = 30 * time.Second
+
+// DigestConfig configures the daily digest, which summarizes the restarts,
+// failures and uptimes of the scripts over the last cronmon.DigestPeriod. See
+// cronmon.Digest.
+type DigestConfig struct {
+	// At is the local time of day in the "15:04" format at which the digest
+	// is sent. It defaults to midnight.
+	At string
+	// To are the destinations of the digest. HTTP and HTTPS URLs are sent the
+	// digest as JSON in a POST request, and "mailto:" URLs are mailed it as
+	// text with DigestSendmail.
+	To []string
+}
+
+func (c DigestConfig) validate() error {
+	if c.At != "" {
+		if _, err := time.Parse("15:04", c.At); err != nil {
+			return errors.Errorf("invalid digest time %q", c.At)
+		}
+	}
+
+	if len(c.To) == 0 {
+		return errors.New("digest has no destinations")
+	}
+
+	for _, to := range c.To {
+		u, err := url.Parse(to)
+		if err != nil {
+			return errors.Errorf("invalid digest destination %q", redactURL(to))
+		}
+
+		switch u.Scheme {
+		case "http", "https", "mailto":
+		default:
+			return errors.Errorf("unsupported digest destination %q", redactURL(to))
+		}
+	}
+
+	return nil
+}
+
+// next returns the time after now at which the next digest is sent.
+func (c DigestConfig) next(now time.Time) time.Time {
+	at, err := time.Parse("15:04", c.At)
+	if err != nil {
+		at = time.Time{}
+	}
+
+	y, m, d := now.Date()
+	next := time.Date(y, m, d, at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
+
+// ReadDigest reads the digest of the scripts between since and until from the
+// journal of the given configuration, including the journals of each script if
+// the journal is split.
+func ReadDigest(ctx context.Context, cfg Config, since, until time.Time) (*cronmon.Digest, error) {
+	d, err := readDigestFile(ctx, cfg.JournalFile, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SplitJournal {
+		paths, err := filepath.Glob(journal.SplitJournalPath(SplitJournalDir(cfg.JournalFile), "*"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			script, err := readDigestFile(ctx, path, since, until)
+			if err != nil {
+				return nil, err
+			}
+			d.Merge(script)
+		}
+	}
+
+	return d, nil
+}
+
+func readDigestFile(ctx context.Context, path string, since, until time.Time) (*cronmon.Digest, error) {
+	r, err := journal.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	d, err := cronmon.ReadDigest(ctx, r, since, until)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	return d, nil
+}
+
+// runDigests sends the digest every day until the context is canceled.
+// Failures are journaled as warnings.
+func runDigests(ctx context.Context, cfg Config, m *cronmon.Monitor, j cronmon.Journaler) {
+	for {
+		next := cfg.Digest.next(time.Now())
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		for _, err := range sendDigests(ctx, cfg, m, next) {
+			j.Write(&cronmon.EventWarning{
+				Component: "digest",
+				Error:     err.Error(),
+			})
+		}
+	}
+}
+
+// sendDigests sends the digest of the period until the given time to all
+// destinations. The errors of the failed ones are returned.
+func sendDigests(ctx context.Context, cfg Config, m *cronmon.Monitor, until time.Time) []error {
+	d, err := ReadDigest(ctx, cfg, until.Add(-cronmon.DigestPeriod), until)
+	if err != nil {
+		return []error{errors.Wrap(err, "failed to read digest")}
+	}
+
+	if statuses, err := m.Snapshot(); err == nil {
+		d.Fill(statuses)
+	}
+
+	var errs []error
+
+	for _, to := range cfg.Digest.To {
+		if err := sendDigest(ctx, to, d); err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to send digest to %s", redactURL(to)))
+		}
+	}
+
+	return errs
+}
+
+// sendDigest sends the digest to a single destination.
+func sendDigest(ctx context.Context, to string, d *cronmon.Digest) error {
+	ctx, cancel := context.WithTimeout(ctx, DigestTimeout)
+	defer cancel()
+
+	u, err := url.Parse(to)
+	if err != nil {
+		return errors.New("invalid URL")
+	}
+
+	if u.Scheme == "mailto" {
+		return mailDigest(ctx, u.Opaque, d)
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, to, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// redactURL returns the destination with only the scheme and host of a URL,
+// since webhook URLs usually carry their secret token in the path, the query
+// or the user info. Mail addresses are returned as they are.
+func redactURL(to string) string {
+	u, err := url.Parse(to)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	if u.Scheme == "mailto" {
+		return to
+	}
+
+	redacted := (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+	if u.User != nil || u.Opaque != "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		redacted += "/..."
+	}
+
+	return redacted
+}
+
+// mailDigest mails the digest as text to the given address.
+func mailDigest(ctx context.Context, addr string, d *cronmon.Digest) error {
+	hostname, _ := os.Hostname()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "To: %s\n", addr)
+	fmt.Fprintf(&msg, "Subject: cronmon digest for %s\n\n", hostname)
+
+	if err := d.WriteText(&msg); err != nil {
+		return err
+	}
+
+	cmd := osexec.CommandContext(ctx, DigestSendmail, "-t")
+	cmd.Stdin = &msg
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "sendmail failed: %s", bytes.TrimSpace(out))
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// Dirs are the directories that cronmon keeps its files in by default. They
+// follow the XDG Base Directory Specification, so that the configuration,
+// which may be shared or backed up, is kept apart from the data that cronmon
+// writes.
+type Dirs struct {
+	// Config is the directory of the configuration, such as the scripts. It
+	// is $XDG_CONFIG_HOME/cronmon.
+	Config string
+	// State is the directory of the data that cronmon keeps across runs,
+	// such as the journal. It is $XDG_STATE_HOME/cronmon, or
+	// ~/.local/state/cronmon if that's unset.
+	State string
+	// Runtime is the directory of the files that only live while cronmon
+	// runs, such as the control socket. It is $XDG_RUNTIME_DIR/cronmon, or
+	// /run/user/$UID/cronmon if that's unset, or the state directory if
+	// neither exists.
+	Runtime string
+}
+
+// DefaultDirs returns the default directories of the current user.
+func DefaultDirs() (Dirs, error) {
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return Dirs{}, err
+	}
+
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Dirs{}, err
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+
+	dirs := Dirs{
+		Config: filepath.Join(config, "cronmon"),
+		State:  filepath.Join(state, "cronmon"),
+	}
+
+	// Cron doesn't set $XDG_RUNTIME_DIR, so look for the directory that it
+	// would be set to in a login session, so that cronmon started by cron and
+	// the user's shell agree on it.
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime == "" {
+		if dir := fmt.Sprintf("/run/user/%d", os.Getuid()); dirExists(dir) {
+			runtime = dir
+		}
+	}
+
+	dirs.Runtime = dirs.State
+	if runtime != "" {
+		dirs.Runtime = filepath.Join(runtime, "cronmon")
+	}
+
+	return dirs, nil
+}
+
+// SystemDirs returns the directories of a system-wide cronmon, which runs as a
+// system service rather than for a single user: /etc/cronmon, /var/lib/cronmon
+// and /run/cronmon.
+func SystemDirs() Dirs {
+	return Dirs{
+		Config:  "/etc/cronmon",
+		State:   "/var/lib/cronmon",
+		Runtime: "/run/cronmon",
+	}
+}
+
+// ScriptsDir returns the default scripts directory.
+func (d Dirs) ScriptsDir() string { return filepath.Join(d.Config, "scripts") }
+
+// JournalFile returns the default journal file.
+func (d Dirs) JournalFile() string { return filepath.Join(d.State, "journal.json") }
+
+// SocketFile returns the default control socket.
+func (d Dirs) SocketFile() string { return filepath.Join(d.Runtime, "control.sock") }
+
+// LegacyJournalFile returns where the journal was kept before it was moved out
+// of the configuration directory. See RelocateJournal.
+func (d Dirs) LegacyJournalFile() string { return filepath.Join(d.Config, "journal.json") }
+
+// LegacySocketFile returns where the control socket was served before it was
+// moved out of the configuration directory.
+func (d Dirs) LegacySocketFile() string { return filepath.Join(d.Config, "control.sock") }
+
+// RelocateJournal moves the journal at from, along with its rotated segments
+// and the per-script journals of Config.SplitJournal, to to. Nothing is done
+// and false is returned if there is no journal at from or there already is one
+// at to.
+//
+// The journal is locked while it's moved, so an error is returned if a cronmon
+// is running with it. The journal file itself is moved last, so a relocation
+// that failed halfway is finished by calling RelocateJournal again.
+func RelocateJournal(from, to string) (bool, error) {
+	if _, err := os.Stat(to); err == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(from); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	lock := flock.New(from)
+
+	locked, err := lock.TryLock()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to lock journal")
+	}
+	if !locked {
+		return false, errors.New("journal is in use by a running cronmon")
+	}
+	defer lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(to), 0750); err != nil {
+		return false, errors.Wrap(err, "failed to create journal directory")
+	}
+
+	segments, err := journal.Segments(from)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to find rotated segments")
+	}
+
+	for _, segment := range segments {
+		if segment == from {
+			continue
+		}
+		if err := moveFile(segment, to+strings.TrimPrefix(segment, from)); err != nil {
+			return false, err
+		}
+	}
+
+	if dir := SplitJournalDir(from); dirExists(dir) {
+		if err := moveDir(dir, SplitJournalDir(to)); err != nil {
+			return false, err
+		}
+	}
+
+	// The metadata of the last lock holder is stale anyway.
+	os.Remove(journal.LockInfoPath(from))
+
+	if err := moveFile(from, to); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func dirExists(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+// moveDir moves the files in the directory from into the directory to, then
+// removes from. Files that already exist in to are replaced.
+func moveDir(from, to string) error {
+	if err := os.MkdirAll(to, 0750); err != nil {
+		return errors.Wrap(err, "failed to create directory")
+	}
+
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := moveFile(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(from)
+	return nil
+}
+
+// moveFile moves the file at from to to. Files are copied and synced before
+// the original is removed if they're on different filesystems.
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, syscall.EXDEV) {
+		return errors.Wrapf(err, "failed to move %s", from)
+	}
+
+	if err := copyFile(from, to); err != nil {
+		os.Remove(to)
+		return errors.Wrapf(err, "failed to copy %s", from)
+	}
+
+	return os.Remove(from)
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"github.com/gofrs/flock"
+)
+
+func TestRelocateJournal(t *testing.T) {
+	tmp := t.TempDir()
+	from := filepath.Join(tmp, "config", "journal.json")
+	to := filepath.Join(tmp, "state", "cronmon", "journal.json")
+
+	files := map[string]string{
+		from:                         "current",
+		journal.SegmentPath(from, 1): "rotated",
+		journal.SegmentPath(from, 3): "older",
+		journal.LockInfoPath(from):   "{}",
+		journal.SplitJournalPath(SplitJournalDir(from), "a"): "split",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A running cronmon holds the lock.
+	lock := flock.New(from)
+	if _, err := lock.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RelocateJournal(from, to); err == nil {
+		t.Fatal("expected an error while the journal is locked")
+	}
+
+	lock.Unlock()
+
+	moved, err := RelocateJournal(from, to)
+	if err != nil {
+		t.Fatal("failed to relocate journal:", err)
+	}
+	if !moved {
+		t.Fatal("journal wasn't moved")
+	}
+
+	expect := map[string]string{
+		to:                         "current",
+		journal.SegmentPath(to, 1): "rotated",
+		journal.SegmentPath(to, 3): "older",
+		journal.SplitJournalPath(SplitJournalDir(to), "a"): "split",
+	}
+	for path, content := range expect {
+		b, err := os.ReadFile(path)
+		if err != nil || string(b) != content {
+			t.Errorf("%s: got %q (%v), expected %q", path, b, err, content)
+		}
+	}
+
+	for path := range files {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", path)
+		}
+	}
+
+	if moved, err := RelocateJournal(from, to); moved || err != nil {
+		t.Errorf("relocated again: %v, %v", moved, err)
+	}
+}
+
+func TestSystemDirs(t *testing.T) {
+	dirs := SystemDirs()
+
+	paths := map[string]string{
+		dirs.ScriptsDir():  "/etc/cronmon/scripts",
+		dirs.JournalFile(): "/var/lib/cronmon/journal.json",
+		dirs.SocketFile():  "/run/cronmon/control.sock",
+	}
+	for got, expect := range paths {
+		if got != expect {
+			t.Errorf("expected %q, got %q", expect, got)
+		}
+	}
+}
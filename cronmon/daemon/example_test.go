@@ -0,0 +1,54 @@
+package daemon_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/daemon"
+	"github.com/pkg/errors"
+)
+
+// This example supervises a directory of plugin executables from within
+// another daemon until it's interrupted.
+func ExampleRun() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	err := daemon.Run(ctx, daemon.Config{
+		JournalFile: "/var/lib/mydaemon/plugins.json",
+		ScriptsDir:  "/etc/mydaemon/plugins",
+		SocketFile:  "/run/mydaemon/plugins.sock",
+		Log:         os.Stderr,
+		Output:      cronmon.NewLogMux(os.Stdout),
+	})
+	if err != nil {
+		if errors.Is(err, daemon.ErrAlreadyRunning) {
+			log.Fatalln("plugins are already supervised by another instance")
+		}
+		log.Fatalln("failed to supervise plugins:", err)
+	}
+}
+
+// This example uses the monitor directly with a custom journaler instead of
+// the journal file, such as to forward events into an existing logger.
+func ExampleRun_monitor() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	events := cronmon.NewRingJournal(100)
+
+	m, err := cronmon.NewMonitor(ctx, "/etc/mydaemon/plugins", events)
+	if err != nil {
+		log.Fatalln("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	<-ctx.Done()
+
+	for _, entry := range m.RecentEvents() {
+		log.Printf("%s: %s", entry.Time, entry.Event.Type())
+	}
+}
@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/plugin"
+	"github.com/pkg/errors"
+)
+
+// plugins are the started plugins of a daemon.
+type plugins []*plugin.Client
+
+// startPlugins starts every executable file in the given directory as a
+// plugin, in the order of their names.
+func startPlugins(dir string) (plugins, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read plugins directory")
+	}
+
+	var ps plugins
+
+	for _, file := range files {
+		s, err := file.Info()
+		if err != nil || !s.Mode().IsRegular() || s.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		c, err := plugin.Start(filepath.Join(dir, file.Name()))
+		if err != nil {
+			ps.close()
+			return nil, err
+		}
+
+		ps = append(ps, c)
+	}
+
+	return ps, nil
+}
+
+// journaler returns the journaler that also writes to the journaler and
+// notifier plugins. If keep isn't nil, then notifiers are only sent the events
+// that it returns true for.
+func (ps plugins) journaler(j cronmon.Journaler, opts journal.MultiWriterOptions, keep func(cronmon.Event) bool) cronmon.Journaler {
+	writers := []cronmon.Journaler{j}
+
+	for _, p := range ps {
+		if p.Info.Journaler {
+			writers = append(writers, p.Journaler())
+		}
+	}
+
+	// Notifiers warn about their failures through the other journalers only.
+	base := journal.MultiWriterWithOptions(opts, writers...)
+
+	for _, p := range ps {
+		if p.Info.Notifier {
+			n := p.Notifier(base)
+			if keep != nil {
+				n = journal.Filter(keep)(n)
+			}
+			writers = append(writers, n)
+		}
+	}
+
+	if len(writers) == 1 {
+		return j
+	}
+	return journal.MultiWriterWithOptions(opts, writers...)
+}
+
+// spawners returns the spawners of the spawner plugins by their names.
+func (ps plugins) spawners() (map[string]cronmon.Spawner, error) {
+	spawners := map[string]cronmon.Spawner{}
+
+	for _, p := range ps {
+		if !p.Info.Spawner {
+			continue
+		}
+		if _, ok := spawners[p.Info.Name]; ok {
+			return nil, errors.Errorf("duplicate spawner plugin %q", p.Info.Name)
+		}
+		spawners[p.Info.Name] = p.Spawner()
+	}
+
+	return spawners, nil
+}
+
+// flapFilter leaves the process events of flapping scripts out, asking the
+// monitor of the current term. Everything is kept while there's none.
+type flapFilter struct {
+	m atomic.Value // *cronmon.Monitor
+}
+
+func (f *flapFilter) set(m *cronmon.Monitor) {
+	f.m.Store(m)
+}
+
+func (f *flapFilter) keep(ev cronmon.Event) bool {
+	pev, ok := ev.(cronmon.ProcessEvent)
+	if !ok || pev.ProcessFile() == "" {
+		return true
+	}
+
+	m, _ := f.m.Load().(*cronmon.Monitor)
+	return m == nil || !m.IsFlapping(pev.ProcessFile())
+}
+
+func (ps plugins) close() {
+	for _, p := range ps {
+		p.Close()
+	}
+}
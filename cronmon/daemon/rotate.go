@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+)
+
+// JournalCheckInterval is the interval at which the size of the journal is
+// checked if Config.JournalMaxSize is set.
+var JournalCheckInterval = time.Minute
+
+// DefaultJournalKeep is the default number of rotated journal segments that
+// are kept. See Config.JournalKeep.
+const DefaultJournalKeep = 5
+
+// rotateJournal rotates the journal at the given path every time it has grown
+// beyond maxSize, until the context is canceled. Failures are journaled as
+// warnings.
+func rotateJournal(
+	ctx context.Context, j *journal.FileLockJournaler, path string,
+	maxSize int64, keep int, warnings cronmon.Journaler) {
+
+	if keep < 1 {
+		keep = DefaultJournalKeep
+	}
+
+	ticker := time.NewTicker(JournalCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s, err := os.Stat(path)
+		if err != nil || s.Size() < maxSize {
+			continue
+		}
+
+		if err := j.Rotate(keep); err != nil {
+			warnings.Write(&cronmon.EventWarning{
+				Component: "journal",
+				Error:     "failed to rotate journal: " + err.Error(),
+			})
+		}
+	}
+}
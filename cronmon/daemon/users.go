@@ -0,0 +1,281 @@
+package daemon
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/control"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"github.com/pkg/errors"
+)
+
+// UserScriptsGlob matches the scripts directories of the users whose scripts
+// are supervised if Config.Users is true. Each directory must be in the home
+// directory of the user that owns it.
+var UserScriptsGlob = "/home/*/.config/cronmon/scripts"
+
+// UsersScanInterval is how often UserScriptsGlob is matched again for the
+// scripts directories of new users.
+var UsersScanInterval = time.Minute
+
+// UserJournalFile returns the journal file of the scripts of the given user,
+// which is kept in a users directory next to the daemon's journal file.
+func UserJournalFile(journalFile, username string) string {
+	return filepath.Join(filepath.Dir(journalFile), "users", username, "journal.json")
+}
+
+// UserSocketFile returns the control socket of the scripts of the given user,
+// which is served in a users directory next to the daemon's control socket.
+// Only the user and root may connect to it.
+func UserSocketFile(socketFile, username string) string {
+	return filepath.Join(filepath.Dir(socketFile), "users", username, "control.sock")
+}
+
+// userScripts is the scripts directory of a user.
+type userScripts struct {
+	User *user.User
+	Dir  string
+}
+
+// findUserScripts returns the scripts directories that match the glob along
+// with the users that own them. Directories that aren't in the home directory
+// of their owner, such as ones owned by root, are skipped with an error.
+func findUserScripts(glob string) ([]userScripts, []error) {
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, []error{errors.Wrap(err, "invalid user scripts glob")}
+	}
+
+	var found []userScripts
+	var errs []error
+
+	for _, dir := range matches {
+		stat, err := os.Stat(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !stat.IsDir() {
+			continue
+		}
+
+		sys, ok := stat.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+
+		u, err := user.LookupId(strconv.FormatUint(uint64(sys.Uid), 10))
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "unknown owner of %s", dir))
+			continue
+		}
+
+		// The owner is only trusted with the directory if it's their own, so
+		// that nobody gets to run scripts as another user by planting them.
+		home := filepath.Clean(u.HomeDir) + string(filepath.Separator)
+		if sys.Uid == 0 || !strings.HasPrefix(dir, home) {
+			errs = append(errs, errors.Errorf("%s is not in the home directory of its owner %s", dir, u.Username))
+			continue
+		}
+
+		found = append(found, userScripts{User: u, Dir: dir})
+	}
+
+	return found, errs
+}
+
+// superviseUsers supervises the scripts of every user found by
+// UserScriptsGlob until the context is canceled. New users are picked up
+// every UsersScanInterval.
+func superviseUsers(ctx context.Context, cfg Config, journaler cronmon.Journaler) {
+	warn := func(err error) {
+		journaler.Write(&cronmon.EventWarning{
+			Component: "users",
+			Error:     err.Error(),
+		})
+	}
+
+	if cfg.SocketFile != "" {
+		if err := prepareUserSockets(cfg.SocketFile); err != nil {
+			warn(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	started := map[string]bool{}
+	warned := map[string]bool{}
+
+	scan := func() {
+		found, errs := findUserScripts(UserScriptsGlob)
+
+		// Only warn about each broken directory once rather than every scan.
+		for _, err := range errs {
+			if !warned[err.Error()] {
+				warned[err.Error()] = true
+				warn(err)
+			}
+		}
+
+		for _, scripts := range found {
+			if started[scripts.User.Username] {
+				continue
+			}
+			started[scripts.User.Username] = true
+
+			wg.Add(1)
+			go func(scripts userScripts) {
+				defer wg.Done()
+
+				if err := serveUser(ctx, cfg, scripts, journaler); err != nil {
+					warn(errors.Wrapf(err, "user %s", scripts.User.Username))
+				}
+			}(scripts)
+		}
+	}
+
+	scan()
+
+	ticker := time.NewTicker(UsersScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scan()
+		}
+	}
+}
+
+// prepareUserSockets creates the directory of the users' control sockets. The
+// directories above it must be searchable by the users, but the daemon's own
+// control socket is still only accessible by root.
+func prepareUserSockets(socketFile string) error {
+	dir := filepath.Dir(socketFile)
+
+	if err := os.MkdirAll(filepath.Join(dir, "users"), 0711); err != nil {
+		return errors.Wrap(err, "failed to create user sockets directory")
+	}
+
+	for _, dir := range []string{dir, filepath.Join(dir, "users")} {
+		if err := os.Chmod(dir, 0711); err != nil {
+			return errors.Wrap(err, "failed to chmod user sockets directory")
+		}
+	}
+
+	return nil
+}
+
+// serveUser runs a monitor of the scripts of the user with its own journal and
+// control socket until the context is canceled. The journal of the daemon
+// only receives warnings about serving the control socket.
+func serveUser(ctx context.Context, cfg Config, scripts userScripts, warnings cronmon.Journaler) error {
+	name := scripts.User.Username
+
+	uid, err := strconv.Atoi(scripts.User.Uid)
+	if err != nil {
+		return errors.Wrap(err, "invalid user ID")
+	}
+	gid, err := strconv.Atoi(scripts.User.Gid)
+	if err != nil {
+		return errors.Wrap(err, "invalid group ID")
+	}
+
+	ucfg := cfg
+	ucfg.JournalFile = UserJournalFile(cfg.JournalFile, name)
+	ucfg.ScriptsDir = scripts.Dir
+	ucfg.SplitJournal = false
+
+	if err := os.MkdirAll(filepath.Dir(ucfg.JournalFile), 0750); err != nil {
+		return errors.Wrap(err, "failed to create journal directory")
+	}
+
+	j, err := journal.NewFileLockJournaler(ucfg.JournalFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to acquire journal lock")
+	}
+	defer j.Close()
+
+	j.Monotonic = true
+	j.Host = cfg.Host
+
+	if cfg.Sync != "" {
+		j.SetSyncPolicy(cfg.Sync)
+	}
+
+	var journaler cronmon.Journaler = j
+	if cfg.Log != nil {
+		logger := log.New(cfg.Log, "journal: "+name+": ", log.Ldate|log.Lmicroseconds|log.Lmsgprefix)
+		journaler = journal.MultiWriterWithOptions(
+			journal.MultiWriterOptions{Policy: cfg.JournalPolicy},
+			journaler, journal.WrapHumanWriter("stderr", logger),
+		)
+	}
+
+	state, err := readPreviousStateFile(ucfg)
+	if err != nil {
+		state = nil
+	}
+
+	if cfg.JournalMaxSize > 0 {
+		go rotateJournal(ctx, j, ucfg.JournalFile, cfg.JournalMaxSize, cfg.JournalKeep, journaler)
+	}
+
+	m, err := cronmon.NewMonitorWithOptions(ctx, ucfg.ScriptsDir, journaler, cronmon.MonitorOptions{
+		State:  state,
+		Settle: cfg.Settle,
+		DryRun: cfg.Mirror,
+		User:   scripts.User,
+
+		RestartLimit:     cfg.RestartLimit,
+		SpawnConcurrency: cfg.SpawnConcurrency,
+		Pressure:         cfg.Pressure,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create monitor")
+	}
+	defer m.Stop()
+
+	if cfg.SocketFile != "" {
+		ucfg.SocketFile = UserSocketFile(cfg.SocketFile, name)
+
+		go func() {
+			if err := serveUserSocket(ctx, ucfg, m, uid, gid); err != nil {
+				warnings.Write(&cronmon.EventWarning{
+					Component: "control",
+					Error:     "failed to serve control socket of user " + name + ": " + err.Error(),
+				})
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// serveUserSocket serves the control socket of a user's monitor, which is in a
+// directory that only the user may enter.
+func serveUserSocket(ctx context.Context, cfg Config, m *cronmon.Monitor, uid, gid int) error {
+	dir := filepath.Dir(cfg.SocketFile)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create control socket directory")
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return errors.Wrap(err, "failed to chown control socket directory")
+	}
+
+	return control.ListenAndServeAs(ctx, cfg.SocketFile, uid, gid, newControlServer(cfg, m))
+}
@@ -0,0 +1,44 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindUserScripts(t *testing.T) {
+	tmp := t.TempDir()
+
+	// The temporary directory is never in its owner's home directory, so the
+	// scripts in it must not be run as the owner.
+	if err := os.MkdirAll(filepath.Join(tmp, "alice", "scripts"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "bob"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "bob", "scripts"), nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	found, errs := findUserScripts(filepath.Join(tmp, "*", "scripts"))
+	if len(found) > 0 {
+		t.Errorf("unexpected scripts directories %v", found)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error for the planted directory, got %v", errs)
+	}
+
+	if _, errs := findUserScripts("["); len(errs) != 1 {
+		t.Errorf("expected an error for an invalid glob, got %v", errs)
+	}
+}
+
+func TestUserFiles(t *testing.T) {
+	if path := UserJournalFile("/var/lib/cronmon/journal.json", "alice"); path != "/var/lib/cronmon/users/alice/journal.json" {
+		t.Errorf("unexpected user journal file %q", path)
+	}
+	if path := UserSocketFile("/run/cronmon/control.sock", "alice"); path != "/run/cronmon/users/alice/control.sock" {
+		t.Errorf("unexpected user socket file %q", path)
+	}
+}
@@ -0,0 +1,232 @@
+package cronmon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// DigestPeriod is the period that a digest summarizes by default.
+var DigestPeriod = 24 * time.Hour
+
+// Digest summarizes what the scripts did over a period of time, such as for a
+// daily report.
+type Digest struct {
+	Since   time.Time      `json:"since"`
+	Until   time.Time      `json:"until"`
+	Scripts []ScriptDigest `json:"scripts"`
+}
+
+// ScriptDigest summarizes a single script in a Digest.
+type ScriptDigest struct {
+	File   string `json:"file"`
+	Spawns int    `json:"spawns"`
+	// Restarts is the number of spawns that followed an exit or a spawn
+	// error of the script.
+	Restarts int `json:"restarts"`
+	// Failures is the number of exits with a nonzero code or a core dump and
+	// spawn errors. Exits from signals aren't counted, since they're usually
+	// from the script being stopped.
+	Failures int `json:"failures"`
+	// Uptime is the fraction of the period that the script was running, from 0
+	// to 1.
+	Uptime float64 `json:"uptime"`
+}
+
+// digestEvent is an event of a script or the monitor within a digest's period.
+type digestEvent struct {
+	t  time.Time
+	ev Event
+}
+
+// ReadDigest reads the digest of the scripts between since and until from the
+// journal. Only the events within the period are read. Scripts without any
+// events in the period are left out; see Digest.Fill.
+func ReadDigest(ctx context.Context, r JournalReader, since, until time.Time) (*Digest, error) {
+	var events []digestEvent
+
+	err := ReadJournal(ctx, r, Since(since, func(ev Event, t time.Time) error {
+		if t.After(until) {
+			return nil
+		}
+
+		switch ev.(type) {
+		case *EventProcessSpawned, *EventProcessExited, *EventProcessSpawnError, *EventQuit:
+			events = append(events, digestEvent{t, ev})
+		}
+
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// Go through the events from oldest to newest.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	d := newDigestBuilder(since, until)
+	for _, ev := range events {
+		d.add(ev)
+	}
+
+	return d.digest(), nil
+}
+
+// digestBuilder builds a Digest from chronological events.
+type digestBuilder struct {
+	since   time.Time
+	until   time.Time
+	scripts map[string]*scriptDigestState
+}
+
+type scriptDigestState struct {
+	ScriptDigest
+	up      time.Duration
+	running time.Time // non-zero if running
+	down    bool      // true if the last event was an exit or a spawn error
+	seen    bool
+}
+
+func newDigestBuilder(since, until time.Time) *digestBuilder {
+	return &digestBuilder{
+		since:   since,
+		until:   until,
+		scripts: map[string]*scriptDigestState{},
+	}
+}
+
+func (d *digestBuilder) script(file string) *scriptDigestState {
+	s, ok := d.scripts[file]
+	if !ok {
+		s = &scriptDigestState{ScriptDigest: ScriptDigest{File: file}}
+		d.scripts[file] = s
+	}
+	return s
+}
+
+func (d *digestBuilder) add(ev digestEvent) {
+	switch data := ev.ev.(type) {
+	case *EventQuit:
+		// Processes don't outlive the monitor.
+		for _, s := range d.scripts {
+			s.stop(ev.t)
+		}
+
+	case *EventProcessSpawned:
+		s := d.script(data.File)
+		s.Spawns++
+		if s.down {
+			s.Restarts++
+		}
+		s.stop(ev.t)
+		s.running = ev.t
+		s.down = false
+		s.seen = true
+
+	case *EventProcessExited:
+		s := d.script(data.File)
+		if data.ExitCode > 0 || data.CoreDumped {
+			s.Failures++
+		}
+		if !s.seen {
+			// It was already running when the period started.
+			s.running = d.since
+		}
+		s.stop(ev.t)
+		s.down = true
+		s.seen = true
+
+	case *EventProcessSpawnError:
+		s := d.script(data.File)
+		s.Failures++
+		s.stop(ev.t)
+		s.down = true
+		s.seen = true
+	}
+}
+
+// stop ends the running interval of the script at t, if it's running.
+func (s *scriptDigestState) stop(t time.Time) {
+	if !s.running.IsZero() {
+		s.up += t.Sub(s.running)
+		s.running = time.Time{}
+	}
+}
+
+func (d *digestBuilder) digest() *Digest {
+	digest := Digest{
+		Since:   d.since,
+		Until:   d.until,
+		Scripts: make([]ScriptDigest, 0, len(d.scripts)),
+	}
+
+	period := d.until.Sub(d.since)
+
+	for _, s := range d.scripts {
+		s.stop(d.until)
+		if period > 0 {
+			s.Uptime = float64(s.up) / float64(period)
+		}
+		digest.Scripts = append(digest.Scripts, s.ScriptDigest)
+	}
+
+	digest.sort()
+	return &digest
+}
+
+func (d *Digest) sort() {
+	sort.Slice(d.Scripts, func(i, j int) bool {
+		return d.Scripts[i].File < d.Scripts[j].File
+	})
+}
+
+// Merge adds the scripts of the other digest of the same period, such as one
+// read from another journal, to the digest.
+func (d *Digest) Merge(other *Digest) {
+	d.Scripts = append(d.Scripts, other.Scripts...)
+	d.sort()
+}
+
+// Fill adds the scripts that have no events in the digest from their current
+// statuses, assuming that they've been in the same state for the whole period.
+func (d *Digest) Fill(statuses []ProcessStatus) {
+	known := make(map[string]bool, len(d.Scripts))
+	for _, s := range d.Scripts {
+		known[s.File] = true
+	}
+
+	for _, status := range statuses {
+		if known[status.File] {
+			continue
+		}
+
+		s := ScriptDigest{File: status.File}
+		if status.PID != 0 {
+			s.Uptime = 1
+		}
+		d.Scripts = append(d.Scripts, s)
+	}
+
+	d.sort()
+}
+
+// WriteText writes the digest as a human-readable table.
+func (d *Digest) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "cronmon digest from %s to %s\n\n",
+		d.Since.Local().Format(time.RFC3339), d.Until.Local().Format(time.RFC3339))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCRIPT\tSPAWNS\tRESTARTS\tFAILURES\tUPTIME")
+
+	for _, s := range d.Scripts {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f%%\n",
+			s.File, s.Spawns, s.Restarts, s.Failures, s.Uptime*100)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,60 @@
+package cronmon
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadDigest(t *testing.T) {
+	since := time.Date(2020, 04, 01, 00, 00, 00, 00, time.UTC)
+	at := func(hour int) time.Time { return since.Add(time.Duration(hour) * time.Hour) }
+
+	// From newest to oldest, like journals are read.
+	r := mockReader{events: []mockEvent{
+		{&EventProcessSpawned{PID: 5, File: "a"}, at(11)},
+		{&EventQuit{}, at(5)},
+		{&EventProcessSpawnError{File: "c", Reason: "not found"}, at(4)},
+		{&EventProcessSpawned{PID: 3, File: "b"}, at(3)},
+		{&EventProcessSpawned{PID: 2, File: "a"}, at(2)},
+		{&EventProcessExited{PID: 1, File: "a", ExitCode: 1}, at(1)},
+		{&EventProcessSpawned{PID: 4, File: "d"}, at(-1)},
+	}}
+
+	d, err := ReadDigest(context.Background(), &r, since, at(10))
+	if err != nil {
+		t.Fatal("failed to read digest:", err)
+	}
+
+	// Processes don't outlive the monitor, so a is down after the quit until
+	// the period ends.
+	expect := []ScriptDigest{
+		{File: "a", Spawns: 1, Restarts: 1, Failures: 1, Uptime: 0.4},
+		{File: "b", Spawns: 1, Uptime: 0.2},
+		{File: "c", Failures: 1},
+	}
+
+	if !reflect.DeepEqual(d.Scripts, expect) {
+		t.Fatalf("unexpected digest:\n"+
+			"got      %+v\n"+
+			"expected %+v", d.Scripts, expect)
+	}
+
+	d.Fill([]ProcessStatus{
+		{File: "a"},
+		{File: "e", PID: 6},
+		{File: "f"},
+	})
+
+	expect = append(expect,
+		ScriptDigest{File: "e", Uptime: 1},
+		ScriptDigest{File: "f"},
+	)
+
+	if !reflect.DeepEqual(d.Scripts, expect) {
+		t.Fatalf("unexpected filled digest:\n"+
+			"got      %+v\n"+
+			"expected %+v", d.Scripts, expect)
+	}
+}
@@ -0,0 +1,220 @@
+package cronmon
+
+import (
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/pkg/errors"
+)
+
+// DefaultEnvAllow is the list of environment variables that are passed from
+// cronmon to every process. Other variables, such as ones set by cron or
+// systemd that may be sensitive, are not passed unless allowed by the script's
+// configuration. Each entry may be a pattern as described by path.Match.
+var DefaultEnvAllow = []string{
+	"PATH",
+	"HOME",
+	"USER",
+	"LOGNAME",
+	"SHELL",
+	"LANG",
+	"LANGUAGE",
+	"LC_*",
+	"TZ",
+	"TERM",
+	"TMPDIR",
+	"XDG_*",
+	"DISPLAY",
+	"WAYLAND_DISPLAY",
+	"DBUS_SESSION_BUS_ADDRESS",
+}
+
+// DefaultPath is the PATH of processes whose configuration sets StandardEnv.
+var DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// standardEnv returns environ with PATH, HOME, USER and LOGNAME replaced by
+// deterministic values for the given user. The user's variables are left
+// alone if it's nil.
+func standardEnv(environ []string, u *user.User) []string {
+	std := map[string]string{"PATH": DefaultPath}
+	if u != nil {
+		std["HOME"] = u.HomeDir
+		std["USER"] = u.Username
+		std["LOGNAME"] = u.Username
+	}
+
+	env := make([]string, 0, len(environ)+len(std))
+
+	for _, kv := range environ {
+		k := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k = kv[:i]
+		}
+
+		if _, ok := std[k]; !ok {
+			env = append(env, kv)
+		}
+	}
+
+	for k, v := range std {
+		env = append(env, k+"="+v)
+	}
+
+	return env
+}
+
+// lookupGroups resolves the given group names or IDs into group IDs.
+func lookupGroups(groups []string) ([]uint32, error) {
+	gids := make([]uint32, 0, len(groups))
+
+	for _, group := range groups {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+
+			if gid, err = strconv.ParseUint(g.Gid, 10, 32); err != nil {
+				return nil, errors.Wrapf(err, "invalid ID of group %q", group)
+			}
+		}
+
+		gids = append(gids, uint32(gid))
+	}
+
+	return gids, nil
+}
+
+// userCredential returns the user and primary group IDs of the given user.
+func userCredential(u *user.User) (*exec.User, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ID of user %q", u.Username)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid group ID of user %q", u.Username)
+	}
+
+	return &exec.User{UID: uint32(uid), GID: uint32(gid)}, nil
+}
+
+// userGroups returns the IDs of the groups that the given user is a member
+// of.
+func userGroups(u *user.User) ([]uint32, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up groups of user %q", u.Username)
+	}
+
+	gids := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		gid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ID of group %q", id)
+		}
+		gids = append(gids, uint32(gid))
+	}
+
+	return gids, nil
+}
+
+// processEnv returns the environment of a process with the given
+// configuration, taking the variables from environ. The resolved secrets
+// override every other variable.
+func processEnv(environ []string, cfg ScriptConfig, secrets map[string]string) []string {
+	env := make([]string, 0, len(environ)+len(cfg.Env)+len(secrets))
+
+	for _, kv := range environ {
+		k := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k = kv[:i]
+		}
+
+		if _, ok := cfg.Env[k]; ok {
+			continue
+		}
+		if _, ok := secrets[k]; ok {
+			continue
+		}
+
+		if cfg.EnvInherit || envAllowed(k, DefaultEnvAllow) || envAllowed(k, cfg.EnvAllow) {
+			env = append(env, kv)
+		}
+	}
+
+	for k, v := range cfg.Env {
+		if _, ok := secrets[k]; !ok {
+			env = append(env, k+"="+v)
+		}
+	}
+
+	for k, v := range secrets {
+		env = append(env, k+"="+v)
+	}
+
+	return env
+}
+
+// FenceEnv is the environment variable that processes get the fencing token of
+// the monitor's leadership term in. See MonitorOptions.Fence.
+const FenceEnv = "CRONMON_FENCE"
+
+// withFence returns env with FenceEnv set to the given fencing token, or
+// unchanged if it's zero. Nothing else may set FenceEnv, so that processes can
+// trust it.
+func withFence(env []string, fence uint64) []string {
+	if fence == 0 {
+		return env
+	}
+
+	filtered := env[:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, FenceEnv+"=") {
+			filtered = append(filtered, kv)
+		}
+	}
+
+	return append(filtered, FenceEnv+"="+strconv.FormatUint(fence, 10))
+}
+
+func envAllowed(key string, allow []string) bool {
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEnv validates the environment options of the configuration.
+func validateEnv(cfg ScriptConfig) error {
+	for _, pattern := range cfg.EnvAllow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid env_allow pattern %q", pattern)
+		}
+	}
+	for k := range cfg.Env {
+		if !validEnvName(k) {
+			return errors.Errorf("invalid env name %q", k)
+		}
+	}
+	for k, ref := range cfg.Secrets {
+		if !validEnvName(k) {
+			return errors.Errorf("invalid secret name %q", k)
+		}
+		if _, _, err := parseSecret(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validEnvName(k string) bool {
+	return k != "" && !strings.ContainsAny(k, "=\x00")
+}
@@ -0,0 +1,135 @@
+package cronmon
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestProcessEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"LC_TIME=C",
+		"INVOCATION_ID=abc",
+		"AWS_TOKEN=secret",
+		"HOME=/home/a",
+	}
+
+	tests := []struct {
+		name    string
+		config  ScriptConfig
+		secrets map[string]string
+		expect  []string
+	}{
+		{"default", ScriptConfig{}, nil, []string{
+			"HOME=/home/a", "LC_TIME=C", "PATH=/usr/bin",
+		}},
+		{"allow", ScriptConfig{EnvAllow: []string{"AWS_*"}}, nil, []string{
+			"AWS_TOKEN=secret", "HOME=/home/a", "LC_TIME=C", "PATH=/usr/bin",
+		}},
+		{"inherit", ScriptConfig{EnvInherit: true}, nil, []string{
+			"AWS_TOKEN=secret", "HOME=/home/a", "INVOCATION_ID=abc", "LC_TIME=C", "PATH=/usr/bin",
+		}},
+		{"override", ScriptConfig{Env: map[string]string{"PATH": "/bin", "A": "1"}}, nil, []string{
+			"A=1", "HOME=/home/a", "LC_TIME=C", "PATH=/bin",
+		}},
+		{"secrets", ScriptConfig{Env: map[string]string{"A": "1"}}, map[string]string{"A": "2", "HOME": "/"}, []string{
+			"A=2", "HOME=/", "LC_TIME=C", "PATH=/usr/bin",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := processEnv(environ, test.config, test.secrets)
+			sort.Strings(env)
+
+			if !reflect.DeepEqual(env, test.expect) {
+				t.Errorf("expected env %q, got %q", test.expect, env)
+			}
+		})
+	}
+}
+
+func TestStandardEnv(t *testing.T) {
+	environ := []string{"PATH=/usr/bin:/bin", "HOME=/", "LANG=C"}
+
+	u := &user.User{Username: "a", HomeDir: "/home/a"}
+	env := standardEnv(environ, u)
+	sort.Strings(env)
+
+	expect := []string{"HOME=/home/a", "LANG=C", "LOGNAME=a", "PATH=" + DefaultPath, "USER=a"}
+	if !reflect.DeepEqual(env, expect) {
+		t.Errorf("expected env %q, got %q", expect, env)
+	}
+
+	env = standardEnv(environ, nil)
+	sort.Strings(env)
+
+	expect = []string{"HOME=/", "LANG=C", "PATH=" + DefaultPath}
+	if !reflect.DeepEqual(env, expect) {
+		t.Errorf("expected env without user %q, got %q", expect, env)
+	}
+}
+
+func TestLookupGroups(t *testing.T) {
+	g, err := user.LookupGroupId("0")
+	if err != nil {
+		t.Skip("no group 0:", err)
+	}
+
+	gids, err := lookupGroups([]string{g.Name, "1234"})
+	if err != nil {
+		t.Fatal("failed to look up groups:", err)
+	}
+	if !reflect.DeepEqual(gids, []uint32{0, 1234}) {
+		t.Errorf("unexpected group IDs %v", gids)
+	}
+
+	if _, err := lookupGroups([]string{"cronmon-nonexistent-group"}); err == nil {
+		t.Error("expected error for a missing group")
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal("failed to write secret:", err)
+	}
+
+	secrets, err := resolveSecrets(context.Background(), dir, ScriptConfig{
+		Secrets: map[string]string{
+			"TOKEN":    "file:token",
+			"PASSWORD": "exec:echo swordfish",
+		},
+	})
+	if err != nil {
+		t.Fatal("failed to resolve secrets:", err)
+	}
+
+	expect := map[string]string{"TOKEN": "hunter2", "PASSWORD": "swordfish"}
+	if !reflect.DeepEqual(secrets, expect) {
+		t.Errorf("expected secrets %q, got %q", expect, secrets)
+	}
+
+	_, err = resolveSecrets(context.Background(), dir, ScriptConfig{
+		Secrets: map[string]string{"TOKEN": "file:missing"},
+	})
+	if err == nil {
+		t.Error("expected error resolving missing secret file")
+	}
+
+	_, err = resolveSecrets(context.Background(), dir, ScriptConfig{
+		Secrets: map[string]string{"TOKEN": "exec:echo swordfish >&2; exit 1"},
+	})
+	if err == nil {
+		t.Error("expected error resolving failing secret command")
+	} else if strings.Contains(err.Error(), "swordfish") {
+		t.Errorf("secret command's stderr leaked into the error: %v", err)
+	}
+}
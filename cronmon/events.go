@@ -1,17 +1,54 @@
 package cronmon
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 // eventType describes an event type.
 type eventType = string
 
 const (
-	eventWarning           eventType = "warning"
-	eventAcquired          eventType = "acquired lock"
-	eventQuit              eventType = "monitor quit"
-	eventLogTruncated      eventType = "log truncated"
-	eventProcessSpawnError eventType = "process spawn error"
-	eventProcessSpawned    eventType = "process spawned"
-	eventProcessExited     eventType = "process exited"
-	eventProcessListModify eventType = "process list modified"
+	eventWarning             eventType = "warning"
+	eventAcquired            eventType = "acquired lock"
+	eventQuit                eventType = "monitor quit"
+	eventLogTruncated        eventType = "log truncated"
+	eventProcessSpawnError   eventType = "process spawn error"
+	eventProcessSpawned      eventType = "process spawned"
+	eventProcessExited       eventType = "process exited"
+	eventProcessListModify   eventType = "process list modified"
+	eventProcessUnchanged    eventType = "process unchanged"
+	eventStatsSnapshot       eventType = "stats snapshot"
+	eventStatsReset          eventType = "stats reset"
+	eventProcessReported     eventType = "process reported"
+	eventProcessReady        eventType = "process ready"
+	eventProcessStartTimeout eventType = "process start timeout"
+	eventProcessTimedOut     eventType = "process timed out"
+	eventProcessStable       eventType = "process stable"
+	eventProcessRecycled     eventType = "process recycled"
+	eventProcessWaiting      eventType = "process waiting"
+	eventDryRunSpawn         eventType = "dry run spawn"
+	eventControlAction       eventType = "control action"
+	eventLockStolen          eventType = "lock stolen"
+	eventLeaderElected       eventType = "leader elected"
+	eventLeaderLost          eventType = "leader lost"
+	eventBinaryChanged       eventType = "binary changed"
+	eventProcessStale        eventType = "process stale"
+	eventProcessSpawnFailing eventType = "process spawn failing"
+	eventRepeated            eventType = "repeated"
+	eventProcessPathChanged  eventType = "process path changed"
+	eventProcessReloaded     eventType = "process reloaded"
+	eventListReconciled      eventType = "process list reconciled"
+	eventArtifactFetched     eventType = "artifact fetched"
+	eventScriptsSynced       eventType = "scripts synced"
+	eventMonitorThrottled    eventType = "monitor throttled"
+	eventProcessDeferred     eventType = "process deferred"
+	eventProcessState        eventType = "process state changed"
+	eventWarningsSuppressed  eventType = "warnings suppressed"
+	eventProcessAdopted      eventType = "process adopted"
+	eventSpawnCanceled       eventType = "process spawn canceled"
 )
 
 // Event is an interface describing known events.
@@ -20,6 +57,13 @@ type Event interface {
 	event()
 }
 
+// ProcessEvent is an event that concerns a single process.
+type ProcessEvent interface {
+	Event
+	// ProcessFile returns the file name of the process.
+	ProcessFile() string
+}
+
 // NewEvent creates a new event from the given event type. It is used primarily
 // for decoding events from its type. Nil is returned if the event type is
 // unknown.
@@ -29,21 +73,137 @@ func NewEvent(eventType string) Event {
 		return &EventWarning{}
 	case eventAcquired:
 		return &EventAcquired{}
+	case eventQuit:
+		return &EventQuit{}
 	case eventLogTruncated:
 		return &EventLogTruncated{}
 	case eventProcessSpawnError:
 		return &EventProcessSpawnError{}
+	case eventProcessSpawnFailing:
+		return &EventProcessSpawnFailing{}
+	case eventListReconciled:
+		return &EventProcessListReconciled{}
+	case eventProcessReloaded:
+		return &EventProcessReloaded{}
+	case eventProcessPathChanged:
+		return &EventProcessPathChanged{}
+	case eventRepeated:
+		return &EventRepeated{}
 	case eventProcessSpawned:
 		return &EventProcessSpawned{}
 	case eventProcessExited:
 		return &EventProcessExited{}
 	case eventProcessListModify:
 		return &EventProcessListModify{}
+	case eventProcessUnchanged:
+		return &EventProcessUnchanged{}
+	case eventStatsSnapshot:
+		return &EventStatsSnapshot{}
+	case eventStatsReset:
+		return &EventStatsReset{}
+	case eventProcessReported:
+		return &EventProcessReported{}
+	case eventProcessReady:
+		return &EventProcessReady{}
+	case eventProcessStartTimeout:
+		return &EventProcessStartTimeout{}
+	case eventProcessTimedOut:
+		return &EventProcessTimedOut{}
+	case eventProcessStable:
+		return &EventProcessStable{}
+	case eventProcessRecycled:
+		return &EventProcessRecycled{}
+	case eventProcessWaiting:
+		return &EventProcessWaiting{}
+	case eventDryRunSpawn:
+		return &EventDryRunSpawn{}
+	case eventControlAction:
+		return &EventControlAction{}
+	case eventLockStolen:
+		return &EventLockStolen{}
+	case eventLeaderElected:
+		return &EventLeaderElected{}
+	case eventLeaderLost:
+		return &EventLeaderLost{}
+	case eventBinaryChanged:
+		return &EventBinaryChanged{}
+	case eventProcessStale:
+		return &EventProcessStale{}
+	case eventArtifactFetched:
+		return &EventArtifactFetched{}
+	case eventScriptsSynced:
+		return &EventScriptsSynced{}
+	case eventMonitorThrottled:
+		return &EventMonitorThrottled{}
+	case eventProcessDeferred:
+		return &EventProcessDeferred{}
+	case eventProcessState:
+		return &EventProcessStateChanged{}
+	case eventProcessAdopted:
+		return &EventProcessAdopted{}
+	case eventSpawnCanceled:
+		return &EventProcessSpawnCanceled{}
+	case eventWarningsSuppressed:
+		return &EventWarningsSuppressed{}
 	default:
 		return nil
 	}
 }
 
+// ValidateEvent checks the fields of a decoded event for values that no
+// cronmon could have written, such as a process event without a file. It does
+// not check fields that are only informational.
+func ValidateEvent(ev Event) error {
+	if ev, ok := ev.(ProcessEvent); ok && ev.ProcessFile() == "" {
+		switch ev := ev.(type) {
+		case *EventRepeated:
+			// Repeated events only have a file if the repeated event has one.
+		case *EventControlAction:
+			if !ev.global() {
+				return errors.New("missing process file")
+			}
+		default:
+			return errors.New("missing process file")
+		}
+	}
+
+	switch ev := ev.(type) {
+	case *EventProcessSpawned:
+		if ev.PID <= 0 {
+			return errors.Errorf("invalid PID %d", ev.PID)
+		}
+	case *EventProcessExited:
+		if ev.PID < 0 {
+			return errors.Errorf("invalid PID %d", ev.PID)
+		}
+	case *EventProcessListModify:
+		switch ev.Op {
+		case ProcessListAdd, ProcessListRemove, ProcessListUpdate:
+		default:
+			return errors.Errorf("invalid process list operation %q", ev.Op)
+		}
+	case *EventRepeated:
+		if NewEvent(ev.Event) == nil {
+			return errors.Errorf("unknown repeated event %q", ev.Event)
+		}
+		if ev.Count < 1 {
+			return errors.Errorf("invalid repeat count %d", ev.Count)
+		}
+		if ev.Last.Before(ev.First) {
+			return errors.New("last repeat is before the first")
+		}
+	case *EventWarningsSuppressed:
+		if ev.Count < 1 {
+			return errors.Errorf("invalid suppressed warning count %d", ev.Count)
+		}
+		if ev.Last.Before(ev.First) {
+			return errors.New("last suppressed warning is before the first")
+		}
+	}
+
+	return nil
+}
+
 // EventWarning is emitted when a non-fatal error occurs.
 type EventWarning struct {
 	Component string `json:"component"`
@@ -53,9 +213,130 @@ type EventWarning struct {
 func (ev *EventWarning) Type() string { return eventWarning }
 func (ev *EventWarning) event()       {}
 
+// EventWarningsSuppressed summarizes the warnings of a component that were left
+// out of the journal because the component kept failing. Count is the number
+// of warnings that were left out, First and Last are the times of the first
+// and last of them, and Error is the error of the last one. See
+// MonitorOptions.WarningLimit.
+type EventWarningsSuppressed struct {
+	Component string    `json:"component"`
+	Count     int       `json:"count"`
+	Error     string    `json:"error"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+func (ev *EventWarningsSuppressed) Type() string { return eventWarningsSuppressed }
+func (ev *EventWarningsSuppressed) event()       {}
+
+// EventRepeated summarizes a run of events that are identical to the event
+// written right before the run. Count is the number of identical events that
+// were left out, and First and Last are the times of the first and last of
+// them. File is the file of the process if the event is a process event. See
+// journal.DedupJournaler.
+type EventRepeated struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+	File  string          `json:"file,omitempty"`
+	Count int             `json:"count"`
+	First time.Time       `json:"first"`
+	Last  time.Time       `json:"last"`
+}
+
+func (ev *EventRepeated) Type() string        { return eventRepeated }
+func (ev *EventRepeated) event()              {}
+func (ev *EventRepeated) ProcessFile() string { return ev.File }
+
+// EventLockStolen is emitted when the journal lock was taken over from a
+// holder that no longer exists.
+type EventLockStolen struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+func (ev *EventLockStolen) Type() string { return eventLockStolen }
+func (ev *EventLockStolen) event()       {}
+
+// EventLeaderElected is emitted when this cronmon becomes the leader among
+// several hosts and starts running the scripts. Token is the fencing token of
+// the leadership term.
+type EventLeaderElected struct {
+	Holder string `json:"holder"`
+	Token  uint64 `json:"token"`
+}
+
+func (ev *EventLeaderElected) Type() string { return eventLeaderElected }
+func (ev *EventLeaderElected) event()       {}
+
+// EventLeaderLost is emitted when this cronmon loses its leadership, after
+// which its scripts are stopped until it's elected again.
+type EventLeaderLost struct {
+	Token uint64 `json:"token"`
+}
+
+func (ev *EventLeaderLost) Type() string { return eventLeaderLost }
+func (ev *EventLeaderLost) event()       {}
+
+// EventBinaryChanged is emitted when cronmon's own binary changed, such as
+// after a package upgrade. All processes are then stopped, and cronmon restarts
+// itself with the new binary.
+type EventBinaryChanged struct {
+	Path string `json:"path"`
+}
+
+func (ev *EventBinaryChanged) Type() string { return eventBinaryChanged }
+func (ev *EventBinaryChanged) event()       {}
+
+// EventArtifactFetched is emitted when the artifact of a script declared in the
+// artifact manifest is fetched and verified, right before the script is pointed
+// to it. See ArtifactManifest.
+type EventArtifactFetched struct {
+	File   string `json:"file"`
+	Source string `json:"source"`
+	Digest string `json:"digest"`
+}
+
+func (ev *EventArtifactFetched) Type() string        { return eventArtifactFetched }
+func (ev *EventArtifactFetched) ProcessFile() string { return ev.File }
+func (ev *EventArtifactFetched) event()              {}
+
+// EventScriptsSynced is emitted when the scripts directory is synced to a new
+// commit of its git repository. Updated and Removed are the changed files. See
+// package gitsync.
+type EventScriptsSynced struct {
+	Repository string   `json:"repository"`
+	Commit     string   `json:"commit"`
+	Updated    []string `json:"updated,omitempty"`
+	Removed    []string `json:"removed,omitempty"`
+}
+
+func (ev *EventScriptsSynced) Type() string { return eventScriptsSynced }
+func (ev *EventScriptsSynced) event()       {}
+
+// EventMonitorThrottled is emitted when the automatic restarts of all processes
+// exceed the restart limit, such as when a dependency shared by every script is
+// down. Until the cool-down ends, every automatic restart is delayed by at
+// least MonitorThrottledBackoff. The cool-down is extended for as long as the
+// limit keeps being exceeded. See MonitorRestartLimit.
+type EventMonitorThrottled struct {
+	// Restarts is the number of restarts within the last minute.
+	Restarts int `json:"restarts"`
+	// Limit is the restart limit per minute.
+	Limit int `json:"limit"`
+	// Until is when the cool-down ends unless it's extended.
+	Until time.Time `json:"until"`
+}
+
+func (ev *EventMonitorThrottled) Type() string { return eventMonitorThrottled }
+func (ev *EventMonitorThrottled) event()       {}
+
 // EventAcquired is emitted when the monitor is started.
 type EventAcquired struct {
 	JournalID string `json:"journal_id"`
+	// DryRun is true if the monitor never spawns anything and only journals
+	// what it would spawn. See MonitorOptions.DryRun.
+	DryRun bool `json:"dry_run,omitempty"`
 }
 
 func (ev *EventAcquired) Type() string { return eventAcquired }
@@ -82,20 +363,50 @@ func (ev *EventLogTruncated) event()       {}
 type EventProcessSpawnError struct {
 	File   string `json:"file"`
 	Reason string `json:"reason"`
+	// Errno is the symbolic name of the errno that caused the error, such as
+	// "EACCES", if any.
+	Errno string `json:"errno,omitempty"`
+	// Hint explains the likely cause of the error and how to fix it, such as
+	// a script that is not executable, if it's known.
+	Hint string `json:"hint,omitempty"`
 }
 
-func (ev *EventProcessSpawnError) Type() string { return eventProcessSpawnError }
-func (ev *EventProcessSpawnError) event()       {}
+func (ev *EventProcessSpawnError) Type() string        { return eventProcessSpawnError }
+func (ev *EventProcessSpawnError) event()              {}
+func (ev *EventProcessSpawnError) ProcessFile() string { return ev.File }
+
+// EventProcessSpawnFailing is emitted once when a process keeps failing to
+// start with the same reason. From then on, the process is only retried every
+// ProbeInterval, and its spawn errors are not journaled until the reason
+// changes or the process is spawned.
+type EventProcessSpawnFailing struct {
+	File          string        `json:"file"`
+	Reason        string        `json:"reason"`
+	Hint          string        `json:"hint,omitempty"`
+	Attempts      int           `json:"attempts"`
+	ProbeInterval time.Duration `json:"probe_interval"`
+}
+
+func (ev *EventProcessSpawnFailing) Type() string        { return eventProcessSpawnFailing }
+func (ev *EventProcessSpawnFailing) event()              {}
+func (ev *EventProcessSpawnFailing) ProcessFile() string { return ev.File }
 
 // EventProcessSpawned is emitted when a process has been started for any
 // reason.
 type EventProcessSpawned struct {
 	File string `json:"file"`
 	PID  int    `json:"pid"`
+	// Restarts is the cumulative number of restarts of the script, including
+	// this spawn.
+	Restarts int `json:"restarts,omitempty"`
+	// Hash is the hash of the script and its configuration that is run. See
+	// Process.Hash.
+	Hash string `json:"hash,omitempty"`
 }
 
-func (ev *EventProcessSpawned) Type() string { return eventProcessSpawned }
-func (ev *EventProcessSpawned) event()       {}
+func (ev *EventProcessSpawned) Type() string        { return eventProcessSpawned }
+func (ev *EventProcessSpawned) event()              {}
+func (ev *EventProcessSpawned) ProcessFile() string { return ev.File }
 
 // EventProcessExited is emitted when a process has been stopped for any reason.
 type EventProcessExited struct {
@@ -103,6 +414,14 @@ type EventProcessExited struct {
 	PID      int    `json:"pid"`
 	Error    string `json:"error,omitempty"`
 	ExitCode int    `json:"exit_code"` // -1 if interrupted or terminated
+	// LastWords is the last output of the process if it exited with a
+	// nonzero code and its script keeps it. See ScriptConfig.LastWords.
+	LastWords string `json:"last_words,omitempty"`
+	// CoreDumped is true if the process dumped core.
+	CoreDumped bool `json:"core_dumped,omitempty"`
+	// CoreDump is the path to the collected core dump, if its script collects
+	// them and the dump was written to a file. See ScriptConfig.CoreDump.
+	CoreDump string `json:"core_dump,omitempty"`
 }
 
 // IsGraceful returns true if the process stopped gracefully (i.e. on SIGINT).
@@ -110,8 +429,9 @@ func (ev EventProcessExited) IsGraceful() bool {
 	return ev.ExitCode != -1
 }
 
-func (ev *EventProcessExited) Type() string { return eventProcessExited }
-func (ev *EventProcessExited) event()       {}
+func (ev *EventProcessExited) Type() string        { return eventProcessExited }
+func (ev *EventProcessExited) event()              {}
+func (ev *EventProcessExited) ProcessFile() string { return ev.File }
 
 // EventProcessListModify is emitted when the process list is modified to add,
 // update or remove a process from the internal state.
@@ -120,6 +440,21 @@ type EventProcessListModify struct {
 	File string              `json:"file"`
 }
 
+// EventProcessListReconciled is emitted when a batch of changes in the scripts
+// directory is applied together, after the directory has settled, or when the
+// process list is reconciled from scratch. It lists the script files that are
+// added, updated and removed. See DirSettle and Monitor.Reconcile.
+type EventProcessListReconciled struct {
+	Added   []string `json:"added,omitempty"`
+	Updated []string `json:"updated,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Full is true if the whole directory was reconciled from scratch.
+	Full bool `json:"full,omitempty"`
+}
+
+func (ev *EventProcessListReconciled) Type() string { return eventListReconciled }
+func (ev *EventProcessListReconciled) event()       {}
+
 // ProcessListModifyOp contains possible operations that modify the process
 // list, often from changes in the configuration directory.
 type ProcessListModifyOp string
@@ -130,5 +465,262 @@ const (
 	ProcessListUpdate ProcessListModifyOp = "update"
 )
 
-func (ev *EventProcessListModify) Type() string { return eventProcessListModify }
-func (ev *EventProcessListModify) event()       {}
+func (ev *EventProcessListModify) Type() string        { return eventProcessListModify }
+func (ev *EventProcessListModify) event()              {}
+func (ev *EventProcessListModify) ProcessFile() string { return ev.File }
+
+// EventProcessUnchanged is emitted when a process is not restarted on an update
+// because its script's contents did not change, such as when the file is only
+// touched.
+type EventProcessUnchanged struct {
+	File string `json:"file"`
+	Hash string `json:"hash"`
+}
+
+func (ev *EventProcessUnchanged) Type() string        { return eventProcessUnchanged }
+func (ev *EventProcessUnchanged) event()              {}
+func (ev *EventProcessUnchanged) ProcessFile() string { return ev.File }
+
+// EventStatsSnapshot is emitted when the monitor is started and when it quits
+// to record the statistics of all known scripts, including ones that are not
+// running, so that they're carried over to the next monitor.
+type EventStatsSnapshot struct {
+	Restarts map[string]int `json:"restarts"`
+}
+
+func (ev *EventStatsSnapshot) Type() string { return eventStatsSnapshot }
+func (ev *EventStatsSnapshot) event()       {}
+
+// EventStatsReset is emitted when the statistics of a script, such as its
+// cumulative restart counter, are explicitly reset.
+type EventStatsReset struct {
+	File string `json:"file"`
+}
+
+func (ev *EventStatsReset) Type() string        { return eventStatsReset }
+func (ev *EventStatsReset) event()              {}
+func (ev *EventStatsReset) ProcessFile() string { return ev.File }
+
+// EventProcessReported is emitted when a process reports an event of its own by
+// writing a line prefixed with ProcessEventPrefix to its output. See
+// ScriptConfig.Events.
+type EventProcessReported struct {
+	File string          `json:"file"`
+	PID  int             `json:"pid"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (ev *EventProcessReported) Type() string        { return eventProcessReported }
+func (ev *EventProcessReported) event()              {}
+func (ev *EventProcessReported) ProcessFile() string { return ev.File }
+
+// EventProcessReady is emitted when a process that is waited for reports that
+// it's ready. See ScriptConfig.WaitReady.
+type EventProcessReady struct {
+	File string `json:"file"`
+	PID  int    `json:"pid"`
+}
+
+func (ev *EventProcessReady) Type() string        { return eventProcessReady }
+func (ev *EventProcessReady) event()              {}
+func (ev *EventProcessReady) ProcessFile() string { return ev.File }
+
+// EventProcessStartTimeout is emitted when a process does not become ready
+// within its start timeout. The process is then killed. See
+// ScriptConfig.StartTimeout.
+type EventProcessStartTimeout struct {
+	File    string        `json:"file"`
+	PID     int           `json:"pid"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+func (ev *EventProcessStartTimeout) Type() string        { return eventProcessStartTimeout }
+func (ev *EventProcessStartTimeout) event()              {}
+func (ev *EventProcessStartTimeout) ProcessFile() string { return ev.File }
+
+// EventProcessTimedOut is emitted when a process has been running for longer
+// than its maximum runtime. The process is then terminated. See
+// ScriptConfig.MaxRuntime.
+type EventProcessTimedOut struct {
+	File       string        `json:"file"`
+	PID        int           `json:"pid"`
+	MaxRuntime time.Duration `json:"max_runtime"`
+}
+
+func (ev *EventProcessTimedOut) Type() string        { return eventProcessTimedOut }
+func (ev *EventProcessTimedOut) event()              {}
+func (ev *EventProcessTimedOut) ProcessFile() string { return ev.File }
+
+// EventProcessStable is emitted when a process has been up for its minimum
+// uptime, after which it's considered to have started successfully and its
+// restart backoff is reset. See ScriptConfig.MinUptime.
+type EventProcessStable struct {
+	File      string        `json:"file"`
+	PID       int           `json:"pid"`
+	MinUptime time.Duration `json:"min_uptime"`
+}
+
+func (ev *EventProcessStable) Type() string        { return eventProcessStable }
+func (ev *EventProcessStable) event()              {}
+func (ev *EventProcessStable) ProcessFile() string { return ev.File }
+
+// EventProcessRecycled is emitted when a running process is restarted on its
+// schedule. See ScriptConfig.RestartEvery and ScriptConfig.RestartAt.
+type EventProcessRecycled struct {
+	File string `json:"file"`
+	PID  int    `json:"pid"`
+}
+
+func (ev *EventProcessRecycled) Type() string        { return eventProcessRecycled }
+func (ev *EventProcessRecycled) event()              {}
+func (ev *EventProcessRecycled) ProcessFile() string { return ev.File }
+
+// EventProcessWaiting is emitted when a process is not started because one of
+// its start conditions is not met. It is emitted again only if the unmet
+// condition changes. See ScriptConfig.Conditions.
+type EventProcessWaiting struct {
+	File      string `json:"file"`
+	Condition string `json:"condition"`
+}
+
+func (ev *EventProcessWaiting) Type() string        { return eventProcessWaiting }
+func (ev *EventProcessWaiting) event()              {}
+func (ev *EventProcessWaiting) ProcessFile() string { return ev.File }
+
+// EventProcessDeferred is emitted when the restart of a crashed process is
+// deferred because the host is under pressure. It is emitted once per deferred
+// restart, which happens once the pressure drops or after PressureMaxDeferral.
+// See PressureLimits.
+type EventProcessDeferred struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+func (ev *EventProcessDeferred) Type() string        { return eventProcessDeferred }
+func (ev *EventProcessDeferred) event()              {}
+func (ev *EventProcessDeferred) ProcessFile() string { return ev.File }
+
+// EventProcessStateChanged is emitted when a process changes from one state to
+// another. See ProcessState.
+type EventProcessStateChanged struct {
+	File string       `json:"file"`
+	From ProcessState `json:"from"`
+	To   ProcessState `json:"to"`
+}
+
+func (ev *EventProcessStateChanged) Type() string        { return eventProcessState }
+func (ev *EventProcessStateChanged) event()              {}
+func (ev *EventProcessStateChanged) ProcessFile() string { return ev.File }
+
+// EventProcessAdopted is emitted when a running process that a previous cronmon
+// started is adopted instead of spawning the script again. See Process.Adopt.
+type EventProcessAdopted struct {
+	File string `json:"file"`
+	PID  int    `json:"pid"`
+}
+
+func (ev *EventProcessAdopted) Type() string        { return eventProcessAdopted }
+func (ev *EventProcessAdopted) event()              {}
+func (ev *EventProcessAdopted) ProcessFile() string { return ev.File }
+
+// EventProcessSpawnCanceled is emitted when a process is stopped while its
+// start is still waiting for one of the monitor's spawn slots, so it's never
+// spawned. See MonitorSpawnConcurrency.
+type EventProcessSpawnCanceled struct {
+	File string `json:"file"`
+}
+
+func (ev *EventProcessSpawnCanceled) Type() string        { return eventSpawnCanceled }
+func (ev *EventProcessSpawnCanceled) event()              {}
+func (ev *EventProcessSpawnCanceled) ProcessFile() string { return ev.File }
+
+// EventDryRunSpawn is emitted in dry-run mode instead of spawning a process,
+// describing what would have been spawned. See MonitorOptions.DryRun.
+type EventDryRunSpawn struct {
+	File string `json:"file"`
+	// Path is the resolved path of the executable.
+	Path   string        `json:"path,omitempty"`
+	Config *ScriptConfig `json:"config,omitempty"`
+	// Error is the reason that the process would fail to spawn, if any.
+	Error string `json:"error,omitempty"`
+}
+
+func (ev *EventDryRunSpawn) Type() string        { return eventDryRunSpawn }
+func (ev *EventDryRunSpawn) event()              {}
+func (ev *EventDryRunSpawn) ProcessFile() string { return ev.File }
+
+// EventControlAction is emitted when an action that changes the monitor is
+// requested over the control API, giving an audit trail of who did what.
+type EventControlAction struct {
+	Action string `json:"action"`
+	File   string `json:"file,omitempty"`
+	// Actor is the peer that requested the action, if known.
+	Actor *ControlActor `json:"actor,omitempty"`
+	// Error is the reason that the action failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// ControlActor describes the peer of a control API request.
+type ControlActor struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+	PID int `json:"pid"`
+}
+
+func (ev *EventControlAction) Type() string        { return eventControlAction }
+func (ev *EventControlAction) event()              {}
+func (ev *EventControlAction) ProcessFile() string { return ev.File }
+
+// global returns true if the action concerns the whole monitor rather than a
+// process, so that it has no file.
+func (ev *EventControlAction) global() bool {
+	switch ev.Action {
+	case "reconcile", "import state":
+		return true
+	default:
+		return false
+	}
+}
+
+// EventProcessPathChanged is emitted when one of the watched paths of a running
+// process changed, after which the process is restarted. See
+// ScriptConfig.WatchPaths.
+type EventProcessPathChanged struct {
+	File string `json:"file"`
+	PID  int    `json:"pid"`
+	Path string `json:"path"`
+}
+
+func (ev *EventProcessPathChanged) Type() string        { return eventProcessPathChanged }
+func (ev *EventProcessPathChanged) event()              {}
+func (ev *EventProcessPathChanged) ProcessFile() string { return ev.File }
+
+// EventProcessReloaded is emitted when the reload signal was sent to a running
+// process instead of restarting it, because the given path changed. The path
+// is either one of its watched paths or its configuration file. See
+// ScriptConfig.ReloadSignal.
+type EventProcessReloaded struct {
+	File   string `json:"file"`
+	PID    int    `json:"pid"`
+	Path   string `json:"path"`
+	Signal string `json:"signal"`
+}
+
+func (ev *EventProcessReloaded) Type() string        { return eventProcessReloaded }
+func (ev *EventProcessReloaded) event()              {}
+func (ev *EventProcessReloaded) ProcessFile() string { return ev.File }
+
+// EventProcessStale is emitted when a running process' script no longer matches
+// the one it was started from, such as when the change was missed by the
+// watcher. The process needs to be restarted to run the new script. See
+// ScriptCheckInterval.
+type EventProcessStale struct {
+	File    string `json:"file"`
+	PID     int    `json:"pid"`
+	Hash    string `json:"hash"`
+	NewHash string `json:"new_hash"`
+}
+
+func (ev *EventProcessStale) Type() string        { return eventProcessStale }
+func (ev *EventProcessStale) event()              {}
+func (ev *EventProcessStale) ProcessFile() string { return ev.File }
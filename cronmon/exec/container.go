@@ -0,0 +1,129 @@
+package exec
+
+import (
+	"context"
+	osexec "os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Container describes a container to run a process in. See StartContainer.
+type Container struct {
+	// Runtime is the container CLI, such as "docker" or "podman". It is looked
+	// up in $PATH.
+	Runtime string
+	// Name is the name of the container. Any existing container with the same
+	// name is removed before the container is started, since it can only be
+	// left over from a previous run that didn't clean up.
+	Name string
+	// Image is the image to run.
+	Image string
+	// Args are the extra arguments to the run command, such as volumes.
+	Args []string
+	// Command is the command to run in the image. If it's empty, then the
+	// executable is mounted read-only into the container and run instead.
+	Command []string
+	// Env is the names of the environment variables that are passed from the
+	// process' environment into the container. Other variables are only seen
+	// by the runtime.
+	Env []string
+}
+
+// ContainerStopTimeout is the duration to wait for the container runtime to
+// kill or remove a container.
+var ContainerStopTimeout = 10 * time.Second
+
+// containerScript is the path that the executable is mounted at inside the
+// container.
+const containerScript = "/run/cronmon/script"
+
+// StartContainer starts argv inside the container described by opts.Container
+// through its runtime's CLI. The returned process is the CLI, which proxies
+// signals to the container and exits with its status, so it can be treated
+// like any other process. Killing it also kills the container.
+func StartContainer(argv []string, opts Options) (Process, error) {
+	c := opts.Container
+	if c == nil {
+		return nil, errors.New("no container given")
+	}
+
+	runtime, err := osexec.LookPath(c.Runtime)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find container runtime")
+	}
+
+	// Remove leftovers of a previous run, which would otherwise conflict with
+	// the name.
+	removeContainer(runtime, c.Name)
+
+	cmd := runArgv(runtime, argv, opts)
+
+	p, err := StartProcess(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return containerProcess{p, runtime, c.Name}, nil
+}
+
+// runArgv returns the argv of the runtime's CLI that runs argv in the
+// container.
+func runArgv(runtime string, argv []string, opts Options) []string {
+	c := opts.Container
+
+	cmd := []string{runtime, "run", "--rm", "--init", "--name", c.Name}
+	if opts.Stdin != nil {
+		cmd = append(cmd, "--interactive")
+	}
+	if opts.TTY {
+		cmd = append(cmd, "--tty")
+	}
+	for _, k := range c.Env {
+		cmd = append(cmd, "--env", k)
+	}
+
+	if len(c.Command) == 0 {
+		cmd = append(cmd, "--volume", argv[0]+":"+containerScript+":ro")
+	}
+
+	cmd = append(cmd, c.Args...)
+	cmd = append(cmd, c.Image)
+
+	if len(c.Command) == 0 {
+		cmd = append(cmd, containerScript)
+		cmd = append(cmd, argv[1:]...)
+	} else {
+		cmd = append(cmd, c.Command...)
+	}
+
+	return cmd
+}
+
+// removeContainer forcibly removes the container with the given name, if any.
+func removeContainer(runtime, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ContainerStopTimeout)
+	defer cancel()
+
+	return osexec.CommandContext(ctx, runtime, "rm", "--force", name).Run()
+}
+
+// containerProcess is the runtime's CLI process of a container.
+type containerProcess struct {
+	Process
+	runtime string
+	name    string
+}
+
+var _ Process = containerProcess{}
+
+// Kill kills the container as well as the CLI, since killing the CLI alone
+// leaves the container running.
+func (p containerProcess) Kill() error {
+	if err := removeContainer(p.runtime, p.name); err != nil {
+		p.Process.Kill()
+		return errors.Wrap(err, "failed to remove container")
+	}
+
+	return p.Process.Kill()
+}
@@ -27,10 +27,16 @@ type ExitStatus struct {
 	PID   int
 	Code  int // -1 for interrupt
 	Error error
+	// CoreDumped is true if the process dumped core. It's only known for
+	// processes started by StartProcess.
+	CoreDumped bool
 }
 
 type process struct {
 	*os.Process
+	// keepLocked is true if the locked OS thread must not be reused after
+	// the process exits, because its attributes were changed.
+	keepLocked bool
 }
 
 var _ Process = process{}
@@ -42,11 +48,132 @@ func FindProcess(pid int) (Process, error) {
 		return nil, err
 	}
 
-	return process{p}, nil
+	return process{Process: p}, nil
+}
+
+// AdoptPollInterval is how often an adopted process is checked for whether it
+// has exited. See AdoptProcess.
+var AdoptPollInterval = time.Second
+
+// ErrUnknownExitCode is the error of the ExitStatus of an adopted process, whose
+// exit code can't be known.
+var ErrUnknownExitCode = errors.New("exit code of adopted process is unknown")
+
+type adoptedProcess struct {
+	pid int
+}
+
+var _ Process = adoptedProcess{}
+
+// AdoptProcess creates a new Process for the running process with the given ID,
+// which doesn't need to be a child of the current process, such as one that was
+// started by a previous cronmon. Only a parent can wait for its children, so
+// Wait polls whether the process still exists every AdoptPollInterval instead,
+// and the exit code is never known.
+func AdoptProcess(pid int) (Process, error) {
+	if err := unix.Kill(pid, 0); err != nil {
+		return nil, errors.Wrapf(err, "cannot adopt process %d", pid)
+	}
+
+	return adoptedProcess{pid}, nil
+}
+
+// ProcessExists returns true if a process with the given PID exists, even if
+// it's owned by another user.
+func ProcessExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+func (proc adoptedProcess) PID() int {
+	return proc.pid
+}
+
+func (proc adoptedProcess) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return errors.New("unsupported signal")
+	}
+	return unix.Kill(proc.pid, s)
+}
+
+func (proc adoptedProcess) Kill() error {
+	return unix.Kill(proc.pid, unix.SIGKILL)
+}
+
+func (proc adoptedProcess) Wait() ExitStatus {
+	for unix.Kill(proc.pid, 0) != unix.ESRCH {
+		time.Sleep(AdoptPollInterval)
+	}
+
+	return ExitStatus{
+		PID:   proc.pid,
+		Code:  -1,
+		Error: ErrUnknownExitCode,
+	}
+}
+
+// Options contains optional parameters for starting a process.
+type Options struct {
+	// Stdin, Stdout and Stderr are the standard files of the process. A nil
+	// file is connected to /dev/null.
+	Stdin  *os.File
+	Stdout *os.File
+	Stderr *os.File
+
+	// Env is the environment of the process in the "key=value" form. The
+	// process inherits the current environment if it's nil.
+	Env []string
+
+	// Dir is the working directory of the process. The process inherits the
+	// current working directory if it's empty.
+	Dir string
+	// Umask, if not nil, is the file mode creation mask of the process.
+	// Otherwise, the process inherits the current one.
+	Umask *os.FileMode
+	// Groups, if not nil, replaces the supplementary groups of the process,
+	// which requires CAP_SETGID. An empty slice drops all of them.
+	Groups []uint32
+	// User, if not nil, is the user that the process runs as, which requires
+	// CAP_SETUID and CAP_SETGID. Its supplementary groups are dropped unless
+	// Groups is also set.
+	User *User
+	// Seccomp, if not nil, is the seccomp filter that is applied to the
+	// process before it's executed. See SeccompPreset and ParseSeccompFilter.
+	Seccomp []unix.SockFilter
+	// CoreDumps, if true, raises the core file size limit of the process to
+	// its hard limit, so that it dumps core if it crashes. See
+	// ExitStatus.CoreDumped.
+	CoreDumps bool
+
+	// TTY, if true, starts the process in a new session with Stdout as its
+	// controlling terminal. Stdout must then be the slave end of a
+	// pseudo-terminal; see OpenPTY.
+	TTY bool
+
+	// Container, if not nil, makes the process run inside the container. It
+	// is only used by StartContainer.
+	Container *Container
+	// Remote, if not nil, makes the process run on another host. It is only
+	// used by StartRemote.
+	Remote *Remote
+}
+
+// User is the user and primary group that a process runs as.
+type User struct {
+	UID uint32
+	GID uint32
 }
 
 // StartProcess creates a new command process on the system.
-func StartProcess(argv []string) (Process, error) {
+func StartProcess(argv []string, opts Options) (Process, error) {
+	if opts.TTY && opts.Stdout == nil {
+		return nil, errors.New("TTY requires a stdout")
+	}
+
 	// Lock this goroutine to the OS thread for Pdeathsig.
 	// See https://github.com/golang/go/issues/27505.
 	runtime.LockOSThread()
@@ -58,17 +185,88 @@ func StartProcess(argv []string) (Process, error) {
 		return nil, errors.Wrap(err, "failed to set subreaper")
 	}
 
-	p, err := os.StartProcess(argv[0], argv, &os.ProcAttr{
-		// Linux-only: we need the child to die when we do, because it's the
-		// next best thing we can do that doesn't involve reparenting orphaned
-		// children magic.
-		Sys: &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM},
+	// Linux-only: the umask is shared by all threads of the process, so this
+	// thread first gets its own copy to set the child's umask on without
+	// affecting the rest of cronmon. The thread is then never reused.
+	var keepLocked bool
+	if opts.Umask != nil {
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			return nil, errors.Wrap(err, "failed to unshare filesystem attributes")
+		}
+		keepLocked = true
+		old := unix.Umask(int(*opts.Umask & os.ModePerm))
+		defer unix.Umask(old)
+	}
+
+	files := []*os.File{opts.Stdin, opts.Stdout, opts.Stderr}
+	for i, f := range files {
+		if f != nil {
+			continue
+		}
+
+		null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open /dev/null")
+		}
+		defer null.Close()
+
+		files[i] = null
+	}
+
+	// Linux-only: we need the child to die when we do, because it's the next
+	// best thing we can do that doesn't involve reparenting orphaned children
+	// magic.
+	sys := &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+
+	if opts.Groups != nil || opts.User != nil {
+		sys.Credential = &syscall.Credential{
+			Uid:    uint32(os.Getuid()),
+			Gid:    uint32(os.Getgid()),
+			Groups: opts.Groups,
+		}
+		if opts.User != nil {
+			sys.Credential.Uid = opts.User.UID
+			sys.Credential.Gid = opts.User.GID
+		}
+	}
+
+	if opts.TTY {
+		sys.Setsid = true
+		sys.Setctty = true
+		sys.Ctty = 1 // stdout in the child
+	}
+
+	name := argv[0]
+
+	shim, err := shimOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if shim != nil {
+		cfg, err := shim.pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer cfg.Close()
+
+		files = append(files, cfg)
+		// /proc/self/exe still works if the binary was replaced.
+		name = "/proc/self/exe"
+		argv = append([]string{shimArg0}, argv...)
+	}
+
+	p, err := os.StartProcess(name, argv, &os.ProcAttr{
+		Dir:   opts.Dir,
+		Env:   opts.Env,
+		Files: files,
+		Sys:   sys,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return process{p}, nil
+	return process{Process: p, keepLocked: keepLocked}, nil
 }
 
 func (proc process) PID() int {
@@ -79,12 +277,22 @@ func (proc process) PID() int {
 // as StartProcess.
 func (proc process) Wait() ExitStatus {
 	s, err := proc.Process.Wait()
-	runtime.UnlockOSThread()
+	if !proc.keepLocked {
+		runtime.UnlockOSThread()
+	}
+
+	var coreDumped bool
+	if s != nil {
+		if ws, ok := s.Sys().(syscall.WaitStatus); ok {
+			coreDumped = ws.CoreDump()
+		}
+	}
 
 	return ExitStatus{
-		PID:   proc.Pid,
-		Code:  s.ExitCode(),
-		Error: err,
+		PID:        proc.Pid,
+		Code:       s.ExitCode(),
+		Error:      err,
+		CoreDumped: coreDumped,
 	}
 }
 
@@ -122,6 +330,8 @@ func (mock *sleepProcess) Signal(sig os.Signal) error {
 		status = 0
 	case syscall.SIGKILL:
 		status = -1
+	case syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2: // handled
+		return nil
 	default:
 		return errors.New("unknown signal")
 	}
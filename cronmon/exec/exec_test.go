@@ -0,0 +1,50 @@
+package exec
+
+import (
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func TestAdoptProcess(t *testing.T) {
+	interval := AdoptPollInterval
+	t.Cleanup(func() { AdoptPollInterval = interval })
+	AdoptPollInterval = time.Millisecond
+
+	p, err := StartProcess([]string{"/bin/sleep", "60"}, Options{})
+	if err != nil {
+		t.Fatal("failed to start process:", err)
+	}
+
+	if !ProcessExists(p.PID()) {
+		t.Error("running process does not exist")
+	}
+
+	adopted, err := AdoptProcess(p.PID())
+	if err != nil {
+		t.Fatal("failed to adopt process:", err)
+	}
+
+	if err := adopted.Kill(); err != nil {
+		t.Fatal("failed to kill adopted process:", err)
+	}
+
+	// Reap the child, like init would for a real orphan.
+	p.Wait()
+
+	status := adopted.Wait()
+	if status.PID != p.PID() || status.Code != -1 {
+		t.Errorf("unexpected exit status %#v", status)
+	}
+	if !errors.Is(status.Error, ErrUnknownExitCode) {
+		t.Errorf("unexpected exit error %v", status.Error)
+	}
+
+	if ProcessExists(p.PID()) || ProcessExists(0) {
+		t.Error("process exists after exiting")
+	}
+
+	if _, err := AdoptProcess(p.PID()); err == nil {
+		t.Error("adopted a process that exited")
+	}
+}
@@ -0,0 +1,48 @@
+package exec
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// OpenPTY allocates a new pseudo-terminal. The slave end is meant to be passed
+// to a process started with Options.TTY, while the master end is read from for
+// the process' output. Reading from the master returns an error once the slave
+// is closed by all processes; see IsPTYClosed.
+func OpenPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open ptmx")
+	}
+
+	fd := int(master.Fd())
+
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed to unlock pty")
+	}
+
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed to get pty number")
+	}
+
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed to open pty slave")
+	}
+
+	return master, slave, nil
+}
+
+// IsPTYClosed returns true if the given error was returned from reading the
+// master end of a pseudo-terminal whose slave end has been closed, which Linux
+// reports as EIO.
+func IsPTYClosed(err error) bool {
+	return errors.Is(err, unix.EIO)
+}
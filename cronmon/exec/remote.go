@@ -0,0 +1,227 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Remote describes a host to run a process on over SSH. See StartRemote.
+type Remote struct {
+	// Host is the destination passed to ssh, such as "user@host" or the name
+	// of a host in ~/.ssh/config.
+	Host string
+	// Name is the name of the directory on the host that holds the script,
+	// its environment and the PID of its process. It must be unique to the
+	// script.
+	Name string
+	// Args are the extra arguments to ssh, such as "-p" or "-i" flags.
+	Args []string
+	// Env is the environment variables in the "key=value" form that are set
+	// for the process on the host. They are uploaded with the script instead
+	// of being put on the command line, so secrets don't show up in process
+	// lists.
+	Env []string
+}
+
+// RemoteKeepAlive is the interval at which ssh checks that the host is still
+// alive. The process is considered to have exited once 3 checks in a row fail.
+var RemoteKeepAlive = 15 * time.Second
+
+// RemoteCommandTimeout is the duration to wait for the commands that upload
+// the script or signal its process on the host.
+var RemoteCommandTimeout = 30 * time.Second
+
+// remoteDir is the shell expression of the directory of the given name on the
+// host.
+func remoteDir(name string) string {
+	return `"${TMPDIR:-/tmp}/` + name + `"`
+}
+
+// StartRemote runs the executable argv[0] on the host described by
+// opts.Remote over SSH. Nothing needs to be installed on the host other than a
+// POSIX shell: the executable is uploaded every time it's started, so it must
+// be able to run there, such as a shell script.
+//
+// The returned process is the local ssh process, which exits with the status
+// of the remote process. Since the remote process keeps running if the
+// connection drops, its PID is recorded on the host, so that it's signaled
+// directly and any leftover process is killed before the next one is started.
+func StartRemote(argv []string, opts Options) (Process, error) {
+	r := opts.Remote
+	if r == nil {
+		return nil, errors.New("no remote given")
+	}
+
+	ssh, err := osexec.LookPath("ssh")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find ssh")
+	}
+
+	script, err := os.ReadFile(argv[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read script")
+	}
+
+	p := remoteProcess{ssh: ssh, remote: r, opts: opts}
+
+	if err := p.upload(script); err != nil {
+		return nil, err
+	}
+
+	dir := remoteDir(r.Name)
+
+	// The script is run in the background rather than exec'd, so that its PID
+	// can be recorded before it starts. Background commands read from
+	// /dev/null, so stdin is passed through another descriptor. The PID is
+	// removed once the script exits, so that it's never reused to signal
+	// another process.
+	cmd := fmt.Sprintf(
+		`set -a && . %[1]s/env && set +a && rm -f %[1]s/env && exec 3<&0 && `+
+			`{ %[1]s/script %[2]s <&3 3<&- & } && echo $! > %[1]s/pid && `+
+			`wait $!; s=$?; rm -f %[1]s/pid; exit $s`,
+		dir, shellQuoteArgs(argv[1:]),
+	)
+
+	p.Process, err = StartProcess(p.argv(opts.TTY, cmd), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// remoteProcess is the local ssh process of a remote process.
+type remoteProcess struct {
+	Process
+	ssh    string
+	remote *Remote
+	opts   Options
+}
+
+var _ Process = remoteProcess{}
+
+// argv returns the argv of ssh that runs the given command on the host.
+func (p remoteProcess) argv(tty bool, cmd string) []string {
+	argv := []string{
+		p.ssh,
+		"-o", "BatchMode=yes",
+		"-o", fmt.Sprintf("ServerAliveInterval=%d", int(RemoteKeepAlive.Seconds())),
+		"-o", "ServerAliveCountMax=3",
+	}
+	if tty {
+		argv = append(argv, "-tt")
+	} else {
+		argv = append(argv, "-T")
+	}
+	argv = append(argv, p.remote.Args...)
+	argv = append(argv, "--", p.remote.Host, cmd)
+	return argv
+}
+
+// run runs the given command on the host with the given stdin.
+func (p remoteProcess) run(cmd, stdin string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RemoteCommandTimeout)
+	defer cancel()
+
+	argv := p.argv(false, cmd)
+
+	c := osexec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Env = p.opts.Env
+	c.Stdin = strings.NewReader(stdin)
+
+	if out, err := c.CombinedOutput(); err != nil {
+		if out := strings.TrimSpace(string(out)); out != "" {
+			return errors.Errorf("%v: %s", err, out)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// upload uploads the script and its environment to the host. Leftovers of a
+// previous run, which may still be running if the connection dropped, are
+// killed first. Both are sent through stdin, so the environment is read one
+// byte at a time with dd, which is in POSIX unlike head -c, to leave the script
+// to cat.
+func (p remoteProcess) upload(script []byte) error {
+	env := make([]string, 0, len(p.remote.Env))
+	for _, kv := range p.remote.Env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env = append(env, kv[:i]+"="+shellQuote(kv[i+1:])+"\n")
+		}
+	}
+	sort.Strings(env)
+	envFile := strings.Join(env, "")
+
+	dir := remoteDir(p.remote.Name)
+	cmd := fmt.Sprintf(
+		`{ pid=$(cat %[1]s/pid 2> /dev/null) && kill -9 "$pid" 2> /dev/null; rm -f %[1]s/pid; } && `+
+			`umask 077 && mkdir -p %[1]s && dd bs=1 count=%[2]d of=%[1]s/env 2> /dev/null && `+
+			`cat > %[1]s/script && chmod 700 %[1]s/script`,
+		dir, len(envFile),
+	)
+
+	if err := p.run(cmd, envFile+string(script)); err != nil {
+		return errors.Wrap(err, "failed to upload script")
+	}
+
+	return nil
+}
+
+// signal sends the signal to the remote process, if it's running.
+func (p remoteProcess) signal(sig syscall.Signal) error {
+	cmd := fmt.Sprintf(
+		`pid=$(cat %[1]s/pid 2> /dev/null) || exit 0; kill -%[2]d "$pid" 2> /dev/null || true`,
+		remoteDir(p.remote.Name), int(sig),
+	)
+	return p.run(cmd, "")
+}
+
+// Signal sends the signal to the remote process. The local ssh process is
+// signaled as well if that fails, such as when the host is unreachable.
+func (p remoteProcess) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return p.Process.Signal(sig)
+	}
+
+	if err := p.signal(s); err != nil {
+		p.Process.Signal(sig)
+		return errors.Wrap(err, "failed to signal remote process")
+	}
+
+	return nil
+}
+
+// Kill kills the remote process as well as the local ssh process.
+func (p remoteProcess) Kill() error {
+	if err := p.signal(syscall.SIGKILL); err != nil {
+		p.Process.Kill()
+		return errors.Wrap(err, "failed to kill remote process")
+	}
+
+	return p.Process.Kill()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellQuoteArgs quotes each argument for a POSIX shell.
+func shellQuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
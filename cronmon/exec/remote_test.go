@@ -0,0 +1,92 @@
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	args := []string{"", "a b", "it's", `$HOME "x" \n`, "a\nb", "*"}
+
+	out, err := osexec.Command("/bin/sh", "-c", `printf '%s\0' `+shellQuoteArgs(args)).Output()
+	if err != nil {
+		t.Fatal("failed to run sh:", err)
+	}
+
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("expected args %q, got %q", args, got)
+	}
+}
+
+func TestRemoteArgv(t *testing.T) {
+	p := remoteProcess{
+		ssh:    "/usr/bin/ssh",
+		remote: &Remote{Host: "user@host", Args: []string{"-p", "2222"}},
+	}
+
+	expect := []string{
+		"/usr/bin/ssh",
+		"-o", "BatchMode=yes",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveCountMax=3",
+		"-T", "-p", "2222",
+		"--", "user@host", "true",
+	}
+	if argv := p.argv(false, "true"); !reflect.DeepEqual(argv, expect) {
+		t.Errorf("expected argv %q, got %q", expect, argv)
+	}
+
+	expect[7] = "-tt"
+	if argv := p.argv(true, "true"); !reflect.DeepEqual(argv, expect) {
+		t.Errorf("expected argv with TTY %q, got %q", expect, argv)
+	}
+}
+
+func TestRemoteUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	// Run the command locally, like sshd would on the host.
+	ssh := filepath.Join(dir, "ssh")
+	fake := "#!/bin/sh\nwhile [ \"$1\" != -- ]; do shift; done\nexec /bin/sh -c \"$3\"\n"
+	if err := os.WriteFile(ssh, []byte(fake), 0755); err != nil {
+		t.Fatal("failed to write fake ssh:", err)
+	}
+
+	p := remoteProcess{
+		ssh: ssh,
+		remote: &Remote{
+			Host: "host",
+			Name: "test",
+			Env:  []string{"B=x\ny", "A=it's"},
+		},
+		opts: Options{
+			Env: []string{"PATH=" + os.Getenv("PATH"), "TMPDIR=" + dir},
+		},
+	}
+
+	script := "#!/bin/sh\necho \"$A\"\n"
+	if err := p.upload([]byte(script)); err != nil {
+		t.Fatal("failed to upload:", err)
+	}
+
+	env, err := os.ReadFile(filepath.Join(dir, "test", "env"))
+	if err != nil {
+		t.Fatal("failed to read uploaded env:", err)
+	}
+	if expect := "A='it'\\''s'\nB='x\ny'\n"; string(env) != expect {
+		t.Errorf("expected env %q, got %q", expect, env)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "test", "script"))
+	if err != nil {
+		t.Fatal("failed to read uploaded script:", err)
+	}
+	if string(b) != script {
+		t.Errorf("expected script %q, got %q", script, b)
+	}
+}
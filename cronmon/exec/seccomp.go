@@ -0,0 +1,258 @@
+package exec
+
+import (
+	"encoding/binary"
+	"runtime"
+	"sort"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SeccompMaxInstructions is the maximum length of a seccomp filter, as limited
+// by the kernel.
+const SeccompMaxInstructions = 4096
+
+// Seccomp return actions and the offsets into struct seccomp_data, which aren't
+// in package unix.
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16 // lower half on little-endian architectures
+)
+
+// seccompArch describes the current architecture for the presets. Only
+// little-endian architectures are supported.
+type seccompArch struct {
+	audit uint32
+	// x32 is the bit that marks syscalls of the x32 ABI, which share the
+	// architecture of x86-64 and must be rejected, or 0.
+	x32 uint32
+	// socketcall is the number of the multiplexed socketcall syscall, which
+	// could be used to get around a socket rule, or 0.
+	socketcall uint32
+}
+
+var seccompArches = map[string]seccompArch{
+	"amd64":   {audit: 0xc000003e, x32: 0x40000000},
+	"386":     {audit: 0x40000003, socketcall: 102},
+	"arm64":   {audit: 0xc00000b7},
+	"arm":     {audit: 0x40000028},
+	"riscv64": {audit: 0xc00000f3},
+	"ppc64le": {audit: 0xc0000015},
+}
+
+// seccompDenied are the syscalls that the presets make fail with EPERM: those
+// that administer the system, such as loading kernel modules or mounting, and
+// those that inspect or escape from other processes.
+var seccompDenied = []uint32{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_ADJTIMEX,
+	unix.SYS_BPF,
+	unix.SYS_CHROOT,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_MOUNT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_SYSLOG,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+}
+
+// seccompCloneNamespaces are the flags of clone that create namespaces, which
+// the presets deny like unshare.
+const seccompCloneNamespaces = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// SeccompPresets describes the seccomp filter presets of SeccompPreset.
+var SeccompPresets = map[string]string{
+	"default":    "deny system administration, tracing and namespace syscalls",
+	"no-network": "default, and deny sockets other than Unix sockets",
+}
+
+// SeccompPreset returns the seccomp filter of the given preset, which is one of
+// SeccompPresets. Denied syscalls fail with EPERM, and syscalls of other
+// architectures, such as 32-bit syscalls on x86-64, kill the process.
+//
+// Since the flags of clone3 are behind a pointer that the filter can't read,
+// clone3 fails with ENOSYS, which makes libc fall back to clone, whose flags
+// are checked for namespaces.
+func SeccompPreset(name string) ([]unix.SockFilter, error) {
+	if _, ok := SeccompPresets[name]; !ok {
+		return nil, errors.Errorf("unknown seccomp preset %q", name)
+	}
+
+	arch, ok := seccompArches[runtime.GOARCH]
+	if !ok {
+		return nil, errors.Errorf("seccomp presets are not supported on %s", runtime.GOARCH)
+	}
+
+	denied := append([]uint32(nil), seccompDenied...)
+	if name == "no-network" && arch.socketcall != 0 {
+		denied = append(denied, arch.socketcall)
+	}
+	sort.Slice(denied, func(i, j int) bool { return denied[i] < denied[j] })
+
+	// The checks are followed by the allow, deny and ENOSYS returns, the
+	// check of clone's flags and, for no-network, the check of the socket's
+	// address family. Each check jumps to one of them, as an offset from the
+	// end of the checks. Jumps are relative to the next instruction.
+	const (
+		toAllow = iota
+		toDeny
+		toNosys
+		toClone
+		toSocket = toClone + 4
+	)
+
+	type check struct {
+		code uint16
+		k    uint32
+		to   int
+	}
+
+	var checks []check
+	if arch.x32 != 0 {
+		checks = append(checks, check{code: unix.BPF_JSET, k: arch.x32, to: toDeny})
+	}
+	for _, nr := range denied {
+		checks = append(checks, check{code: unix.BPF_JEQ, k: nr, to: toDeny})
+	}
+	checks = append(checks,
+		check{code: unix.BPF_JEQ, k: unix.SYS_CLONE, to: toClone},
+		check{code: unix.BPF_JEQ, k: unix.SYS_CLONE3, to: toNosys},
+	)
+	if name == "no-network" {
+		checks = append(checks, check{code: unix.BPF_JEQ, k: unix.SYS_SOCKET, to: toSocket})
+	}
+
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch.audit, Jt: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+	}
+
+	for i, c := range checks {
+		filter = append(filter, unix.SockFilter{
+			Code: unix.BPF_JMP | c.code | unix.BPF_K,
+			K:    c.k,
+			Jt:   uint8(len(checks) + c.to - i - 1),
+		})
+	}
+
+	filter = append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.ENOSYS)},
+
+		// The namespace flags are in the lower half of clone's flags.
+		unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArg0},
+		unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: seccompCloneNamespaces, Jt: 1},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+	)
+
+	if name == "no-network" {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArg0},
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.AF_UNIX, Jf: 1},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+		)
+	}
+
+	return filter, nil
+}
+
+// ParseSeccompFilter parses a compiled seccomp filter, which is an array of
+// struct sock_filter in the native byte order, such as one exported by
+// libseccomp's seccomp_export_bpf.
+func ParseSeccompFilter(b []byte) ([]unix.SockFilter, error) {
+	if len(b) == 0 || len(b)%8 != 0 {
+		return nil, errors.New("invalid seccomp filter size")
+	}
+	if len(b)/8 > SeccompMaxInstructions {
+		return nil, errors.New("seccomp filter is too long")
+	}
+
+	filter := make([]unix.SockFilter, len(b)/8)
+	for i := range filter {
+		ins := b[i*8:]
+		filter[i] = unix.SockFilter{
+			Code: nativeEndian.Uint16(ins[0:]),
+			Jt:   ins[2],
+			Jf:   ins[3],
+			K:    nativeEndian.Uint32(ins[4:]),
+		}
+	}
+
+	return filter, nil
+}
+
+// encodeSeccompFilter encodes the filter in the form of ParseSeccompFilter.
+func encodeSeccompFilter(filter []unix.SockFilter) []byte {
+	b := make([]byte, len(filter)*8)
+	for i, ins := range filter {
+		nativeEndian.PutUint16(b[i*8:], ins.Code)
+		b[i*8+2] = ins.Jt
+		b[i*8+3] = ins.Jf
+		nativeEndian.PutUint32(b[i*8+4:], ins.K)
+	}
+	return b
+}
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// applySeccomp applies the filter to the calling thread and its future
+// children.
+func applySeccomp(filter []unix.SockFilter) error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "failed to set no_new_privs")
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	_, _, errno := unix.RawSyscall(unix.SYS_PRCTL,
+		unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errors.Wrap(errno, "failed to apply seccomp filter")
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package exec
+
+import (
+	"io"
+	"os"
+	osexec "os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSeccompPreset(t *testing.T) {
+	if _, ok := seccompArches[runtime.GOARCH]; !ok {
+		t.Skip("seccomp presets are not supported on", runtime.GOARCH)
+	}
+
+	perl, err := osexec.LookPath("perl")
+	if err != nil {
+		t.Skip("perl not found")
+	}
+
+	const (
+		eperm  = "Operation not permitted"
+		enosys = "Function not implemented"
+	)
+
+	// CLONE_NEWUSER and SIGCHLD.
+	newUser := strconv.Itoa(unix.CLONE_NEWUSER | int(unix.SIGCHLD))
+
+	// Each script prints the error of the syscall, if any.
+	tests := []struct {
+		preset string
+		script string
+		err    string
+	}{
+		{"default", `socket(S, 2, 1, 0) or print "$!"`, ""},
+		{"no-network", `socket(S, 2, 1, 0) or print "$!"`, eperm},
+		{"no-network", `socket(S, 1, 1, 0) or print "$!"`, ""},
+		{"default", `syscall(` + perlSyscall(t, "reboot") + `, 0, 0, 0, 0) == -1 and print "$!"`, eperm},
+		{"default", `syscall(` + perlSyscall(t, "clone") + `, ` + newUser + `, 0, 0, 0, 0) == -1 and print "$!"`, eperm},
+		{"default", `syscall(435, 0, 0) == -1 and print "$!"`, enosys},
+		{"default", `my $pid = fork; defined $pid or print "$!"; exit if $pid == 0; wait`, ""},
+	}
+
+	for _, test := range tests {
+		filter, err := SeccompPreset(test.preset)
+		if err != nil {
+			t.Fatal("failed to get preset:", err)
+		}
+
+		if out := runFiltered(t, filter, perl, "-e", test.script); out != test.err {
+			t.Errorf("%s: %s: expected %q, got output %q", test.preset, test.script, test.err, out)
+		}
+	}
+}
+
+// perlSyscall returns the number of the syscall for perl's syscall function.
+func perlSyscall(t *testing.T, name string) string {
+	switch name + "/" + runtime.GOARCH {
+	case "reboot/amd64":
+		return "169"
+	case "reboot/arm64", "reboot/riscv64":
+		return "142"
+	case "clone/amd64":
+		return "56"
+	case "clone/arm64", "clone/riscv64":
+		return "220"
+	default:
+		t.Skip("unknown syscall number of", name)
+		return ""
+	}
+}
+
+func runFiltered(t *testing.T, filter []unix.SockFilter, argv ...string) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	p, err := StartProcess(argv, Options{Stdout: w, Stderr: w, Seccomp: filter})
+	w.Close()
+	if err != nil {
+		t.Fatal("failed to start process:", err)
+	}
+
+	out, _ := io.ReadAll(r)
+	p.Wait()
+
+	return string(out)
+}
+
+func TestParseSeccompFilter(t *testing.T) {
+	filter, err := SeccompPreset("no-network")
+	if err != nil {
+		t.Skip("no preset:", err)
+	}
+
+	parsed, err := ParseSeccompFilter(encodeSeccompFilter(filter))
+	if err != nil {
+		t.Fatal("failed to parse filter:", err)
+	}
+	if !reflect.DeepEqual(parsed, filter) {
+		t.Error("parsed filter differs from the encoded one")
+	}
+
+	for _, b := range [][]byte{nil, make([]byte, 7), make([]byte, 8*(SeccompMaxInstructions+1))} {
+		if _, err := ParseSeccompFilter(b); err == nil {
+			t.Errorf("expected error parsing %d bytes", len(b))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes that can only be set from within the process are applied by
+// re-executing the current binary with shimArg0 as argv[0] and a shimConfig on
+// fd 3. The init function of this package then applies them and executes the
+// actual process, which keeps the PID, before any of the binary's own code
+// runs.
+const shimArg0 = "cronmon-exec-shim"
+
+func init() {
+	if len(os.Args) > 1 && os.Args[0] == shimArg0 {
+		runShim(os.Args[1:])
+	}
+}
+
+// shimConfig is what the shim applies before executing the process.
+type shimConfig struct {
+	// Seccomp is the seccomp filter in the form of ParseSeccompFilter.
+	Seccomp []byte `json:"seccomp,omitempty"`
+	// CoreDumps, if true, raises the core file size limit to the hard limit.
+	CoreDumps bool `json:"core_dumps,omitempty"`
+}
+
+// shimOf returns the shim configuration of the options, or nil if no shim is
+// needed.
+func shimOf(opts Options) (*shimConfig, error) {
+	if opts.Seccomp == nil && !opts.CoreDumps {
+		return nil, nil
+	}
+
+	cfg := shimConfig{CoreDumps: opts.CoreDumps}
+
+	if opts.Seccomp != nil {
+		if len(opts.Seccomp) == 0 || len(opts.Seccomp) > SeccompMaxInstructions {
+			return nil, errors.New("invalid seccomp filter length")
+		}
+		cfg.Seccomp = encodeSeccompFilter(opts.Seccomp)
+	}
+
+	return &cfg, nil
+}
+
+// pipe returns the read end of a pipe that holds the configuration, to be
+// passed to the shim as fd 3.
+func (cfg *shimConfig) pipe() (*os.File, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create shim pipe")
+	}
+	defer w.Close()
+
+	// The configuration always fits into the pipe's buffer, since seccomp
+	// filters are limited in size.
+	if _, err := w.Write(b); err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "failed to write shim config")
+	}
+
+	return r, nil
+}
+
+// runShim applies the configuration on fd 3 and executes argv. It never
+// returns.
+func runShim(argv []string) {
+	// Seccomp filters only apply to the calling thread, which must then be
+	// the one that executes the process.
+	runtime.LockOSThread()
+
+	err := applyShim()
+	if err == nil {
+		err = unix.Exec(argv[0], argv, os.Environ())
+	}
+
+	fmt.Fprintf(os.Stderr, "cronmon: %s: %v\n", argv[0], err)
+	os.Exit(127)
+}
+
+func applyShim() error {
+	f := os.NewFile(3, "shim")
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to read shim config")
+	}
+
+	var cfg shimConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return errors.Wrap(err, "failed to parse shim config")
+	}
+
+	if cfg.CoreDumps {
+		var lim unix.Rlimit
+		if err := unix.Getrlimit(unix.RLIMIT_CORE, &lim); err != nil {
+			return errors.Wrap(err, "failed to get core limit")
+		}
+		lim.Cur = lim.Max
+		if err := unix.Setrlimit(unix.RLIMIT_CORE, &lim); err != nil {
+			return errors.Wrap(err, "failed to set core limit")
+		}
+	}
+
+	// The filter is applied last, since it may deny the other syscalls.
+	if cfg.Seccomp != nil {
+		filter, err := ParseSeccompFilter(cfg.Seccomp)
+		if err != nil {
+			return err
+		}
+		if err := applySeccomp(filter); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package exec
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCoreDumps(t *testing.T) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &limit); err != nil || limit.Max == 0 {
+		t.Skip("core dumps are disabled")
+	}
+
+	dir := t.TempDir()
+
+	p, err := StartProcess([]string{"/bin/sh", "-c", "kill -SEGV $$"}, Options{Dir: dir, CoreDumps: true})
+	if err != nil {
+		t.Fatal("failed to start process:", err)
+	}
+
+	status := p.Wait()
+	if status.Code != -1 {
+		t.Errorf("unexpected exit code %d", status.Code)
+	}
+	if !status.CoreDumped {
+		t.Error("no core dump was written")
+	}
+}
@@ -0,0 +1,45 @@
+package cronmon
+
+import "time"
+
+// FlapWindow is the window over which the flapping score of a script is
+// computed.
+var FlapWindow = 24 * time.Hour
+
+// FlapThreshold is the flapping score, in restarts per hour, at or above which
+// a script is considered to be flapping.
+var FlapThreshold = 6.0
+
+// FlapScore computes the flapping score of a script from its spawn times,
+// which is the number of restarts per hour over the FlapWindow before now.
+func FlapScore(spawns []time.Time, now time.Time) float64 {
+	since := now.Add(-FlapWindow)
+
+	var n int
+	for _, spawn := range spawns {
+		if !spawn.Before(since) && !spawn.After(now) {
+			n++
+		}
+	}
+
+	// The first spawn in the window isn't a restart.
+	if n > 0 {
+		n--
+	}
+
+	return float64(n) / FlapWindow.Hours()
+}
+
+// pruneSpawns removes spawn times that are out of the FlapWindow before now.
+// The given spawn times must be sorted from oldest to newest.
+func pruneSpawns(spawns []time.Time, now time.Time) []time.Time {
+	since := now.Add(-FlapWindow)
+
+	for i, spawn := range spawns {
+		if !spawn.Before(since) {
+			return spawns[i:]
+		}
+	}
+
+	return spawns[:0]
+}
@@ -0,0 +1,473 @@
+// Package gitsync keeps a scripts directory in sync with a git repository, so
+// that deployments are done by pushing to the repository.
+//
+// The repository is fetched into a hidden directory inside the scripts
+// directory, and the files of each synced commit are written into a tree of
+// their own there. Each synced script is a symlink through the "current"
+// symlink to the synced tree, which is swapped with a single rename, so that
+// the scripts always come from the same commit. Symlinks in the repository are
+// linked into the scripts directory as they are instead.
+//
+// The changed scripts are then linked again so that the monitor sees the
+// change, and its settling applies all of the changes together. Only the files
+// that were synced are ever updated or removed; other files in the scripts
+// directory are left alone unless the repository has a file of the same name.
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// StateDir is the name of the directory in the scripts directory that holds
+// the fetched repository and the sync state.
+const StateDir = ".git-sync"
+
+// DefaultInterval is the default interval at which the repository is fetched.
+const DefaultInterval = time.Minute
+
+// CommandTimeout is the maximum duration of a single git command, such as a
+// fetch.
+var CommandTimeout = 5 * time.Minute
+
+// Config is the configuration of a Syncer.
+type Config struct {
+	// Repository is the URL or path of the repository, as understood by git.
+	// It is required.
+	Repository string
+	// Branch is the branch to sync. The remote's default branch is synced if
+	// it's empty.
+	Branch string
+	// Subdir, if not empty, is the directory in the repository that holds the
+	// scripts. Only its files are synced; directories are skipped.
+	Subdir string
+	// Interval is the interval at which the repository is fetched. It
+	// defaults to DefaultInterval.
+	Interval time.Duration
+	// VerifySignatures, if true, only syncs commits whose signatures are valid
+	// according to "git verify-commit", which uses the GPG keyring or the SSH
+	// allowed signers file configured for git.
+	VerifySignatures bool
+}
+
+// Syncer syncs a scripts directory with a git repository.
+type Syncer struct {
+	cfg Config
+	dir string
+	j   cronmon.Journaler
+}
+
+// NewSyncer creates a syncer of the given scripts directory. Failures are
+// journaled as warnings.
+func NewSyncer(dir string, cfg Config, j cronmon.Journaler) (*Syncer, error) {
+	if cfg.Repository == "" {
+		return nil, errors.New("missing repository")
+	}
+	if strings.HasPrefix(cfg.Branch, "-") {
+		return nil, errors.Errorf("invalid branch %q", cfg.Branch)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+
+	return &Syncer{cfg: cfg, dir: dir, j: j}, nil
+}
+
+// Run syncs the directory immediately and then every interval until the context
+// is canceled.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+			s.j.Write(&cronmon.EventWarning{
+				Component: "git sync",
+				Error:     err.Error(),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// state is the persisted state of the last sync.
+type state struct {
+	Commit string               `json:"commit"`
+	Files  map[string]fileState `json:"files"`
+}
+
+// fileState is a synced file.
+type fileState struct {
+	Blob string `json:"blob"`
+	Mode string `json:"mode"`
+}
+
+func (s *Syncer) stateDir() string  { return filepath.Join(s.dir, StateDir) }
+func (s *Syncer) gitDir() string    { return filepath.Join(s.stateDir(), "repo.git") }
+func (s *Syncer) statePath() string { return filepath.Join(s.stateDir(), "state.json") }
+func (s *Syncer) treesDir() string  { return filepath.Join(s.stateDir(), "trees") }
+
+// currentLink is the symlink in StateDir to the tree of the synced commit.
+const currentLink = "current"
+
+// scriptLink returns the symlink target of the synced script of the given
+// name, relative to the scripts directory.
+func scriptLink(name string) string {
+	return filepath.Join(StateDir, currentLink, name)
+}
+
+func (s *Syncer) loadState() (state, error) {
+	st := state{Files: map[string]fileState{}}
+
+	b, err := os.ReadFile(s.statePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, errors.Wrap(err, "failed to read state")
+	}
+
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, errors.Wrap(err, "failed to parse state")
+	}
+	if st.Files == nil {
+		st.Files = map[string]fileState{}
+	}
+
+	return st, nil
+}
+
+func (s *Syncer) saveState(st state) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0640); err != nil {
+		return errors.Wrap(err, "failed to write state")
+	}
+	if err := os.Rename(tmp, s.statePath()); err != nil {
+		return errors.Wrap(err, "failed to write state")
+	}
+
+	return nil
+}
+
+// git runs git on the fetched repository and returns its stdout.
+func (s *Syncer) git(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir=" + s.gitDir()}, args...)...)
+	cmd.Stderr = &stderr
+	// Never prompt for credentials.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Errorf("git %s: %v: %s", args[0], err, msg)
+		}
+		return nil, errors.Errorf("git %s: %v", args[0], err)
+	}
+
+	return out, nil
+}
+
+// Sync fetches the repository and updates the scripts directory to its latest
+// commit if it changed. The sync is journaled as an EventScriptsSynced.
+func (s *Syncer) Sync(ctx context.Context) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+
+	ref := s.cfg.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if _, err := s.git(ctx, "fetch", "--quiet", "--depth=1", "--", s.cfg.Repository, ref); err != nil {
+		return err
+	}
+
+	out, err := s.git(ctx, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return err
+	}
+	commit := strings.TrimSpace(string(out))
+
+	st, err := s.loadState()
+	if err != nil {
+		return err
+	}
+
+	if commit == st.Commit {
+		return nil
+	}
+
+	if s.cfg.VerifySignatures {
+		if _, err := s.git(ctx, "verify-commit", commit); err != nil {
+			return errors.Wrapf(err, "commit %s is not validly signed", commit)
+		}
+	}
+
+	files, err := s.listFiles(ctx, commit)
+	if err != nil {
+		return err
+	}
+
+	ev := cronmon.EventScriptsSynced{
+		Repository: s.cfg.Repository,
+		Commit:     commit,
+	}
+
+	tree, err := s.writeTree(ctx, files)
+	if err != nil {
+		return err
+	}
+
+	// Remove the scripts that are gone before the swap, so that they're never
+	// left dangling.
+	for name := range st.Files {
+		if _, ok := files[name]; ok {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove %s", name)
+		}
+
+		delete(st.Files, name)
+		ev.Removed = append(ev.Removed, name)
+	}
+	sort.Strings(ev.Removed)
+
+	if err := s.swap(tree); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := files[name]
+		if old, ok := st.Files[name]; ok && old == f && s.linked(name, f) {
+			continue
+		}
+
+		if err := s.link(ctx, name, f); err != nil {
+			return err
+		}
+
+		st.Files[name] = f
+		ev.Updated = append(ev.Updated, name)
+	}
+
+	s.removeTrees(tree)
+
+	st.Commit = commit
+	if err := s.saveState(st); err != nil {
+		return err
+	}
+
+	s.j.Write(&ev)
+	return nil
+}
+
+func (s *Syncer) init(ctx context.Context) error {
+	if _, err := os.Stat(s.gitDir()); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.stateDir(), 0750); err != nil {
+		return errors.Wrap(err, "failed to create state directory")
+	}
+
+	if _, err := s.git(ctx, "init", "--quiet", "--bare", s.gitDir()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// linked returns true if the script of the given name is already linked to
+// the synced file.
+func (s *Syncer) linked(name string, f fileState) bool {
+	target, err := os.Readlink(filepath.Join(s.dir, name))
+	if err != nil {
+		return false
+	}
+
+	if f.Mode == "120000" {
+		// The link is installed by link, which already compared its blob.
+		return true
+	}
+
+	return target == scriptLink(name)
+}
+
+// listFiles lists the files of the scripts in the given commit.
+func (s *Syncer) listFiles(ctx context.Context, commit string) (map[string]fileState, error) {
+	tree := commit
+	if s.cfg.Subdir != "" {
+		tree += ":" + strings.Trim(s.cfg.Subdir, "/")
+	}
+
+	out, err := s.git(ctx, "ls-tree", "-z", tree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]fileState{}
+
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		// Each entry is "<mode> <type> <object>\t<name>".
+		tab := bytes.IndexByte(entry, '\t')
+		if tab < 0 {
+			continue
+		}
+
+		fields := strings.Fields(string(entry[:tab]))
+		name := string(entry[tab+1:])
+
+		if len(fields) != 3 || fields[1] != "blob" || name == StateDir {
+			continue
+		}
+
+		switch fields[0] {
+		case "100644", "100755", "120000":
+			files[name] = fileState{Blob: fields[2], Mode: fields[0]}
+		}
+	}
+
+	return files, nil
+}
+
+// writeTree writes the files of the commit into a new tree inside the trees
+// directory and returns its path. Symlinks are left out, since they're linked
+// into the scripts directory as they are.
+func (s *Syncer) writeTree(ctx context.Context, files map[string]fileState) (string, error) {
+	if err := os.MkdirAll(s.treesDir(), 0750); err != nil {
+		return "", errors.Wrap(err, "failed to create trees directory")
+	}
+
+	tree, err := os.MkdirTemp(s.treesDir(), "")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create tree")
+	}
+	// MkdirTemp creates the tree with 0700, which the processes' users may
+	// not be able to traverse.
+	if err := os.Chmod(tree, 0755); err != nil {
+		os.RemoveAll(tree)
+		return "", errors.Wrap(err, "failed to create tree")
+	}
+
+	for name, f := range files {
+		if f.Mode == "120000" {
+			continue
+		}
+
+		content, err := s.git(ctx, "cat-file", "blob", f.Blob)
+		if err != nil {
+			os.RemoveAll(tree)
+			return "", err
+		}
+
+		mode := os.FileMode(0644)
+		if f.Mode == "100755" {
+			mode = 0755
+		}
+
+		if err := os.WriteFile(filepath.Join(tree, name), content, mode); err != nil {
+			os.RemoveAll(tree)
+			return "", errors.Wrapf(err, "failed to write %s", name)
+		}
+	}
+
+	return tree, nil
+}
+
+// swap atomically points the current link to the given tree.
+func (s *Syncer) swap(tree string) error {
+	rel, err := filepath.Rel(s.stateDir(), tree)
+	if err != nil {
+		return errors.Wrap(err, "failed to link tree")
+	}
+
+	tmp := filepath.Join(s.stateDir(), currentLink+".tmp")
+	os.Remove(tmp)
+
+	if err := os.Symlink(rel, tmp); err != nil {
+		return errors.Wrap(err, "failed to link tree")
+	}
+	if err := os.Rename(tmp, filepath.Join(s.stateDir(), currentLink)); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to swap tree")
+	}
+
+	return nil
+}
+
+// removeTrees removes every tree other than the given one, such as the tree
+// of the last synced commit or ones left behind by a failed sync.
+func (s *Syncer) removeTrees(keep string) {
+	entries, err := os.ReadDir(s.treesDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if path := filepath.Join(s.treesDir(), entry.Name()); path != keep {
+			os.RemoveAll(path)
+		}
+	}
+}
+
+// link atomically links the script of the given name into the scripts
+// directory. Replacing the link makes the monitor see the change even if the
+// link didn't change.
+func (s *Syncer) link(ctx context.Context, name string, f fileState) error {
+	target := scriptLink(name)
+
+	if f.Mode == "120000" {
+		content, err := s.git(ctx, "cat-file", "blob", f.Blob)
+		if err != nil {
+			return err
+		}
+		target = string(content)
+	}
+
+	tmp := filepath.Join(s.stateDir(), "tmp")
+	os.Remove(tmp)
+
+	if err := os.Symlink(target, tmp); err != nil {
+		return errors.Wrapf(err, "failed to link %s", name)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to install %s", name)
+	}
+
+	return nil
+}
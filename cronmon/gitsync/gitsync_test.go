@@ -0,0 +1,169 @@
+package gitsync
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+type journal struct {
+	events []cronmon.Event
+}
+
+func (j *journal) ID() string { return "test" }
+
+func (j *journal) Write(ev cronmon.Event) error {
+	j.events = append(j.events, ev)
+	return nil
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return string(out)
+}
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	repo := t.TempDir()
+	git(t, repo, "init", "--quiet", "--initial-branch=main")
+
+	writeFile(t, filepath.Join(repo, "scripts", "a.sh"), "#!/bin/sh\n", 0755)
+	writeFile(t, filepath.Join(repo, "scripts", ".a.sh.json"), "{}", 0644)
+	writeFile(t, filepath.Join(repo, "scripts", "lib", "b.sh"), "#!/bin/sh\n", 0755)
+	writeFile(t, filepath.Join(repo, "scripts", "d.sh"), "#!/bin/sh\necho 1\n", 0755)
+	writeFile(t, filepath.Join(repo, "README"), "", 0644)
+	git(t, repo, "add", ".")
+	git(t, repo, "commit", "--quiet", "-m", "1")
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "local.sh"), "#!/bin/sh\n", 0755)
+
+	var j journal
+
+	s, err := NewSyncer(dir, Config{Repository: repo, Subdir: "scripts"}, &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal("failed to sync:", err)
+	}
+
+	s1, err := os.Stat(filepath.Join(dir, "a.sh"))
+	if err != nil {
+		t.Fatal("script was not synced:", err)
+	}
+	if s1.Mode().Perm()&0111 == 0 {
+		t.Error("synced script is not executable")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lib")); !os.IsNotExist(err) {
+		t.Error("directory was synced:", err)
+	}
+
+	// Syncing the same commit again does nothing.
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal("failed to sync again:", err)
+	}
+
+	git(t, repo, "rm", "--quiet", "scripts/a.sh", "scripts/.a.sh.json")
+	writeFile(t, filepath.Join(repo, "scripts", "c.sh"), "#!/bin/sh\n", 0755)
+	writeFile(t, filepath.Join(repo, "scripts", "d.sh"), "#!/bin/sh\necho 2\n", 0755)
+	git(t, repo, "add", ".")
+	git(t, repo, "commit", "--quiet", "-m", "2")
+
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatal("failed to sync second commit:", err)
+	}
+
+	for name, exists := range map[string]bool{"a.sh": false, ".a.sh.json": false, "c.sh": true, "local.sh": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Errorf("%s: expected exists=%v, got error %v", name, exists, err)
+		}
+	}
+
+	// Scripts are linked through the swapped tree, and the last tree is gone.
+	if target, err := os.Readlink(filepath.Join(dir, "d.sh")); err != nil || target != scriptLink("d.sh") {
+		t.Errorf("d.sh is not linked to the tree: %q, %v", target, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "d.sh")); err != nil || string(b) != "#!/bin/sh\necho 2\n" {
+		t.Errorf("d.sh was not updated: %q, %v", b, err)
+	}
+	if trees, err := os.ReadDir(s.treesDir()); err != nil || len(trees) != 1 {
+		t.Errorf("expected only the synced tree, got %v, %v", trees, err)
+	}
+
+	if len(j.events) != 2 {
+		t.Fatalf("expected 2 events, got %#v", j.events)
+	}
+
+	commit, _ := s.git(context.Background(), "rev-parse", "FETCH_HEAD")
+	expect := &cronmon.EventScriptsSynced{
+		Repository: repo,
+		Commit:     string(commit[:len(commit)-1]),
+		Updated:    []string{"c.sh", "d.sh"},
+		Removed:    []string{".a.sh.json", "a.sh"},
+	}
+	if !reflect.DeepEqual(j.events[1], expect) {
+		t.Errorf("unexpected event %#v, expected %#v", j.events[1], expect)
+	}
+}
+
+func TestSyncVerifySignatures(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	repo := t.TempDir()
+	git(t, repo, "init", "--quiet", "--initial-branch=main")
+	writeFile(t, filepath.Join(repo, "a.sh"), "#!/bin/sh\n", 0755)
+	git(t, repo, "add", ".")
+	git(t, repo, "commit", "--quiet", "-m", "unsigned")
+
+	dir := t.TempDir()
+
+	s, err := NewSyncer(dir, Config{Repository: repo, VerifySignatures: true}, &journal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Sync(context.Background()); err == nil {
+		t.Fatal("unsigned commit was synced")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.sh")); !os.IsNotExist(err) {
+		t.Error("script of unsigned commit exists:", err)
+	}
+}
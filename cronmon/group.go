@@ -0,0 +1,266 @@
+package cronmon
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// GroupConcurrency is the maximum number of processes that a group operation
+// acts on at once.
+var GroupConcurrency = 4
+
+// ErrUnknownGroup is returned when an operation is done on a group that no
+// known script belongs to.
+var ErrUnknownGroup = errors.New("unknown group")
+
+// GroupStatus is the rolled up status of the scripts in a group. See
+// ScriptConfig.Group.
+type GroupStatus struct {
+	Group   string   `json:"group"`
+	Scripts []string `json:"scripts"`
+	// Running is the number of scripts with a running process.
+	Running int `json:"running"`
+	// Waiting is the number of scripts waiting for start conditions.
+	Waiting int `json:"waiting"`
+	// Stopped is the number of manually stopped scripts.
+	Stopped int `json:"stopped"`
+	// Flapping is the number of flapping scripts.
+	Flapping int `json:"flapping"`
+	// Restarts is the sum of the restart counters of the scripts.
+	Restarts int `json:"restarts"`
+}
+
+// groupMember is a script in a group.
+type groupMember struct {
+	file     string
+	priority int
+	proc     *Process // nil if stopped
+}
+
+// groupMembers returns the known scripts in the given group, sorted by their
+// priorities. It must only be called in the monitor goroutine.
+func (m *Monitor) groupMembers(group string) []groupMember {
+	var members []groupMember
+
+	add := func(file string, proc *Process) {
+		if m.scriptGroup(file) != group {
+			return
+		}
+
+		members = append(members, groupMember{
+			file:     file,
+			priority: scriptPriority(m.dir, file, m.user),
+			proc:     proc,
+		})
+	}
+
+	for file, proc := range m.procs {
+		add(file, proc)
+	}
+	for file := range m.stopped {
+		add(file, nil)
+	}
+
+	sortMembers(members)
+	return members
+}
+
+// sortMembers sorts the members by their priorities, then their file names.
+func sortMembers(members []groupMember) {
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].priority != members[j].priority {
+			return members[i].priority < members[j].priority
+		}
+		return members[i].file < members[j].file
+	})
+}
+
+// runOrdered calls fn on the given members one priority at a time, from the
+// lowest to the highest or the other way around if reverse is true. Up to
+// GroupConcurrency members of the same priority are handled at once.
+func runOrdered(members []groupMember, reverse bool, fn func(groupMember)) {
+	runOrderedLimit(members, reverse, GroupConcurrency, fn)
+}
+
+// runOrderedLimit is like runOrdered, except up to limit members of the same
+// priority are handled at once.
+func runOrderedLimit(members []groupMember, reverse bool, limit int, fn func(groupMember)) {
+	var levels [][]groupMember
+	for i, member := range members {
+		if i == 0 || member.priority != members[i-1].priority {
+			levels = append(levels, nil)
+		}
+		levels[len(levels)-1] = append(levels[len(levels)-1], member)
+	}
+
+	if reverse {
+		for i, j := 0, len(levels)-1; i < j; i, j = i+1, j-1 {
+			levels[i], levels[j] = levels[j], levels[i]
+		}
+	}
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	for _, level := range levels {
+		var wg sync.WaitGroup
+		sema := make(chan struct{}, limit)
+
+		for _, member := range level {
+			wg.Add(1)
+			sema <- struct{}{}
+
+			go func(member groupMember) {
+				defer wg.Done()
+				defer func() { <-sema }()
+				fn(member)
+			}(member)
+		}
+
+		wg.Wait()
+	}
+}
+
+// GroupSnapshot returns the rolled up statuses of all groups, sorted by their
+// names. Scripts without a group are not included.
+func (m *Monitor) GroupSnapshot() ([]GroupStatus, error) {
+	statuses, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*GroupStatus{}
+
+	for _, status := range statuses {
+		if status.Group == "" {
+			continue
+		}
+
+		group, ok := groups[status.Group]
+		if !ok {
+			group = &GroupStatus{Group: status.Group}
+			groups[status.Group] = group
+		}
+
+		group.Scripts = append(group.Scripts, status.File)
+		group.Restarts += status.Restarts
+
+		switch {
+		case status.Stopped:
+			group.Stopped++
+		case status.Waiting != "":
+			group.Waiting++
+		case status.PID != 0:
+			group.Running++
+		}
+
+		if status.Flapping {
+			group.Flapping++
+		}
+	}
+
+	rollups := make([]GroupStatus, 0, len(groups))
+	for _, group := range groups {
+		rollups = append(rollups, *group)
+	}
+
+	sort.Slice(rollups, func(i, j int) bool {
+		return rollups[i].Group < rollups[j].Group
+	})
+
+	return rollups, nil
+}
+
+// RestartGroup restarts the running processes of the scripts in the given
+// group in the order of their priorities. The scripts of a priority are only
+// restarted once those of the previous one have been spawned again. See
+// runOrdered.
+func (m *Monitor) RestartGroup(group string) error {
+	members, err := m.getGroup(group)
+	if err != nil {
+		return err
+	}
+
+	runOrdered(members, false, func(member groupMember) {
+		if member.proc != nil && member.proc.Start(true) == nil {
+			m.waitAttempted(member.proc)
+		}
+	})
+
+	if m.ctx.Err() != nil {
+		return ErrMonitorStopped
+	}
+
+	return nil
+}
+
+// StopGroup manually stops the scripts in the given group in the reverse order
+// of their priorities. See StopProcess.
+func (m *Monitor) StopGroup(group string) error {
+	var members []groupMember
+
+	ok := m.do(func() {
+		members = m.groupMembers(group)
+		for _, member := range members {
+			if member.proc != nil {
+				m.detachProc(member.file)
+			}
+		}
+	})
+	if !ok {
+		return ErrMonitorStopped
+	}
+	if len(members) == 0 {
+		return ErrUnknownGroup
+	}
+
+	runOrdered(members, true, func(member groupMember) {
+		if member.proc != nil {
+			member.proc.Stop()
+		}
+	})
+
+	return nil
+}
+
+// StartGroup starts the manually stopped scripts in the given group in the
+// order of their priorities like RestartGroup.
+func (m *Monitor) StartGroup(group string) error {
+	members, err := m.getGroup(group)
+	if err != nil {
+		return err
+	}
+
+	runOrdered(members, false, func(member groupMember) {
+		if member.proc != nil {
+			return
+		}
+
+		var pr *Process
+		if m.do(func() { pr = m.startStopped(member.file) }) && pr != nil {
+			m.waitAttempted(pr)
+		}
+	})
+
+	if m.ctx.Err() != nil {
+		return ErrMonitorStopped
+	}
+
+	return nil
+}
+
+func (m *Monitor) getGroup(group string) ([]groupMember, error) {
+	var members []groupMember
+
+	if !m.do(func() { members = m.groupMembers(group) }) {
+		return nil, ErrMonitorStopped
+	}
+	if len(members) == 0 {
+		return nil, ErrUnknownGroup
+	}
+
+	return members, nil
+}
@@ -0,0 +1,105 @@
+package cronmon
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunOrdered(t *testing.T) {
+	members := []groupMember{
+		{file: "a", priority: 10},
+		{file: "b", priority: 20},
+		{file: "c", priority: 20},
+		{file: "d", priority: 20},
+		{file: "e", priority: 30},
+	}
+
+	old := GroupConcurrency
+	GroupConcurrency = 2
+	defer func() { GroupConcurrency = old }()
+
+	var mu sync.Mutex
+	var priorities []int
+	var running, maxRunning int32
+
+	runOrdered(members, true, func(member groupMember) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		priorities = append(priorities, member.priority)
+		mu.Unlock()
+	})
+
+	expect := []int{30, 20, 20, 20, 10}
+	if !reflect.DeepEqual(priorities, expect) {
+		t.Errorf("expected priorities %v, got %v", expect, priorities)
+	}
+
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 concurrent calls, got %d", maxRunning)
+	}
+}
+
+func TestMonitorGroupOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"10-db", "20-cache", "20-queue", "30-web"} {
+		writeScript(t, filepath.Join(dir, file))
+		writeConfig(t, ScriptConfigPath(dir, file), `{"spawner": "order", "group": "app"}`)
+	}
+
+	spawner := &orderSpawner{slow: "10-db", spawns: make(chan struct{}, 4)}
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, NewRingJournal(100), MonitorOptions{
+		Spawners: map[string]Spawner{"order": spawner},
+	})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	spawner.takePaths(t, 4)
+	<-m.scanned
+
+	// The slow database must be spawned again before the rest of the group.
+	expect := []string{"10-db", "20-cache", "20-queue", "30-web"}
+
+	if err := m.RestartGroup("app"); err != nil {
+		t.Fatal("failed to restart group:", err)
+	}
+
+	paths := spawner.takePaths(t, 4)
+	// Scripts of the same priority are restarted at once.
+	sort.Strings(paths[1:3])
+	if !reflect.DeepEqual(paths, expect) {
+		t.Errorf("unexpected restart order %q", paths)
+	}
+
+	if err := m.StopGroup("app"); err != nil {
+		t.Fatal("failed to stop group:", err)
+	}
+	if err := m.StartGroup("app"); err != nil {
+		t.Fatal("failed to start group:", err)
+	}
+
+	paths = spawner.takePaths(t, 4)
+	sort.Strings(paths[1:3])
+	if !reflect.DeepEqual(paths, expect) {
+		t.Errorf("unexpected start order %q", paths)
+	}
+}
@@ -0,0 +1,89 @@
+package cronmon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Health is the health of a monitor itself, as opposed to its processes. See
+// Monitor.Health.
+type Health struct {
+	// Responsive is true if the monitor goroutine handled a ping in time.
+	Responsive bool `json:"responsive"`
+	// Watching is true if the scripts directory is being watched for changes.
+	Watching bool `json:"watching"`
+	// JournalError is the error of the last journal write, or empty if it
+	// succeeded.
+	JournalError string `json:"journal_error,omitempty"`
+}
+
+// Healthy returns true if the monitor is alive: it's responsive and it can
+// write into its journal.
+func (h Health) Healthy() bool {
+	return h.Responsive && h.JournalError == ""
+}
+
+// Ready returns true if the monitor is healthy and also watches the scripts
+// directory, so that it fully works.
+func (h Health) Ready() bool {
+	return h.Healthy() && h.Watching
+}
+
+// Health checks the health of the monitor. The monitor goroutine is pinged
+// until the given context expires, so the caller should give it a timeout.
+// Journal writability is judged by the last write, since checking it would
+// require writing an event.
+func (m *Monitor) Health(ctx context.Context) Health {
+	return Health{
+		Responsive:   m.ping(ctx) == nil,
+		Watching:     m.watch.Watching(),
+		JournalError: m.health.lastError(),
+	}
+}
+
+// ping waits until the monitor goroutine is ready to run a function.
+func (m *Monitor) ping(ctx context.Context) error {
+	select {
+	case m.ctrl <- func() {}:
+		return nil
+	case <-m.ctx.Done():
+		return ErrMonitorStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// healthJournaler remembers the result of the last write into the journaler.
+type healthJournaler struct {
+	Journaler
+
+	mut sync.Mutex
+	err error
+}
+
+func (j *healthJournaler) Write(ev Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j *healthJournaler) WriteAt(ev Event, t time.Time) error {
+	err := WriteAt(j.Journaler, ev, t)
+
+	j.mut.Lock()
+	j.err = err
+	j.mut.Unlock()
+
+	return err
+}
+
+// lastError returns the error of the last write as a string, or an empty string
+// if it succeeded.
+func (j *healthJournaler) lastError() string {
+	j.mut.Lock()
+	defer j.mut.Unlock()
+
+	if j.err == nil {
+		return ""
+	}
+	return j.err.Error()
+}
@@ -0,0 +1,76 @@
+package cronmon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingJournal is a mockJournal whose writes return the error given to fail.
+type failingJournal struct {
+	mockJournal
+	mut sync.Mutex
+	err error
+}
+
+func (j *failingJournal) Write(ev Event) error {
+	j.mockJournal.Write(ev)
+
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	return j.err
+}
+
+func (j *failingJournal) fail(err error) {
+	j.mut.Lock()
+	j.err = err
+	j.mut.Unlock()
+}
+
+func TestMonitorHealth(t *testing.T) {
+	var j failingJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), t.TempDir(), &j, MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+
+	health := func() Health {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return m.Health(ctx)
+	}
+
+	// The directory is watched asynchronously.
+	timeout := time.After(5 * time.Second)
+	for !health().Ready() {
+		select {
+		case <-timeout:
+			t.Fatalf("monitor never became ready: %+v", health())
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	j.fail(errors.New("disk full"))
+	m.JournalControlAction(&EventControlAction{Action: "test"})
+
+	if h := health(); h.Healthy() || h.JournalError != "disk full" {
+		t.Errorf("unexpected health with a failing journal: %+v", h)
+	}
+
+	j.fail(nil)
+	m.JournalControlAction(&EventControlAction{Action: "test"})
+
+	if h := health(); !h.Ready() {
+		t.Errorf("monitor didn't recover from journal error: %+v", h)
+	}
+
+	m.Stop()
+
+	if h := health(); h.Healthy() || h.Ready() || h.Responsive || h.Watching {
+		t.Errorf("stopped monitor is healthy: %+v", h)
+	}
+}
@@ -0,0 +1,143 @@
+package cronmon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// spawnErrno returns the symbolic name of the errno that caused the spawn
+// error, such as "EACCES", or an empty string if there is none.
+func spawnErrno(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ""
+	}
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+	return fmt.Sprintf("errno %d", int(errno))
+}
+
+// spawnHint inspects the script at the given path to explain why it failed to
+// spawn with the given error and how to fix it. An empty string is returned if
+// there is nothing more to say than the error itself.
+func spawnHint(path string, cfg ScriptConfig, err error, u *user.User) string {
+	var dangling *DanglingSymlinkError
+	if errors.As(err, &dangling) {
+		return "the symlink's target does not exist; fix or remove the symlink"
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ""
+	}
+
+	// Other spawners fail for reasons that the local script can't explain.
+	local := cfg.Container == nil && cfg.Remote == nil && cfg.Spawner == ""
+
+	switch errno {
+	case unix.ENOENT:
+		if !local {
+			return ""
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "the script does not exist"
+		}
+		interp, crlf := readShebang(path, u)
+		switch {
+		case crlf:
+			return "the shebang line ends with a carriage return; convert the script to Unix line endings"
+		case interp != "":
+			return fmt.Sprintf("the interpreter %s does not exist; fix the shebang line or install it", interp)
+		default:
+			return "the dynamic loader or a library of the binary does not exist; it may be built for another system"
+		}
+
+	case unix.EACCES:
+		if !local {
+			return ""
+		}
+		if noexecMount(path) {
+			return fmt.Sprintf("%s is on a noexec mount; move the script or remount without noexec", filepath.Dir(path))
+		}
+		if s, err := os.Stat(path); err == nil && s.Mode().Perm()&0111 == 0 {
+			return "the script is not executable; run chmod +x " + path
+		}
+		if interp, _ := readShebang(path, u); interp != "" {
+			if s, err := os.Stat(interp); err == nil && s.Mode().Perm()&0111 == 0 {
+				return fmt.Sprintf("the interpreter %s is not executable", interp)
+			}
+		}
+		return "permission denied; check the permissions of the script and its parent directories"
+
+	case unix.ENOEXEC:
+		return "the script is neither a binary nor has a shebang line; add one such as #!/bin/sh"
+
+	case unix.ETXTBSY:
+		return "the script is being written to; it is retried once the write finishes"
+
+	case unix.EPERM:
+		if len(cfg.Groups) > 0 || cfg.ClearGroups {
+			return "groups and clear_groups require cronmon to run as root or with CAP_SETGID"
+		}
+		return ""
+
+	case unix.E2BIG:
+		return "the arguments or environment are too large; check env and secrets"
+
+	case unix.ELOOP:
+		return "the script is a symlink loop"
+
+	case unix.EMFILE, unix.ENFILE:
+		return "too many open files; raise the file descriptor limit of cronmon"
+
+	case unix.EAGAIN, unix.ENOMEM:
+		return "out of memory or over the process limit; check ulimit -u"
+	}
+
+	return ""
+}
+
+// readShebang returns the interpreter of the script's shebang line, if any, and
+// whether the line ends with a carriage return.
+func readShebang(path string, u *user.User) (interp string, crlf bool) {
+	f, err := openScriptFile(path, u)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return "", false
+	}
+
+	line = strings.TrimSuffix(line[2:], "\n")
+	crlf = strings.HasSuffix(line, "\r")
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", crlf
+	}
+
+	return fields[0], crlf
+}
+
+// noexecMount returns true if the given path is on a filesystem mounted with
+// noexec.
+func noexecMount(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	// ST_NOEXEC has the same value as MS_NOEXEC.
+	return st.Flags&unix.MS_NOEXEC != 0
+}
@@ -0,0 +1,97 @@
+package cronmon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSpawnHint(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string, mode os.FileMode) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		config ScriptConfig
+		err    error
+		hint   string
+	}{
+		{
+			name: "not executable",
+			path: write("a", "#!/bin/sh\n", 0644),
+			err:  syscall.EACCES,
+			hint: "chmod +x",
+		},
+		{
+			name: "missing interpreter",
+			path: write("b", "#!/nonexistent/sh\n", 0755),
+			err:  syscall.ENOENT,
+			hint: "/nonexistent/sh does not exist",
+		},
+		{
+			name: "crlf",
+			path: write("c", "#!/bin/sh\r\n", 0755),
+			err:  syscall.ENOENT,
+			hint: "carriage return",
+		},
+		{
+			name: "missing script",
+			path: filepath.Join(dir, "d"),
+			err:  syscall.ENOENT,
+			hint: "does not exist",
+		},
+		{
+			name: "no shebang",
+			path: write("e", "echo hi\n", 0755),
+			err:  syscall.ENOEXEC,
+			hint: "shebang",
+		},
+		{
+			name:   "groups",
+			path:   write("f", "#!/bin/sh\n", 0755),
+			config: ScriptConfig{ClearGroups: true},
+			err:    syscall.EPERM,
+			hint:   "CAP_SETGID",
+		},
+		{
+			name:   "remote",
+			path:   filepath.Join(dir, "g"),
+			config: ScriptConfig{Remote: &RemoteConfig{Host: "a"}},
+			err:    syscall.ENOENT,
+		},
+		{
+			name: "other error",
+			path: filepath.Join(dir, "h"),
+			err:  errors.New("failed"),
+		},
+	}
+
+	for _, test := range tests {
+		err := errors.Wrap(test.err, "fork/exec")
+
+		hint := spawnHint(test.path, test.config, err, nil)
+		if test.hint == "" && hint != "" {
+			t.Errorf("%s: unexpected hint %q", test.name, hint)
+		}
+		if !strings.Contains(hint, test.hint) {
+			t.Errorf("%s: hint %q doesn't contain %q", test.name, hint, test.hint)
+		}
+	}
+
+	if errno := spawnErrno(errors.Wrap(syscall.EACCES, "fork/exec")); errno != "EACCES" {
+		t.Errorf("unexpected errno %q", errno)
+	}
+}
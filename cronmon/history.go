@@ -0,0 +1,84 @@
+package cronmon
+
+import (
+	"context"
+	"time"
+)
+
+// HistoryEntry is a single entry in the timeline of a script.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	// Type is the type of the event, which is one of the process spawned,
+	// exited or spawn error events.
+	Type     string `json:"type"`
+	PID      int    `json:"pid,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Duration is how long the process ran for. It is only set for exits
+	// whose spawn is also in the history.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Gap is how long the script was down before it was spawned. It is only
+	// set for spawns that come after an exit or a spawn error.
+	Gap time.Duration `json:"gap,omitempty"`
+}
+
+// ReadHistory reads the timeline of spawns, exits and spawn errors of the given
+// script from the journal. The timeline is returned in chronological order.
+func ReadHistory(ctx context.Context, r JournalReader, file string) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+
+	err := ReadJournal(ctx, r, ByFile(file, func(ev Event, t time.Time) error {
+		entry := HistoryEntry{Time: t, Type: ev.Type()}
+
+		switch ev := ev.(type) {
+		case *EventProcessSpawned:
+			entry.PID = ev.PID
+		case *EventProcessExited:
+			code := ev.ExitCode
+			entry.PID = ev.PID
+			entry.ExitCode = &code
+			entry.Error = ev.Error
+		case *EventProcessSpawnError:
+			entry.Error = ev.Reason
+		default:
+			return nil
+		}
+
+		entries = append(entries, entry)
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse the entries, since journals are read from newest to oldest.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	spawns := map[int]time.Time{}
+	var downSince time.Time
+
+	for i, entry := range entries {
+		switch entry.Type {
+		case eventProcessSpawned:
+			spawns[entry.PID] = entry.Time
+			if !downSince.IsZero() {
+				entries[i].Gap = entry.Time.Sub(downSince)
+				downSince = time.Time{}
+			}
+		case eventProcessExited:
+			if spawned, ok := spawns[entry.PID]; ok {
+				entries[i].Duration = entry.Time.Sub(spawned)
+				delete(spawns, entry.PID)
+			}
+			downSince = entry.Time
+		case eventProcessSpawnError:
+			if downSince.IsZero() {
+				downSince = entry.Time
+			}
+		}
+	}
+
+	return entries, nil
+}
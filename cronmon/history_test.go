@@ -0,0 +1,50 @@
+package cronmon
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadHistory(t *testing.T) {
+	start := time.Date(2020, 04, 01, 00, 00, 00, 00, time.UTC)
+	at := func(min int) time.Time { return start.Add(time.Duration(min) * time.Minute) }
+
+	// From newest to oldest, like journals are read.
+	r := mockReader{events: []mockEvent{
+		{&EventProcessSpawned{PID: 3, File: "a"}, at(20)},
+		{&EventProcessSpawnError{File: "a", Reason: "not found"}, at(12)},
+		{&EventProcessSpawnError{File: "a", Reason: "not found"}, at(11)},
+		{&EventProcessExited{PID: 2, File: "a", ExitCode: 1, Error: "exit status 1"}, at(10)},
+		{&EventProcessSpawned{PID: 4, File: "b"}, at(9)},
+		{&EventProcessSpawned{PID: 2, File: "a"}, at(5)},
+		{&EventProcessExited{PID: 1, File: "a"}, at(2)},
+		{&EventProcessWaiting{File: "a", Condition: "network"}, at(1)},
+	}}
+
+	entries, err := ReadHistory(context.Background(), &r, "a")
+	if err != nil {
+		t.Fatal("failed to read history:", err)
+	}
+
+	exited := func(code int) *int { return &code }
+
+	// The first exit's spawn isn't in the journal, so its duration is
+	// unknown. The gap of the last spawn starts at the exit rather than at
+	// the spawn errors after it.
+	expect := []HistoryEntry{
+		{Time: at(2), Type: eventProcessExited, PID: 1, ExitCode: exited(0)},
+		{Time: at(5), Type: eventProcessSpawned, PID: 2, Gap: 3 * time.Minute},
+		{Time: at(10), Type: eventProcessExited, PID: 2, ExitCode: exited(1), Error: "exit status 1", Duration: 5 * time.Minute},
+		{Time: at(11), Type: eventProcessSpawnError, Error: "not found"},
+		{Time: at(12), Type: eventProcessSpawnError, Error: "not found"},
+		{Time: at(20), Type: eventProcessSpawned, PID: 3, Gap: 10 * time.Minute},
+	}
+
+	if !reflect.DeepEqual(entries, expect) {
+		t.Fatalf("unexpected history:\n"+
+			"got      %+v\n"+
+			"expected %+v", entries, expect)
+	}
+}
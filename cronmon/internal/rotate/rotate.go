@@ -0,0 +1,80 @@
+// Package rotate implements the rotation of numbered files shared by the
+// journal's segments and the processes' log files, where file 1 is the newest.
+package rotate
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// Shift renames each rotated file n, as named by the given function, to n+1,
+// so that file 1 is free for the newest one. The file that would go beyond keep
+// is removed instead.
+func Shift(keep int, name func(n int) string) error {
+	os.Remove(name(keep))
+
+	for n := keep - 1; n >= 1; n-- {
+		if err := os.Rename(name(n), name(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rotate compresses the contents of r into the new rotated file 1, shifting
+// the older ones up like Shift. The contents are compressed into a temporary
+// file before anything is shifted, so that the rotated files are left as they
+// were if compressing fails, such as when the disk is full.
+func Rotate(keep int, name func(n int) string, r io.Reader) error {
+	tmp := name(1) + ".tmp"
+	defer os.Remove(tmp)
+
+	if err := compress(tmp, r); err != nil {
+		return err
+	}
+
+	if err := Shift(keep, name); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name(1))
+}
+
+// Compress writes the gzip-compressed contents of r into the file at the given
+// path. The file is written into a temporary file first, so that it is never
+// seen half-written.
+func Compress(path string, r io.Reader) error {
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+
+	if err := compress(tmp, r); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// compress writes the gzip-compressed contents of r into the file at the given
+// path.
+func compress(path string, r io.Reader) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	z := gzip.NewWriter(out)
+
+	if _, err := io.Copy(z, r); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := z.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
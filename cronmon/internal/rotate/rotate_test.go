@@ -0,0 +1,125 @@
+package rotate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestShift(t *testing.T) {
+	dir := t.TempDir()
+	name := func(n int) string { return filepath.Join(dir, fmt.Sprintf("log.%d", n)) }
+
+	// File 2 is missing, as if an older rotation kept fewer files.
+	for _, n := range []int{1, 3} {
+		if err := os.WriteFile(name(n), []byte{byte('0' + n)}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Shift(3, name); err != nil {
+		t.Fatal("failed to shift:", err)
+	}
+
+	for n, expect := range map[int]string{1: "", 2: "1", 3: ""} {
+		b, err := os.ReadFile(name(n))
+		if expect == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("file %d still exists: %q, %v", n, b, err)
+			}
+			continue
+		}
+		if string(b) != expect {
+			t.Errorf("file %d is %q, expected %q (%v)", n, b, expect, err)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.1.gz")
+
+	if err := Compress(path, strings.NewReader("hello")); err != nil {
+		t.Fatal("failed to compress:", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("invalid gzip:", err)
+	}
+
+	if b, err := io.ReadAll(z); err != nil || string(b) != "hello" {
+		t.Errorf("unexpected contents %q, %v", b, err)
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file was left behind:", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	name := func(n int) string { return filepath.Join(dir, fmt.Sprintf("log.%d.gz", n)) }
+
+	for _, n := range []int{1, 2} {
+		if err := Compress(name(n), strings.NewReader(fmt.Sprint(n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is shifted if compressing fails.
+	if err := Rotate(2, name, iotest.ErrReader(errors.New("disk full"))); err == nil {
+		t.Fatal("expected an error")
+	}
+	expectFiles(t, name, map[int]string{1: "1", 2: "2"})
+
+	if err := Rotate(2, name, strings.NewReader("new")); err != nil {
+		t.Fatal("failed to rotate:", err)
+	}
+	expectFiles(t, name, map[int]string{1: "new", 2: "1", 3: ""})
+
+	if _, err := os.Stat(name(1) + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file was left behind:", err)
+	}
+}
+
+// expectFiles checks the decompressed contents of the files, where an empty
+// string means that the file must not exist.
+func expectFiles(t *testing.T, name func(n int) string, expect map[int]string) {
+	t.Helper()
+
+	for n, contents := range expect {
+		b, err := os.ReadFile(name(n))
+		if contents == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("file %d still exists: %v", n, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("file %d: %v", n, err)
+			continue
+		}
+
+		z, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("file %d: invalid gzip: %v", n, err)
+			continue
+		}
+
+		if b, err := io.ReadAll(z); err != nil || string(b) != contents {
+			t.Errorf("file %d is %q, expected %q (%v)", n, b, contents, err)
+		}
+	}
+}
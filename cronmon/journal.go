@@ -1,6 +1,7 @@
 package cronmon
 
 import (
+	"context"
 	"io"
 	"time"
 
@@ -15,6 +16,41 @@ type Journaler interface {
 	Write(Event) error
 }
 
+// TimedJournaler is a journaler that can also write events with a given time
+// instead of the current time. Journalers that wrap others implement it to pass
+// on the time that the event was first written with, so that all journalers
+// behind them record the same time no matter how late they get the event.
+type TimedJournaler interface {
+	Journaler
+	// WriteAt writes the event into the journaler with the given time.
+	WriteAt(ev Event, t time.Time) error
+}
+
+// WriteAt writes the event into the journaler with the given time if it's a
+// TimedJournaler. Otherwise, the event is written with Write, and the
+// journaler uses its own time.
+func WriteAt(j Journaler, ev Event, t time.Time) error {
+	if tj, ok := j.(TimedJournaler); ok {
+		return tj.WriteAt(ev, t)
+	}
+	return j.Write(ev)
+}
+
+// JournalMiddleware wraps a journaler to add a feature to it, such as filtering
+// or rate limiting events, so that features compose instead of being built
+// into each journaler. The returned journaler should implement TimedJournaler
+// to pass the time of events on. See package journal for the built-in ones.
+type JournalMiddleware func(Journaler) Journaler
+
+// ChainJournaler wraps the journaler with the given middlewares. Events go
+// through the middlewares in the given order before they reach j.
+func ChainJournaler(j Journaler, mws ...JournalMiddleware) Journaler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		j = mws[i](j)
+	}
+	return j
+}
+
 // JournalReader describes a journal reader.
 type JournalReader interface {
 	Read() (Event, time.Time, error)
@@ -26,29 +62,113 @@ type JournalReadWriter interface {
 	JournalReader
 }
 
+// ErrStopReading can be returned by a ReadFunc to stop reading without
+// ReadJournal returning an error.
+var ErrStopReading = errors.New("stop reading")
+
+// ReadFunc is a callback called for each event read from a journal.
+type ReadFunc func(Event, time.Time) error
+
+// ReadJournal reads all events from the JournalReader and calls fn on each of
+// them until the journal is fully consumed, the context is canceled or fn
+// returns an error. Journals are read from newest to oldest. If fn returns
+// ErrStopReading, then nil is returned.
+func ReadJournal(ctx context.Context, r JournalReader, fn ReadFunc) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		event, t, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if err := fn(event, t); err != nil {
+			if errors.Is(err, ErrStopReading) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// ByFile wraps fn to only be called for events of the process with the given
+// file name.
+func ByFile(file string, fn ReadFunc) ReadFunc {
+	return func(ev Event, t time.Time) error {
+		if pev, ok := ev.(ProcessEvent); ok && pev.ProcessFile() == file {
+			return fn(ev, t)
+		}
+		return nil
+	}
+}
+
+// ByType wraps fn to only be called for events of any of the given types.
+func ByType(types []string, fn ReadFunc) ReadFunc {
+	return func(ev Event, t time.Time) error {
+		for _, typ := range types {
+			if ev.Type() == typ {
+				return fn(ev, t)
+			}
+		}
+		return nil
+	}
+}
+
+// Since wraps fn to only be called for events written at or after the given
+// time. Since journals are read from newest to oldest, reading is stopped once
+// an older event is encountered.
+func Since(since time.Time, fn ReadFunc) ReadFunc {
+	return func(ev Event, t time.Time) error {
+		if t.Before(since) {
+			return ErrStopReading
+		}
+		return fn(ev, t)
+	}
+}
+
 // ReadPreviousState reads from the JournalReader the previous state of the
 // cronmon monitor.
 func ReadPreviousState(r JournalReader) (*PreviousState, error) {
 	state := PreviousState{
-		Processes: map[string]int{},
+		Processes:    map[string]int{},
+		Restarts:     map[string]int{},
+		RecentSpawns: map[string][]time.Time{},
+		Flapping:     map[string]float64{},
 	}
 	hasQuit := false
+	hasAcquired := false
 	deleted := map[int]struct{}{}
 
-	for {
-		event, time, err := r.Read()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil, io.ErrUnexpectedEOF
+	var newest time.Time
+
+	err := ReadJournal(context.Background(), r, func(event Event, time time.Time) error {
+		if newest.IsZero() {
+			newest = time
+		}
+
+		// Keep collecting spawns past the previous monitor's start for the
+		// flapping scores, but only until the flapping window.
+		if hasAcquired {
+			if time.Before(newest.Add(-FlapWindow)) {
+				return ErrStopReading
+			}
+
+			if data, ok := event.(*EventProcessSpawned); ok {
+				state.RecentSpawns[data.File] = append(state.RecentSpawns[data.File], time)
 			}
 
-			return nil, err
+			return nil
 		}
 
 		switch data := event.(type) {
 		case *EventAcquired:
 			state.StartedAt = time
-			return &state, nil
+			hasAcquired = true
 
 		case *EventQuit:
 			hasQuit = true
@@ -56,7 +176,28 @@ func ReadPreviousState(r JournalReader) (*PreviousState, error) {
 		case *EventProcessExited:
 			deleted[data.PID] = struct{}{}
 
+		case *EventStatsSnapshot:
+			for file, restarts := range data.Restarts {
+				if _, ok := state.Restarts[file]; !ok {
+					state.Restarts[file] = restarts
+				}
+			}
+
+		case *EventStatsReset:
+			if _, ok := state.Restarts[data.File]; !ok {
+				state.Restarts[data.File] = 0
+			}
+
 		case *EventProcessSpawned:
+			if !time.Before(newest.Add(-FlapWindow)) {
+				state.RecentSpawns[data.File] = append(state.RecentSpawns[data.File], time)
+			}
+
+			// The newest spawn has the latest restart counter.
+			if _, ok := state.Restarts[data.File]; !ok {
+				state.Restarts[data.File] = data.Restarts
+			}
+
 			if !hasQuit {
 				// If the process is still alive, then it shouldn't be in the
 				// deleted map, since it'll appear later.
@@ -64,6 +205,31 @@ func ReadPreviousState(r JournalReader) (*PreviousState, error) {
 					state.Processes[data.File] = data.PID
 				}
 			}
+
+		case *EventProcessAdopted:
+			if _, ok := deleted[data.PID]; !ok && !hasQuit {
+				state.Processes[data.File] = data.PID
+			}
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasAcquired {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	for file, spawns := range state.RecentSpawns {
+		// Sort the spawns from oldest to newest.
+		for i, j := 0, len(spawns)-1; i < j; i, j = i+1, j-1 {
+			spawns[i], spawns[j] = spawns[j], spawns[i]
+		}
+
+		state.Flapping[file] = FlapScore(spawns, newest)
 	}
+
+	return &state, nil
 }
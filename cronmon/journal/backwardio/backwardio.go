@@ -0,0 +1,211 @@
+// Package backwardio implements a buffered scanner that scans backwards.
+//
+// Unlike github.com/diamondburned/backwardio, the scanner reads using
+// io.ReaderAt with explicit offsets instead of seeking, so it never touches the
+// underlying file offset. This allows a file to be read while it is being
+// appended to by another writer sharing the same file descriptor.
+package backwardio
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBufferSize is the default initial buffer size of a Scanner.
+const DefaultBufferSize = bufio.MaxScanTokenSize
+
+// Scanner is similar to bufio.Scanner, except things are scanned from the
+// bottom up.
+type Scanner struct {
+	r    io.ReaderAt
+	size func() (int64, error)
+	buf  []byte
+	end  int64 // last read offset, bound size for buf
+
+	bufSize int
+	maxSize int // 0 for unlimited
+}
+
+// NewScanner creates a new backwards scanner that scans the first size bytes of
+// the given reader.
+func NewScanner(r io.ReaderAt, size int64) *Scanner {
+	return &Scanner{
+		r:       r,
+		size:    func() (int64, error) { return size, nil },
+		bufSize: DefaultBufferSize,
+	}
+}
+
+// NewFileScanner creates a new backwards scanner that scans the given file,
+// starting from its size at the time of the first read. The file offset is
+// never changed, so the file can be concurrently written to.
+func NewFileScanner(f *os.File) *Scanner {
+	return &Scanner{
+		r: f,
+		size: func() (int64, error) {
+			s, err := f.Stat()
+			if err != nil {
+				return 0, err
+			}
+			return s.Size(), nil
+		},
+		bufSize: DefaultBufferSize,
+	}
+}
+
+// Buffer sets the initial size of the buffer and the maximum size of a token.
+// Tokens larger than the buffer are read by growing the buffer up to max. If
+// max is 0, then the buffer can grow indefinitely. Buffer must be called before
+// the first read.
+func (r *Scanner) Buffer(size, max int) {
+	if r.buf != nil {
+		panic("Buffer called after reading")
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	r.bufSize = size
+	r.maxSize = max
+}
+
+// SkipPartial skips the trailing data after the last delimiter, such as a
+// partially written line left by a crashed writer. The skipped data is
+// returned, which is empty if the data ends with the delimiter. It must be
+// called before any other read.
+func (r *Scanner) SkipPartial(delim byte) ([]byte, error) {
+	if r.buf != nil {
+		panic("SkipPartial called after reading")
+	}
+
+	// Tokens are terminated by the delimiter before them, so the first token
+	// is always the trailing data.
+	return r.ReadUntil(delim)
+}
+
+// ReadUntil reads from the bottom up until the given delimiter is encountered.
+func (r *Scanner) ReadUntil(delim byte) ([]byte, error) {
+	for {
+		if r.buf == nil {
+			goto fill
+		}
+
+		// Seek backwards the buffer until we find a delimiter.
+		for i := len(r.buf) - 1; i >= 0; i-- {
+			isBOF := i == 0 && r.end == 0
+
+			// If the current byte is not a delimiter AND we have not consumed
+			// the whole reader yet, then skip.
+			if r.buf[i] != delim && !isBOF {
+				continue
+			}
+
+			tok := r.buf[i:]
+			r.buf = r.buf[:i]
+
+			if len(tok) > 0 && tok[0] == delim {
+				tok = tok[1:] // trim prefix delim
+
+				// If this is the beginning of file and we have a prefixing
+				// delimiter, then we should make that its own token. If the
+				// token is already a delimiter, then bail.
+				if isBOF && len(tok) > 0 {
+					r.buf = r.buf[:1]
+				}
+			}
+
+			return tok, nil
+		}
+
+		if len(r.buf) == cap(r.buf) {
+			// At this point, we started from the end of the buffer and read all
+			// the way until the start of the buffer, and we couldn't find the
+			// delimiter. Grow the buffer to chain another fill.
+			if !r.grow() {
+				return nil, bufio.ErrTooLong
+			}
+		}
+
+	fill:
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// grow doubles the capacity of the buffer while keeping its content. False is
+// returned if the buffer is already at its maximum size.
+func (r *Scanner) grow() bool {
+	newCap := cap(r.buf) * 2
+	if r.maxSize > 0 {
+		if cap(r.buf) >= r.maxSize {
+			return false
+		}
+		if newCap > r.maxSize {
+			newCap = r.maxSize
+		}
+	}
+
+	buf := make([]byte, len(r.buf), newCap)
+	copy(buf, r.buf)
+	r.buf = buf
+
+	return true
+}
+
+func (r *Scanner) fill() error {
+	if r.buf == nil {
+		o, err := r.size()
+		if err != nil {
+			return errors.Wrap(err, "failed to find end of file")
+		}
+
+		r.end = o
+		r.buf = make([]byte, 0, r.bufSize)
+	}
+
+	if r.end == 0 {
+		return io.EOF
+	}
+
+	// Try to see how much we can actually read into the buffer.
+	max := int64(cap(r.buf))
+
+	if len(r.buf) > 0 {
+		// Subtract the read bounds by the cursor position, since that end
+		// region is going to be reserved for old data.
+		max -= int64(len(r.buf))
+		// Grow the buffer to its maximum capacity.
+		r.buf = r.buf[:cap(r.buf)]
+		// Copy what we've already read into the end of the buffer.
+		copy(r.buf[max:], r.buf)
+	}
+
+	readAt := r.end - max
+	min := int64(0)
+
+	// If we've reached the start of the file, then what we're about to read
+	// may not fill up all of our buffer. Thus, we need to know the offset
+	// relative to the last read position and use that as the starting bound.
+	if readAt < 0 {
+		readAt = 0
+		min = max - r.end
+	}
+
+	// Read the chunk right before the last read position.
+	_, err := r.r.ReadAt(r.buf[min:max], readAt)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Wrap(err, "failed to read chunk")
+	}
+
+	r.end = readAt
+
+	// Set the buffer to only the valid chunk.
+	r.buf = r.buf[min:cap(r.buf)]
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package backwardio
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	type test struct {
+		name   string
+		input  string
+		output []string
+	}
+
+	var tests = []test{
+		{"enough", "aa\nbb\ncc\ndd\n", []string{"", "dd", "cc", "bb", "aa"}},
+		{"enough both", "\naa\nbb\n", []string{"", "bb", "aa", ""}},
+		{"enough prefix", "\naa\nbb", []string{"bb", "aa", ""}},
+
+		{"short", "a\nb\nc\nd\n", []string{"", "d", "c", "b", "a"}},
+		{"short both", "\na\nb\n", []string{"", "b", "a", ""}},
+		{"short prefix", "\na\nb", []string{"b", "a", ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewScanner(strings.NewReader(test.input), int64(len(test.input)))
+			r.Buffer(3, 0)
+			expectTokens(t, r, test.output)
+
+			_, err := r.ReadUntil('\n')
+			errorEq(t, err, io.EOF)
+		})
+	}
+
+	t.Run("long", func(t *testing.T) {
+		const input = "aaaaaaa\nbbbbb\nc"
+
+		r := NewScanner(strings.NewReader(input), int64(len(input)))
+		r.Buffer(3, 0)
+		expectTokens(t, r, []string{"c", "bbbbb", "aaaaaaa"})
+
+		_, err := r.ReadUntil('\n')
+		errorEq(t, err, io.EOF)
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		const input = "aaaaa\nbbbbb"
+
+		r := NewScanner(strings.NewReader(input), int64(len(input)))
+		r.Buffer(3, 4)
+
+		_, err := r.ReadUntil('\n')
+		errorEq(t, err, bufio.ErrTooLong)
+	})
+
+	t.Run("read error", func(t *testing.T) {
+		failErr := errors.New("custom error")
+
+		r := NewScanner(failReaderAt{failErr}, 10)
+
+		_, err := r.ReadUntil('\n')
+		errorEq(t, err, failErr)
+	})
+}
+
+func TestScannerSkipPartial(t *testing.T) {
+	type test struct {
+		name    string
+		input   string
+		partial string
+		output  []string
+	}
+
+	var tests = []test{
+		{"complete", "aa\nbb\n", "", []string{"bb", "aa"}},
+		{"torn", "aa\nbb\ncc", "cc", []string{"bb", "aa"}},
+		{"torn only", "aa", "aa", nil},
+		{"empty", "", "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewScanner(strings.NewReader(test.input), int64(len(test.input)))
+			r.Buffer(3, 0)
+
+			partial, err := r.SkipPartial('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatal("failed to skip partial:", err)
+			}
+
+			if string(partial) != test.partial {
+				t.Errorf("expected partial %q, got %q", test.partial, partial)
+			}
+
+			expectTokens(t, r, test.output)
+
+			_, err = r.ReadUntil('\n')
+			errorEq(t, err, io.EOF)
+		})
+	}
+}
+
+func TestFileScanner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal("failed to open file:", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString("a\nb\n"); err != nil {
+		t.Fatal("failed to write:", err)
+	}
+
+	r := NewFileScanner(f)
+	expectTokens(t, r, []string{"", "b"})
+
+	// Writing in the middle of reading must not affect the reader, and the
+	// reader must not affect the writer.
+	if _, err := f.WriteString("c\n"); err != nil {
+		t.Fatal("failed to write:", err)
+	}
+
+	expectTokens(t, r, []string{"a"})
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("failed to read file:", err)
+	}
+
+	if string(b) != "a\nb\nc\n" {
+		t.Fatalf("unexpected file content %q", b)
+	}
+}
+
+func BenchmarkFileScanner(b *testing.B) {
+	const size = 64 << 20 // 64 MiB
+
+	f, err := os.Create(filepath.Join(b.TempDir(), "file"))
+	if err != nil {
+		b.Fatal("failed to create file:", err)
+	}
+	defer f.Close()
+
+	// Write lines of typical journal event lengths.
+	line := []byte(strings.Repeat("x", 199) + "\n")
+	w := bufio.NewWriter(f)
+	for n := 0; n < size; n += len(line) {
+		w.Write(line)
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal("failed to write file:", err)
+	}
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := NewFileScanner(f)
+		for {
+			_, err := r.ReadUntil('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal("failed to read:", err)
+			}
+		}
+	}
+}
+
+func expectTokens(t *testing.T, r *Scanner, tokens []string) {
+	t.Helper()
+
+	for _, expect := range tokens {
+		b, err := r.ReadUntil('\n')
+		if err != nil {
+			t.Fatal("failed to read:", err)
+		}
+
+		if s := string(b); s != expect {
+			t.Errorf("expected %q, got %q", expect, s)
+		}
+	}
+}
+
+func errorEq(t *testing.T, got, expect error) {
+	t.Helper()
+
+	if got == nil {
+		t.Fatal("missing error")
+	}
+
+	if !errors.Is(got, expect) {
+		t.Fatal("unexpected error:", got)
+	}
+}
+
+type failReaderAt struct {
+	err error
+}
+
+func (r failReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,138 @@
+package journal
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+// benchEvent is a typical event, which is written every time a script exits.
+var benchEvent = &cronmon.EventProcessExited{
+	File:      "backup.sh",
+	PID:       12345,
+	ExitCode:  1,
+	Error:     "exit status 1",
+	LastWords: "rsync: connection unexpectedly closed (0 bytes received so far)",
+}
+
+func BenchmarkWriter(b *testing.B) {
+	benches := []struct {
+		name      string
+		format    Format
+		monotonic bool
+	}{
+		{"json", FormatJSON, false},
+		{"json monotonic", FormatJSON, true},
+		{"cbor", FormatCBOR, false},
+		{"cbor monotonic", FormatCBOR, true},
+	}
+
+	for _, bench := range benches {
+		b.Run(bench.name, func(b *testing.B) {
+			var n countWriter
+
+			w := NewFormatWriter("bench", &n, bench.format)
+			w.Monotonic = bench.monotonic
+
+			now := time.Now()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteAt(benchEvent, now); err != nil {
+					b.Fatal("failed to write:", err)
+				}
+			}
+
+			b.SetBytes(int64(n) / int64(b.N))
+		})
+	}
+}
+
+// countWriter counts the bytes written into it.
+type countWriter int
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	*w += countWriter(len(b))
+	return len(b), nil
+}
+
+func BenchmarkReader(b *testing.B) {
+	const events = 100000
+
+	for _, format := range []Format{FormatJSON, FormatCBOR} {
+		b.Run(string(format), func(b *testing.B) {
+			var buf bytes.Buffer
+
+			w := NewFormatWriter("bench", &buf, format)
+			now := time.Now()
+			for i := 0; i < events; i++ {
+				w.WriteAt(benchEvent, now)
+			}
+
+			journal := buf.Bytes()
+
+			b.SetBytes(int64(len(journal)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				r := NewReader(bytes.NewReader(journal), int64(len(journal)))
+
+				var n int
+				for {
+					_, _, err := r.Read()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal("failed to read:", err)
+					}
+					n++
+				}
+
+				if n != events {
+					b.Fatalf("read %d events, expected %d", n, events)
+				}
+			}
+		})
+	}
+}
+
+// writerAllocBudget is the most allocations that writing a single event may
+// do, so that allocation regressions in the write path are caught by tests
+// rather than by benchmarks that nobody runs.
+var writerAllocBudget = map[Format]float64{
+	FormatJSON: 2,
+	FormatCBOR: 2,
+}
+
+// raceEnabled is true if the race detector is enabled, which makes sync.Pool
+// drop items at random.
+var raceEnabled bool
+
+func TestWriterAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations aren't predictable with the race detector")
+	}
+
+	for format, budget := range writerAllocBudget {
+		w := NewFormatWriter("test", io.Discard, format)
+		w.Monotonic = true
+
+		now := time.Now()
+
+		allocs := testing.AllocsPerRun(100, func() {
+			w.WriteAt(benchEvent, now)
+		})
+
+		if allocs > budget {
+			t.Errorf("%s: writing an event allocates %v times, over the budget of %v",
+				format, allocs, budget)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// Format is the encoding of the events in a journal file.
+type Format string
+
+const (
+	// FormatJSON writes each event as a line of JSON. It is the default.
+	FormatJSON Format = "json"
+	// FormatCBOR writes each event as a length-framed CBOR record, which is
+	// smaller and faster to encode than JSON, for installations that journal
+	// many events.
+	FormatCBOR Format = "cbor"
+)
+
+// ParseFormat parses the given format name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSON, FormatCBOR:
+		return f, nil
+	default:
+		return "", errors.Errorf("unknown journal format %q", s)
+	}
+}
+
+// FormatForPath returns the format that a new journal at the given path is
+// written in: FormatCBOR if its name ends with ".cbor" and FormatJSON
+// otherwise. Existing journals are always appended to in their own format.
+func FormatForPath(path string) Format {
+	if filepath.Ext(path) == ".cbor" {
+		return FormatCBOR
+	}
+	return FormatJSON
+}
+
+// DetectFormat detects the format of the journal in the first size bytes of
+// the given reader. An empty format is returned if the journal is empty.
+func DetectFormat(r io.ReaderAt, size int64) (Format, error) {
+	if size == 0 {
+		return "", nil
+	}
+
+	var b [1]byte
+	if _, err := r.ReadAt(b[:], 0); err != nil {
+		return "", errors.Wrap(err, "failed to read journal format")
+	}
+
+	if b[0] == binaryMarker {
+		return FormatCBOR, nil
+	}
+	return FormatJSON, nil
+}
+
+// Each CBOR record is framed by a marker byte and its length on both sides,
+// so that it can be read backwards:
+//
+//	0xCB | length (uint32 BE) | CBOR | length (uint32 BE) | 0xCB
+//
+// The marker can never start a JSON journal.
+const (
+	binaryMarker    = 0xCB
+	binaryFrameSize = 5
+)
+
+// binaryEvent is the CBOR structure of an event. Its keys are kept short, since
+// they're repeated in every record.
+type binaryEvent struct {
+	Time int64           `cbor:"t"` // Unix nanoseconds
+	Type string          `cbor:"y"`
+	Data cbor.RawMessage `cbor:"d"`
+	Mono *MonoTime       `cbor:"m,omitempty"`
+	Host *Host           `cbor:"h,omitempty"`
+}
+
+var (
+	binaryEncMode cbor.EncMode
+	binaryDecMode cbor.DecMode
+)
+
+func init() {
+	var err error
+
+	binaryEncMode, err = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	binaryDecMode, err = cbor.DecOptions{}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// binaryEncoder encodes events into framed CBOR records. Its buffers and
+// encoders are reused across events, so it's kept in binaryEncoders.
+type binaryEncoder struct {
+	data     bytes.Buffer
+	dataEnc  *cbor.Encoder
+	frame    bytes.Buffer
+	frameEnc *cbor.Encoder
+	ev       binaryEvent
+	mono     MonoTime
+}
+
+// binaryEncoderMaxSize is the largest buffer size of a binaryEncoder that is
+// put back into binaryEncoders, so that a single large event doesn't keep its
+// memory around.
+const binaryEncoderMaxSize = 64 * 1024
+
+var binaryEncoders = sync.Pool{
+	New: func() interface{} {
+		e := &binaryEncoder{}
+		e.dataEnc = binaryEncMode.NewEncoder(&e.data)
+		e.frameEnc = binaryEncMode.NewEncoder(&e.frame)
+		return e
+	},
+}
+
+// encodeBinary encodes the event into a framed CBOR record and calls fn with
+// it. The record is only valid until fn returns.
+func encodeBinary(
+	ev cronmon.Event, t time.Time, mono *MonoTime, host *Host, fn func([]byte) error) error {
+
+	e := binaryEncoders.Get().(*binaryEncoder)
+	defer e.release()
+
+	if err := e.dataEnc.Encode(ev); err != nil {
+		return err
+	}
+
+	e.ev = binaryEvent{
+		Time: t.UnixNano(),
+		Type: ev.Type(),
+		Data: e.data.Bytes(),
+		Host: host,
+	}
+	if mono != nil {
+		e.mono = *mono
+		e.ev.Mono = &e.mono
+	}
+
+	// Reserve the head of the frame, whose length is only known after
+	// encoding.
+	var head [binaryFrameSize]byte
+	head[0] = binaryMarker
+	e.frame.Write(head[:])
+
+	if err := e.frameEnc.Encode(&e.ev); err != nil {
+		return err
+	}
+
+	length := uint32(e.frame.Len() - binaryFrameSize)
+	binary.BigEndian.PutUint32(e.frame.Bytes()[1:binaryFrameSize], length)
+
+	var tail [binaryFrameSize]byte
+	binary.BigEndian.PutUint32(tail[:], length)
+	tail[binaryFrameSize-1] = binaryMarker
+	e.frame.Write(tail[:])
+
+	return fn(e.frame.Bytes())
+}
+
+// release resets the encoder and puts it back into binaryEncoders.
+func (e *binaryEncoder) release() {
+	e.ev = binaryEvent{}
+	e.mono = MonoTime{}
+
+	if e.data.Cap() > binaryEncoderMaxSize || e.frame.Cap() > binaryEncoderMaxSize {
+		return
+	}
+
+	e.data.Reset()
+	e.frame.Reset()
+	binaryEncoders.Put(e)
+}
+
+// decodeBinary decodes the CBOR payload of a record. Like decodeEvent, it
+// validates the event.
+func decodeBinary(payload []byte) (cronmon.Event, time.Time, *MonoTime, error) {
+	var raw binaryEvent
+
+	if err := binaryDecMode.Unmarshal(payload, &raw); err != nil {
+		return nil, time.Time{}, nil, errors.Wrap(err, "failed to decode CBOR")
+	}
+
+	if raw.Time == 0 {
+		return nil, time.Time{}, nil, errors.New("missing event time")
+	}
+
+	event := cronmon.NewEvent(raw.Type)
+	if event == nil {
+		return nil, time.Time{}, nil, &UnknownEventError{raw.Type}
+	}
+
+	// CBOR maps are major type 5.
+	if len(raw.Data) == 0 || raw.Data[0]>>5 != 5 {
+		return nil, time.Time{}, nil, errors.Errorf("event %q has no data map", raw.Type)
+	}
+
+	if err := binaryDecMode.Unmarshal(raw.Data, event); err != nil {
+		return nil, time.Time{}, nil, errors.Wrapf(err, "failed to decode event %q", raw.Type)
+	}
+
+	if err := cronmon.ValidateEvent(event); err != nil {
+		return nil, time.Time{}, nil, errors.Wrapf(err, "invalid event %q", raw.Type)
+	}
+
+	if raw.Mono != nil && raw.Mono.Session == "" {
+		return nil, time.Time{}, nil, errors.New("monotonic time has no session")
+	}
+
+	return event, time.Unix(0, raw.Time), raw.Mono, nil
+}
+
+// binaryScanner reads framed CBOR records from the bottom up.
+type binaryScanner struct {
+	r   io.ReaderAt
+	end int64  // offset right after the next record to read
+	buf []byte // reused for the payloads
+}
+
+// errBadFrame is returned when a record's frame is inconsistent.
+var errBadFrame = errors.New("corrupted record frame")
+
+// skipPartial sets up the scanner to read the first size bytes and skips the
+// trailing data after the last complete record, such as a partially written
+// record left by a crashed writer. The number of skipped bytes is returned.
+func (s *binaryScanner) skipPartial(size int64) (int64, error) {
+	s.end = size
+
+	// Fast path: the last record is complete.
+	if _, _, err := s.frame(size); err == nil {
+		return 0, nil
+	}
+
+	// Otherwise, find the end of the last complete record from the top.
+	var end int64
+	for end < size {
+		next, err := s.nextFrame(end, size)
+		if err != nil {
+			break
+		}
+		end = next
+	}
+
+	s.end = end
+	return size - end, nil
+}
+
+// nextFrame returns the end offset of the record starting at the given offset.
+func (s *binaryScanner) nextFrame(start, size int64) (int64, error) {
+	var head [binaryFrameSize]byte
+	if _, err := s.r.ReadAt(head[:], start); err != nil {
+		return 0, err
+	}
+
+	if head[0] != binaryMarker {
+		return 0, errBadFrame
+	}
+
+	end := start + int64(binary.BigEndian.Uint32(head[1:])) + 2*binaryFrameSize
+	if end > size {
+		return 0, errBadFrame
+	}
+
+	if _, _, err := s.frame(end); err != nil {
+		return 0, err
+	}
+
+	return end, nil
+}
+
+// frame validates the frame of the record that ends at the given offset and
+// returns the offsets of its payload.
+func (s *binaryScanner) frame(end int64) (start, length int64, err error) {
+	if end < 2*binaryFrameSize {
+		return 0, 0, errBadFrame
+	}
+
+	var tail [binaryFrameSize]byte
+	if _, err := s.r.ReadAt(tail[:], end-binaryFrameSize); err != nil {
+		return 0, 0, err
+	}
+
+	if tail[binaryFrameSize-1] != binaryMarker {
+		return 0, 0, errBadFrame
+	}
+
+	length = int64(binary.BigEndian.Uint32(tail[:]))
+	start = end - length - 2*binaryFrameSize
+	if start < 0 {
+		return 0, 0, errBadFrame
+	}
+
+	var head [binaryFrameSize]byte
+	if _, err := s.r.ReadAt(head[:], start); err != nil {
+		return 0, 0, err
+	}
+
+	if head[0] != binaryMarker || int64(binary.BigEndian.Uint32(head[1:])) != length {
+		return 0, 0, errBadFrame
+	}
+
+	return start, length, nil
+}
+
+// read reads the payload of the next record from the bottom up. An EOF error
+// is returned once all records have been read. The payload is only valid until
+// the next read.
+func (s *binaryScanner) read() ([]byte, error) {
+	if s.end == 0 {
+		return nil, io.EOF
+	}
+
+	start, length, err := s.frame(s.end)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read record ending at %d", s.end)
+	}
+
+	if int64(cap(s.buf)) < length {
+		s.buf = make([]byte, length)
+	}
+
+	payload := s.buf[:length]
+	if _, err := s.r.ReadAt(payload, start+binaryFrameSize); err != nil {
+		return nil, errors.Wrapf(err, "failed to read record ending at %d", s.end)
+	}
+
+	s.end = start
+	return payload, nil
+}
@@ -0,0 +1,110 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// UnknownEventError is returned when decoding an event of a type that this
+// version of cronmon doesn't know, such as one written by a newer version.
+type UnknownEventError struct {
+	Type string
+}
+
+func (err *UnknownEventError) Error() string {
+	return fmt.Sprintf("unknown event %q", err.Type)
+}
+
+// rawEvent is the undecoded JSON structure of a written Event.
+type rawEvent struct {
+	Time time.Time       `json:"time"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	Mono *MonoTime       `json:"mono"`
+	Host *Host           `json:"host"`
+}
+
+// DecodeEvent decodes a single line written by Writer into its event and time.
+// The line is validated with cronmon.ValidateEvent, and an error is returned
+// for any malformed line instead of a partially decoded event.
+//
+// Unknown fields are ignored, so that events written by newer versions of
+// cronmon, which may add fields, can still be read. Use DecodeEventStrict to
+// reject them instead.
+func DecodeEvent(line []byte) (cronmon.Event, time.Time, error) {
+	ev, t, _, err := decodeEvent(line, false)
+	return ev, t, err
+}
+
+// DecodeEventStrict is like DecodeEvent, except that fields unknown to this
+// version of cronmon are rejected.
+func DecodeEventStrict(line []byte) (cronmon.Event, time.Time, error) {
+	ev, t, _, err := decodeEvent(line, true)
+	return ev, t, err
+}
+
+func decodeEvent(line []byte, strict bool) (cronmon.Event, time.Time, *MonoTime, error) {
+	var raw rawEvent
+
+	if err := unmarshalJSON(line, &raw, strict); err != nil {
+		return nil, time.Time{}, nil, errors.Wrap(err, "failed to decode JSON")
+	}
+
+	if raw.Time.IsZero() {
+		return nil, time.Time{}, nil, errors.New("missing event time")
+	}
+
+	event := cronmon.NewEvent(raw.Type)
+	if event == nil {
+		return nil, time.Time{}, nil, &UnknownEventError{raw.Type}
+	}
+
+	// Unmarshaling null into the event would silently leave it zero.
+	data := bytes.TrimSpace(raw.Data)
+	if len(data) == 0 || data[0] != '{' {
+		return nil, time.Time{}, nil, fmt.Errorf("event %q has no data object", raw.Type)
+	}
+
+	if err := unmarshalJSON(data, event, strict); err != nil {
+		return nil, time.Time{}, nil, errors.Wrapf(err, "failed to decode event %q", raw.Type)
+	}
+
+	if err := cronmon.ValidateEvent(event); err != nil {
+		return nil, time.Time{}, nil, errors.Wrapf(err, "invalid event %q", raw.Type)
+	}
+
+	if raw.Mono != nil && raw.Mono.Session == "" {
+		return nil, time.Time{}, nil, errors.New("monotonic time has no session")
+	}
+
+	return event, raw.Time, raw.Mono, nil
+}
+
+// unmarshalJSON unmarshals b into v. If strict is true, then unknown fields are
+// rejected.
+func unmarshalJSON(b []byte, v interface{}, strict bool) error {
+	if !strict {
+		return json.Unmarshal(b, v)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	// Decode stops after the first value, but Unmarshal rejects anything after
+	// it, so do the same.
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+
+	return nil
+}
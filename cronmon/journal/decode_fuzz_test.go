@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+package journal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+func FuzzDecodeEvent(f *testing.F) {
+	var buf bytes.Buffer
+	w := NewWriter("fuzz", &buf)
+	w.Monotonic = true
+	w.Write(&cronmon.EventAcquired{JournalID: "fuzz"})
+	w.Write(&cronmon.EventProcessSpawned{File: "a", PID: 1, Hash: "abc"})
+	w.Write(&cronmon.EventProcessExited{File: "a", PID: 1, ExitCode: -1})
+	w.Write(&cronmon.EventProcessListModify{Op: cronmon.ProcessListAdd, File: "a"})
+	w.Write(&cronmon.EventProcessReported{File: "a", PID: 1, Data: []byte(`{"a":[1,2]}`)})
+	w.Write(&cronmon.EventRepeated{
+		Event: "warning",
+		Data:  []byte(`{"component":"a","error":"b"}`),
+		Count: 2,
+		First: time.Unix(1, 0),
+		Last:  time.Unix(2, 0),
+	})
+	w.Write(&cronmon.EventStatsSnapshot{Restarts: map[string]int{"a": 1}})
+
+	for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+		f.Add(line)
+	}
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		ev, _, err := DecodeEvent(line)
+		if err != nil {
+			if ev != nil {
+				t.Fatal("event returned with error:", err)
+			}
+			return
+		}
+
+		// Anything that decodes must survive being written and read back.
+		var buf bytes.Buffer
+		if err := NewWriter("fuzz", &buf).Write(ev); err != nil {
+			return
+		}
+
+		if _, _, err := DecodeEvent(bytes.TrimSpace(buf.Bytes())); err != nil {
+			t.Fatalf("rewritten event %q failed to decode: %v", buf.Bytes(), err)
+		}
+	})
+}
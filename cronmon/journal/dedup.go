@@ -0,0 +1,126 @@
+package journal
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+// DedupFlushInterval is the default interval after which an ongoing run of
+// identical events is summarized. See DedupJournaler.
+var DedupFlushInterval = time.Minute
+
+// DedupJournaler is a journaler that collapses runs of identical events, which
+// are events with the same type and data, to protect the journal from
+// pathological loops. The first event of a run is written as-is, and the rest
+// are summarized into a single EventRepeated once a different event is written,
+// once FlushInterval has passed since the first repeat, or once Flush is
+// called.
+type DedupJournaler struct {
+	// FlushInterval is the longest time that repeated events are held before
+	// they're summarized. It must not be changed after the first Write. See
+	// DedupFlushInterval.
+	FlushInterval time.Duration
+
+	j cronmon.Journaler
+
+	mutex   sync.Mutex
+	key     string // type and data of the last event
+	last    cronmon.Event
+	repeats int
+	first   time.Time
+	latest  time.Time
+	timer   *time.Timer
+}
+
+var _ cronmon.Journaler = (*DedupJournaler)(nil)
+
+// NewDedupJournaler creates a new DedupJournaler that writes into j.
+func NewDedupJournaler(j cronmon.Journaler) *DedupJournaler {
+	return &DedupJournaler{
+		FlushInterval: DedupFlushInterval,
+		j:             j,
+	}
+}
+
+// ID returns the ID of the underlying journaler prefixed with "dedup:".
+func (d *DedupJournaler) ID() string {
+	return "dedup:" + d.j.ID()
+}
+
+// Write writes the event unless it's identical to the last event, in which case
+// it's counted to be summarized later.
+func (d *DedupJournaler) Write(ev cronmon.Event) error {
+	return d.WriteAt(ev, time.Now())
+}
+
+// WriteAt writes the event like Write with the given time instead of the
+// current time.
+func (d *DedupJournaler) WriteAt(ev cronmon.Event, now time.Time) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		// Events that can't be compared are never deduplicated.
+		b = nil
+	}
+
+	key := ev.Type() + "\x00" + string(b)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if b != nil && key == d.key {
+		if d.repeats == 0 {
+			d.first = now
+			d.timer = time.AfterFunc(d.FlushInterval, func() { d.Flush() })
+		}
+		d.repeats++
+		d.latest = now
+		return nil
+	}
+
+	flushErr := d.flush()
+
+	d.key = key
+	d.last = ev
+
+	if err := cronmon.WriteAt(d.j, ev, now); err != nil {
+		return err
+	}
+
+	return flushErr
+}
+
+// Flush writes the summary of the current run of repeated events, if any.
+func (d *DedupJournaler) Flush() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.flush()
+}
+
+func (d *DedupJournaler) flush() error {
+	if d.repeats == 0 {
+		return nil
+	}
+
+	d.timer.Stop()
+	d.timer = nil
+
+	data, _ := json.Marshal(d.last)
+
+	repeated := &cronmon.EventRepeated{
+		Event: d.last.Type(),
+		Data:  data,
+		Count: d.repeats,
+		First: d.first,
+		Last:  d.latest,
+	}
+	if pev, ok := d.last.(cronmon.ProcessEvent); ok {
+		repeated.File = pev.ProcessFile()
+	}
+
+	d.repeats = 0
+	return d.j.Write(repeated)
+}
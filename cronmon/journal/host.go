@@ -0,0 +1,73 @@
+package journal
+
+import (
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// modulePath is the path of cronmon's module, whose version is reported in
+// Host.Version.
+const modulePath = "git.unix.lgbt/diamondburned/cronmon"
+
+// Host describes the host and the cronmon instance that wrote an event. It is
+// written alongside the event rather than in it, so that multi-host aggregation
+// backends can tell journals apart without every event having these fields.
+type Host struct {
+	Hostname string `json:"hostname,omitempty"`
+	// Instance is the name of the cronmon instance, which tells several
+	// instances on the same host apart.
+	Instance string `json:"instance,omitempty"`
+	// BootID is the random ID of the host's current boot, so that events
+	// written before and after a reboot can be told apart.
+	BootID string `json:"boot_id,omitempty"`
+	// Version is the version of cronmon that wrote the event.
+	Version string `json:"version,omitempty"`
+}
+
+// CurrentHost returns the Host of this process with the given instance name.
+// Fields that can't be determined are left empty.
+func CurrentHost(instance string) *Host {
+	hostname, _ := os.Hostname()
+
+	return &Host{
+		Hostname: hostname,
+		Instance: instance,
+		BootID:   bootID(),
+		Version:  version(),
+	}
+}
+
+// bootID returns the boot ID of the host on Linux, or an empty string
+// elsewhere.
+func bootID() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// version returns the version of cronmon that is built into the binary, which
+// may be "(devel)" if it was built from a checkout.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+
+	return ""
+}
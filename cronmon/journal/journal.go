@@ -5,76 +5,19 @@ package journal
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"git.unix.lgbt/diamondburned/cronmon/cronmon"
-	"github.com/diamondburned/backwardio"
-	"github.com/gofrs/flock"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal/backwardio"
 	"github.com/pkg/errors"
 )
 
-// multiWriter combines multiple journalers.
-type multiWriter struct {
-	id      string
-	writers []cronmon.Journaler
-}
-
-// MultiWriter creates a journaler that writes to multiple other journalers. The
-// passed in ID is the one used for the new journaler.
-func MultiWriter(ws ...cronmon.Journaler) cronmon.Journaler {
-	return wrapMultiWriter(ws...)
-}
-
-func wrapMultiWriter(ws ...cronmon.Journaler) *multiWriter {
-	id := strings.Builder{}
-	id.Grow(256)
-
-	for i, w := range ws {
-		id.WriteString(w.ID())
-
-		if i != len(ws)-1 {
-			id.WriteByte('+')
-		}
-	}
-
-	return &multiWriter{id.String(), ws}
-}
-
-func (w *multiWriter) ID() string { return w.id }
-
-func (w *multiWriter) Write(event cronmon.Event) error {
-	var firstErr error
-	for _, writer := range w.writers {
-		if err := writer.Write(event); err != nil && firstErr == nil {
-			firstErr = err
-		}
-	}
-
-	return firstErr
-}
-
-type multiReadWriter struct {
-	multiWriter
-	cronmon.JournalReader
-}
-
-// MultiReadWriter creates a journaler that writes to multiple other journalers
-// but reads from a single journaler. The new journaler makes no guarantee that
-// the reader will read only once all writers are done, so caller should not
-// assume that.
-func MultiReadWriter(
-	r cronmon.JournalReadWriter, ws ...cronmon.Journaler) cronmon.JournalReadWriter {
-
-	return &multiReadWriter{
-		multiWriter:   *wrapMultiWriter(append([]cronmon.Journaler{r}, ws...)...),
-		JournalReader: r,
-	}
-}
-
 // FileLockJournaler is a journaler that uses a file lock (flock) to lock the
 // given file and writes to it. The FileLockJournaler instance must be closed by
 // the caller or by the operating system when the application exits.
@@ -83,17 +26,92 @@ func MultiReadWriter(
 //
 // The caller does not need to acquire a file lock in order to read the written
 // journal, as each Write operation performed on the file is guaranteed to
-// always be valid and atomic.
+// always be valid and atomic. The embedded Reader reads the file using explicit
+// offsets, so it can safely be used while the journaler is being written to.
 //
 // To read the log, simply use Reader, which is implemented with a line reader
 // and a known index to point to the last known length of the file.
+//
+// Full Disk
+//
+// If a write fails because the disk is full, the partially written event is
+// truncated off, and the event is kept in an in-memory ring buffer of
+// FullDiskBufferSize events instead. Each subsequent write attempts to flush the
+// buffer into the file first, after which an EventLogTruncated is written to
+// describe the backfill and the number of events that were lost, if any.
+//
+// Syncing
+//
+// By default, each event is synced to disk before Write returns. Since that
+// slows down writes on spinning disks, a laxer SyncPolicy can be set with
+// SetSyncPolicy.
 type FileLockJournaler struct {
 	Writer
 	Reader
-	f *os.File
-	l *flock.Flock
+	f    *os.File
+	l    Locker
+	path string
+
+	wmut       sync.Mutex
+	pending    *cronmon.RingJournal // non-nil if the disk is full
+	backfilled int
+
+	sync      SyncPolicy
+	syncTimer *time.Timer // non-nil if a sync is scheduled
+	dirty     bool        // true if there are unsynced writes
+}
+
+// SyncPolicy determines when FileLockJournaler syncs written events to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs every event before Write returns. It is the default.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs written events at most SyncEvery after they're
+	// written, so at most that much of the journal is lost on a power loss.
+	SyncInterval SyncPolicy = "interval"
+	// SyncCritical syncs only after critical events, which are the events that
+	// the statistics of the next cronmon are restored from, such as spawns and
+	// exits. Other events are synced along with the next critical event.
+	SyncCritical SyncPolicy = "critical"
+)
+
+// SyncEvery is how long written events may stay unsynced with SyncInterval.
+var SyncEvery = time.Second
+
+// ParseSyncPolicy parses the given sync policy name.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncCritical:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown sync policy %q", s)
+	}
 }
 
+// isCritical returns true if the event is synced right away with SyncCritical.
+func isCritical(ev cronmon.Event) bool {
+	switch ev.(type) {
+	case
+		*cronmon.EventAcquired,
+		*cronmon.EventQuit,
+		*cronmon.EventLogTruncated,
+		*cronmon.EventLockStolen,
+		*cronmon.EventProcessSpawned,
+		*cronmon.EventProcessExited,
+		*cronmon.EventProcessSpawnFailing,
+		*cronmon.EventStatsSnapshot,
+		*cronmon.EventStatsReset:
+		return true
+	default:
+		return false
+	}
+}
+
+// FullDiskBufferSize is the number of events that FileLockJournaler keeps in
+// memory while the disk is full.
+var FullDiskBufferSize = 1024
+
 // ErrLockedElsewhere is returned if NewFileLockJournaler can't acquire the file
 // lock.
 var ErrLockedElsewhere = errors.New("file already locked elsewhere")
@@ -101,53 +119,317 @@ var ErrLockedElsewhere = errors.New("file already locked elsewhere")
 // NewFileLockJournaler creates a new file journaler if it can acquire a flock
 // on the path. It returns an error if it fails to acquire the lock.
 func NewFileLockJournaler(path string) (*FileLockJournaler, error) {
-	return newFileLockJournaler(nil, path)
+	return newFileLockJournaler(nil, path, NewFileLocker(path))
 }
 
 // NewFileLockJournalerWait creates a new file journaler but waits until the
 // lock can be acquired or until the context times out.
 func NewFileLockJournalerWait(ctx context.Context, path string) (*FileLockJournaler, error) {
-	return newFileLockJournaler(ctx, path)
+	return newFileLockJournaler(ctx, path, NewFileLocker(path))
 }
 
-func newFileLockJournaler(ctx context.Context, path string) (*FileLockJournaler, error) {
+// NewLockedJournaler creates a new file journaler like NewFileLockJournaler,
+// except the given locker is used instead of a flock on the path.
+func NewLockedJournaler(path string, l Locker) (*FileLockJournaler, error) {
+	return newFileLockJournaler(nil, path, l)
+}
+
+func newFileLockJournaler(ctx context.Context, path string, l Locker) (*FileLockJournaler, error) {
 	// Ensure the directory exists.
 	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
 		return nil, errors.Wrap(err, "failed to create journal directory")
 	}
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0600)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open file")
 	}
 
-	l := flock.New(path)
-
-	var locked bool
+	locked := true
 	if ctx != nil {
-		locked, err = l.TryLockContext(ctx, 25*time.Millisecond)
+		err = LockWait(ctx, l)
 	} else {
 		locked, err = l.TryLock()
 	}
 
 	if err != nil {
+		f.Close()
 		return nil, errors.Wrap(err, "failed to acquire lock")
 	}
 
 	if !locked {
+		f.Close()
 		return nil, ErrLockedElsewhere
 	}
 
-	return &FileLockJournaler{
-		Writer: Writer{json.NewEncoder(f), "file:" + path},
-		Reader: Reader{backwardio.NewScanner(f)},
+	format, err := fileFormat(f, path)
+	if err != nil {
+		f.Close()
+		l.Unlock()
+		return nil, err
+	}
+
+	j := &FileLockJournaler{
+		Writer: newWriter("file:"+path, f, format),
+		Reader: *NewFileReader(f),
 		f:      f,
 		l:      l,
-	}, nil
+		path:   path,
+	}
+
+	if err := j.repairTornWrite(); err != nil {
+		j.Close()
+		return nil, errors.Wrap(err, "failed to repair journal")
+	}
+
+	return j, nil
+}
+
+// fileFormat returns the format of the journal file: the detected format if
+// the file has any records, or the format for its path otherwise.
+func fileFormat(f *os.File, path string) (Format, error) {
+	size, err := fileSize(f)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to stat journal")
+	}
+
+	format, err := DetectFormat(f, size)
+	if err != nil {
+		return "", err
+	}
+
+	if format == "" {
+		format = FormatForPath(path)
+	}
+
+	return format, nil
+}
+
+// repairTornWrite truncates off the partially written record at the end of the
+// file, if any, so that new records aren't appended onto it.
+func (f *FileLockJournaler) repairTornWrite() error {
+	size, err := fileSize(f.f)
+	if err != nil {
+		return err
+	}
+
+	var partial int64
+
+	if f.Writer.Format() == FormatCBOR {
+		partial, err = (&binaryScanner{r: f.f}).skipPartial(size)
+		if err != nil {
+			return err
+		}
+	} else {
+		tail, err := backwardio.NewFileScanner(f.f).SkipPartial('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		partial = int64(len(tail))
+	}
+
+	if partial == 0 {
+		return nil
+	}
+
+	if err := f.f.Truncate(size - partial); err != nil {
+		return err
+	}
+
+	return f.Write(&cronmon.EventLogTruncated{
+		Reason: fmt.Sprintf("skipped %d bytes of a partial record from a crashed writer", partial),
+	})
+}
+
+// Write writes the given event into the file. If the disk is full, then the
+// event is buffered in memory, and nil is returned.
+func (f *FileLockJournaler) Write(ev cronmon.Event) error {
+	return f.WriteAt(ev, time.Now())
+}
+
+// WriteAt writes the given event into the file like Write with the given time
+// instead of the current time.
+func (f *FileLockJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+
+	return f.writeLocked(ev, t)
+}
+
+// writeLocked writes the given event like WriteAt. The caller must hold wmut.
+func (f *FileLockJournaler) writeLocked(ev cronmon.Event, t time.Time) error {
+	if f.pending != nil {
+		f.pending.WriteAt(ev, t)
+		return f.flushPending()
+	}
+
+	err := f.writeRecord(record{t, ev})
+	if err != nil && errors.Is(err, syscall.ENOSPC) {
+		f.pending = cronmon.NewRingJournal(FullDiskBufferSize)
+		f.pending.WriteAt(ev, t)
+		return nil
+	}
+
+	return err
+}
+
+// flushPending tries to flush the pending events into the file. If the disk is
+// still full, then nil is returned, and the events are kept.
+func (f *FileLockJournaler) flushPending() error {
+	for {
+		entry, ok := f.pending.Peek()
+		if !ok {
+			break
+		}
+
+		if err := f.writeRecord(record{entry.Time, entry.Event}); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				return nil
+			}
+			return err
+		}
+
+		f.pending.Pop()
+		f.backfilled++
+	}
+
+	backfilled := f.backfilled
+	dropped := f.pending.Dropped()
+
+	f.pending = nil
+	f.backfilled = 0
+
+	return f.writeRecord(record{time.Now(), &cronmon.EventLogTruncated{
+		Reason: fmt.Sprintf(
+			"disk was full: backfilled %d buffered events, dropped %d events",
+			backfilled, dropped,
+		),
+	}})
+}
+
+// record is a journal event along with the time that it was written.
+type record struct {
+	time  time.Time
+	event cronmon.Event
+}
+
+// writeRecord writes the record into the file and syncs it according to the
+// sync policy. If the write fails, the file is truncated back to its previous
+// size to drop any partially written data.
+func (f *FileLockJournaler) writeRecord(rec record) error {
+	s, err := f.f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat journal")
+	}
+
+	if err := f.Writer.WriteAt(rec.event, rec.time); err != nil {
+		f.f.Truncate(s.Size())
+		return err
+	}
+
+	f.dirty = true
+
+	switch f.sync {
+	case SyncInterval:
+		if f.syncTimer == nil {
+			f.syncTimer = time.AfterFunc(SyncEvery, f.syncScheduled)
+		}
+		return nil
+	case SyncCritical:
+		if !isCritical(rec.event) {
+			return nil
+		}
+	}
+
+	// Like a failed write, drop the record if it can't be synced, so that it
+	// can be buffered if the disk is full.
+	if err := f.syncLocked(); err != nil {
+		f.f.Truncate(s.Size())
+		return err
+	}
+
+	return nil
+}
+
+// SetSyncPolicy sets when written events are synced to disk. Any unsynced
+// events are synced first.
+func (f *FileLockJournaler) SetSyncPolicy(p SyncPolicy) error {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+
+	f.sync = p
+	return f.syncLocked()
 }
 
-// Close closes the file and releases the flock.
+// Sync syncs all written events to disk.
+func (f *FileLockJournaler) Sync() error {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+
+	return f.syncLocked()
+}
+
+func (f *FileLockJournaler) syncScheduled() {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+
+	f.syncTimer = nil
+	f.syncLocked()
+}
+
+func (f *FileLockJournaler) syncLocked() error {
+	if f.syncTimer != nil {
+		f.syncTimer.Stop()
+		f.syncTimer = nil
+	}
+
+	if !f.dirty {
+		return nil
+	}
+
+	if err := f.f.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync journal")
+	}
+
+	f.dirty = false
+	return nil
+}
+
+// Rotate compresses the current journal into a new rotated segment, keeping at
+// most keep segments, and then truncates the journal. Use SegmentReader to read
+// across the rotated segments. Events buffered while the disk is full are
+// flushed into the journal before it's rotated, if they can be.
+func (f *FileLockJournaler) Rotate(keep int) error {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+
+	if f.pending != nil {
+		if err := f.flushPending(); err != nil {
+			return err
+		}
+	}
+
+	if err := rotateSegments(f.f, f.path, keep); err != nil {
+		return err
+	}
+
+	if err := f.f.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate journal")
+	}
+
+	// The events that are still buffered are written after the rotated ones.
+	return f.writeLocked(&cronmon.EventLogTruncated{Reason: "journal rotated"}, time.Now())
+}
+
+// Close syncs and closes the file and releases the flock.
 func (f *FileLockJournaler) Close() error {
+	f.wmut.Lock()
+	f.syncLocked()
+	f.wmut.Unlock()
+
 	f.f.Close()
 	return f.l.Unlock()
 }
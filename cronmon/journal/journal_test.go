@@ -0,0 +1,1284 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+func TestReaderTornWrite(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := NewWriter("test", &buf)
+	w.Write(&cronmon.EventAcquired{JournalID: "test"})
+	w.Write(&cronmon.EventProcessSpawned{File: "a", PID: 1})
+
+	// Simulate a crash halfway through writing an event.
+	full := buf.String()
+	w.Write(&cronmon.EventProcessExited{File: "a", PID: 1})
+	all := buf.String()
+	torn := all[:len(full)+(len(all)-len(full))/2]
+
+	r := NewReader(strings.NewReader(torn), int64(len(torn)))
+
+	events := readEvents(t, r)
+	expectEvents(t, events, []cronmon.Event{
+		&cronmon.EventProcessSpawned{File: "a", PID: 1},
+		&cronmon.EventAcquired{JournalID: "test"},
+	})
+
+	if !r.SkippedPartial() {
+		t.Error("reader did not report the skipped partial record")
+	}
+}
+
+func TestFileLockJournalerTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to create journaler:", err)
+	}
+
+	j.Write(&cronmon.EventAcquired{JournalID: j.ID()})
+	j.Close()
+
+	// Simulate a crash halfway through writing an event.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	f.WriteString(`{"time":"2021-04-01T00:00:00Z","type":"proc`)
+	f.Close()
+
+	j, err = NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to reopen journaler:", err)
+	}
+	defer j.Close()
+
+	j.Write(&cronmon.EventQuit{})
+
+	events := readEvents(t, &j.Reader)
+	if len(events) != 3 {
+		t.Fatalf("unexpected events %#v", events)
+	}
+
+	if _, ok := events[1].(*cronmon.EventLogTruncated); !ok {
+		t.Errorf("expected log truncated event, got %#v", events[1])
+	}
+
+	if j.SkippedPartial() {
+		t.Error("reader unexpectedly skipped a partial record after repair")
+	}
+}
+
+func TestSegmentReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to create journaler:", err)
+	}
+	defer j.Close()
+
+	for i := 1; i <= 3; i++ {
+		j.Write(&cronmon.EventProcessSpawned{File: "a", PID: i})
+
+		if err := j.Rotate(2); err != nil {
+			t.Fatal("failed to rotate:", err)
+		}
+	}
+
+	j.Write(&cronmon.EventProcessSpawned{File: "a", PID: 4})
+
+	r, err := NewSegmentReader(path)
+	if err != nil {
+		t.Fatal("failed to create segment reader:", err)
+	}
+	defer r.Close()
+
+	var pids []int
+
+	err = cronmon.ReadJournal(context.Background(), r, cronmon.ByType(
+		[]string{(*cronmon.EventProcessSpawned)(nil).Type()},
+		func(ev cronmon.Event, _ time.Time) error {
+			pids = append(pids, ev.(*cronmon.EventProcessSpawned).PID)
+			return nil
+		},
+	))
+	if err != nil {
+		t.Fatal("failed to read segments:", err)
+	}
+
+	// The first segment should've been deleted.
+	if !reflect.DeepEqual(pids, []int{4, 3, 2}) {
+		t.Fatalf("unexpected PIDs read: %v", pids)
+	}
+}
+
+func readEvents(t *testing.T, r *Reader) []cronmon.Event {
+	t.Helper()
+
+	var events []cronmon.Event
+
+	err := r.ReadAll(context.Background(), func(ev cronmon.Event, _ time.Time) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to read journal:", err)
+	}
+
+	return events
+}
+
+func expectEvents(t *testing.T, got, expect []cronmon.Event) {
+	t.Helper()
+
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("unexpected events:\n"+
+			"got      %#v\n"+
+			"expected %#v", got, expect)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state", "journal.json")
+
+	if _, err := OpenReadOnly(path); !os.IsNotExist(err) {
+		t.Fatal("expected not exist error, got", err)
+	}
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Fatal("OpenReadOnly created the journal directory")
+	}
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer j.Close()
+
+	if err := j.Write(&cronmon.EventProcessSpawned{PID: 1, File: "a"}); err != nil {
+		t.Fatal("failed to write:", err)
+	}
+
+	// Reading must work while the lock is held.
+	r, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal("failed to open read-only:", err)
+	}
+	defer r.Close()
+
+	ev, _, err := r.Read()
+	if err != nil {
+		t.Fatal("failed to read:", err)
+	}
+
+	expectEvents(t, []cronmon.Event{ev}, []cronmon.Event{
+		&cronmon.EventProcessSpawned{PID: 1, File: "a"},
+	})
+}
+
+func TestControlActionWithoutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+
+	events := []cronmon.Event{
+		&cronmon.EventAcquired{JournalID: "test"},
+		&cronmon.EventProcessSpawned{PID: 1, File: "a"},
+		&cronmon.EventControlAction{Action: "reconcile"},
+		&cronmon.EventControlAction{Action: "import state", Error: "bad state"},
+	}
+	for _, ev := range events {
+		if err := j.Write(ev); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+	}
+	j.Close()
+
+	r, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal("failed to open read-only:", err)
+	}
+	defer r.Close()
+
+	var got []cronmon.Event
+	for {
+		ev, _, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatal("failed to read:", err)
+		}
+		got = append([]cronmon.Event{ev}, got...)
+	}
+	expectEvents(t, got, events)
+
+	state, err := ReadPreviousStateFromFile(path)
+	if err != nil {
+		t.Fatal("failed to read previous state:", err)
+	}
+	if state.Processes["a"] != 1 {
+		t.Errorf("unexpected previous state %+v", state)
+	}
+
+	if err := cronmon.ValidateEvent(&cronmon.EventControlAction{Action: "restart"}); err == nil {
+		t.Error("expected restart without a file to be invalid")
+	}
+}
+
+func TestSplitJournaler(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.json")
+	splitDir := filepath.Join(dir, "journal.d")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+
+	split, err := NewSplitJournaler(j, splitDir)
+	if err != nil {
+		t.Fatal("failed to create split journal:", err)
+	}
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []cronmon.Event{
+		&cronmon.EventAcquired{JournalID: "test"},
+		&cronmon.EventProcessSpawned{PID: 1, File: "a"},
+		&cronmon.EventProcessSpawned{PID: 2, File: "b"},
+		&cronmon.EventProcessExited{PID: 1, File: "a", ExitCode: 1},
+		&cronmon.EventProcessSpawned{PID: 3, File: "a"},
+		&cronmon.EventControlAction{Action: "reconcile"},
+	}
+
+	for i, ev := range events {
+		if err := split.WriteAt(ev, base.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+	}
+
+	split.Close()
+	j.Close()
+
+	// The index journal must only have the monitor-level events.
+	index, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal("failed to open index:", err)
+	}
+	expectEvents(t, readAllEvents(t, index), []cronmon.Event{
+		&cronmon.EventAcquired{JournalID: "test"},
+		&cronmon.EventControlAction{Action: "reconcile"},
+	})
+	index.Close()
+
+	a, err := OpenReadOnly(SplitJournalPath(splitDir, "a"))
+	if err != nil {
+		t.Fatal("failed to open process journal:", err)
+	}
+	expectEvents(t, readAllEvents(t, a), []cronmon.Event{
+		&cronmon.EventProcessSpawned{PID: 1, File: "a"},
+		&cronmon.EventProcessExited{PID: 1, File: "a", ExitCode: 1},
+		&cronmon.EventProcessSpawned{PID: 3, File: "a"},
+	})
+	a.Close()
+
+	r, err := OpenSplitReadOnly(path, splitDir)
+	if err != nil {
+		t.Fatal("failed to open split journal:", err)
+	}
+	expectEvents(t, readAllEvents(t, r), events)
+	r.Close()
+
+	r, err = OpenSplitReadOnly(path, splitDir)
+	if err != nil {
+		t.Fatal("failed to open split journal:", err)
+	}
+	defer r.Close()
+
+	state, err := cronmon.ReadPreviousState(r)
+	if err != nil {
+		t.Fatal("failed to read previous state:", err)
+	}
+
+	expect := map[string]int{"a": 3, "b": 2}
+	if !reflect.DeepEqual(state.Processes, expect) {
+		t.Errorf("unexpected previous processes %v, expected %v", state.Processes, expect)
+	}
+}
+
+func TestSplitJournalerFormat(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.cbor")
+	splitDir := filepath.Join(dir, "journal.d")
+
+	// b was journaled before the journal was switched to CBOR.
+	if err := os.MkdirAll(splitDir, 0750); err != nil {
+		t.Fatal("failed to create split directory:", err)
+	}
+	b := []byte(`{"type":"process spawned","time":"2021-01-01T00:00:00Z","data":{"pid":1,"file":"b"}}` + "\n")
+	if err := os.WriteFile(SplitJournalPath(splitDir, "b"), b, 0600); err != nil {
+		t.Fatal("failed to write process journal:", err)
+	}
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer j.Close()
+
+	split, err := NewSplitJournaler(j, splitDir)
+	if err != nil {
+		t.Fatal("failed to create split journal:", err)
+	}
+	split.Format = j.Format()
+
+	for _, ev := range []cronmon.Event{
+		&cronmon.EventAcquired{JournalID: "test"},
+		&cronmon.EventProcessSpawned{PID: 2, File: "a"},
+		&cronmon.EventProcessSpawned{PID: 3, File: "b"},
+	} {
+		if err := split.Write(ev); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+	}
+	split.Close()
+
+	for file, expect := range map[string]Format{"a": FormatCBOR, "b": FormatJSON} {
+		f, err := os.Open(SplitJournalPath(splitDir, file))
+		if err != nil {
+			t.Fatal("failed to open process journal:", err)
+		}
+		size, _ := fileSize(f)
+		format, err := DetectFormat(f, size)
+		f.Close()
+
+		if err != nil || format != expect {
+			t.Errorf("journal of %s is in %q (error %v), expected %q", file, format, err, expect)
+		}
+	}
+
+	r, err := OpenSplitReadOnly(path, splitDir)
+	if err != nil {
+		t.Fatal("failed to open split journal:", err)
+	}
+	defer r.Close()
+
+	state, err := cronmon.ReadPreviousState(r)
+	if err != nil {
+		t.Fatal("failed to read previous state:", err)
+	}
+	if expect := map[string]int{"a": 2, "b": 3}; !reflect.DeepEqual(state.Processes, expect) {
+		t.Errorf("unexpected previous processes %v, expected %v", state.Processes, expect)
+	}
+}
+
+// readAllEvents reads all events of the reader and returns them from oldest to
+// newest.
+func readAllEvents(t *testing.T, r cronmon.JournalReader) []cronmon.Event {
+	t.Helper()
+
+	var events []cronmon.Event
+	for {
+		ev, _, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return events
+			}
+			t.Fatal("failed to read:", err)
+		}
+		events = append([]cronmon.Event{ev}, events...)
+	}
+}
+
+func TestStealLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer j.Close()
+
+	if _, err := StealLock(path); !errors.Is(err, ErrLockHolderAlive) {
+		t.Fatal("expected ErrLockHolderAlive stealing a live lock, got", err)
+	}
+
+	// Pretend that the lock is held by a process that has exited.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal("failed to run true:", err)
+	}
+
+	host, _ := os.Hostname()
+	b, _ := json.Marshal(LockInfo{PID: cmd.Process.Pid, Host: host})
+	if err := os.WriteFile(LockInfoPath(path), b, 0600); err != nil {
+		t.Fatal("failed to write lock metadata:", err)
+	}
+
+	// The journal is shared with the readers of the group.
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal("failed to chmod journal:", err)
+	}
+
+	info, err := StealLock(path)
+	if err != nil {
+		t.Fatal("failed to steal lock:", err)
+	}
+	if info == nil || info.PID != cmd.Process.Pid {
+		t.Fatalf("unexpected stolen lock metadata %#v", info)
+	}
+
+	if stat, err := os.Stat(path); err != nil {
+		t.Fatal("failed to stat journal:", err)
+	} else if mode := stat.Mode().Perm(); mode != 0640 {
+		t.Errorf("stolen journal has mode %v, expected -rw-r-----", mode)
+	}
+
+	j2, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to acquire stolen lock:", err)
+	}
+	j2.Close()
+}
+
+func TestFileLocker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	a := NewFileLocker(path)
+	b := NewFileLocker(path)
+
+	if locked, err := a.TryLock(); err != nil || !locked {
+		t.Fatal("a failed to lock:", err)
+	}
+
+	if locked, err := b.TryLock(); err != nil || locked {
+		t.Fatal("b locked a held lock:", err)
+	}
+
+	host, _ := os.Hostname()
+	if holder, err := b.Holder(); err != nil || holder != host+":"+strconv.Itoa(os.Getpid()) {
+		t.Errorf("unexpected holder %q (error %v)", holder, err)
+	}
+
+	if err := a.Unlock(); err != nil {
+		t.Fatal("a failed to unlock:", err)
+	}
+
+	if holder, err := b.Holder(); err != nil || holder != "" {
+		t.Errorf("unexpected holder %q after unlock (error %v)", holder, err)
+	}
+
+	if locked, err := b.TryLock(); err != nil || !locked {
+		t.Fatal("b failed to lock after unlock:", err)
+	}
+	b.Unlock()
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "journal.json")
+
+	j, err := NewFileLockJournaler(src)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer j.Close()
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []cronmon.Event{
+		&cronmon.EventProcessSpawned{PID: 1, File: "a"},
+		&cronmon.EventProcessExited{PID: 1, File: "a", ExitCode: 1},
+		&cronmon.EventProcessSpawned{PID: 2, File: "a"},
+	}
+
+	for i, ev := range events {
+		if err := j.WriteAt(ev, base.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+	}
+
+	r, err := OpenReadOnly(src)
+	if err != nil {
+		t.Fatal("failed to open read-only:", err)
+	}
+	defer r.Close()
+
+	dst, err := NewFileLockJournaler(filepath.Join(dir, "migrated.json"))
+	if err != nil {
+		t.Fatal("failed to open destination:", err)
+	}
+	defer dst.Close()
+
+	n, err := Migrate(context.Background(), r, dst)
+	if err != nil {
+		t.Fatal("failed to migrate:", err)
+	}
+	if n != len(events) {
+		t.Fatalf("migrated %d events, expected %d", n, len(events))
+	}
+
+	var read []cronmon.Event
+	for i := len(events) - 1; i >= 0; i-- {
+		ev, evt, err := dst.Read()
+		if err != nil {
+			t.Fatal("failed to read migrated event:", err)
+		}
+		if want := base.Add(time.Duration(i) * time.Minute); !evt.Equal(want) {
+			t.Errorf("event %d has time %v, expected %v", i, evt, want)
+		}
+		read = append([]cronmon.Event{ev}, read...)
+	}
+
+	expectEvents(t, read, events)
+
+	if _, err := Migrate(context.Background(), r, NewHumanWriter("human", io.Discard)); err != ErrUntimedJournaler {
+		t.Fatal("expected ErrUntimedJournaler, got", err)
+	}
+}
+
+func TestMultiWriterTime(t *testing.T) {
+	ring1 := cronmon.NewRingJournal(10)
+	ring2 := cronmon.NewRingJournal(10)
+	ring3 := cronmon.NewRingJournal(10)
+
+	w := MultiWriter(ring1, NewDedupJournaler(ring2), MultiWriter(ring3))
+	for i := 0; i < 5; i++ {
+		w.Write(&cronmon.EventProcessSpawned{File: "a", PID: i})
+		time.Sleep(time.Millisecond)
+	}
+
+	entries1 := ring1.Snapshot()
+	entries2 := ring2.Snapshot()
+	entries3 := ring3.Snapshot()
+
+	if len(entries1) != 5 || len(entries2) != 5 || len(entries3) != 5 {
+		t.Fatalf("got %d, %d and %d entries, expected 5", len(entries1), len(entries2), len(entries3))
+	}
+
+	for i := range entries1 {
+		if !entries1[i].Time.Equal(entries2[i].Time) || !entries1[i].Time.Equal(entries3[i].Time) {
+			t.Errorf("entry %d has times %v, %v and %v", i,
+				entries1[i].Time, entries2[i].Time, entries3[i].Time)
+		}
+	}
+}
+
+// failJournaler fails every write while its error is set.
+type failJournaler struct {
+	id  string
+	err error
+}
+
+func (j *failJournaler) ID() string                   { return j.id }
+func (j *failJournaler) Write(ev cronmon.Event) error { return j.err }
+
+func TestMultiWriterPolicy(t *testing.T) {
+	errFail := errors.New("fail")
+
+	tests := []struct {
+		policy ErrorPolicy
+		fails  []bool
+		ok     bool
+		wrote  int // into the ring, which is last
+	}{
+		{ErrorAll, []bool{false, false}, true, 1},
+		{ErrorAll, []bool{true, false}, false, 1},
+		{ErrorFailFast, []bool{true, false}, false, 0},
+		{ErrorBestEffort, []bool{true, true}, true, 1},
+		{ErrorQuorum, []bool{true, false}, true, 1},
+		{ErrorQuorum, []bool{true, true}, false, 1},
+	}
+
+	for _, test := range tests {
+		ring := cronmon.NewRingJournal(10)
+
+		var ws []cronmon.Journaler
+		for i, fail := range test.fails {
+			j := &failJournaler{id: fmt.Sprint(i)}
+			if fail {
+				j.err = errFail
+			}
+			ws = append(ws, j)
+		}
+		ws = append(ws, ring)
+
+		w := MultiWriterWithOptions(MultiWriterOptions{Policy: test.policy}, ws...)
+		err := w.Write(&cronmon.EventQuit{})
+
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s %v: got error %v", test.policy, test.fails, err)
+		}
+		if wrote := len(ring.Snapshot()); wrote != test.wrote {
+			t.Errorf("%s %v: ring got %d events, expected %d", test.policy, test.fails, wrote, test.wrote)
+		}
+	}
+}
+
+func TestMultiWriterDisable(t *testing.T) {
+	failing := &failJournaler{id: "failing", err: errors.New("fail")}
+	ring := cronmon.NewRingJournal(10)
+
+	w := MultiWriterWithOptions(MultiWriterOptions{
+		Policy:       ErrorBestEffort,
+		DisableAfter: 2,
+		RetryAfter:   50 * time.Millisecond,
+	}, ring, failing)
+
+	for i := 0; i < 3; i++ {
+		w.Write(&cronmon.EventQuit{})
+	}
+
+	// The third write skips the disabled journaler, so it isn't counted.
+	status := w.Journalers()[1]
+	if !status.Disabled || status.Failures != 2 || status.LastError != "fail" {
+		t.Fatalf("unexpected status of the failing journaler: %#v", status)
+	}
+
+	failing.err = nil
+	time.Sleep(50 * time.Millisecond)
+	w.Write(&cronmon.EventQuit{})
+
+	if status := w.Journalers()[1]; status.Disabled || status.Consecutive != 0 {
+		t.Fatalf("failing journaler wasn't re-enabled: %#v", status)
+	}
+
+	var warnings []string
+	for _, entry := range ring.Snapshot() {
+		if ev, ok := entry.Event.(*cronmon.EventWarning); ok {
+			warnings = append(warnings, ev.Error)
+		}
+	}
+
+	if len(warnings) != 2 ||
+		!strings.Contains(warnings[0], "disabled") ||
+		!strings.Contains(warnings[1], "re-enabled") {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+
+	// The primary journaler gets every event no matter how often it fails.
+	primary := &failJournaler{id: "primary", err: errors.New("disk full")}
+	w = MultiWriterWithOptions(MultiWriterOptions{
+		Policy:       ErrorBestEffort,
+		DisableAfter: 2,
+	}, primary, cronmon.NewRingJournal(10))
+
+	for i := 0; i < 5; i++ {
+		w.Write(&cronmon.EventQuit{})
+	}
+
+	if status := w.Journalers()[0]; status.Disabled || status.Failures != 5 {
+		t.Fatalf("unexpected status of the primary journaler: %#v", status)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ring := cronmon.NewRingJournal(20)
+
+	var metrics JournalMetrics
+
+	j := cronmon.ChainJournaler(ring,
+		metrics.Middleware(),
+		Filter(func(ev cronmon.Event) bool {
+			_, isQuit := ev.(*cronmon.EventQuit)
+			return !isQuit
+		}),
+		Enrich(func(ev cronmon.Event) cronmon.Event {
+			if ev, ok := ev.(*cronmon.EventWarning); ok {
+				cp := *ev
+				cp.Component = "enriched " + cp.Component
+				return &cp
+			}
+			return ev
+		}),
+		RateLimit(2, time.Hour),
+	)
+
+	j.Write(&cronmon.EventQuit{})
+	for i := 0; i < 5; i++ {
+		j.Write(&cronmon.EventWarning{Component: "test", Error: fmt.Sprint(i)})
+	}
+
+	var got []string
+	for _, entry := range ring.Snapshot() {
+		ev := entry.Event.(*cronmon.EventWarning)
+		got = append(got, ev.Component+": "+ev.Error)
+	}
+
+	expect := []string{"enriched test: 0", "enriched test: 1"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got events %q, expected %q", got, expect)
+	}
+
+	written := metrics.Written()
+	if written[(&cronmon.EventQuit{}).Type()] != 1 || written[(&cronmon.EventWarning{}).Type()] != 5 {
+		t.Fatalf("unexpected metrics: %v", written)
+	}
+}
+
+// warningFailJournaler fails the writes of EventWarnings and writes the other
+// events into the ring.
+type warningFailJournaler struct {
+	ring *cronmon.RingJournal
+}
+
+func (j warningFailJournaler) ID() string { return "warning-fail" }
+
+func (j warningFailJournaler) Write(ev cronmon.Event) error {
+	if _, ok := ev.(*cronmon.EventWarning); ok {
+		return errors.New("fail")
+	}
+	return j.ring.Write(ev)
+}
+
+func TestRateLimit(t *testing.T) {
+	ring := cronmon.NewRingJournal(10)
+	j := RateLimit(1, time.Minute)(ring).(cronmon.TimedJournaler)
+
+	start := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		j.WriteAt(&cronmon.EventQuit{}, start.Add(time.Duration(i)*time.Second))
+	}
+	j.WriteAt(&cronmon.EventAcquired{}, start.Add(3*time.Second))
+	j.WriteAt(&cronmon.EventQuit{}, start.Add(2*time.Minute))
+
+	var got []string
+	for _, entry := range ring.Snapshot() {
+		got = append(got, entry.Event.Type())
+		if ev, ok := entry.Event.(*cronmon.EventWarning); ok {
+			if expect := "rate limit dropped 2 monitor quit events"; ev.Error != expect {
+				t.Errorf("got warning %q, expected %q", ev.Error, expect)
+			}
+		}
+	}
+
+	warning := (&cronmon.EventWarning{}).Type()
+	quit := (&cronmon.EventQuit{}).Type()
+	acquired := (&cronmon.EventAcquired{}).Type()
+
+	expect := []string{quit, acquired, warning, quit}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got events %q, expected %q", got, expect)
+	}
+
+	// The event is still written if its warning can't be, but the error is
+	// returned.
+	ring = cronmon.NewRingJournal(10)
+	j = RateLimit(1, time.Minute)(warningFailJournaler{ring}).(cronmon.TimedJournaler)
+
+	j.WriteAt(&cronmon.EventQuit{}, start)
+	j.WriteAt(&cronmon.EventQuit{}, start.Add(time.Second))
+	if err := j.WriteAt(&cronmon.EventQuit{}, start.Add(2*time.Minute)); err == nil {
+		t.Error("expected the error of writing the warning")
+	}
+	if n := len(ring.Snapshot()); n != 2 {
+		t.Errorf("got %d events, expected 2", n)
+	}
+}
+
+func TestFileLockJournalerFullDisk(t *testing.T) {
+	defer func(size int) { FullDiskBufferSize = size }(FullDiskBufferSize)
+	FullDiskBufferSize = 3
+
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to create journaler:", err)
+	}
+	defer j.Close()
+
+	disk := &fullDisk{f: j.f}
+	j.Writer = newWriter(j.ID(), disk, FormatJSON)
+
+	j.Write(&cronmon.EventAcquired{JournalID: "test"})
+
+	disk.full = true
+	for pid := 1; pid <= 3; pid++ {
+		if err := j.Write(&cronmon.EventProcessSpawned{File: "a", PID: pid}); err != nil {
+			t.Fatal("write failed while the disk is full:", err)
+		}
+	}
+
+	// Partial writes are truncated off, so nothing was written since.
+	if events := readEvents(t, NewFileReader(j.f)); len(events) != 1 {
+		t.Fatalf("unexpected events while the disk is full %#v", events)
+	}
+
+	// The buffer overflows and drops the oldest event, and then the buffer
+	// is backfilled once there's space again.
+	disk.full = false
+	if err := j.Write(&cronmon.EventQuit{}); err != nil {
+		t.Fatal("failed to flush the buffer:", err)
+	}
+
+	expectEvents(t, readEvents(t, NewFileReader(j.f)), []cronmon.Event{
+		&cronmon.EventLogTruncated{Reason: "disk was full: backfilled 3 buffered events, dropped 1 events"},
+		&cronmon.EventQuit{},
+		&cronmon.EventProcessSpawned{File: "a", PID: 3},
+		&cronmon.EventProcessSpawned{File: "a", PID: 2},
+		&cronmon.EventAcquired{JournalID: "test"},
+	})
+}
+
+func TestRotateFullDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to create journaler:", err)
+	}
+	defer j.Close()
+
+	disk := &fullDisk{f: j.f}
+	j.Writer = newWriter(j.ID(), disk, FormatJSON)
+
+	j.Write(&cronmon.EventAcquired{JournalID: "test"})
+
+	disk.full = true
+	j.Write(&cronmon.EventProcessSpawned{File: "a", PID: 1})
+	disk.full = false
+
+	// The buffered event is flushed into the rotated segment.
+	if err := j.Rotate(2); err != nil {
+		t.Fatal("failed to rotate:", err)
+	}
+
+	readSegments := func() []cronmon.Event {
+		r, err := NewSegmentReader(path)
+		if err != nil {
+			t.Fatal("failed to create segment reader:", err)
+		}
+		defer r.Close()
+
+		var events []cronmon.Event
+		err = cronmon.ReadJournal(context.Background(), r, func(ev cronmon.Event, _ time.Time) error {
+			events = append(events, ev)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("failed to read segments:", err)
+		}
+		return events
+	}
+
+	expect := []cronmon.Event{
+		&cronmon.EventLogTruncated{Reason: "journal rotated"},
+		&cronmon.EventLogTruncated{Reason: "disk was full: backfilled 1 buffered events, dropped 0 events"},
+		&cronmon.EventProcessSpawned{File: "a", PID: 1},
+		&cronmon.EventAcquired{JournalID: "test"},
+	}
+	expectEvents(t, readSegments(), expect)
+
+	// Segments are left alone and the journal isn't truncated if the new
+	// segment can't be written.
+	if err := os.Mkdir(SegmentPath(path, 1)+".tmp", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Rotate(2); err == nil {
+		t.Fatal("expected rotating to fail")
+	}
+	if _, err := os.Stat(SegmentPath(path, 2)); !os.IsNotExist(err) {
+		t.Error("segment was shifted although rotating failed:", err)
+	}
+	expectEvents(t, readSegments(), expect)
+}
+
+// fullDisk writes into the file until it's full, after which it only writes
+// half of each write before failing like a full disk would.
+type fullDisk struct {
+	f    *os.File
+	full bool
+}
+
+func (d *fullDisk) Write(b []byte) (int, error) {
+	if !d.full {
+		return d.f.Write(b)
+	}
+
+	n, _ := d.f.Write(b[:len(b)/2])
+	return n, &os.PathError{Op: "write", Path: d.f.Name(), Err: syscall.ENOSPC}
+}
+
+func TestReaderCorrectTimes(t *testing.T) {
+	boot := time.Date(1970, 01, 01, 00, 00, 00, 00, time.UTC)
+	synced := time.Date(2021, 04, 01, 12, 00, 00, 00, time.UTC)
+
+	// The clock is synchronized between the second and third events of the
+	// session. The last event has no monotonic time.
+	records := []Event{
+		{Time: boot.Add(5 * time.Second), Mono: &MonoTime{"boot", 5 * time.Second}},
+		{Time: boot.Add(10 * time.Second), Mono: &MonoTime{"boot", 10 * time.Second}},
+		{Time: synced.Add(20 * time.Second), Mono: &MonoTime{"boot", 20 * time.Second}},
+		{Time: boot.Add(30 * time.Second)},
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		records[i].Type = (&cronmon.EventQuit{}).Type()
+		records[i].Data = &cronmon.EventQuit{}
+		if err := enc.Encode(&records[i]); err != nil {
+			t.Fatal("failed to encode:", err)
+		}
+	}
+
+	readTimes := func(correct bool) []time.Time {
+		r := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		r.CorrectTimes = correct
+
+		var times []time.Time
+		err := r.ReadAll(context.Background(), func(_ cronmon.Event, t time.Time) error {
+			times = append(times, t.UTC())
+			return nil
+		})
+		if err != nil {
+			t.Fatal("failed to read:", err)
+		}
+		return times
+	}
+
+	expect := []time.Time{
+		boot.Add(30 * time.Second),
+		synced.Add(20 * time.Second),
+		synced.Add(10 * time.Second),
+		synced.Add(5 * time.Second),
+	}
+	if times := readTimes(true); !reflect.DeepEqual(times, expect) {
+		t.Errorf("unexpected corrected times %v", times)
+	}
+
+	expect = []time.Time{
+		boot.Add(30 * time.Second),
+		synced.Add(20 * time.Second),
+		boot.Add(10 * time.Second),
+		boot.Add(5 * time.Second),
+	}
+	if times := readTimes(false); !reflect.DeepEqual(times, expect) {
+		t.Errorf("unexpected uncorrected times %v", times)
+	}
+}
+
+func TestWriterHost(t *testing.T) {
+	host := &Host{Hostname: "db1", Instance: "backups", BootID: "boot", Version: "v1"}
+
+	for _, format := range []Format{FormatJSON, FormatCBOR} {
+		var buf bytes.Buffer
+
+		w := NewFormatWriter("test", &buf, format)
+		w.Host = host
+		w.Monotonic = true
+
+		if err := w.Write(&cronmon.EventQuit{}); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+
+		if format == FormatJSON {
+			var rec struct{ Host *Host }
+			if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+				t.Fatal("failed to decode record:", err)
+			}
+			if rec.Host == nil || *rec.Host != *host {
+				t.Errorf("got host %#v, expected %#v", rec.Host, host)
+			}
+
+			if _, _, err := DecodeEventStrict(bytes.TrimSpace(buf.Bytes())); err != nil {
+				t.Error("failed to decode strictly:", err)
+			}
+		}
+
+		r := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if ev, _, err := r.Read(); err != nil {
+			t.Errorf("%s: failed to read: %v", format, err)
+		} else if _, ok := ev.(*cronmon.EventQuit); !ok {
+			t.Errorf("%s: read unexpected event %#v", format, ev)
+		}
+	}
+}
+
+func TestDedupJournaler(t *testing.T) {
+	ring := cronmon.NewRingJournal(10)
+
+	d := NewDedupJournaler(ring)
+	d.FlushInterval = time.Hour
+
+	spawnErr := &cronmon.EventProcessSpawnError{File: "a", Reason: "loop"}
+
+	for i := 0; i < 4; i++ {
+		d.Write(spawnErr)
+	}
+	d.Write(&cronmon.EventWarning{Component: "test", Error: "different"})
+	d.Write(&cronmon.EventWarning{Component: "test", Error: "different"})
+
+	if err := d.Flush(); err != nil {
+		t.Fatal("failed to flush:", err)
+	}
+
+	var got []cronmon.Event
+	for _, entry := range ring.Snapshot() {
+		if repeated, ok := entry.Event.(*cronmon.EventRepeated); ok {
+			if repeated.First.IsZero() || repeated.Last.Before(repeated.First) {
+				t.Errorf("invalid repeat times %v to %v", repeated.First, repeated.Last)
+			}
+			repeated.First = time.Time{}
+			repeated.Last = time.Time{}
+		}
+		got = append(got, entry.Event)
+	}
+
+	spawnErrJSON, _ := json.Marshal(spawnErr)
+	warningJSON, _ := json.Marshal(&cronmon.EventWarning{Component: "test", Error: "different"})
+
+	expectEvents(t, got, []cronmon.Event{
+		spawnErr,
+		&cronmon.EventRepeated{
+			Event: "process spawn error",
+			Data:  spawnErrJSON,
+			File:  "a",
+			Count: 3,
+		},
+		&cronmon.EventWarning{Component: "test", Error: "different"},
+		&cronmon.EventRepeated{
+			Event: "warning",
+			Data:  warningJSON,
+			Count: 1,
+		},
+	})
+}
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		event  cronmon.Event
+		strict bool // true if the line fails only in strict mode
+	}{
+		{
+			name:  "valid",
+			line:  `{"time":"2021-04-01T00:00:00Z","type":"process spawned","data":{"file":"a","pid":1}}`,
+			event: &cronmon.EventProcessSpawned{File: "a", PID: 1},
+		},
+		{
+			name:   "unknown field",
+			line:   `{"time":"2021-04-01T00:00:00Z","type":"process spawned","data":{"file":"a","pid":1,"new":true}}`,
+			event:  &cronmon.EventProcessSpawned{File: "a", PID: 1},
+			strict: true,
+		},
+		{
+			name:   "unknown top-level field",
+			line:   `{"time":"2021-04-01T00:00:00Z","type":"monitor quit","data":{},"new":true}`,
+			event:  &cronmon.EventQuit{},
+			strict: true,
+		},
+		{name: "not JSON", line: `process spawned`},
+		{name: "trailing data", line: `{"time":"2021-04-01T00:00:00Z","type":"monitor quit","data":{}} {}`},
+		{name: "no time", line: `{"type":"monitor quit","data":{}}`},
+		{name: "unknown type", line: `{"time":"2021-04-01T00:00:00Z","type":"what","data":{}}`},
+		{name: "no data", line: `{"time":"2021-04-01T00:00:00Z","type":"monitor quit"}`},
+		{name: "null data", line: `{"time":"2021-04-01T00:00:00Z","type":"monitor quit","data":null}`},
+		{name: "array data", line: `{"time":"2021-04-01T00:00:00Z","type":"monitor quit","data":[]}`},
+		{name: "wrong field type", line: `{"time":"2021-04-01T00:00:00Z","type":"process spawned","data":{"file":"a","pid":"1"}}`},
+		{name: "no file", line: `{"time":"2021-04-01T00:00:00Z","type":"process exited","data":{"pid":1}}`},
+		{name: "invalid PID", line: `{"time":"2021-04-01T00:00:00Z","type":"process spawned","data":{"file":"a","pid":-1}}`},
+		{name: "invalid op", line: `{"time":"2021-04-01T00:00:00Z","type":"process list modified","data":{"op":"rename","file":"a"}}`},
+		{name: "no mono session", line: `{"time":"2021-04-01T00:00:00Z","type":"monitor quit","data":{},"mono":{}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ev, _, err := DecodeEvent([]byte(test.line))
+			if test.event == nil {
+				if err == nil {
+					t.Fatalf("unexpected event decoded: %#v", ev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !reflect.DeepEqual(ev, test.event) {
+				t.Fatalf("unexpected event %#v, expected %#v", ev, test.event)
+			}
+
+			_, _, err = DecodeEventStrict([]byte(test.line))
+			if test.strict && err == nil {
+				t.Fatal("unexpected strict decoding success")
+			}
+			if !test.strict && err != nil {
+				t.Fatal("unexpected strict decoding error:", err)
+			}
+		})
+	}
+
+	_, _, err := DecodeEvent([]byte(`{"time":"2021-04-01T00:00:00Z","type":"what","data":{}}`))
+	var unknownErr *UnknownEventError
+	if !errors.As(err, &unknownErr) || unknownErr.Type != "what" {
+		t.Errorf("unexpected error for unknown event: %v", err)
+	}
+}
+
+func TestBinaryJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.cbor")
+
+	j, err := NewFileLockJournaler(path)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	j.Monotonic = true
+
+	if format := j.Format(); format != FormatCBOR {
+		t.Fatalf("new journal has format %q, expected %q", format, FormatCBOR)
+	}
+
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []cronmon.Event{
+		&cronmon.EventAcquired{JournalID: j.ID()},
+		&cronmon.EventProcessSpawned{PID: 1, File: "a", Hash: "abc"},
+		&cronmon.EventProcessReported{PID: 1, File: "a", Data: []byte(`{"progress":0.5}`)},
+		&cronmon.EventProcessStartTimeout{PID: 1, File: "a", Timeout: time.Second},
+		&cronmon.EventRepeated{Event: "warning", Data: []byte(`{}`), Count: 2, First: base, Last: base},
+		&cronmon.EventStatsSnapshot{Restarts: map[string]int{"a": 1}},
+	}
+
+	for i, ev := range events {
+		if err := j.WriteAt(ev, base.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal("failed to write:", err)
+		}
+	}
+	j.Close()
+
+	// Simulate a crash halfway through writing an event.
+	var buf bytes.Buffer
+	NewFormatWriter("test", &buf, FormatCBOR).Write(&cronmon.EventQuit{})
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	f.Write(buf.Bytes()[:buf.Len()/2])
+	f.Close()
+
+	r, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal("failed to open read-only:", err)
+	}
+	defer r.Close()
+
+	var read []cronmon.Event
+	for i := len(events) - 1; i >= 0; i-- {
+		ev, evt, err := r.Read()
+		if err != nil {
+			t.Fatal("failed to read event:", err)
+		}
+		if want := base.Add(time.Duration(i) * time.Minute); !evt.Equal(want) {
+			t.Errorf("event %d has time %v, expected %v", i, evt, want)
+		}
+		read = append([]cronmon.Event{ev}, read...)
+	}
+
+	expectEvents(t, read, events)
+
+	if _, _, err := r.Read(); !errors.Is(err, io.EOF) {
+		t.Fatal("expected EOF, got", err)
+	}
+
+	// Reopening the journal must repair the torn write and keep the format,
+	// even though the path no longer asks for it.
+	moved := filepath.Join(filepath.Dir(path), "journal")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal("failed to move journal:", err)
+	}
+
+	j, err = NewFileLockJournaler(moved)
+	if err != nil {
+		t.Fatal("failed to reopen journal:", err)
+	}
+	defer j.Close()
+
+	if format := j.Format(); format != FormatCBOR {
+		t.Fatalf("reopened journal has format %q, expected %q", format, FormatCBOR)
+	}
+
+	j.Write(&cronmon.EventQuit{})
+
+	read = readEvents(t, NewFileReader(j.f))
+	expectEvents(t, read[:2], []cronmon.Event{
+		&cronmon.EventQuit{},
+		&cronmon.EventLogTruncated{
+			Reason: fmt.Sprintf("skipped %d bytes of a partial record from a crashed writer", buf.Len()/2),
+		},
+	})
+	expectEvents(t, read[2:], []cronmon.Event{
+		events[5], events[4], events[3], events[2], events[1], events[0],
+	})
+}
+
+func TestSyncPolicy(t *testing.T) {
+	j, err := NewFileLockJournaler(filepath.Join(t.TempDir(), "journal.json"))
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer j.Close()
+
+	dirty := func() bool {
+		j.wmut.Lock()
+		defer j.wmut.Unlock()
+		return j.dirty
+	}
+
+	warning := &cronmon.EventWarning{Component: "test", Error: "test"}
+
+	j.Write(warning)
+	if dirty() {
+		t.Fatal("event not synced by default")
+	}
+
+	j.SetSyncPolicy(SyncCritical)
+
+	j.Write(warning)
+	if !dirty() {
+		t.Fatal("non-critical event synced with SyncCritical")
+	}
+
+	j.Write(&cronmon.EventProcessSpawned{File: "a", PID: 1})
+	if dirty() {
+		t.Fatal("critical event not synced with SyncCritical")
+	}
+
+	every := SyncEvery
+	t.Cleanup(func() { SyncEvery = every })
+	SyncEvery = 10 * time.Millisecond
+
+	j.SetSyncPolicy(SyncInterval)
+
+	j.Write(&cronmon.EventProcessSpawned{File: "a", PID: 2})
+	if !dirty() {
+		t.Fatal("event synced right away with SyncInterval")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if dirty() {
+		t.Fatal("event not synced after SyncEvery with SyncInterval")
+	}
+}
@@ -0,0 +1,100 @@
+package journal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// Locker is a lock that ensures that only one cronmon runs with a journal. The
+// default is FileLocker, but other implementations, such as ones backed by
+// etcd, Consul or PostgreSQL advisory locks, may be used for clustered
+// deployments.
+type Locker interface {
+	// TryLock tries to acquire the lock without blocking. False is returned
+	// if the lock is held elsewhere.
+	TryLock() (bool, error)
+	// Unlock releases the lock.
+	Unlock() error
+	// Holder describes the current holder of the lock, such as "host:pid".
+	// An empty string is returned if the holder is unknown.
+	Holder() (string, error)
+}
+
+// LockWait polls the given locker until it's acquired or the context is
+// canceled.
+func LockWait(ctx context.Context, l Locker) error {
+	ticker := time.NewTicker(25 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		locked, err := l.TryLock()
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// FileLocker is a Locker that takes a flock on a file. While locked, the
+// holder's metadata is written next to the file; see LockInfo.
+type FileLocker struct {
+	path string
+	l    *flock.Flock
+}
+
+var _ Locker = (*FileLocker)(nil)
+
+// NewFileLocker creates a new FileLocker on the file at the given path.
+func NewFileLocker(path string) *FileLocker {
+	return &FileLocker{
+		path: path,
+		l:    flock.New(path),
+	}
+}
+
+// TryLock implements Locker.
+func (l *FileLocker) TryLock() (bool, error) {
+	locked, err := l.l.TryLock()
+	if err != nil || !locked {
+		return false, err
+	}
+
+	if err := writeLockInfo(l.path); err != nil {
+		l.l.Unlock()
+		return false, errors.Wrap(err, "failed to write lock metadata")
+	}
+
+	return true, nil
+}
+
+// Unlock implements Locker.
+func (l *FileLocker) Unlock() error {
+	os.Remove(LockInfoPath(l.path))
+	return l.l.Unlock()
+}
+
+// Holder implements Locker. It returns the holder from the lock metadata.
+func (l *FileLocker) Holder() (string, error) {
+	info, err := ReadLockInfo(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%d", info.Host, info.PID), nil
+}
@@ -0,0 +1,150 @@
+package journal
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// LockInfo describes the holder of a journal lock. It is written next to the
+// journal while the lock is held so that a stale lock can be validated before
+// it's broken. See StealLock.
+type LockInfo struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+// LockInfoPath returns the path to the lock metadata of the journal at the given
+// path.
+func LockInfoPath(path string) string {
+	return path + ".lock"
+}
+
+// ReadLockInfo reads the lock metadata of the journal at the given path.
+func ReadLockInfo(path string) (*LockInfo, error) {
+	b, err := os.ReadFile(LockInfoPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var info LockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, errors.Wrap(err, "failed to parse lock metadata")
+	}
+
+	return &info, nil
+}
+
+func writeLockInfo(path string) error {
+	host, _ := os.Hostname()
+
+	b, err := json.Marshal(LockInfo{
+		PID:   os.Getpid(),
+		Host:  host,
+		Since: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(LockInfoPath(path), b, 0600)
+}
+
+// ErrLockHolderAlive is returned by StealLock if the lock holder is still
+// running or can't be validated.
+var ErrLockHolderAlive = errors.New("lock holder may still be running")
+
+// StealLock breaks the lock on the journal at the given path if its holder, as
+// recorded in its lock metadata, is a process on this host that no longer
+// exists. This recovers from locks that outlive their holders, such as on some
+// network filesystems or when the journal's descriptor was leaked into another
+// process.
+//
+// The lock is broken by replacing the journal with a copy of itself, leaving
+// the stale lock on the old file. The metadata of the broken lock is returned.
+// ErrLockHolderAlive is returned if the holder can't be confirmed dead, and nil
+// metadata is returned if the journal isn't locked.
+func StealLock(path string) (*LockInfo, error) {
+	l := flock.New(path)
+
+	locked, err := l.TryLock()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to test lock")
+	}
+	if locked {
+		// The lock isn't held, so there's nothing to steal.
+		l.Unlock()
+		return nil, nil
+	}
+
+	info, err := ReadLockInfo(path)
+	if err != nil {
+		return nil, errors.Wrap(ErrLockHolderAlive, "no usable lock metadata: "+err.Error())
+	}
+
+	if host, _ := os.Hostname(); info.Host != host {
+		return nil, errors.Wrapf(ErrLockHolderAlive, "lock is held by host %q", info.Host)
+	}
+
+	if exec.ProcessExists(info.PID) {
+		return nil, errors.Wrapf(ErrLockHolderAlive, "lock is held by running PID %d", info.PID)
+	}
+
+	if err := replaceFile(path); err != nil {
+		return nil, errors.Wrap(err, "failed to replace journal")
+	}
+
+	return info, nil
+}
+
+// replaceFile replaces the file at the given path with a copy of itself. The
+// copy keeps the mode of the file.
+func replaceFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".steal-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+
+	// CreateTemp always creates the copy with 0600.
+	if err := dst.Chmod(stat.Mode().Perm()); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+
+	if err := os.Rename(dst.Name(), path); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package journal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+// Dedup returns a middleware that collapses runs of identical events. See
+// DedupJournaler. Use NewDedupJournaler instead to be able to flush the last
+// run on shutdown.
+func Dedup() cronmon.JournalMiddleware {
+	return func(j cronmon.Journaler) cronmon.Journaler {
+		return NewDedupJournaler(j)
+	}
+}
+
+// Filter returns a middleware that only writes the events that keep returns
+// true for. The rest are dropped without an error.
+func Filter(keep func(cronmon.Event) bool) cronmon.JournalMiddleware {
+	return func(j cronmon.Journaler) cronmon.Journaler {
+		return &filterJournaler{j, keep}
+	}
+}
+
+type filterJournaler struct {
+	cronmon.Journaler
+	keep func(cronmon.Event) bool
+}
+
+func (j *filterJournaler) Write(ev cronmon.Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j *filterJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	if !j.keep(ev) {
+		return nil
+	}
+	return cronmon.WriteAt(j.Journaler, ev, t)
+}
+
+// Enrich returns a middleware that replaces each event with the one returned
+// by fn before writing it, such as to add details to it. fn must not modify
+// the given event, since other journalers may have it too; it should return a
+// copy instead.
+func Enrich(fn func(cronmon.Event) cronmon.Event) cronmon.JournalMiddleware {
+	return func(j cronmon.Journaler) cronmon.Journaler {
+		return &enrichJournaler{j, fn}
+	}
+}
+
+type enrichJournaler struct {
+	cronmon.Journaler
+	fn func(cronmon.Event) cronmon.Event
+}
+
+func (j *enrichJournaler) Write(ev cronmon.Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j *enrichJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	return cronmon.WriteAt(j.Journaler, j.fn(ev), t)
+}
+
+// RateLimit returns a middleware that writes up to burst events of each type at
+// once, after which one more event of that type is written every every. The
+// rest are dropped, and how many were dropped is journaled as an EventWarning
+// before the next event of that type that is written. Limiting each type apart
+// keeps a flood of one event from hiding the others. See cronmon.RateLimiter.
+func RateLimit(burst int, every time.Duration) cronmon.JournalMiddleware {
+	limit := cronmon.StartLimit{Burst: burst, Every: every}
+
+	return func(j cronmon.Journaler) cronmon.Journaler {
+		return cronmon.NewRateLimiter(j, limit, eventType, summarizeDropped)
+	}
+}
+
+func eventType(ev cronmon.Event) (string, bool) {
+	return ev.Type(), true
+}
+
+func summarizeDropped(typ string, s cronmon.Suppressed) cronmon.Event {
+	return &cronmon.EventWarning{
+		Component: "journal",
+		Error:     fmt.Sprintf("rate limit dropped %d %s events", s.Count, typ),
+	}
+}
+
+// JournalMetrics counts the events written through its middleware by type. It
+// is safe to use concurrently.
+type JournalMetrics struct {
+	mutex   sync.Mutex
+	written map[string]uint64
+	failed  map[string]uint64
+}
+
+// EventCounts is the number of events by their types.
+type EventCounts map[string]uint64
+
+// Middleware returns the middleware that counts the events written through it.
+func (m *JournalMetrics) Middleware() cronmon.JournalMiddleware {
+	return func(j cronmon.Journaler) cronmon.Journaler {
+		return &metricsJournaler{j, m}
+	}
+}
+
+// Written returns the number of events that were written successfully.
+func (m *JournalMetrics) Written() EventCounts {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return copyCounts(m.written)
+}
+
+// Failed returns the number of events that failed to be written.
+func (m *JournalMetrics) Failed() EventCounts {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return copyCounts(m.failed)
+}
+
+func (m *JournalMetrics) count(typ string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counts := &m.written
+	if err != nil {
+		counts = &m.failed
+	}
+
+	if *counts == nil {
+		*counts = map[string]uint64{}
+	}
+	(*counts)[typ]++
+}
+
+func copyCounts(counts map[string]uint64) EventCounts {
+	cp := make(EventCounts, len(counts))
+	for typ, n := range counts {
+		cp[typ] = n
+	}
+	return cp
+}
+
+type metricsJournaler struct {
+	cronmon.Journaler
+	m *JournalMetrics
+}
+
+func (j *metricsJournaler) Write(ev cronmon.Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j *metricsJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	err := cronmon.WriteAt(j.Journaler, ev, t)
+	j.m.count(ev.Type(), err)
+	return err
+}
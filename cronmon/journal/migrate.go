@@ -0,0 +1,71 @@
+package journal
+
+import (
+	"context"
+	"io"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// TimedJournaler is a journaler that can also write events with a given time
+// instead of the current time, which is needed to migrate events into it. See
+// cronmon.TimedJournaler.
+type TimedJournaler = cronmon.TimedJournaler
+
+var (
+	_ TimedJournaler = (*Writer)(nil)
+	_ TimedJournaler = (*FileLockJournaler)(nil)
+	_ TimedJournaler = (*SplitJournaler)(nil)
+	_ TimedJournaler = (*DedupJournaler)(nil)
+	_ TimedJournaler = (*MultiJournaler)(nil)
+)
+
+// ErrUntimedJournaler is returned if events are migrated into a journaler that
+// can't write events with their original times.
+var ErrUntimedJournaler = errors.New("journaler cannot write events with their original times")
+
+// Migrate replays all events read from r into w, from oldest to newest, with
+// their original times, so that w ends up with the same history in the same
+// order. The number of events written is returned. If w does not implement
+// TimedJournaler, then ErrUntimedJournaler is returned before anything is
+// written.
+//
+// Since journals are read from newest to oldest, all events are read into
+// memory before the first one is written.
+func Migrate(ctx context.Context, r cronmon.JournalReader, w cronmon.Journaler) (int, error) {
+	tw, ok := w.(TimedJournaler)
+	if !ok {
+		return 0, ErrUntimedJournaler
+	}
+
+	var records []record
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		ev, t, err := r.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return 0, errors.Wrapf(err, "failed to read event %d from the end", len(records))
+		}
+
+		records = append(records, record{t, ev})
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return len(records) - 1 - i, err
+		}
+
+		if err := tw.WriteAt(records[i].event, records[i].time); err != nil {
+			return len(records) - 1 - i, errors.Wrapf(err, "failed to write event at %v", records[i].time)
+		}
+	}
+
+	return len(records), nil
+}
@@ -0,0 +1,304 @@
+package journal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// ErrorPolicy determines when a MultiJournaler fails a write that some of its
+// journalers failed.
+type ErrorPolicy string
+
+const (
+	// ErrorAll writes into all journalers and fails if any of them failed. It
+	// is the default.
+	ErrorAll ErrorPolicy = "all"
+	// ErrorFailFast stops at the first journaler that fails, so the journalers
+	// after it don't get the event.
+	ErrorFailFast ErrorPolicy = "fail-fast"
+	// ErrorBestEffort writes into all journalers and only fails if all of them
+	// failed.
+	ErrorBestEffort ErrorPolicy = "best-effort"
+	// ErrorQuorum writes into all journalers and fails unless more than half
+	// of them succeeded.
+	ErrorQuorum ErrorPolicy = "quorum"
+)
+
+// ParseErrorPolicy parses the given error policy name.
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch p := ErrorPolicy(s); p {
+	case ErrorAll, ErrorFailFast, ErrorBestEffort, ErrorQuorum:
+		return p, nil
+	default:
+		return "", errors.Errorf("unknown error policy %q", s)
+	}
+}
+
+// MultiWriterDisableAfter is the default number of consecutive failures after
+// which a MultiJournaler disables a journaler.
+var MultiWriterDisableAfter = 5
+
+// MultiWriterRetryAfter is the default duration after which a MultiJournaler
+// tries writing into a disabled journaler again.
+var MultiWriterRetryAfter = time.Minute
+
+// ErrJournalerDisabled is returned for journalers that a MultiJournaler
+// disabled after they failed too many times in a row.
+var ErrJournalerDisabled = errors.New("journaler disabled after repeated failures")
+
+// MultiWriterOptions contains optional parameters for a MultiJournaler.
+type MultiWriterOptions struct {
+	// Policy determines when a write fails. See ErrorPolicy.
+	Policy ErrorPolicy
+	// DisableAfter is the number of consecutive failures after which a
+	// journaler is disabled. It defaults to MultiWriterDisableAfter. A
+	// negative number never disables journalers.
+	DisableAfter int
+	// RetryAfter is the duration after which a disabled journaler is tried
+	// again. It defaults to MultiWriterRetryAfter.
+	RetryAfter time.Duration
+}
+
+// MultiJournaler is a journaler that writes to multiple other journalers. It
+// counts the failures of each journaler, and it disables journalers that keep
+// failing, so that they're only retried every RetryAfter. Writes into a
+// disabled journaler fail with ErrJournalerDisabled. Disabling and re-enabling
+// a journaler is journaled as an EventWarning into the other journalers.
+//
+// The first journaler is the primary one, such as the journal file, and it is
+// never disabled: every event is still written into it, so that it handles
+// its failures itself, such as by buffering events while the disk is full.
+type MultiJournaler struct {
+	id    string
+	opts  MultiWriterOptions
+	mutex sync.Mutex
+	sinks []multiSink
+}
+
+type multiSink struct {
+	j           cronmon.Journaler
+	failures    int
+	consecutive int
+	lastErr     error
+	retryAt     time.Time // non-zero if disabled
+}
+
+// JournalerStatus is the status of a journaler of a MultiJournaler.
+type JournalerStatus struct {
+	ID string `json:"id"`
+	// Failures is the total number of failed writes.
+	Failures int `json:"failures"`
+	// Consecutive is the number of failed writes since the last successful
+	// one.
+	Consecutive int `json:"consecutive"`
+	// LastError is the error of the last failed write, if any.
+	LastError string `json:"last_error,omitempty"`
+	// Disabled is true if the journaler is disabled.
+	Disabled bool `json:"disabled"`
+}
+
+// MultiWriter creates a journaler that writes to multiple other journalers with
+// the default options. Its ID is the IDs of the given journalers joined with
+// "+". See MultiWriterWithOptions.
+func MultiWriter(ws ...cronmon.Journaler) cronmon.Journaler {
+	return MultiWriterWithOptions(MultiWriterOptions{}, ws...)
+}
+
+// MultiWriterWithOptions creates a MultiJournaler that writes to the given
+// journalers. Each event is written into all of them with the same time, which
+// is taken once by Write or given to WriteAt; journalers that aren't a
+// TimedJournaler use their own time.
+func MultiWriterWithOptions(opts MultiWriterOptions, ws ...cronmon.Journaler) *MultiJournaler {
+	if opts.Policy == "" {
+		opts.Policy = ErrorAll
+	}
+	if opts.DisableAfter == 0 {
+		opts.DisableAfter = MultiWriterDisableAfter
+	}
+	if opts.RetryAfter == 0 {
+		opts.RetryAfter = MultiWriterRetryAfter
+	}
+
+	ids := make([]string, len(ws))
+	sinks := make([]multiSink, len(ws))
+
+	for i, w := range ws {
+		ids[i] = w.ID()
+		sinks[i] = multiSink{j: w}
+	}
+
+	return &MultiJournaler{
+		id:    strings.Join(ids, "+"),
+		opts:  opts,
+		sinks: sinks,
+	}
+}
+
+// ID returns the IDs of the journalers joined with "+".
+func (w *MultiJournaler) ID() string { return w.id }
+
+// Write writes the event into the journalers with the current time.
+func (w *MultiJournaler) Write(ev cronmon.Event) error {
+	return w.WriteAt(ev, time.Now())
+}
+
+// WriteAt writes the event into the journalers with the given time. The first
+// error is returned if the write fails according to the error policy.
+func (w *MultiJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	var firstErr error
+	var failed int
+
+	for i := range w.sinks {
+		err := w.writeSink(i, ev, t)
+		if err == nil {
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed++
+
+		if w.opts.Policy == ErrorFailFast {
+			break
+		}
+	}
+
+	switch w.opts.Policy {
+	case ErrorBestEffort:
+		if failed < len(w.sinks) {
+			return nil
+		}
+	case ErrorQuorum:
+		if (len(w.sinks)-failed)*2 > len(w.sinks) {
+			return nil
+		}
+	}
+
+	return firstErr
+}
+
+// writeSink writes the event into the i-th journaler unless it's disabled,
+// and records the result.
+func (w *MultiJournaler) writeSink(i int, ev cronmon.Event, t time.Time) error {
+	now := time.Now()
+
+	w.mutex.Lock()
+	sink := &w.sinks[i]
+	if !sink.retryAt.IsZero() && now.Before(sink.retryAt) {
+		w.mutex.Unlock()
+		return errors.Wrap(ErrJournalerDisabled, sink.j.ID())
+	}
+	w.mutex.Unlock()
+
+	err := cronmon.WriteAt(sink.j, ev, t)
+
+	w.mutex.Lock()
+	warning := w.record(sink, err, now)
+	w.mutex.Unlock()
+
+	if warning != "" {
+		w.warn(i, warning)
+	}
+
+	return err
+}
+
+// record records the result of a write into the sink and returns a warning
+// if the sink was disabled or re-enabled. The mutex must be held.
+func (w *MultiJournaler) record(sink *multiSink, err error, now time.Time) string {
+	disabled := !sink.retryAt.IsZero()
+
+	if err == nil {
+		failures := sink.consecutive
+		sink.consecutive = 0
+		sink.retryAt = time.Time{}
+
+		if disabled {
+			return fmt.Sprintf("journaler %s re-enabled after %d failed writes", sink.j.ID(), failures)
+		}
+		return ""
+	}
+
+	sink.failures++
+	sink.consecutive++
+	sink.lastErr = err
+
+	if disabled {
+		sink.retryAt = now.Add(w.opts.RetryAfter)
+		return ""
+	}
+
+	primary := sink == &w.sinks[0]
+
+	if w.opts.DisableAfter > 0 && sink.consecutive >= w.opts.DisableAfter && !primary {
+		sink.retryAt = now.Add(w.opts.RetryAfter)
+		return fmt.Sprintf(
+			"journaler %s disabled for %v after %d failed writes: %v",
+			sink.j.ID(), w.opts.RetryAfter, sink.consecutive, err,
+		)
+	}
+
+	return ""
+}
+
+// warn writes the warning into all enabled journalers other than the one that
+// it's about. Failures aren't recorded, since warnings would otherwise cause
+// more warnings.
+func (w *MultiJournaler) warn(except int, msg string) {
+	ev := &cronmon.EventWarning{
+		Component: "journal",
+		Error:     msg,
+	}
+
+	for i, sink := range w.Journalers() {
+		if i != except && !sink.Disabled {
+			w.sinks[i].j.Write(ev)
+		}
+	}
+}
+
+// Journalers returns the status of each journaler in the order that they were
+// given.
+func (w *MultiJournaler) Journalers() []JournalerStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	statuses := make([]JournalerStatus, len(w.sinks))
+	for i, sink := range w.sinks {
+		statuses[i] = JournalerStatus{
+			ID:          sink.j.ID(),
+			Failures:    sink.failures,
+			Consecutive: sink.consecutive,
+			Disabled:    !sink.retryAt.IsZero(),
+		}
+		if sink.lastErr != nil {
+			statuses[i].LastError = sink.lastErr.Error()
+		}
+	}
+
+	return statuses
+}
+
+type multiReadWriter struct {
+	*MultiJournaler
+	cronmon.JournalReader
+}
+
+// MultiReadWriter creates a journaler that writes to multiple other journalers
+// but reads from a single journaler. The new journaler makes no guarantee that
+// the reader will read only once all writers are done, so caller should not
+// assume that.
+func MultiReadWriter(
+	r cronmon.JournalReadWriter, ws ...cronmon.Journaler) cronmon.JournalReadWriter {
+
+	return &multiReadWriter{
+		MultiJournaler: MultiWriterWithOptions(MultiWriterOptions{}, append([]cronmon.Journaler{r}, ws...)...),
+		JournalReader:  r,
+	}
+}
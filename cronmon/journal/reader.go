@@ -1,64 +1,217 @@
 package journal
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"io"
 	"os"
 	"time"
 
 	"git.unix.lgbt/diamondburned/cronmon/cronmon"
-	"github.com/diamondburned/backwardio"
-	"github.com/pkg/errors"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal/backwardio"
 )
 
 // Reader implements a primitive reader that can parse journals written by
-// Writer from top to bottom.
+// Writer from top to bottom. The format of the journal is detected on the first
+// read.
 type Reader struct {
-	b *backwardio.Scanner
+	// CorrectTimes, if true, makes the reader correct the timestamps of events
+	// that have their monotonic time recorded. The newest event of each writer
+	// session is assumed to have the correct wall time, and the times of older
+	// events in that session are derived from their monotonic offsets.
+	CorrectTimes bool
+	// Strict, if true, makes the reader reject events with fields unknown to
+	// this version of cronmon. See DecodeEventStrict. It only applies to
+	// FormatJSON.
+	Strict bool
+
+	r       io.ReaderAt
+	size    func() (int64, error)
+	b       *backwardio.Scanner
+	bin     *binaryScanner       // non-nil if the journal is in FormatCBOR
+	anchors map[string]time.Time // session -> wall time at offset 0
+	started bool
+	partial bool
 }
 
-// NewReader creates a new journal reader.
-func NewReader(r io.ReadSeeker) *Reader {
-	return &Reader{backwardio.NewScanner(r)}
+// NewReader creates a new journal reader that reads the first size bytes of
+// the given reader.
+func NewReader(r io.ReaderAt, size int64) *Reader {
+	return &Reader{
+		r:    r,
+		size: func() (int64, error) { return size, nil },
+		b:    backwardio.NewScanner(r, size),
+	}
+}
+
+// NewFileReader creates a new journal reader that reads the given file from
+// its size at the time of the first read. The file offset is never changed.
+func NewFileReader(f *os.File) *Reader {
+	return &Reader{
+		r:    f,
+		size: func() (int64, error) { return fileSize(f) },
+		b:    backwardio.NewFileScanner(f),
+	}
+}
+
+func fileSize(f *os.File) (int64, error) {
+	s, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return s.Size(), nil
 }
 
-// Read reads a single entry, starting from the top file. An EOF error is
+// Buffer sets the initial buffer size and the maximum size of a record. See
+// (*backwardio.Scanner).Buffer. It only applies to FormatJSON.
+func (r *Reader) Buffer(size, max int) {
+	r.b.Buffer(size, max)
+}
+
+// Read reads a single entry, starting from the bottom of the file. An EOF error is
 // returned if the file has been fully consumed.
 func (r *Reader) Read() (cronmon.Event, time.Time, error) {
-	var line []byte
-	var err error
+	if !r.started {
+		r.started = true
 
-	for {
-		line, err = r.b.ReadUntil('\n')
+		if err := r.start(); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	var event cronmon.Event
+	var t time.Time
+	var mono *MonoTime
+
+	if r.bin != nil {
+		payload, err := r.bin.read()
 		if err != nil {
 			return nil, time.Time{}, err
 		}
+
+		event, t, mono, err = decodeBinary(payload)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	} else {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		event, t, mono, err = decodeEvent(line, r.Strict)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	if r.CorrectTimes && mono != nil {
+		return event, r.correctTime(t, *mono), nil
+	}
+
+	return event, t, nil
+}
+
+// start detects the format of the journal and skips the last record if it's
+// partially written, which happens if the writer crashed mid-write.
+func (r *Reader) start() error {
+	size, err := r.size()
+	if err != nil {
+		return err
+	}
+
+	format, err := DetectFormat(r.r, size)
+	if err != nil {
+		return err
+	}
+
+	if format == FormatCBOR {
+		r.bin = &binaryScanner{r: r.r}
+
+		skipped, err := r.bin.skipPartial(size)
+		if err != nil {
+			return err
+		}
+		r.partial = skipped > 0
+
+		return nil
+	}
+
+	partial, err := r.b.SkipPartial('\n')
+	if err != nil {
+		return err
+	}
+	r.partial = len(partial) > 0
+
+	return nil
+}
+
+// readLine reads the next non-empty line from the bottom up.
+func (r *Reader) readLine() ([]byte, error) {
+	for {
+		line, err := r.b.ReadUntil('\n')
+		if err != nil {
+			return nil, err
+		}
 		if len(line) > 0 {
-			break
+			return line, nil
 		}
 	}
+}
+
+// correctTime returns the corrected wall time of an event using its monotonic
+// time. Since events are read from newest to oldest, the first event read of
+// each session anchors the rest of that session.
+func (r *Reader) correctTime(wall time.Time, mono MonoTime) time.Time {
+	if r.anchors == nil {
+		r.anchors = map[string]time.Time{}
+	}
 
-	var rawEvent struct {
-		Time time.Time       `json:"time"`
-		Type string          `json:"type"`
-		Data json.RawMessage `json:"data"`
+	anchor, ok := r.anchors[mono.Session]
+	if !ok {
+		anchor = wall.Add(-mono.Offset)
+		r.anchors[mono.Session] = anchor
 	}
 
-	if err := json.Unmarshal(line, &rawEvent); err != nil {
-		return nil, time.Time{}, errors.Wrap(err, "failed to decode JSON")
+	return anchor.Add(mono.Offset)
+}
+
+// SkippedPartial returns true if the reader has skipped a partially written
+// record at the end of the journal, which is left by a writer that crashed
+// mid-write.
+func (r *Reader) SkippedPartial() bool {
+	return r.partial
+}
+
+// ReadAll reads all remaining entries from newest to oldest and calls fn on
+// each of them. See cronmon.ReadJournal.
+func (r *Reader) ReadAll(ctx context.Context, fn cronmon.ReadFunc) error {
+	return cronmon.ReadJournal(ctx, r, fn)
+}
+
+// OpenReadOnly opens the journal at the given path and its rotated segments for
+// reading only. Unlike NewFileLockJournaler, it never creates any directory or
+// file and never takes the lock, so it can be used while cronmon is running,
+// such as by other users that can only read the journal. An error satisfying
+// os.IsNotExist is returned if there is no journal at the path.
+func OpenReadOnly(path string) (*SegmentReader, error) {
+	r, err := NewSegmentReader(path)
+	if err != nil {
+		return nil, err
 	}
 
-	event := cronmon.NewEvent(rawEvent.Type)
-	if event == nil {
-		return nil, time.Time{}, fmt.Errorf("unknown event %q", rawEvent.Type)
+	if len(r.paths) == 0 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
 	}
 
-	if err := json.Unmarshal(rawEvent.Data, event); err != nil {
-		return nil, time.Time{}, errors.Wrap(err, "failed to decode event data")
+	// Check that the newest segment is readable early rather than on the first
+	// read.
+	f, err := os.Open(r.paths[0])
+	if err != nil {
+		return nil, err
 	}
+	f.Close()
 
-	return event, rawEvent.Time, nil
+	return r, nil
 }
 
 // ReadPreviousStateFromFile reads the PreviousState from the given file path.
@@ -69,11 +222,11 @@ func ReadPreviousStateFromFile(path string) (*cronmon.PreviousState, error) {
 	}
 	defer f.Close()
 
-	return ReadPreviousState(f)
+	return cronmon.ReadPreviousState(NewFileReader(f))
 }
 
-// ReadPreviousState reads backwards the given reader to return the
-// PreviousState.
-func ReadPreviousState(r io.ReadSeeker) (*cronmon.PreviousState, error) {
-	return cronmon.ReadPreviousState(NewReader(r))
+// ReadPreviousState reads backwards the first size bytes of the given reader to
+// return the PreviousState.
+func ReadPreviousState(r io.ReaderAt, size int64) (*cronmon.PreviousState, error) {
+	return cronmon.ReadPreviousState(NewReader(r, size))
 }
@@ -0,0 +1,11 @@
+package journal
+
+import (
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+// NewRingWriter creates a journaler that keeps the last n events in memory.
+// Use its Snapshot method to get the events.
+func NewRingWriter(n int) *cronmon.RingJournal {
+	return cronmon.NewRingJournal(n)
+}
@@ -0,0 +1,183 @@
+package journal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/internal/rotate"
+	"github.com/pkg/errors"
+)
+
+// SegmentPath returns the path to the nth rotated segment of the journal at the
+// given path. Segment 1 is the newest. Rotated segments are gzip-compressed.
+func SegmentPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d.gz", path, n)
+}
+
+// Segments returns the paths of the journal at the given path and all its
+// rotated segments, from newest to oldest. The current journal is only
+// included if it exists.
+func Segments(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	type segment struct {
+		path string
+		n    int
+	}
+
+	segments := make([]segment, 0, len(matches))
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz"))
+		if err != nil || n < 1 {
+			continue
+		}
+		segments = append(segments, segment{match, n})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].n < segments[j].n
+	})
+
+	paths := make([]string, 0, len(segments)+1)
+	if _, err := os.Stat(path); err == nil {
+		paths = append(paths, path)
+	}
+	for _, segment := range segments {
+		paths = append(paths, segment.path)
+	}
+
+	return paths, nil
+}
+
+// SegmentReader reads a journal and all its rotated segments from newest to
+// oldest. Compressed segments are decompressed into memory only once the
+// reader reaches them.
+type SegmentReader struct {
+	// CorrectTimes is passed to the Reader of each segment. See
+	// Reader.CorrectTimes.
+	CorrectTimes bool
+
+	paths []string
+	f     *os.File
+	r     *Reader
+}
+
+var _ cronmon.JournalReader = (*SegmentReader)(nil)
+
+// NewSegmentReader creates a new SegmentReader for the journal at the given
+// path.
+func NewSegmentReader(path string) (*SegmentReader, error) {
+	paths, err := Segments(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find journal segments")
+	}
+
+	return &SegmentReader{paths: paths}, nil
+}
+
+// Read reads a single entry. An EOF error is returned once all segments have
+// been fully consumed.
+func (r *SegmentReader) Read() (cronmon.Event, time.Time, error) {
+	for {
+		if r.r == nil {
+			if len(r.paths) == 0 {
+				return nil, time.Time{}, io.EOF
+			}
+
+			if err := r.openNext(); err != nil {
+				return nil, time.Time{}, err
+			}
+		}
+
+		ev, t, err := r.r.Read()
+		if err == nil || !errors.Is(err, io.EOF) {
+			return ev, t, err
+		}
+
+		r.closeCurrent()
+	}
+}
+
+func (r *SegmentReader) openNext() error {
+	path := r.paths[0]
+	r.paths = r.paths[1:]
+
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open journal segment")
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		r.f = f
+		r.r = NewFileReader(f)
+		r.r.CorrectTimes = r.CorrectTimes
+		return nil
+	}
+
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decompress %s", path)
+	}
+	defer z.Close()
+
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decompress %s", path)
+	}
+
+	r.r = NewReader(bytes.NewReader(b), int64(len(b)))
+	r.r.CorrectTimes = r.CorrectTimes
+	return nil
+}
+
+func (r *SegmentReader) closeCurrent() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	r.r = nil
+}
+
+// Close closes the currently opened segment.
+func (r *SegmentReader) Close() error {
+	r.closeCurrent()
+	r.paths = nil
+	return nil
+}
+
+// rotateSegments compresses the file at path into a new segment 1, shifting
+// older segments up and deleting the ones beyond keep. The segments are left
+// as they were if compressing fails. The file itself is not truncated.
+func rotateSegments(f *os.File, path string, keep int) error {
+	if keep < 1 {
+		return errors.New("must keep at least 1 segment")
+	}
+
+	s, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat journal")
+	}
+
+	name := func(n int) string { return SegmentPath(path, n) }
+
+	if err := rotate.Rotate(keep, name, io.NewSectionReader(f, 0, s.Size())); err != nil {
+		return errors.Wrap(err, "failed to rotate journal")
+	}
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package journal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"github.com/pkg/errors"
+)
+
+// SplitJournaler is a journaler that writes the events of each process into
+// its own journal file inside a directory, while writing monitor-level events
+// into an index journaler. This keeps the events of a single process close
+// together, and it allows each process' journal to be managed separately.
+//
+// Since the index journaler does not contain process events, the previous
+// state cannot be read from it alone. Use NewSplitReader or OpenSplitReadOnly to
+// read the index and process journals as one.
+type SplitJournaler struct {
+	// Monotonic is passed to each per-process Writer. See Writer.Monotonic.
+	Monotonic bool
+	// Host is passed to each per-process Writer. See Writer.Host.
+	Host *Host
+	// Format is the format that new process journals are written in, or
+	// FormatJSON if it's empty. Existing ones are appended to in their own
+	// format.
+	Format Format
+
+	index cronmon.Journaler
+	dir   string
+
+	mutex   sync.Mutex
+	writers map[string]*splitWriter
+}
+
+type splitWriter struct {
+	Writer
+	f *os.File
+}
+
+var _ cronmon.Journaler = (*SplitJournaler)(nil)
+
+// NewSplitJournaler creates a new SplitJournaler that writes process events
+// into the given directory, which is created if it doesn't exist yet.
+func NewSplitJournaler(index cronmon.Journaler, dir string) (*SplitJournaler, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "failed to create journal directory")
+	}
+
+	return &SplitJournaler{
+		index:   index,
+		dir:     dir,
+		writers: map[string]*splitWriter{},
+	}, nil
+}
+
+// SplitJournalPath returns the path to the journal file of the process with the
+// given file name inside the SplitJournaler directory.
+func SplitJournalPath(dir, file string) string {
+	return filepath.Join(dir, file+".json")
+}
+
+// ID returns the ID of the index journaler prefixed with the directory.
+func (j *SplitJournaler) ID() string {
+	return "split:" + j.dir + "+" + j.index.ID()
+}
+
+// Write writes the event into the journal of its process if it's a process
+// event, or into the index journaler otherwise.
+func (j *SplitJournaler) Write(ev cronmon.Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+// WriteAt writes the event like Write but with the given time instead of the
+// current time. If the index journaler isn't a TimedJournaler, then it uses its
+// own time.
+func (j *SplitJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	pev, ok := ev.(cronmon.ProcessEvent)
+	if !ok || pev.ProcessFile() == "" {
+		return cronmon.WriteAt(j.index, ev, t)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	w, err := j.writer(pev.ProcessFile())
+	if err != nil {
+		return err
+	}
+
+	return w.WriteAt(ev, t)
+}
+
+func (j *SplitJournaler) writer(file string) (*splitWriter, error) {
+	if w, ok := j.writers[file]; ok {
+		return w, nil
+	}
+
+	path := SplitJournalPath(j.dir, file)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open process journal")
+	}
+
+	format, err := j.fileFormat(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := &splitWriter{
+		Writer: newWriter("file:"+path, f, format),
+		f:      f,
+	}
+	w.Monotonic = j.Monotonic
+	w.Host = j.Host
+
+	j.writers[file] = w
+	return w, nil
+}
+
+// fileFormat returns the format of the process journal file: the detected
+// format if the file has any records, or j.Format otherwise.
+func (j *SplitJournaler) fileFormat(f *os.File) (Format, error) {
+	size, err := fileSize(f)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to stat process journal")
+	}
+
+	format, err := DetectFormat(f, size)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case format != "":
+		return format, nil
+	case j.Format != "":
+		return j.Format, nil
+	default:
+		return FormatJSON, nil
+	}
+}
+
+// Close closes all per-process journal files. The index journaler is not
+// closed.
+func (j *SplitJournaler) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var firstErr error
+	for file, w := range j.writers {
+		if err := w.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(j.writers, file)
+	}
+
+	return firstErr
+}
+
+// MergedReader reads the events of several journals from newest to oldest as
+// if they were a single journal, such as the index and process journals of a
+// SplitJournaler.
+type MergedReader struct {
+	readers []cronmon.JournalReader
+	heads   []mergedHead
+}
+
+type mergedHead struct {
+	ev   cronmon.Event
+	t    time.Time
+	done bool
+}
+
+var _ cronmon.JournalReader = (*MergedReader)(nil)
+
+// NewMergedReader creates a new MergedReader over the given readers. Events
+// with the same time are read from the earlier reader first.
+func NewMergedReader(readers ...cronmon.JournalReader) *MergedReader {
+	return &MergedReader{
+		readers: readers,
+		heads:   make([]mergedHead, len(readers)),
+	}
+}
+
+// Read reads the newest event that hasn't been read yet out of all readers. An
+// EOF error is returned once all readers have been fully consumed.
+func (r *MergedReader) Read() (cronmon.Event, time.Time, error) {
+	newest := -1
+
+	for i := range r.heads {
+		head := &r.heads[i]
+		if head.done {
+			continue
+		}
+
+		if head.ev == nil {
+			ev, t, err := r.readers[i].Read()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					return nil, time.Time{}, err
+				}
+				head.done = true
+				continue
+			}
+			head.ev = ev
+			head.t = t
+		}
+
+		if newest == -1 || head.t.After(r.heads[newest].t) {
+			newest = i
+		}
+	}
+
+	if newest == -1 {
+		return nil, time.Time{}, io.EOF
+	}
+
+	head := &r.heads[newest]
+	ev, t := head.ev, head.t
+	head.ev = nil
+
+	return ev, t, nil
+}
+
+// Close closes all readers that can be closed.
+func (r *MergedReader) Close() error {
+	var firstErr error
+	for _, reader := range r.readers {
+		if c, ok := reader.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// NewSplitReader creates a MergedReader that reads the given index journal
+// along with all process journals inside the SplitJournaler directory. The
+// directory may not exist yet.
+func NewSplitReader(index cronmon.JournalReader, dir string) (*MergedReader, error) {
+	paths, err := filepath.Glob(SplitJournalPath(dir, "*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find process journals")
+	}
+
+	readers := make([]cronmon.JournalReader, 0, len(paths)+1)
+	readers = append(readers, index)
+
+	for _, path := range paths {
+		r, err := NewSegmentReader(path)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+
+	return NewMergedReader(readers...), nil
+}
+
+// OpenSplitReadOnly opens the index journal at the given path like
+// OpenReadOnly and merges it with the process journals inside dir. See
+// NewSplitReader.
+func OpenSplitReadOnly(path, dir string) (*MergedReader, error) {
+	index, err := OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewSplitReader(index, dir)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
@@ -1,9 +1,12 @@
 package journal
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"log"
+	"sync"
 	"time"
 
 	"git.unix.lgbt/diamondburned/cronmon/cronmon"
@@ -15,43 +18,145 @@ type Event struct {
 	Time time.Time     `json:"time"`
 	Type string        `json:"type"`
 	Data cronmon.Event `json:"data"`
+	Mono *MonoTime     `json:"mono,omitempty"`
+	Host *Host         `json:"host,omitempty"`
+}
+
+// MonoTime describes the time of an event relative to the start of the writer
+// that wrote it, measured using the monotonic clock. Unlike the wall time, it
+// is not affected by the system clock jumping, such as when the clock is first
+// synchronized on boards without a real-time clock.
+type MonoTime struct {
+	// Session is the random ID of the writer that wrote the event.
+	Session string `json:"session"`
+	// Offset is the monotonic duration since the writer was created.
+	Offset time.Duration `json:"offset"`
 }
 
 // Writer is a simple journaler that writes line-delimited JSON events into the
-// writer.
+// writer, or framed CBOR records if it's created with FormatCBOR.
 type Writer struct {
-	e  *json.Encoder
-	id string
+	// Monotonic, if true, makes the writer record the monotonic time of each
+	// event alongside its wall time. Readers can then use it to correct the
+	// timestamps of events written before the clock jumped.
+	Monotonic bool
+	// Host, if not nil, is written alongside every event, so that the host
+	// that wrote it is known once journals of several hosts are aggregated.
+	// See CurrentHost.
+	Host *Host
+
+	w      io.Writer
+	e      *json.Encoder
+	id     string
+	format Format
+
+	session string
+	start   time.Time
 }
 
 var _ cronmon.Journaler = (*Writer)(nil)
 
 // NewWriter creates a new journal writer.
 func NewWriter(id string, w io.Writer) *Writer {
-	return &Writer{json.NewEncoder(w), id}
+	writer := newWriter(id, w, FormatJSON)
+	return &writer
+}
+
+// NewFormatWriter creates a new journal writer that writes in the given format.
+func NewFormatWriter(id string, w io.Writer, format Format) *Writer {
+	writer := newWriter(id, w, format)
+	return &writer
+}
+
+func newWriter(id string, w io.Writer, format Format) Writer {
+	var session [8]byte
+	rand.Read(session[:])
+
+	return Writer{
+		w:       w,
+		e:       json.NewEncoder(w),
+		id:      id,
+		format:  format,
+		session: hex.EncodeToString(session[:]),
+		start:   time.Now(),
+	}
 }
 
 // ID returns the ID of the writer.
 func (w *Writer) ID() string { return w.id }
 
+// Format returns the format that the writer writes in.
+func (w *Writer) Format() Format { return w.format }
+
 // Write writes the given event into the writer. Writes are concurrently safe
 // and are atomic.
 func (w *Writer) Write(ev cronmon.Event) error {
-	evJSON := Event{
-		Time: time.Now(),
+	return w.WriteAt(ev, time.Now())
+}
+
+// WriteAt writes the given event into the writer with the given time instead of
+// the current time.
+func (w *Writer) WriteAt(ev cronmon.Event, t time.Time) error {
+	var mono *MonoTime
+	if w.Monotonic {
+		mono = &MonoTime{
+			Session: w.session,
+			Offset:  t.Sub(w.start),
+		}
+	}
+
+	if w.format == FormatCBOR {
+		// Like Encode, write the whole record in one go.
+		err := encodeBinary(ev, t, mono, w.Host, func(b []byte) error {
+			_, err := w.w.Write(b)
+			return err
+		})
+		return errors.Wrap(err, "failed to write event")
+	}
+
+	e := jsonEvents.Get().(*jsonEvent)
+	defer e.release()
+
+	e.Event = Event{
+		Time: t,
 		Type: ev.Type(),
 		Data: ev,
+		Host: w.Host,
+	}
+	if mono != nil {
+		e.mono = *mono
+		e.Mono = &e.mono
 	}
 
 	// Encode's implementation both does the write in one go and append a new
 	// line after each call.
-	if err := w.e.Encode(evJSON); err != nil {
+	if err := w.e.Encode(&e.Event); err != nil {
+		// The encoder keeps returning the first write error, so replace it to
+		// be able to write again, such as once the disk is no longer full.
+		w.e = json.NewEncoder(w.w)
 		return errors.Wrap(err, "failed to marshal event")
 	}
 
 	return nil
 }
 
+// jsonEvent is an Event that is reused across writes to save allocations, so
+// it's kept in jsonEvents.
+type jsonEvent struct {
+	Event
+	mono MonoTime
+}
+
+var jsonEvents = sync.Pool{
+	New: func() interface{} { return &jsonEvent{} },
+}
+
+// release clears the event and puts it back into jsonEvents.
+func (e *jsonEvent) release() {
+	*e = jsonEvent{}
+	jsonEvents.Put(e)
+}
+
 // HumanWriter writes the journal in a human-friendly format. The format cannot
 // be parsed; use a regular Writer for this.
 type HumanWriter struct {
@@ -81,5 +186,18 @@ func (w *HumanWriter) Write(ev cronmon.Event) error {
 	}
 
 	w.log.Printf("%s: %s\n", ev.Type(), string(b))
+
+	// Hints are meant for humans, so they're repeated on their own line.
+	switch ev := ev.(type) {
+	case *cronmon.EventProcessSpawnError:
+		if ev.Hint != "" {
+			w.log.Printf("hint: %s: %s\n", ev.File, ev.Hint)
+		}
+	case *cronmon.EventProcessSpawnFailing:
+		if ev.Hint != "" {
+			w.log.Printf("hint: %s: %s\n", ev.File, ev.Hint)
+		}
+	}
+
 	return nil
 }
@@ -9,7 +9,8 @@ import (
 )
 
 // mockJournal is an in-memory storage of journals, primarily used for testing.
-// A zero-value instance is a valid instance.
+// A zero-value instance is a valid instance. It mirrors cronmontest.Journal,
+// which can't be imported here without an import cycle.
 type mockJournal struct {
 	mutex    sync.Mutex
 	finalize bool
@@ -41,6 +42,20 @@ func (m *mockJournal) Write(ev Event) error {
 	return nil
 }
 
+// States returns the process state changes out of the journaled events.
+func (m *mockJournal) States() []*EventProcessStateChanged {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var states []*EventProcessStateChanged
+	for _, ev := range m.journals {
+		if ev, ok := ev.(*EventProcessStateChanged); ok {
+			states = append(states, ev)
+		}
+	}
+	return states
+}
+
 // Journals returns the journal slice.
 func (m *mockJournal) Journals() []Event {
 	m.mutex.Lock()
@@ -82,6 +97,7 @@ func TestReadPreviousState(t *testing.T) {
 		&EventProcessExited{PID: 3, File: "b"},
 		&EventProcessSpawned{PID: 2, File: "a"},
 		&EventProcessSpawned{PID: 3, File: "b"},
+		&EventProcessAdopted{PID: 4, File: "c"},
 		&EventAcquired{},
 	}
 
@@ -100,7 +116,13 @@ func TestReadPreviousState(t *testing.T) {
 
 	expect := &PreviousState{
 		StartedAt: d,
-		Processes: map[string]int{"a": 2},
+		Processes: map[string]int{"a": 2, "c": 4},
+		Restarts:  map[string]int{"a": 0, "b": 0},
+		RecentSpawns: map[string][]time.Time{
+			"a": {d, d},
+			"b": {d},
+		},
+		Flapping: map[string]float64{"a": 1 / FlapWindow.Hours(), "b": 0},
 	}
 
 	if !reflect.DeepEqual(state, expect) {
@@ -0,0 +1,297 @@
+// Package leader provides leader election between cronmon daemons on several
+// hosts that share storage, so that only one of them runs the scripts at a
+// time.
+//
+// The election uses a lease file on the shared storage. The leader rewrites
+// the lease every heartbeat interval. Other hosts take the lease over once it
+// hasn't changed for the lease timeout, as observed by their own clocks, so
+// clocks don't need to be synchronized across hosts. Every takeover increments
+// the lease's fencing token, which can be used to reject stale leaders.
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HeartbeatInterval is the default interval at which the leader renews its
+// lease and at which other hosts check it.
+var HeartbeatInterval = 5 * time.Second
+
+// LeaseTimeout is the default duration after which a lease that hasn't been
+// renewed is considered expired. It should be several heartbeat intervals.
+var LeaseTimeout = 30 * time.Second
+
+// Lease is the content of the lease file.
+type Lease struct {
+	// Holder identifies the leader as "host:pid". It is empty if the lease
+	// was released.
+	Holder string `json:"holder"`
+	// Token is the fencing token, which is incremented on every takeover.
+	Token uint64 `json:"token"`
+	// Beat is incremented on every renewal.
+	Beat uint64 `json:"beat"`
+}
+
+// ReadLease reads the lease file at the given path.
+func ReadLease(path string) (*Lease, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lease Lease
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, errors.Wrap(err, "failed to parse lease")
+	}
+
+	return &lease, nil
+}
+
+// writeLease atomically writes the lease. The writer's ID keeps the temporary
+// files of different candidates apart.
+func writeLease(path, id string, lease Lease) error {
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	// Write into a temporary file first, so that other hosts never read a
+	// partially written lease.
+	tmp := path + "." + strings.ReplaceAll(id, "/", "_") + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Elector campaigns for the leadership using a lease file.
+type Elector struct {
+	// ID identifies this candidate. It defaults to "host:pid".
+	ID string
+	// Interval is the heartbeat interval. It defaults to HeartbeatInterval.
+	Interval time.Duration
+	// Timeout is the lease timeout. It defaults to LeaseTimeout.
+	Timeout time.Duration
+
+	path string
+}
+
+// NewElector creates a new elector for the lease file at the given path.
+func NewElector(path string) *Elector {
+	host, _ := os.Hostname()
+
+	return &Elector{
+		ID:       fmt.Sprintf("%s:%d", host, os.Getpid()),
+		Interval: HeartbeatInterval,
+		Timeout:  LeaseTimeout,
+		path:     path,
+	}
+}
+
+// Acquire blocks until this candidate becomes the leader or the context is
+// canceled.
+func (e *Elector) Acquire(ctx context.Context) (*Term, error) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	var last *Lease
+	var lastChange time.Time
+
+	for {
+		lease, err := ReadLease(e.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "failed to read lease")
+		}
+
+		now := time.Now()
+		if lastChange.IsZero() || !sameLease(last, lease) {
+			last = lease
+			lastChange = now
+		}
+
+		if lease == nil || lease.Holder == "" || lease.Holder == e.ID ||
+			now.Sub(lastChange) >= e.Timeout {
+
+			term, err := e.claim(ctx, lease)
+			if err != nil || term != nil {
+				return term, err
+			}
+
+			// Someone else claimed the lease at the same time and won.
+			lastChange = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim tries to take over the given expired lease. A nil term is returned if
+// another candidate won.
+func (e *Elector) claim(ctx context.Context, old *Lease) (*Term, error) {
+	lease := Lease{Holder: e.ID, Token: 1}
+	if old != nil {
+		lease.Token = old.Token + 1
+	}
+
+	if err := writeLease(e.path, e.ID, lease); err != nil {
+		return nil, errors.Wrap(err, "failed to write lease")
+	}
+
+	// Wait for candidates that claimed at the same time to finish writing.
+	// The last one to write wins.
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(e.Interval):
+	}
+
+	current, err := ReadLease(e.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to read lease")
+	}
+
+	if current == nil || current.Holder != e.ID || current.Token != lease.Token {
+		return nil, nil
+	}
+
+	return newTerm(e, *current), nil
+}
+
+func sameLease(a, b *Lease) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Term is a term of leadership. The leader must stop doing its work once the
+// term is lost.
+type Term struct {
+	e     *Elector
+	lease Lease
+
+	lost   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	closer sync.Once
+}
+
+func newTerm(e *Elector, lease Lease) *Term {
+	t := &Term{
+		e:     e,
+		lease: lease,
+		lost:  make(chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	go t.heartbeat()
+
+	return t
+}
+
+// Token returns the fencing token of the term.
+func (t *Term) Token() uint64 {
+	return t.lease.Token
+}
+
+// Lost returns a channel that is closed once the term is lost, either because
+// another candidate took the lease over or because the lease couldn't be
+// renewed in time.
+func (t *Term) Lost() <-chan struct{} {
+	return t.lost
+}
+
+// Resign stops renewing the lease and releases it if it's still held, so that
+// another candidate can take over immediately. The released lease keeps its
+// fencing token, so that the next token is still greater.
+func (t *Term) Resign() error {
+	t.closer.Do(func() { close(t.stop) })
+	<-t.done
+
+	lease, err := ReadLease(t.e.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if lease.Holder == t.e.ID && lease.Token == t.lease.Token {
+		return writeLease(t.e.path, t.e.ID, Lease{Token: lease.Token})
+	}
+
+	return nil
+}
+
+func (t *Term) heartbeat() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.e.Interval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := t.renew(); err != nil {
+			if errors.Is(err, errLeaseLost) {
+				close(t.lost)
+				return
+			}
+
+			// Give up before other candidates may consider the lease expired,
+			// so that two leaders never run at the same time.
+			if time.Since(renewed) >= t.e.Timeout/2 {
+				close(t.lost)
+				return
+			}
+
+			continue
+		}
+
+		renewed = time.Now()
+	}
+}
+
+var errLeaseLost = errors.New("lease lost")
+
+func (t *Term) renew() error {
+	lease, err := ReadLease(t.e.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errLeaseLost
+		}
+		return err
+	}
+
+	if lease.Holder != t.e.ID || lease.Token != t.lease.Token {
+		return errLeaseLost
+	}
+
+	t.lease.Beat = lease.Beat + 1
+	return writeLease(t.e.path, t.e.ID, t.lease)
+}
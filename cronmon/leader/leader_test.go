@@ -0,0 +1,93 @@
+package leader
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestElector(path, id string) *Elector {
+	e := NewElector(path)
+	e.ID = id
+	e.Interval = 5 * time.Millisecond
+	e.Timeout = 50 * time.Millisecond
+	return e
+}
+
+func TestElector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a := newTestElector(path, "a")
+	b := newTestElector(path, "b")
+
+	termA, err := a.Acquire(ctx)
+	if err != nil {
+		t.Fatal("a failed to acquire:", err)
+	}
+	if termA.Token() != 1 {
+		t.Errorf("expected token 1, got %d", termA.Token())
+	}
+
+	// b must not take over while a is renewing its lease.
+	shortCtx, shortCancel := context.WithTimeout(ctx, 150*time.Millisecond)
+	defer shortCancel()
+
+	if _, err := b.Acquire(shortCtx); err == nil {
+		t.Fatal("b acquired a lease that is being renewed")
+	}
+
+	// b takes over once a stops renewing without resigning, such as when its
+	// host dies.
+	termA.closer.Do(func() { close(termA.stop) })
+	<-termA.done
+
+	termB, err := b.Acquire(ctx)
+	if err != nil {
+		t.Fatal("b failed to acquire:", err)
+	}
+	if termB.Token() != 2 {
+		t.Errorf("expected token 2, got %d", termB.Token())
+	}
+
+	if err := termB.Resign(); err != nil {
+		t.Fatal("b failed to resign:", err)
+	}
+
+	// a takes over immediately after b resigns.
+	termA, err = a.Acquire(ctx)
+	if err != nil {
+		t.Fatal("a failed to reacquire:", err)
+	}
+	defer termA.Resign()
+
+	if termA.Token() != 3 {
+		t.Errorf("expected token 3 after resignation, got %d", termA.Token())
+	}
+}
+
+func TestTermLost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+
+	a := newTestElector(path, "a")
+
+	term, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatal("failed to acquire:", err)
+	}
+	defer term.Resign()
+
+	// Simulate another host taking the lease over.
+	if err := writeLease(path, "b", Lease{Holder: "b", Token: term.Token() + 1}); err != nil {
+		t.Fatal("failed to write lease:", err)
+	}
+
+	select {
+	case <-term.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("term was not lost after takeover")
+	}
+}
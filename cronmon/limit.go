@@ -0,0 +1,95 @@
+package cronmon
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxEventFieldSize is the maximum size in bytes of the free-form fields of
+// events, such as spawn error reasons and warnings, which may contain
+// arbitrary output of a process. Longer strings are cut to this size and end
+// with a marker of how much was truncated, and longer reported events are
+// replaced with a warning. Zero disables the limit.
+var MaxEventFieldSize = 8 * 1024
+
+// truncateField truncates s to MaxEventFieldSize bytes, if needed. A truncated
+// string is cut at a rune boundary and ends with a truncation marker.
+func truncateField(s string) string {
+	if MaxEventFieldSize <= 0 || len(s) <= MaxEventFieldSize {
+		return s
+	}
+
+	n := MaxEventFieldSize
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return fmt.Sprintf("%s... [truncated %d bytes]", s[:n], len(s)-n)
+}
+
+// LimitEvent returns the event with its free-form fields truncated to
+// MaxEventFieldSize. The given event is never modified; a copy is returned if
+// any field is truncated.
+func LimitEvent(ev Event) Event {
+	switch ev := ev.(type) {
+	case *EventWarning:
+		if s := truncateField(ev.Error); s != ev.Error {
+			cpy := *ev
+			cpy.Error = s
+			return &cpy
+		}
+	case *EventWarningsSuppressed:
+		if s := truncateField(ev.Error); s != ev.Error {
+			cpy := *ev
+			cpy.Error = s
+			return &cpy
+		}
+	case *EventLogTruncated:
+		if s := truncateField(ev.Reason); s != ev.Reason {
+			cpy := *ev
+			cpy.Reason = s
+			return &cpy
+		}
+	case *EventProcessSpawnError:
+		if s := truncateField(ev.Reason); s != ev.Reason {
+			cpy := *ev
+			cpy.Reason = s
+			return &cpy
+		}
+	case *EventProcessSpawnFailing:
+		if s := truncateField(ev.Reason); s != ev.Reason {
+			cpy := *ev
+			cpy.Reason = s
+			return &cpy
+		}
+	case *EventProcessExited:
+		if s := truncateField(ev.Error); s != ev.Error {
+			cpy := *ev
+			cpy.Error = s
+			return &cpy
+		}
+	case *EventControlAction:
+		if s := truncateField(ev.Error); s != ev.Error {
+			cpy := *ev
+			cpy.Error = s
+			return &cpy
+		}
+	}
+
+	return ev
+}
+
+// limitJournaler truncates the fields of events with LimitEvent before writing
+// them, so that no journaler after it sees oversized events.
+type limitJournaler struct {
+	Journaler
+}
+
+func (j limitJournaler) Write(ev Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j limitJournaler) WriteAt(ev Event, t time.Time) error {
+	return WriteAt(j.Journaler, LimitEvent(ev), t)
+}
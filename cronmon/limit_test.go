@@ -0,0 +1,35 @@
+package cronmon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimitEvent(t *testing.T) {
+	limit := MaxEventFieldSize
+	t.Cleanup(func() { MaxEventFieldSize = limit })
+	MaxEventFieldSize = 7
+
+	short := &EventProcessSpawnError{File: "a", Reason: "short"}
+	if ev := LimitEvent(short); ev != short {
+		t.Errorf("short event was copied: %#v", ev)
+	}
+
+	// "é" is 2 bytes, so 7 bytes end in the middle of the 4th one.
+	long := &EventProcessSpawnError{File: "a", Reason: "ééééé"}
+	ev := LimitEvent(long).(*EventProcessSpawnError)
+
+	if ev.Reason != "ééé... [truncated 4 bytes]" {
+		t.Errorf("unexpected truncated reason %q", ev.Reason)
+	}
+	if long.Reason != "ééééé" {
+		t.Errorf("original event was modified: %q", long.Reason)
+	}
+
+	var j mockJournal
+	reportEvent(&j, "a", 1, []byte(ProcessEventPrefix+`{"a": "`+strings.Repeat("a", 8)+`"}`))
+
+	j.Verify(t, true, []Event{
+		&EventWarning{Component: "process", Error: "a: reported event is too large (17 bytes)"},
+	})
+}
@@ -0,0 +1,308 @@
+package cronmon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/internal/rotate"
+	"github.com/pkg/errors"
+)
+
+// logFile is the log file of a process, which is rotated once it exceeds its
+// maximum size. It is not thread-safe.
+type logFile struct {
+	path     string
+	maxSize  int64 // 0 for no rotation
+	maxFiles int
+	compress bool
+	// warn, if not nil, is called with the errors of compressing rotated
+	// files, which happens in the background.
+	warn func(error)
+
+	f           *os.File
+	size        int64
+	compressing chan struct{} // closed once rotated file 1 is compressed
+}
+
+// openLog opens the log file of a script for the given configuration. Nil is
+// returned if the script has no log file.
+func openLog(dir string, cfg ScriptConfig) (*logFile, error) {
+	if cfg.Log == "" {
+		return nil, nil
+	}
+
+	log := &logFile{
+		path:     resolvePath(dir, cfg.Log),
+		maxSize:  cfg.LogMaxSize,
+		maxFiles: cfg.logMaxFiles(),
+		compress: cfg.LogCompress,
+	}
+
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func (log *logFile) open() error {
+	f, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open log")
+	}
+
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to stat log")
+	}
+
+	log.f = f
+	log.size = s.Size()
+	return nil
+}
+
+// Write writes b into the log file. The file is rotated beforehand if writing b
+// would exceed the maximum size.
+func (log *logFile) Write(b []byte) (int, error) {
+	if log.maxSize > 0 && log.size > 0 && log.size+int64(len(b)) > log.maxSize {
+		if err := log.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := log.f.Write(b)
+	log.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current log file into rotated file 1, shifting older
+// rotated files up and deleting the ones beyond maxFiles, then opens a new log
+// file. Rotated file 1 is compressed in the background, so that the process's
+// output isn't held up meanwhile, and it's kept uncompressed if that fails.
+func (log *logFile) rotate() error {
+	// Shifting renames rotated file 1, so it must be compressed by now.
+	log.waitCompressed()
+
+	if err := log.f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close log")
+	}
+
+	for _, gz := range []bool{false, true} {
+		err := rotate.Shift(log.maxFiles, func(n int) string {
+			return rotatedLogPath(log.path, n, gz)
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to shift rotated log")
+		}
+	}
+
+	rotated := rotatedLogPath(log.path, 1, false)
+
+	if err := os.Rename(log.path, rotated); err != nil {
+		return errors.Wrap(err, "failed to rotate log")
+	}
+
+	if err := log.open(); err != nil {
+		return err
+	}
+
+	if log.compress {
+		done := make(chan struct{})
+		log.compressing = done
+
+		go func() {
+			defer close(done)
+
+			if err := compressFile(rotated); err != nil && log.warn != nil {
+				log.warn(errors.Wrap(err, "failed to compress rotated log, keeping it uncompressed"))
+			}
+		}()
+	}
+
+	return nil
+}
+
+// waitCompressed waits until rotated file 1 is compressed, if it's being
+// compressed.
+func (log *logFile) waitCompressed() {
+	if log.compressing != nil {
+		<-log.compressing
+		log.compressing = nil
+	}
+}
+
+// Close closes the log file and waits until rotated file 1 is compressed.
+func (log *logFile) Close() error {
+	err := log.f.Close()
+	log.waitCompressed()
+	return err
+}
+
+// rotatedLogPath returns the path to the nth rotated file of the log at the
+// given path. File 1 is the newest.
+func rotatedLogPath(path string, n int, gz bool) string {
+	path = fmt.Sprintf("%s.%d", path, n)
+	if gz {
+		path += ".gz"
+	}
+	return path
+}
+
+// compressFile compresses the file at path into path.gz and removes it.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := rotate.Compress(path+".gz", in); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// rotatedLog is a rotated file of a log.
+type rotatedLog struct {
+	path string
+	n    int
+}
+
+// rotatedLogs returns the rotated files of the log at the given path, from
+// newest to oldest.
+func rotatedLogs(path string) ([]rotatedLog, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	logs := make([]rotatedLog, 0, len(matches))
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 1 {
+			continue
+		}
+
+		logs = append(logs, rotatedLog{match, n})
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].n < logs[j].n
+	})
+
+	return logs, nil
+}
+
+// ScriptLog describes the log file of a script.
+type ScriptLog struct {
+	File string `json:"file"`
+	Path string `json:"path"`
+	// Size is the total size of the log file and its rotated files.
+	Size int64 `json:"size"`
+	// Rotated contains the paths of the rotated files, from newest to oldest.
+	Rotated []string `json:"rotated,omitempty"`
+}
+
+// ListLogs returns the log files of all scripts in the given directory that
+// have one configured. Scripts whose configuration cannot be loaded are
+// skipped.
+func ListLogs(dir string) ([]ScriptLog, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []ScriptLog
+
+	for _, file := range files {
+		if !isScriptName(file.Name()) || !isScriptMode(file.Type()) {
+			continue
+		}
+
+		cfg, err := LoadScriptConfig(dir, file.Name())
+		if err != nil || cfg.Log == "" {
+			continue
+		}
+
+		log := ScriptLog{
+			File: file.Name(),
+			Path: resolvePath(dir, cfg.Log),
+		}
+
+		if s, err := os.Stat(log.Path); err == nil {
+			log.Size += s.Size()
+		}
+
+		rotated, err := rotatedLogs(log.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range rotated {
+			if s, err := os.Stat(r.path); err == nil {
+				log.Size += s.Size()
+			}
+			log.Rotated = append(log.Rotated, r.path)
+		}
+
+		logs = append(logs, log)
+	}
+
+	return logs, nil
+}
+
+// PruneLogs removes the rotated log files of all scripts in the given directory
+// that are beyond their LogMaxFiles, such as after the limit is lowered. If all
+// is true, then all rotated log files are removed. The paths of the removed
+// files are returned.
+func PruneLogs(dir string, all bool) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+
+	for _, file := range files {
+		if !isScriptName(file.Name()) || !isScriptMode(file.Type()) {
+			continue
+		}
+
+		cfg, err := LoadScriptConfig(dir, file.Name())
+		if err != nil || cfg.Log == "" {
+			continue
+		}
+
+		rotated, err := rotatedLogs(resolvePath(dir, cfg.Log))
+		if err != nil {
+			return removed, err
+		}
+
+		keep := cfg.logMaxFiles()
+		if all {
+			keep = 0
+		}
+
+		for _, r := range rotated {
+			if r.n <= keep {
+				continue
+			}
+
+			if err := os.Remove(r.path); err != nil {
+				return removed, errors.Wrap(err, "failed to remove rotated log")
+			}
+
+			removed = append(removed, r.path)
+		}
+	}
+
+	return removed, nil
+}
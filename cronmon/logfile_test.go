@@ -0,0 +1,130 @@
+package cronmon
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLogFileRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := openLog(dir, ScriptConfig{
+		Log:         "a.log",
+		LogMaxSize:  8,
+		LogMaxFiles: 2,
+		LogCompress: true,
+	})
+	if err != nil {
+		t.Fatal("failed to open log:", err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := log.Write([]byte(line)); err != nil {
+			t.Fatal("failed to write log:", err)
+		}
+	}
+
+	// Rotated files are compressed in the background until closing.
+	if err := log.Close(); err != nil {
+		t.Fatal("failed to close log:", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "a.log"))
+	if err != nil {
+		t.Fatal("failed to read log:", err)
+	}
+	if string(b) != "fourth\n" {
+		t.Fatalf("unexpected log %q", b)
+	}
+
+	rotated, err := rotatedLogs(filepath.Join(dir, "a.log"))
+	if err != nil {
+		t.Fatal("failed to list rotated logs:", err)
+	}
+
+	expect := []rotatedLog{
+		{filepath.Join(dir, "a.log.1.gz"), 1},
+		{filepath.Join(dir, "a.log.2.gz"), 2},
+	}
+	if !reflect.DeepEqual(rotated, expect) {
+		t.Fatalf("unexpected rotated logs %v, expected %v", rotated, expect)
+	}
+}
+
+func TestLogFileCompressFailed(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := openLog(dir, ScriptConfig{
+		Log:         "a.log",
+		LogMaxSize:  8,
+		LogMaxFiles: 2,
+		LogCompress: true,
+	})
+	if err != nil {
+		t.Fatal("failed to open log:", err)
+	}
+
+	var warnings []error
+	log.warn = func(err error) { warnings = append(warnings, err) }
+
+	// Compressing fails since its temporary file can't be created.
+	if err := os.Mkdir(filepath.Join(dir, "a.log.1.gz.tmp"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := log.Write([]byte(line)); err != nil {
+			t.Fatal("failed to write log:", err)
+		}
+	}
+
+	if err := log.Close(); err != nil {
+		t.Fatal("failed to close log:", err)
+	}
+
+	if len(warnings) != 1 {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	// Logging goes on, and the rotated file is kept as it is.
+	for name, expect := range map[string]string{"a.log": "second\n", "a.log.1": "first\n"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != expect {
+			t.Errorf("%s is %q, expected %q (%v)", name, b, expect, err)
+		}
+	}
+}
+
+func TestPruneLogs(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0755); err != nil {
+		t.Fatal("failed to create script:", err)
+	}
+	writeConfig(t, ScriptConfigPath(dir, "a"), `{"log":"a.log","log_max_files":1}`)
+
+	for _, name := range []string{"a.log", "a.log.1", "a.log.2.gz", "a.log.3"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal("failed to create log:", err)
+		}
+	}
+
+	removed, err := PruneLogs(dir, false)
+	if err != nil {
+		t.Fatal("failed to prune logs:", err)
+	}
+
+	expect := []string{
+		filepath.Join(dir, "a.log.2.gz"),
+		filepath.Join(dir, "a.log.3"),
+	}
+	if !reflect.DeepEqual(removed, expect) {
+		t.Fatalf("unexpected removed logs %v, expected %v", removed, expect)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.log.1")); err != nil {
+		t.Fatal("kept rotated log is gone:", err)
+	}
+}
@@ -2,72 +2,347 @@ package cronmon
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
 	"github.com/pkg/errors"
 )
 
+// ScriptCheckInterval is the interval at which the monitor checks whether
+// running processes' scripts still match the ones they were started from. See
+// ProcessStatus.RestartNeeded.
+var ScriptCheckInterval = time.Minute
+
+// MonitorSpawnConcurrency is the default number of processes that a Monitor
+// spawns at the same time, so that starting a large directory doesn't fork
+// thousands of processes at once. Processes stay ProcessStarting while they
+// wait for their turn, and stopping them meanwhile journals an
+// EventProcessSpawnCanceled.
+var MonitorSpawnConcurrency = 64
+
+// MonitorRecentEvents is the number of recent events that each Monitor keeps
+// in memory.
+var MonitorRecentEvents = 256
+
 // Monitor is a cronmon instance that keeps a group of processes.
 type Monitor struct {
-	j Journaler
+	j        Journaler
+	recent   *RingJournal
+	bus      *EventBus
+	health   *healthJournaler
+	warnings *RateLimiter
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// procCtx is the context of the processes. It isn't derived from ctx, so
+	// that Stop can stop them in order instead of all at once.
+	procCtx    context.Context
+	procCancel context.CancelFunc
+
 	dir   string
-	done  chan struct{}
+	done  chan struct{} // closed once the monitor goroutine has shut down
 	ctrl  chan func()
-	procs map[string]*Process
 	watch *Watcher
+	// scanned is closed once the scripts found by the initial scan of the
+	// directory have been added.
+	scanned <-chan struct{}
+
+	// syncing is closed once the artifact syncer has exited, or is nil if
+	// there's none.
+	syncing chan struct{}
+
+	// procs is only modified in the monitor goroutine, and pmut must be held
+	// while doing so. Other goroutines must hold pmut to read it. names is the
+	// same keyed by the journal-facing script names. See addFile.
+	procs map[string]*Process
+	names map[string]*Process
+	pmut  sync.RWMutex
+
+	output   *LogMux
+	dryRun   bool
+	settle   time.Duration
+	spawners map[string]Spawner
+	breaker  *restartBreaker
+	waiters  *waiterSet
+	slots    chan struct{}
+	pressure PressureLimits
+	user     *user.User
+	fence    uint64
+
+	// restarts contains the restart counters of known scripts that don't have
+	// a process, such as removed ones or ones restored from the previous state.
+	// spawns is the same for recent spawn times. Both are keyed by the
+	// journal-facing script names.
+	restarts map[string]int
+	spawns   map[string][]time.Time
+	// orphans contains the PIDs of the processes that the previous cronmon
+	// left running, keyed by script name, until they're adopted.
+	orphans map[string]int
+
+	// stopped contains the file names of manually stopped scripts.
+	stopped map[string]struct{}
+
+	// groups caches the groups of scripts by file name, so that snapshots
+	// don't load every script's configuration. An entry is dropped whenever
+	// its script or configuration changes.
+	groups map[string]string
 }
 
+// DirSettle is the default duration that changes in the scripts directory must
+// be quiet for before they're applied together, so that deploying a new scripts
+// tree doesn't restart processes one by one while it's being written. See
+// MonitorOptions.Settle.
+var DirSettle = time.Second
+
+// MaxSettleFactor limits how long changes are settled for if the directory
+// never goes quiet, as a multiple of the settle duration.
+const MaxSettleFactor = 10
+
+// ErrUnknownProcess is returned when an operation is done on a process that
+// the monitor does not know of.
+var ErrUnknownProcess = errors.New("unknown process")
+
+// ErrMonitorStopped is returned when an operation is done on a stopped
+// monitor.
+var ErrMonitorStopped = errors.New("monitor stopped")
+
 // PreviousState parses the last cronmon's previous state to be used by Monitor
 // for restoring.
 type PreviousState struct {
 	StartedAt time.Time
 	// Processes contains a map of known files to the previous PIDs.
 	Processes map[string]int
+	// Restarts contains a map of known files to their cumulative restart
+	// counters.
+	Restarts map[string]int
+	// RecentSpawns contains a map of known files to their spawn times within
+	// the FlapWindow, sorted from oldest to newest.
+	RecentSpawns map[string][]time.Time
+	// Flapping contains a map of known files to their flapping scores. See
+	// FlapScore.
+	Flapping map[string]float64
 }
 
 // NewMonitor creates a new monitor that oversees adding and removing processes.
 // All files in the given directory will be scanned.
 func NewMonitor(ctx context.Context, dir string, j Journaler) (*Monitor, error) {
-	m, err := newMonitor(ctx, dir, j)
+	return NewMonitorWithState(ctx, dir, j, nil)
+}
+
+// NewMonitorWithState creates a new monitor like NewMonitor, except the
+// statistics of known scripts are restored from the given previous state. The
+// state may be nil.
+func NewMonitorWithState(
+	ctx context.Context, dir string, j Journaler, state *PreviousState) (*Monitor, error) {
+
+	return NewMonitorWithOptions(ctx, dir, j, MonitorOptions{State: state})
+}
+
+// MonitorOptions contains optional parameters for a Monitor.
+type MonitorOptions struct {
+	// State, if not nil, is the previous state that the statistics of known
+	// scripts are restored from.
+	State *PreviousState
+	// Output, if not nil, receives the stdout and stderr of all processes,
+	// prefixed with their script names.
+	Output *LogMux
+	// DryRun, if true, makes the monitor scan the directory and resolve the
+	// configuration of each script, but only journal what it would spawn as
+	// EventDryRunSpawn instead of spawning anything.
+	DryRun bool
+	// Settle is the duration that changes in the scripts directory must be
+	// quiet for before they're applied together. It defaults to DirSettle. A
+	// negative duration applies each change immediately.
+	Settle time.Duration
+	// Spawners are the spawners that scripts can choose by name with their
+	// "spawner" option. See Spawner.
+	Spawners map[string]Spawner
+	// RestartLimit is the number of automatic restarts per minute across all
+	// processes above which the monitor is throttled. It defaults to
+	// MonitorRestartLimit. A negative limit disables throttling. See
+	// EventMonitorThrottled.
+	RestartLimit int
+	// Pressure are the limits of the host's pressure above which the restarts
+	// of crashed processes are deferred. See PressureLimits.
+	Pressure PressureLimits
+	// SpawnConcurrency is the number of processes that may be spawned at the
+	// same time. It defaults to MonitorSpawnConcurrency. A negative number
+	// removes the limit.
+	SpawnConcurrency int
+	// WarningLimit is the rate limit of the warnings of each component, such
+	// as the watcher of the scripts directory, above which they're left out of
+	// the journal and summarized in an EventWarningsSuppressed instead. It
+	// defaults to MonitorWarningLimit. A negative Burst removes the limit.
+	WarningLimit StartLimit
+	// User, if not nil, is the user that the processes run as instead of
+	// cronmon's, such as for a cronmon running as root that supervises the
+	// scripts of a user. Their environment is that of StandardEnv, and the
+	// options of the scripts' configuration that cronmon would act on with
+	// its own privileges, such as log files and secrets, aren't allowed.
+	User *user.User
+	// Fence, if not zero, is the fencing token of the leadership term that
+	// the monitor runs in. Processes get it in the FenceEnv environment
+	// variable, so that they can reject the writes of a stale leader's
+	// processes. See package leader.
+	Fence uint64
+}
+
+// NewMonitorWithOptions creates a new monitor like NewMonitor with the given
+// options.
+func NewMonitorWithOptions(
+	ctx context.Context, dir string, j Journaler, opts MonitorOptions) (*Monitor, error) {
+
+	m, err := newMonitor(ctx, dir, j, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	j.Write(&EventAcquired{
+	if state := opts.State; state != nil {
+		for file, restarts := range state.Restarts {
+			m.restarts[file] = restarts
+		}
+		for file, spawns := range state.RecentSpawns {
+			m.spawns[file] = spawns
+		}
+		// Never touch the processes of a live cronmon in dry runs.
+		if !opts.DryRun {
+			for file, pid := range state.Processes {
+				m.orphans[file] = pid
+			}
+		}
+	}
+
+	m.j.Write(&EventAcquired{
 		JournalID: j.ID(),
+		DryRun:    opts.DryRun,
 	})
 
-	m.RescanDir()
+	m.j.Write(&EventStatsSnapshot{
+		Restarts: copyRestarts(m.restarts),
+	})
+
+	m.scanned = m.rescanDir()
 	return m, nil
 }
 
-func newMonitor(ctx context.Context, dir string, j Journaler) (*Monitor, error) {
+func copyRestarts(restarts map[string]int) map[string]int {
+	cpy := make(map[string]int, len(restarts))
+	for file, n := range restarts {
+		cpy[file] = n
+	}
+	return cpy
+}
+
+func newMonitor(ctx context.Context, dir string, j Journaler, opts MonitorOptions) (*Monitor, error) {
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return nil, errors.Wrap(err, "failed to create scripts directory")
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
+	procCtx, procCancel := context.WithCancel(context.Background())
+
+	// Truncate oversized events once for every journaler.
+	j = limitJournaler{j}
+
+	// Remember whether journal writes fail for Health.
+	health := &healthJournaler{Journaler: j}
+	j = health
+
+	// Always keep the recent events in memory, so that they can be queried
+	// without reading the journal.
+	recent := NewRingJournal(MonitorRecentEvents)
+	bus := NewEventBus()
+	j = teeJournaler{j, recent, bus}
+
+	// Keep a component that fails over and over from flooding every
+	// journaler with the same warning.
+	warningLimit := opts.WarningLimit
+	if warningLimit == (StartLimit{}) {
+		warningLimit = MonitorWarningLimit
+	}
+	warnings := newWarningLimiter(j, warningLimit)
+	j = warnings
 
 	m := &Monitor{
-		j:      j,
-		ctx:    ctx,
-		cancel: cancel,
-		dir:    dir,
-		done:   make(chan struct{}),
-		ctrl:   make(chan func()),
-		watch:  TryWatch(ctx, dir, j),
-		procs:  map[string]*Process{},
+		recent:   recent,
+		bus:      bus,
+		warnings: warnings,
+		health:   health,
+		ctx:      ctx,
+		cancel:   cancel,
+
+		procCtx:    procCtx,
+		procCancel: procCancel,
+
+		dir:   dir,
+		done:  make(chan struct{}),
+		ctrl:  make(chan func()),
+		watch: TryWatch(ctx, dir, j),
+		procs: map[string]*Process{},
+		names: map[string]*Process{},
+
+		output:   opts.Output,
+		dryRun:   opts.DryRun,
+		settle:   opts.Settle,
+		spawners: opts.Spawners,
+		pressure: opts.Pressure,
+		user:     opts.User,
+		fence:    opts.Fence,
+
+		restarts: map[string]int{},
+		spawns:   map[string][]time.Time{},
+		orphans:  map[string]int{},
+		stopped:  map[string]struct{}{},
+		groups:   map[string]string{},
+		waiters:  newWaiterSet(),
 	}
+
+	if m.settle == 0 {
+		m.settle = DirSettle
+	}
+
+	restartLimit := opts.RestartLimit
+	if restartLimit == 0 {
+		restartLimit = MonitorRestartLimit
+	}
+	m.breaker = newRestartBreaker(j, restartLimit)
+
+	spawnConcurrency := opts.SpawnConcurrency
+	if spawnConcurrency == 0 {
+		spawnConcurrency = MonitorSpawnConcurrency
+	}
+	if spawnConcurrency > 0 {
+		m.slots = make(chan struct{}, spawnConcurrency)
+	}
+
+	// Let waiting processes know when a process they may depend on is spawned.
+	m.j = spawnHookJournaler{j, m.recheckConditions}
+
+	if !m.dryRun {
+		m.syncing = make(chan struct{})
+		syncer := &artifactSyncer{dir: dir, j: m.j, client: http.DefaultClient}
+		go func() {
+			syncer.run(ctx, m.watch.Artifacts)
+			close(m.syncing)
+		}()
+	}
+
 	go m.monitor(ctx)
 
 	return m, nil
 }
 
+// readDir returns the scripts in the directory. Hidden files, such as script
+// configuration files, and special files, such as FIFOs, are skipped.
 func (m *Monitor) readDir() []os.DirEntry {
 	files, err := os.ReadDir(m.dir)
 	if err != nil {
@@ -76,40 +351,355 @@ func (m *Monitor) readDir() []os.DirEntry {
 			Error:     "failed to scan directory: " + err.Error(),
 		})
 	}
-	return files
+
+	scripts := files[:0]
+	for _, file := range files {
+		if isScriptName(file.Name()) && isScriptMode(file.Type()) {
+			scripts = append(scripts, file)
+		}
+	}
+
+	return scripts
+}
+
+// RecentEvents returns the most recent events written by the monitor and its
+// processes, from oldest to newest.
+func (m *Monitor) RecentEvents() []JournalEntry {
+	return m.recent.Snapshot()
+}
+
+// Subscribe subscribes to the events written by the monitor and its processes
+// from now on that filter returns true for. See EventBus.Subscribe.
+func (m *Monitor) Subscribe(filter func(Event) bool) *Subscription {
+	return m.bus.Subscribe(filter)
 }
 
 // Stop stops all processes as well as the main monitoring loop then wait for
-// all processes to end and for the monitoring routine to die.
+// all processes to end and for the monitoring routine to die. Canceling the
+// context given to NewMonitor does the same without waiting. Calling Stop again
+// is a no-op.
 func (m *Monitor) Stop() {
-	// Cancelling this context will interrupt all programs in the background.
 	m.cancel()
-	// Ensure the control routine has exited so we can end everything in this
-	// routine instead.
 	<-m.done
+}
+
+// Scanned returns a channel that's closed once the start of every script found
+// by the initial scan of the directory was attempted, or once the monitor was
+// stopped before that.
+func (m *Monitor) Scanned() <-chan struct{} {
+	return m.scanned
+}
 
+// shutdown stops all processes and the background routines, then journals the
+// final events. It's called by the monitor goroutine once the context is
+// canceled.
+func (m *Monitor) shutdown() {
 	// Ensure that all processes are fully stopped.
-	for _, proc := range m.procs {
-		proc.Stop()
+	m.stopAll()
+	m.procCancel()
+
+	// The watcher and the syncer stop on their own once the context is
+	// canceled. Wait for them so that nothing is left running after Stop.
+	<-m.watch.Done()
+	if m.syncing != nil {
+		<-m.syncing
 	}
 
+	m.warnings.Flush()
+
+	m.j.Write(&EventStatsSnapshot{
+		Restarts: m.statsRestarts(),
+	})
+
 	m.j.Write(&EventQuit{})
 }
 
-// RescanDir rescans the directory for new files asynchronously.
+// stopAll stops all processes in the reverse order of their priorities, so that
+// processes that others depend on, such as databases, are stopped after them.
+// Processes of the same priority are stopped at once. It must only be called
+// by the monitor goroutine while it shuts down.
+func (m *Monitor) stopAll() {
+	members := make([]groupMember, 0, len(m.procs))
+	for file, proc := range m.procs {
+		members = append(members, groupMember{
+			file:     file,
+			priority: scriptPriority(m.dir, file, m.user),
+			proc:     proc,
+		})
+	}
+
+	sortMembers(members)
+
+	runOrderedLimit(members, true, len(members), func(member groupMember) {
+		member.proc.Stop()
+	})
+}
+
+// RescanDir rescans the directory for new files asynchronously. New processes
+// are started in the order of their priorities, then their names, and each one
+// is only started once the previous one has been spawned, has failed to spawn
+// or is waiting for its start conditions.
 func (m *Monitor) RescanDir() {
+	m.rescanDir()
+}
+
+// rescanDir is like RescanDir, except that the returned channel is closed once
+// the new files have been added or the monitor has stopped.
+func (m *Monitor) rescanDir() <-chan struct{} {
+	done := make(chan struct{})
+
 	go func() {
+		defer close(done)
+
 		files := m.readDir()
 		if len(files) == 0 {
 			return
 		}
 
-		m.sendFunc(func() {
-			for _, file := range files {
-				m.addFile(file.Name(), false)
+		names := make([]string, len(files))
+		for i, file := range files {
+			names[i] = file.Name()
+		}
+
+		m.sortScripts(names)
+
+		for _, name := range names {
+			var pr *Process
+			if !m.do(func() { pr = m.addFile(name, false) }) {
+				return
 			}
-		})
+			if pr != nil && !m.waitAttempted(pr) {
+				return
+			}
+		}
 	}()
+
+	return done
+}
+
+// waitAttempted waits until the last requested start of the given process was
+// attempted, which starting scripts in order relies on. False is returned if
+// the monitor stopped first.
+func (m *Monitor) waitAttempted(pr *Process) bool {
+	select {
+	case <-pr.attempted():
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
+// sortScripts sorts the given script file names in the order of their
+// priorities, then their names.
+func (m *Monitor) sortScripts(files []string) {
+	priorities := make(map[string]int, len(files))
+	for _, file := range files {
+		priorities[file] = scriptPriority(m.dir, file, m.user)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		pi, pj := priorities[files[i]], priorities[files[j]]
+		if pi != pj {
+			return pi < pj
+		}
+		ni, _ := ParseScriptName(files[i])
+		nj, _ := ParseScriptName(files[j])
+		return ni < nj
+	})
+}
+
+// Snapshot returns the status of all processes.
+func (m *Monitor) Snapshot() ([]ProcessStatus, error) {
+	var statuses []ProcessStatus
+
+	ok := m.do(func() {
+		statuses = make([]ProcessStatus, 0, len(m.procs)+len(m.stopped))
+		for file, proc := range m.procs {
+			status := proc.Status()
+			status.Group = m.scriptGroup(file)
+			statuses = append(statuses, status)
+		}
+		for file := range m.stopped {
+			name, _ := ParseScriptName(file)
+			statuses = append(statuses, ProcessStatus{
+				File:     name,
+				State:    ProcessStopped,
+				Restarts: m.restarts[name],
+				Group:    m.scriptGroup(file),
+				Stopped:  true,
+			})
+		}
+	})
+	if !ok {
+		return nil, ErrMonitorStopped
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].File < statuses[j].File
+	})
+
+	return statuses, nil
+}
+
+// DebugSnapshot returns the status of all processes like Snapshot, but without
+// going through the monitor goroutine, so that it works even if the monitor is
+// wedged. Manually stopped scripts aren't included.
+func (m *Monitor) DebugSnapshot() []ProcessStatus {
+	m.pmut.RLock()
+	statuses := make([]ProcessStatus, 0, len(m.procs))
+	for _, proc := range m.procs {
+		statuses = append(statuses, proc.Status())
+	}
+	m.pmut.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].File < statuses[j].File
+	})
+
+	return statuses
+}
+
+// ResetStats resets the statistics of the given script, such as its cumulative
+// restart counter.
+func (m *Monitor) ResetStats(file string) error {
+	var err error
+
+	ok := m.do(func() {
+		if proc := m.findProc(file); proc != nil {
+			file = proc.Name()
+			proc.SetRestarts(0)
+		} else if _, ok := m.restarts[file]; ok {
+			m.restarts[file] = 0
+		} else {
+			err = ErrUnknownProcess
+			return
+		}
+
+		m.j.Write(&EventStatsReset{File: file})
+	})
+	if !ok {
+		return ErrMonitorStopped
+	}
+
+	return err
+}
+
+// WriteStdin writes the given line to the stdin of the process with the given
+// file name. ErrNoStdin is returned if the process has no writable stdin. See
+// Process.WriteStdin.
+func (m *Monitor) WriteStdin(file, line string) error {
+	var proc *Process
+
+	ok := m.do(func() { proc = m.findProc(file) })
+	if !ok {
+		return ErrMonitorStopped
+	}
+	if proc == nil {
+		return ErrUnknownProcess
+	}
+
+	// Write outside of the monitor goroutine, since this may block for up to
+	// ProcessStdinTimeout.
+	return proc.WriteStdin(line)
+}
+
+// findProc returns the process of the script with the given file name or
+// journal-facing name, or nil if there is none. It may be called from any
+// goroutine.
+func (m *Monitor) findProc(file string) *Process {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+
+	if proc, ok := m.procs[file]; ok {
+		return proc
+	}
+
+	return m.names[file]
+}
+
+// isRunning returns true if the process of the given script is running. It may
+// be called from any goroutine.
+func (m *Monitor) isRunning(file string) bool {
+	proc := m.findProc(file)
+	return proc != nil && proc.Status().PID != 0
+}
+
+// IsFlapping returns true if the script with the given file or journal-facing
+// name is restarting at a rate at or above the FlapThreshold. It may be called
+// from any goroutine.
+func (m *Monitor) IsFlapping(file string) bool {
+	proc := m.findProc(file)
+	return proc != nil && proc.IsFlapping()
+}
+
+// recheckConditions makes the waiting processes re-evaluate their start
+// conditions. It may be called from any goroutine.
+func (m *Monitor) recheckConditions() {
+	m.waiters.recheck()
+}
+
+// spawnHookJournaler calls spawned after a process spawn event is written.
+type spawnHookJournaler struct {
+	Journaler
+	spawned func()
+}
+
+func (j spawnHookJournaler) Write(ev Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j spawnHookJournaler) WriteAt(ev Event, t time.Time) error {
+	err := WriteAt(j.Journaler, ev, t)
+	if _, ok := ev.(*EventProcessSpawned); ok {
+		j.spawned()
+	}
+	return err
+}
+
+// JournalControlAction journals the given control action. It is used by the
+// control API to keep an audit trail of requested actions.
+func (m *Monitor) JournalControlAction(ev *EventControlAction) {
+	m.j.Write(ev)
+}
+
+// WaitExit blocks until the process with the given file name next exits, then
+// returns its exit event. See Process.WaitExit.
+func (m *Monitor) WaitExit(ctx context.Context, file string) (EventProcessExited, error) {
+	var proc *Process
+
+	ok := m.do(func() { proc = m.findProc(file) })
+	if !ok {
+		return EventProcessExited{}, ErrMonitorStopped
+	}
+	if proc == nil {
+		return EventProcessExited{}, ErrUnknownProcess
+	}
+
+	return proc.WaitExit(ctx)
+}
+
+// statsRestarts returns the restart counters of all known scripts. It must
+// only be called in the monitor goroutine or after it has exited.
+func (m *Monitor) statsRestarts() map[string]int {
+	restarts := copyRestarts(m.restarts)
+	for _, proc := range m.procs {
+		restarts[proc.Name()] = proc.Status().Restarts
+	}
+	return restarts
+}
+
+// do runs fn in the monitor goroutine and waits for it to return. False is
+// returned if the monitor is stopped.
+func (m *Monitor) do(fn func()) bool {
+	done := make(chan struct{})
+
+	select {
+	case m.ctrl <- func() { fn(); close(done) }:
+		<-done
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
 }
 
 func (m *Monitor) sendFunc(fn func()) {
@@ -120,48 +710,531 @@ func (m *Monitor) sendFunc(fn func()) {
 }
 
 func (m *Monitor) monitor(ctx context.Context) {
+	defer close(m.done)
+	defer m.shutdown()
+
+	check := time.NewTicker(ScriptCheckInterval)
+	defer check.Stop()
+
+	// checking is closed once the stale checks started by check are done, or
+	// is nil if none are running.
+	var checking <-chan struct{}
+	defer func() {
+		if checking != nil {
+			<-checking
+		}
+	}()
+
+	// pending contains the directory changes that are being settled, keyed by
+	// file name. The batch is applied once settle fires or by the deadline.
+	var pending map[string]ProcessListModifyOp
+	var settle *time.Timer
+	var settleCh <-chan time.Time
+	var deadline time.Time
+
+	defer func() {
+		if settle != nil {
+			settle.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
-			m.done <- struct{}{}
+			return
 
 		case fn := <-m.ctrl:
 			fn()
 
+		case <-check.C:
+			// Skip this round if the last one is still hashing.
+			if checking == nil {
+				checking = m.checkStale(ctx)
+			}
+
+		case <-checking:
+			checking = nil
+
 		case ev := <-m.watch.Events:
-			switch ev.Op {
-			case ProcessListAdd:
-				m.addFile(ev.File, false)
-			case ProcessListUpdate:
-				m.addFile(ev.File, true)
-			case ProcessListRemove:
-				m.removeFile(ev.File)
+			if m.settle < 0 {
+				m.applyListModify(ev)
+				continue
+			}
+
+			now := time.Now()
+
+			if pending == nil {
+				pending = map[string]ProcessListModifyOp{}
+				deadline = now.Add(MaxSettleFactor * m.settle)
+				settle = time.NewTimer(m.settle)
+				settleCh = settle.C
+			} else if now.Add(m.settle).Before(deadline) {
+				settle.Stop()
+				settle = time.NewTimer(m.settle)
+				settleCh = settle.C
 			}
+
+			pending[ev.File] = ev.Op
+
+		case <-settleCh:
+			m.reconcile(pending, false)
+			pending = nil
+			settle = nil
+			settleCh = nil
 		}
 	}
 }
 
-// addFile adds a new process with the given file into the store. If oldPID is
-// 0, then the process is started, otherwise it is restored.
+// staleCheckWorkers is the number of scripts that checkStale hashes at once.
+const staleCheckWorkers = 8
+
+// checkStale checks whether the scripts of running processes have changed in
+// the background, so that hashing a large directory doesn't block the monitor
+// goroutine. The returned channel is closed once all processes are checked or
+// the context is canceled. It must only be called by the monitor goroutine.
+func (m *Monitor) checkStale(ctx context.Context) <-chan struct{} {
+	procs := make(chan *Process, len(m.procs))
+	for _, proc := range m.procs {
+		procs <- proc
+	}
+	close(procs)
+
+	var wg sync.WaitGroup
+	wg.Add(staleCheckWorkers)
+
+	for i := 0; i < staleCheckWorkers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for proc := range procs {
+				if ctx.Err() != nil {
+					return
+				}
+				proc.checkStale()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+func (m *Monitor) applyListModify(ev EventProcessListModify) {
+	switch ev.Op {
+	case ProcessListAdd:
+		m.addFile(ev.File, false)
+	case ProcessListUpdate:
+		m.updateFile(ev.File)
+	case ProcessListRemove:
+		m.removeFile(ev.File)
+	}
+}
+
+// reconcile applies a batch of directory changes as one pass. Only the last
+// change of each file matters: files that ended up removed are removed first,
+// then the rest are added or updated in the order of their priorities. Scripts
+// that are unchanged or manually stopped are left alone. Nothing is journaled
+// if nothing changed, unless full is true.
+func (m *Monitor) reconcile(changes map[string]ProcessListModifyOp, full bool) *EventProcessListReconciled {
+	ev := &EventProcessListReconciled{Full: full}
+	var present []string
+
+	for file, op := range changes {
+		_, running := m.procs[file]
+		_, stopped := m.stopped[file]
+
+		switch {
+		case op == ProcessListRemove:
+			if running || stopped {
+				ev.Removed = append(ev.Removed, file)
+			}
+		case stopped:
+			// Manually stopped scripts stay stopped.
+		case running:
+			if m.scriptChanged(file) {
+				ev.Updated = append(ev.Updated, file)
+				present = append(present, file)
+			}
+		default:
+			ev.Added = append(ev.Added, file)
+			present = append(present, file)
+		}
+	}
+
+	if len(ev.Added)+len(ev.Updated)+len(ev.Removed) == 0 && !full {
+		return ev
+	}
+
+	sort.Strings(ev.Added)
+	sort.Strings(ev.Updated)
+	sort.Strings(ev.Removed)
+	m.j.Write(ev)
+
+	for _, file := range ev.Removed {
+		m.removeFile(file)
+	}
+
+	m.sortScripts(present)
+
+	for _, file := range present {
+		if _, known := m.procs[file]; known {
+			m.updateFile(file)
+		} else {
+			m.addFile(file, false)
+		}
+	}
+
+	return ev
+}
+
+// scriptChanged returns true if the script of the running process with the
+// given file name changed since the process was last started.
+func (m *Monitor) scriptChanged(file string) bool {
+	hash := m.procs[file].Hash()
+	newHash, err := hashScript(m.dir, file, m.user)
+	return hash == "" || err != nil || newHash != hash
+}
+
+// Reconcile recomputes the desired set of scripts from the scripts directory and
+// converges the running processes to it from scratch: missing processes are
+// started, processes of scripts that no longer exist are stopped, and
+// processes of changed scripts are restarted. Manually stopped scripts stay
+// stopped. The journaled summary is returned.
+func (m *Monitor) Reconcile() (*EventProcessListReconciled, error) {
+	var ev *EventProcessListReconciled
+
+	ok := m.do(func() {
+		// Configurations may have changed without the watcher noticing.
+		m.groups = map[string]string{}
+
+		changes := map[string]ProcessListModifyOp{}
+
+		for file := range m.procs {
+			changes[file] = ProcessListRemove
+		}
+		for file := range m.stopped {
+			changes[file] = ProcessListRemove
+		}
+
+		for _, file := range m.readDir() {
+			s, err := os.Stat(filepath.Join(m.dir, file.Name()))
+			if err == nil && s.Mode().Perm()&0111 != 0 {
+				changes[file.Name()] = ProcessListUpdate
+			}
+		}
+
+		ev = m.reconcile(changes, true)
+	})
+	if !ok {
+		return nil, ErrMonitorStopped
+	}
+
+	return ev, nil
+}
+
+// addFile adds a new process with the given file into the store and starts it.
+// Nil is returned if the script was manually stopped, since it stays stopped
+// until it's explicitly started again, or if another script already has the
+// same journal-facing name, such as 10-web.sh and 20-web.sh.
 func (m *Monitor) addFile(file string, restart bool) *Process {
+	delete(m.groups, file)
+
+	if _, ok := m.stopped[file]; ok {
+		return nil
+	}
+
 	// Check that we haven't already added the file.
 	pr, ok := m.procs[file]
 	if !ok {
-		pr = NewProcess(m.ctx, m.dir, file, m.j)
+		if other := m.nameOwner(file); other != "" {
+			name, _ := ParseScriptName(file)
+			m.j.Write(&EventWarning{
+				Component: "monitor",
+				Error:     fmt.Sprintf("%s: not starting, %s already has the name %s", file, other, name),
+			})
+			return nil
+		}
+
+		pr = NewProcess(m.procCtx, m.dir, file, m.j)
+		pr.Output = m.output
+		pr.IsRunning = m.isRunning
+		pr.DryRun = m.dryRun
+		pr.User = m.user
+		pr.Fence = m.fence
+		pr.Spawners = m.spawners
+		pr.Pressure = m.pressure
+		pr.breaker = m.breaker
+		pr.waiters = m.waiters
+		pr.slots = m.slots
+
+		name := pr.Name()
+
+		m.pmut.Lock()
 		m.procs[file] = pr
+		m.names[name] = pr
+		m.pmut.Unlock()
+
+		if restarts, ok := m.restarts[name]; ok {
+			pr.SetRestarts(restarts)
+			delete(m.restarts, name)
+		}
+		if spawns, ok := m.spawns[name]; ok {
+			pr.SetRecentSpawns(spawns)
+			delete(m.spawns, name)
+		}
+		if pid, ok := m.orphans[name]; ok {
+			if p := findOrphan(pid, pr.path); p != nil {
+				pr.Adopt(p)
+			}
+			delete(m.orphans, name)
+		}
 	}
 
 	pr.Start(restart)
 	return pr
 }
 
+// nameOwner returns the file name of the other script, running or manually
+// stopped, that has the same journal-facing name as the given file, or an empty
+// string if there's none.
+func (m *Monitor) nameOwner(file string) string {
+	name, _ := ParseScriptName(file)
+
+	if pr, ok := m.names[name]; ok && pr.file != file {
+		return pr.file
+	}
+	for stopped := range m.stopped {
+		if n, _ := ParseScriptName(stopped); n == name && stopped != file {
+			return stopped
+		}
+	}
+
+	return ""
+}
+
+// findOrphan returns the process with the given PID if it still runs the script
+// at the given path, such as one that the previous cronmon left running when it
+// crashed. Nil is returned otherwise, including if the PID now belongs to
+// another program.
+func findOrphan(pid int, path string) exec.Process {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil
+	}
+
+	script, err := resolveScript(path)
+	if err != nil {
+		return nil
+	}
+
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if arg != script {
+			continue
+		}
+
+		p, err := exec.AdoptProcess(pid)
+		if err != nil {
+			return nil
+		}
+		return p
+	}
+
+	return nil
+}
+
+// updateFile restarts the process with the given file name, unless the
+// script's contents are unchanged since the process was last started.
+func (m *Monitor) updateFile(file string) *Process {
+	delete(m.groups, file)
+
+	if pr, ok := m.procs[file]; ok {
+		if hash := pr.Hash(); hash != "" {
+			newHash, err := hashScript(m.dir, file, m.user)
+			if err == nil && newHash == hash {
+				m.j.Write(&EventProcessUnchanged{
+					File: pr.Name(),
+					Hash: hash,
+				})
+				return pr
+			}
+			if err == nil && pr.reloadConfig(newHash) {
+				return pr
+			}
+		}
+	}
+
+	return m.addFile(file, true)
+}
+
+// detachProc removes the process with the given file name from the monitor
+// without stopping it, keeping its statistics, and marks the script as
+// stopped. The process is returned, or nil if there is none.
+func (m *Monitor) detachProc(file string) *Process {
+	p, ok := m.procs[file]
+	if !ok {
+		return nil
+	}
+
+	m.pmut.Lock()
+	delete(m.procs, file)
+	if m.names[p.Name()] == p {
+		delete(m.names, p.Name())
+	}
+	m.pmut.Unlock()
+
+	// Keep the statistics in case the script comes back.
+	m.restarts[p.Name()] = p.Status().Restarts
+	m.spawns[p.Name()] = p.RecentSpawns()
+	m.stopped[file] = struct{}{}
+
+	return p
+}
+
+// startStopped starts the manually stopped script with the given file name.
+// Its process is returned, or nil if it wasn't stopped.
+func (m *Monitor) startStopped(file string) *Process {
+	if _, ok := m.stopped[file]; ok {
+		delete(m.stopped, file)
+		return m.addFile(file, false)
+	}
+	return nil
+}
+
+// findStopped returns the file name of the manually stopped script with the
+// given file or journal-facing name, or an empty string if there's none.
+func (m *Monitor) findStopped(file string) string {
+	if _, ok := m.stopped[file]; ok {
+		return file
+	}
+	for stopped := range m.stopped {
+		if name, _ := ParseScriptName(stopped); name == file {
+			return stopped
+		}
+	}
+	return ""
+}
+
+// scriptGroup returns the group of the given script, if any. It must only be
+// called in the monitor goroutine.
+func (m *Monitor) scriptGroup(file string) string {
+	group, ok := m.groups[file]
+	if !ok {
+		cfg, _ := loadScriptConfig(m.dir, file, m.user)
+		group = cfg.Group
+		m.groups[file] = group
+	}
+	return group
+}
+
+// StopProcess manually stops the process with the given file name. The script
+// stays stopped until it's started again with StartProcess.
+func (m *Monitor) StopProcess(file string) error {
+	var proc *Process
+
+	ok := m.do(func() {
+		if p := m.findProc(file); p != nil {
+			proc = m.detachProc(m.procFile(p))
+		}
+	})
+	if !ok {
+		return ErrMonitorStopped
+	}
+	if proc == nil {
+		return ErrUnknownProcess
+	}
+
+	return proc.Stop()
+}
+
+// StartProcess starts the manually stopped script with the given file name.
+// Nothing is done if the script's process is already running.
+func (m *Monitor) StartProcess(file string) error {
+	var err error
+
+	ok := m.do(func() {
+		if stopped := m.findStopped(file); stopped != "" {
+			m.startStopped(stopped)
+		} else if m.findProc(file) == nil {
+			err = ErrUnknownProcess
+		}
+	})
+	if !ok {
+		return ErrMonitorStopped
+	}
+
+	return err
+}
+
+// RestartProcess restarts the process with the given file name.
+func (m *Monitor) RestartProcess(file string) error {
+	var proc *Process
+
+	ok := m.do(func() { proc = m.findProc(file) })
+	if !ok {
+		return ErrMonitorStopped
+	}
+	if proc == nil {
+		return ErrUnknownProcess
+	}
+
+	return proc.Start(true)
+}
+
+// KickProcess starts the process with the given file name immediately if it's
+// down, skipping and resetting its restart backoff. A manually stopped script
+// is started as well.
+func (m *Monitor) KickProcess(file string) error {
+	var proc *Process
+	var started bool
+
+	ok := m.do(func() {
+		if stopped := m.findStopped(file); stopped != "" {
+			m.startStopped(stopped)
+			started = true
+			return
+		}
+		proc = m.findProc(file)
+	})
+	if !ok {
+		return ErrMonitorStopped
+	}
+	if started {
+		return nil
+	}
+	if proc == nil {
+		return ErrUnknownProcess
+	}
+
+	return proc.Kick()
+}
+
+// procFile returns the file name that the given process is keyed by. It must
+// only be called in the monitor goroutine.
+func (m *Monitor) procFile(proc *Process) string {
+	if m.procs[proc.file] == proc {
+		return proc.file
+	}
+	return ""
+}
+
 // removeFile removes a process with the given file name. The process is
 // stopped.
 func (m *Monitor) removeFile(file string) {
-	p, ok := m.procs[file]
-	if ok {
+	delete(m.groups, file)
+
+	if p := m.detachProc(file); p != nil {
+		delete(m.stopped, file)
 		p.Stop()
-		delete(m.procs, file)
+		return
+	}
+
+	if _, ok := m.stopped[file]; ok {
+		delete(m.stopped, file)
 		return
 	}
 
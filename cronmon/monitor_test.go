@@ -0,0 +1,682 @@
+package cronmon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"go.uber.org/goleak"
+)
+
+func TestMonitorManualStop(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, filepath.Join(dir, "a"))
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		statuses, _ := m.Snapshot()
+		if len(statuses) == 1 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the script")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := m.StopProcess("a"); err != nil {
+		t.Fatal("failed to stop script:", err)
+	}
+
+	// Neither watcher events nor rescans may start the script again.
+	writeScript(t, filepath.Join(dir, "a"))
+	m.do(func() {
+		m.updateFile("a")
+		m.addFile("a", false)
+	})
+
+	select {
+	case <-m.rescanDir():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the rescan")
+	}
+
+	statuses, err := m.Snapshot()
+	if err != nil {
+		t.Fatal("failed to get snapshot:", err)
+	}
+	if len(statuses) != 1 || !statuses[0].Stopped {
+		t.Fatalf("script is not stopped anymore: %#v", statuses)
+	}
+
+	// Stopped scripts are only tracked by name until they're started again.
+	if proc := m.findProc("a"); proc != nil {
+		t.Fatal("stopped script still has a process")
+	}
+
+	if err := m.StartProcess("a"); err != nil {
+		t.Fatal("failed to start script:", err)
+	}
+
+	statuses, _ = m.Snapshot()
+	if len(statuses) != 1 || statuses[0].Stopped {
+		t.Fatalf("script is still stopped: %#v", statuses)
+	}
+}
+
+func TestMonitorSettle(t *testing.T) {
+	dir := t.TempDir()
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{
+		DryRun: true,
+		Settle: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	// Files written before the watcher has started would be missed, and files
+	// written before the initial scan would be added without settling.
+	for _, ch := range []<-chan struct{}{m.watch.watching, m.scanned} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the monitor to start")
+		}
+	}
+
+	for _, file := range []string{"c", "10-b", "a"} {
+		writeScript(t, filepath.Join(dir, file))
+	}
+
+	// Wait for the spawns rather than the statuses, since the scripts are
+	// listed before they're spawned.
+	timeout := time.After(5 * time.Second)
+	for countJournaled(&j, &EventDryRunSpawn{}) < 3 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the scripts")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var reconciled []*EventProcessListReconciled
+	var spawned []string
+
+	for _, ev := range j.Journals() {
+		switch ev := ev.(type) {
+		case *EventProcessListReconciled:
+			reconciled = append(reconciled, ev)
+		case *EventDryRunSpawn:
+			spawned = append(spawned, ev.File)
+		}
+	}
+
+	if len(reconciled) != 1 {
+		t.Fatalf("expected one reconciliation, got %d", len(reconciled))
+	}
+	if added := reconciled[0].Added; !reflect.DeepEqual(added, []string{"10-b", "a", "c"}) {
+		t.Errorf("unexpected added scripts %q", added)
+	}
+
+	// Scripts are started in the order of their priorities.
+	if len(spawned) != 3 || spawned[0] != "b" {
+		t.Errorf("unexpected spawn order %q", spawned)
+	}
+}
+
+func TestMonitorReconcile(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, filepath.Join(dir, "a"))
+	writeScript(t, filepath.Join(dir, "b"))
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		statuses, _ := m.Snapshot()
+		if len(statuses) == 2 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the scripts")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Lose track of b and pick up a script that doesn't exist.
+	m.do(func() {
+		m.detachProc("b")
+		delete(m.stopped, "b")
+		m.addFile("z", false)
+	})
+
+	ev, err := m.Reconcile()
+	if err != nil {
+		t.Fatal("failed to reconcile:", err)
+	}
+
+	expect := &EventProcessListReconciled{
+		Added:   []string{"b"},
+		Removed: []string{"z"},
+		Full:    true,
+	}
+	if !reflect.DeepEqual(ev, expect) {
+		t.Fatalf("unexpected reconciliation %#v", ev)
+	}
+
+	statuses, _ := m.Snapshot()
+	if len(statuses) != 2 || statuses[0].File != "a" || statuses[1].File != "b" {
+		t.Fatalf("unexpected processes after reconciling: %#v", statuses)
+	}
+}
+
+func TestMonitorStopOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	// The frontend takes a while to shut down, which the database must wait
+	// for.
+	scripts := map[string]string{
+		"10-db":  "#!/bin/sh\nexec sleep 60\n",
+		"20-web": "#!/bin/sh\ntrap 'sleep 0.1; exit 0' TERM\nsleep 60 &\nwait\n",
+	}
+	for file, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(script), 0755); err != nil {
+			t.Fatal("failed to write script:", err)
+		}
+	}
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		statuses, _ := m.Snapshot()
+		if len(statuses) == 2 && statuses[0].PID != 0 && statuses[1].PID != 0 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			m.Stop()
+			t.Fatal("timed out waiting for the scripts")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	m.Stop()
+
+	var exited []string
+	for _, ev := range j.Journals() {
+		if ev, ok := ev.(*EventProcessExited); ok {
+			exited = append(exited, ev.File)
+		}
+	}
+
+	if !reflect.DeepEqual(exited, []string{"web", "db"}) {
+		t.Errorf("unexpected stop order %q", exited)
+	}
+}
+
+func TestMonitorStopLeak(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal("failed to write script:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(ctx, dir, &j, MonitorOptions{})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+
+	waitRunning(t, m, 1)
+
+	// Only cancel the context. The monitor must still stop its processes and
+	// exit without anyone calling Stop.
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for !journaled(&j, &EventQuit{}) {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the monitor to quit")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Stop after the monitor has quit, and twice, is a no-op.
+	m.Stop()
+	m.Stop()
+
+	var quits int
+	for _, ev := range j.Journals() {
+		if _, ok := ev.(*EventQuit); ok {
+			quits++
+		}
+	}
+	if quits != 1 {
+		t.Errorf("monitor quit %d times", quits)
+	}
+
+	if _, err := m.Snapshot(); err != ErrMonitorStopped {
+		t.Errorf("unexpected snapshot error after stop: %v", err)
+	}
+}
+
+func TestMonitorStopWatcherEvents(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir := t.TempDir()
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+
+	// Keep changing the directory while stopping, so that the watcher has
+	// events to send that nobody receives anymore.
+	stop := make(chan struct{})
+	writing := make(chan struct{})
+	go func() {
+		defer close(writing)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				os.WriteFile(filepath.Join(dir, fmt.Sprintf("s%d", i%10)), []byte("#!/bin/sh\n"), 0755)
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	m.Stop()
+	close(stop)
+	<-writing
+}
+
+// waitRunning waits until n processes of the monitor are running.
+func waitRunning(t *testing.T, m *Monitor, n int) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		statuses, _ := m.Snapshot()
+		var running int
+		for _, status := range statuses {
+			if status.PID != 0 {
+				running++
+			}
+		}
+		if running == n {
+			return
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the scripts")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// journaled returns true if an event of the same type as ev was journaled.
+func journaled(j *mockJournal, ev Event) bool {
+	for _, journaled := range j.Journals() {
+		if reflect.TypeOf(journaled) == reflect.TypeOf(ev) {
+			return true
+		}
+	}
+	return false
+}
+
+// countJournaled returns the number of events of the same type as ev that were
+// journaled.
+func countJournaled(j *mockJournal, ev Event) int {
+	var n int
+	for _, journaled := range j.Journals() {
+		if reflect.TypeOf(journaled) == reflect.TypeOf(ev) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMonitorDebugSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, filepath.Join(dir, "a"))
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		statuses, _ := m.Snapshot()
+		if len(statuses) == 1 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the script")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Wedge the monitor goroutine.
+	wedged := make(chan struct{})
+	m.sendFunc(func() { <-wedged })
+	defer close(wedged)
+
+	statuses := m.DebugSnapshot()
+	if len(statuses) != 1 || statuses[0].File != "a" {
+		t.Fatalf("unexpected debug snapshot: %#v", statuses)
+	}
+}
+
+func BenchmarkMonitor(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		dir := b.TempDir()
+		for i := 0; i < n; i++ {
+			writeScript(b, filepath.Join(dir, fmt.Sprintf("%05d-script", i)))
+		}
+
+		// start measures how long it takes to pick up all scripts, and
+		// snapshot how long it takes to get the status of all of them.
+		b.Run(fmt.Sprintf("start %d", n), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				m := benchMonitor(b, dir, n)
+				b.StopTimer()
+				m.Stop()
+				b.StartTimer()
+			}
+		})
+
+		b.Run(fmt.Sprintf("snapshot %d", n), func(b *testing.B) {
+			m := benchMonitor(b, dir, n)
+			defer m.Stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := m.Snapshot(); err != nil {
+					b.Fatal("failed to get snapshot:", err)
+				}
+			}
+		})
+	}
+}
+
+// benchMonitor starts a dry-run monitor of the directory and waits until it
+// has all n scripts.
+func benchMonitor(b *testing.B, dir string, n int) *Monitor {
+	m, err := NewMonitorWithOptions(context.Background(), dir, NewRingJournal(100), MonitorOptions{
+		DryRun: true,
+	})
+	if err != nil {
+		b.Fatal("failed to create monitor:", err)
+	}
+
+	for {
+		statuses, _ := m.Snapshot()
+		if len(statuses) == n {
+			return m
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// sleepSpawner spawns processes that sleep until they're signaled.
+type sleepSpawner struct {
+	nextPID func() int
+	spawns  uint32
+}
+
+func (s *sleepSpawner) Spawn(string, json.RawMessage, exec.Options) (exec.Process, error) {
+	atomic.AddUint32(&s.spawns, 1)
+	return exec.NewSleepProcess(forever, 0, s.nextPID()), nil
+}
+
+func TestMonitorScale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping scale test in short mode")
+	}
+
+	const n = 10000
+
+	dir := t.TempDir()
+	for i := 0; i < n; i++ {
+		file := fmt.Sprintf("s%05d", i)
+		writeScript(t, filepath.Join(dir, file))
+
+		config := `{"spawner": "sleep"}`
+		if i%100 == 1 {
+			// Some scripts wait for others.
+			config = fmt.Sprintf(`{"spawner": "sleep", "conditions": ["script:s%05d"]}`, i-1)
+		}
+		writeConfig(t, ScriptConfigPath(dir, file), config)
+	}
+
+	spawner := &sleepSpawner{nextPID: newNextPID()}
+	started := time.Now()
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, NewRingJournal(100), MonitorOptions{
+		Spawners:     map[string]Spawner{"sleep": spawner},
+		RestartLimit: -1,
+	})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+
+	timeout := time.After(time.Minute)
+	for atomic.LoadUint32(&spawner.spawns) < n {
+		select {
+		case <-timeout:
+			m.Stop()
+			t.Fatalf("timed out with %d of %d scripts spawned", atomic.LoadUint32(&spawner.spawns), n)
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Logf("spawned %d scripts in %v", n, time.Since(started))
+
+	now := time.Now()
+	statuses, err := m.Snapshot()
+	if err != nil {
+		t.Fatal("failed to get snapshot:", err)
+	}
+	if len(statuses) != n {
+		t.Fatalf("got %d statuses, expected %d", len(statuses), n)
+	}
+	t.Logf("snapshot took %v", time.Since(now))
+
+	now = time.Now()
+	if err := m.StopProcess("s05000"); err != nil {
+		t.Fatal("failed to stop script:", err)
+	}
+	if err := m.StartProcess("s05000"); err != nil {
+		t.Fatal("failed to start script:", err)
+	}
+	t.Logf("stopping and starting a script by name took %v", time.Since(now))
+
+	now = time.Now()
+	m.Stop()
+	t.Logf("stopped %d scripts in %v", n, time.Since(now))
+}
+
+func TestFindOrphan(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	writeScript(t, path)
+	writeScript(t, filepath.Join(dir, "b"))
+
+	p, err := exec.StartProcess([]string{"/bin/sh", "-c", "sleep 60", path}, exec.Options{})
+	if err != nil {
+		t.Fatal("failed to start process:", err)
+	}
+	t.Cleanup(func() {
+		p.Kill()
+		p.Wait()
+	})
+
+	if orphan := findOrphan(p.PID(), path); orphan == nil || orphan.PID() != p.PID() {
+		t.Error("process running the script was not found")
+	}
+
+	// The PID may have been reused by another program.
+	if orphan := findOrphan(p.PID(), filepath.Join(dir, "b")); orphan != nil {
+		t.Error("process running another script was found")
+	}
+}
+
+// orderSpawner records the order in which spawns finish. Spawning the slow
+// script takes a while.
+type orderSpawner struct {
+	slow   string
+	mu     sync.Mutex
+	paths  []string
+	spawns chan struct{}
+}
+
+func (s *orderSpawner) Spawn(path string, _ json.RawMessage, _ exec.Options) (exec.Process, error) {
+	if filepath.Base(path) == s.slow {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	s.paths = append(s.paths, filepath.Base(path))
+	s.mu.Unlock()
+
+	s.spawns <- struct{}{}
+	return exec.NewSleepProcess(forever, 0, 1), nil
+}
+
+// takePaths waits for n spawns and returns the paths spawned so far.
+func (s *orderSpawner) takePaths(t *testing.T, n int) []string {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.spawns:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for spawns")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := s.paths
+	s.paths = nil
+	return paths
+}
+
+func TestMonitorSpawnOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"10-db", "20-cache", "30-web"} {
+		writeScript(t, filepath.Join(dir, file))
+		writeConfig(t, ScriptConfigPath(dir, file), `{"spawner": "order"}`)
+	}
+	// Colliding with 30-web, which comes first.
+	writeScript(t, filepath.Join(dir, "40-web"))
+
+	spawner := &orderSpawner{slow: "10-db", spawns: make(chan struct{}, 3)}
+
+	var j mockJournal
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, &j, MonitorOptions{
+		Spawners: map[string]Spawner{"order": spawner},
+	})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	defer m.Stop()
+
+	paths := spawner.takePaths(t, 3)
+
+	select {
+	case <-m.scanned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the scan")
+	}
+
+	// The slow spawn of the database is waited for.
+	if !reflect.DeepEqual(paths, []string{"10-db", "20-cache", "30-web"}) {
+		t.Errorf("unexpected spawn order %q", paths)
+	}
+
+	statuses, _ := m.Snapshot()
+	if len(statuses) != 3 {
+		t.Errorf("colliding script was started: %#v", statuses)
+	}
+
+	var warned bool
+	for _, ev := range j.Journals() {
+		if ev, ok := ev.(*EventWarning); ok && strings.Contains(ev.Error, "40-web") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("colliding script was not warned about")
+	}
+}
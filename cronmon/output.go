@@ -0,0 +1,364 @@
+package cronmon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/pkg/errors"
+)
+
+// LogMux multiplexes the output of multiple processes into a single stream,
+// where each line is prefixed with the time and the script name, similarly to
+// foreman. It is safe for concurrent use.
+type LogMux struct {
+	mutex sync.Mutex
+	w     io.Writer
+	buf   []byte
+}
+
+// NewLogMux creates a new LogMux that writes to the given writer.
+func NewLogMux(w io.Writer) *LogMux {
+	return &LogMux{w: w}
+}
+
+// WriteLine writes a line of the given script's output. The line should not
+// end with a new line.
+func (mux *LogMux) WriteLine(file string, line []byte) error {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	mux.buf = time.Now().AppendFormat(mux.buf[:0], "2006-01-02 15:04:05.000")
+	mux.buf = append(mux.buf, " ["...)
+	mux.buf = append(mux.buf, file...)
+	mux.buf = append(mux.buf, "] "...)
+	mux.buf = append(mux.buf, line...)
+	mux.buf = append(mux.buf, '\n')
+
+	_, err := mux.w.Write(mux.buf)
+	return err
+}
+
+// processOutput is the stdout and stderr of a process, as described by the
+// Log, PTY, Syslog and Events options of its ScriptConfig.
+type processOutput struct {
+	// child is passed to the process as both its stdout and stderr. It is nil
+	// for /dev/null.
+	child *os.File
+	// r is the read end of the pipe or the master end of the pseudo-terminal,
+	// if any. Its output is copied into log and the LogMux.
+	r   *os.File
+	tty bool
+	// log is the log file, if any.
+	log *logFile
+	// syslog is the syslog connection, if any.
+	syslog *syslog.Writer
+	// syslogErr is why syslog couldn't be connected to, if it couldn't. The
+	// process still runs without it.
+	syslogErr error
+	// mux, if not nil, receives the output line by line.
+	mux *LogMux
+	// events is true if lines prefixed with ProcessEventPrefix are parsed into
+	// journal events.
+	events bool
+	// ready, if not nil, is closed once the process reports that it's ready.
+	ready chan struct{}
+	// words, if not nil, keeps the last output of the process.
+	words *lastWords
+}
+
+// openOutput opens the stdout and stderr of the process of the script with the
+// given journal-facing name for its configuration. If mux is not nil, then the
+// output is also captured for it. The caller must call closeChild once the
+// process has started, then either capture or close.
+func openOutput(dir, name string, cfg ScriptConfig, mux *LogMux) (*processOutput, error) {
+	out := processOutput{
+		mux:    mux,
+		events: cfg.Events,
+	}
+
+	if cfg.WaitReady {
+		out.ready = make(chan struct{})
+	}
+	if cfg.LastWords > 0 {
+		out.words = newLastWords(cfg.LastWords)
+	}
+
+	log, err := openLog(dir, cfg)
+	if err != nil {
+		return nil, err
+	}
+	out.log = log
+
+	if facility, _ := parseSyslogFacility(cfg.Syslog); facility != 0 {
+		w, err := syslog.New(facility|syslog.LOG_INFO, name)
+		if err != nil {
+			out.syslogErr = errors.Wrap(err, "failed to connect to syslog, not logging to it")
+		} else {
+			out.syslog = w
+		}
+	}
+
+	switch {
+	case cfg.PTY:
+		master, slave, err := exec.OpenPTY()
+		if err != nil {
+			out.close()
+			return nil, err
+		}
+
+		out.child = slave
+		out.r = master
+		out.tty = true
+
+	case mux != nil || cfg.Events || out.syslog != nil || out.words != nil || (log != nil && log.maxSize > 0):
+		r, w, err := os.Pipe()
+		if err != nil {
+			out.close()
+			return nil, errors.Wrap(err, "failed to create output pipe")
+		}
+
+		out.child = w
+		out.r = r
+
+	case log != nil:
+		// Let the process write to the log file directly, since it never
+		// needs to be rotated.
+		out.child = log.f
+	}
+
+	return &out, nil
+}
+
+// closeChild closes the child end of the output. The log file is left open if
+// it's needed for capturing.
+func (out *processOutput) closeChild() {
+	if out.child == nil {
+		return
+	}
+
+	out.child.Close()
+
+	if out.log != nil && out.child == out.log.f {
+		out.log = nil
+	}
+	out.child = nil
+}
+
+// capture starts copying the output of the process with the given PID line by
+// line into the log file, syslog and the LogMux in the background, if needed,
+// while also parsing reported events into the journaler. Everything is closed
+// once the output is closed by all processes. Errors are written into the
+// journaler as warnings.
+func (out *processOutput) capture(j Journaler, file string, pid int) {
+	if out.syslogErr != nil {
+		j.Write(&EventWarning{
+			Component: "process",
+			Error:     file + ": " + out.syslogErr.Error(),
+		})
+	}
+
+	if out.r == nil {
+		out.close()
+		return
+	}
+
+	if out.log != nil {
+		out.log.warn = func(err error) {
+			j.Write(&EventWarning{
+				Component: "process",
+				Error:     file + ": " + err.Error(),
+			})
+		}
+	}
+
+	go func() {
+		defer out.close()
+
+		if out.words != nil {
+			defer close(out.words.done)
+		}
+
+		r := bufio.NewReader(out.r)
+
+		for {
+			line, err := r.ReadSlice('\n')
+			if len(line) > 0 {
+				if out.log != nil {
+					if _, err := out.log.Write(line); err != nil {
+						j.Write(&EventWarning{
+							Component: "process",
+							Error:     file + ": failed to write log, not logging anymore: " + err.Error(),
+						})
+						out.log.Close()
+						out.log = nil
+					}
+				}
+				if out.syslog != nil {
+					out.syslog.Info(string(trimLine(line)))
+				}
+				if out.mux != nil {
+					out.mux.WriteLine(file, trimLine(line))
+				}
+				if out.words != nil {
+					out.words.Write(line)
+				}
+				if out.events && reportEvent(j, file, pid, trimLine(line)) && out.ready != nil {
+					close(out.ready)
+					out.ready = nil
+				}
+			}
+
+			if err != nil {
+				if errors.Is(err, bufio.ErrBufferFull) {
+					continue
+				}
+
+				if !errors.Is(err, io.EOF) && !(out.tty && exec.IsPTYClosed(err)) {
+					j.Write(&EventWarning{
+						Component: "process",
+						Error:     file + ": failed to capture output: " + err.Error(),
+					})
+				}
+
+				return
+			}
+		}
+	}()
+}
+
+// close closes everything that is still open.
+func (out *processOutput) close() {
+	for _, f := range []*os.File{out.child, out.r} {
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	if out.log != nil {
+		out.log.Close()
+	}
+	if out.syslog != nil {
+		out.syslog.Close()
+	}
+
+	*out = processOutput{}
+}
+
+// ProcessLastWordsTimeout is how long the output of a process that exited with
+// a nonzero code is waited for to be fully read before its last words are
+// journaled. Output may be left unread if the process' children still hold it
+// open.
+var ProcessLastWordsTimeout = 250 * time.Millisecond
+
+// lastWords keeps the last bytes of the output of a process, so that the cause
+// of a crash can be journaled. See ScriptConfig.LastWords.
+type lastWords struct {
+	mutex sync.Mutex
+	buf   []byte
+	size  int
+	cut   bool
+	// done is closed once the output is fully read.
+	done chan struct{}
+}
+
+func newLastWords(size int) *lastWords {
+	if MaxEventFieldSize > 0 && size > MaxEventFieldSize {
+		size = MaxEventFieldSize
+	}
+	return &lastWords{size: size, done: make(chan struct{})}
+}
+
+// Write appends the output, dropping what is older than the last size bytes.
+func (lw *lastWords) Write(b []byte) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	lw.buf = append(lw.buf, b...)
+	if over := len(lw.buf) - lw.size; over > 0 {
+		lw.buf = append(lw.buf[:0], lw.buf[over:]...)
+		lw.cut = true
+	}
+}
+
+// String waits up to the timeout for the output to be fully read and returns
+// the last words. If older output was dropped, then the partial first line is
+// dropped as well, unless it's the only line.
+func (lw *lastWords) String(timeout time.Duration) string {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-lw.done:
+	case <-timer.C:
+	}
+
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	b := lw.buf
+	if i := bytes.IndexByte(b, '\n'); lw.cut && i >= 0 && i < len(b)-1 {
+		b = b[i+1:]
+	}
+
+	return string(bytes.TrimRight(b, "\r\n"))
+}
+
+// trimLine trims the trailing new line, including the carriage return written
+// by terminals, off the line.
+func trimLine(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return line
+}
+
+// ProcessEventPrefix is the prefix of output lines that a process writes to
+// report an event, if enabled by ScriptConfig.Events. The rest of the line must
+// be a JSON object, which is journaled as an EventProcessReported.
+const ProcessEventPrefix = "CRONMON-EVENT: "
+
+// reportEvent journals the event reported in the given line, if any. True is
+// returned if the event has "ready" set to true.
+func reportEvent(j Journaler, file string, pid int, line []byte) (ready bool) {
+	if !bytes.HasPrefix(line, []byte(ProcessEventPrefix)) {
+		return false
+	}
+
+	data := bytes.TrimSpace(line[len(ProcessEventPrefix):])
+
+	if !bytes.HasPrefix(data, []byte("{")) || !json.Valid(data) {
+		j.Write(&EventWarning{
+			Component: "process",
+			Error:     file + ": reported event is not a JSON object",
+		})
+		return false
+	}
+
+	if MaxEventFieldSize > 0 && len(data) > MaxEventFieldSize {
+		j.Write(&EventWarning{
+			Component: "process",
+			Error:     fmt.Sprintf("%s: reported event is too large (%d bytes)", file, len(data)),
+		})
+		return false
+	}
+
+	j.Write(&EventProcessReported{
+		File: file,
+		PID:  pid,
+		Data: json.RawMessage(append([]byte(nil), data...)),
+	})
+
+	var status struct {
+		Ready bool `json:"ready"`
+	}
+	json.Unmarshal(data, &status)
+
+	return status.Ready
+}
@@ -0,0 +1,116 @@
+package cronmon
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessOutput(t *testing.T) {
+	dir := t.TempDir()
+
+	pr, pw := io.Pipe()
+	mux := NewLogMux(pw)
+
+	out, err := openOutput(dir, "a", ScriptConfig{Log: "a.log"}, mux)
+	if err != nil {
+		t.Fatal("failed to open output:", err)
+	}
+
+	child := out.child
+	out.child = nil // pretend that the child has the only copy
+
+	var j mockJournal
+	out.capture(&j, "a", 1)
+
+	go func() {
+		io.WriteString(child, "hello\r\nworld\n")
+		child.Close()
+	}()
+
+	r := bufio.NewReader(pr)
+	for _, expect := range []string{"hello", "world"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal("failed to read aggregated output:", err)
+		}
+		if !strings.HasSuffix(line, " [a] "+expect+"\n") {
+			t.Fatalf("unexpected aggregated line %q, expected %q", line, expect)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "a.log"))
+	if err != nil {
+		t.Fatal("failed to read log:", err)
+	}
+	if string(b) != "hello\r\nworld\n" {
+		t.Fatalf("unexpected log %q", b)
+	}
+}
+
+func TestSyslogUnavailable(t *testing.T) {
+	out, err := openOutput(t.TempDir(), "a", ScriptConfig{Syslog: "user"}, nil)
+	if err != nil {
+		t.Fatal("failed to open output:", err)
+	}
+	if out.syslog != nil {
+		out.close()
+		t.Skip("syslog is available")
+	}
+
+	syslogErr := out.syslogErr
+
+	var j mockJournal
+	out.capture(&j, "a", 1)
+
+	j.Verify(t, true, []Event{
+		&EventWarning{Component: "process", Error: "a: " + syslogErr.Error()},
+	})
+}
+
+func TestReportEvent(t *testing.T) {
+	var j mockJournal
+
+	reportEvent(&j, "a", 1, []byte("regular output"))
+	reportEvent(&j, "a", 1, []byte(ProcessEventPrefix+`{"progress": 0.5}`))
+	reportEvent(&j, "a", 1, []byte(ProcessEventPrefix+`0.5`))
+
+	j.Verify(t, true, []Event{
+		&EventProcessReported{File: "a", PID: 1, Data: []byte(`{"progress": 0.5}`)},
+		&EventWarning{Component: "process", Error: "a: reported event is not a JSON object"},
+	})
+}
+
+func TestLastWords(t *testing.T) {
+	out, err := openOutput(t.TempDir(), "a", ScriptConfig{LastWords: 16}, nil)
+	if err != nil {
+		t.Fatal("failed to open output:", err)
+	}
+
+	child := out.child
+	out.child = nil // pretend that the child has the only copy
+
+	words := out.words
+
+	var j mockJournal
+	out.capture(&j, "a", 1)
+
+	io.WriteString(child, "starting\nworking hard\npanic: oops\n")
+	child.Close()
+
+	if got := words.String(time.Second); got != "panic: oops" {
+		t.Errorf("unexpected last words %q", got)
+	}
+
+	words = newLastWords(8)
+	words.Write([]byte("a very long line"))
+	close(words.done)
+
+	if got := words.String(0); got != "ong line" {
+		t.Errorf("unexpected last words of a single line %q", got)
+	}
+}
@@ -0,0 +1,137 @@
+package cronmon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// PathWatchSettle is the duration that a process waits after one of its watched
+// paths changed before restarting, so that a burst of changes, such as a
+// certificate and its key being renewed, only restarts it once.
+var PathWatchSettle = time.Second
+
+// pathWatcher watches the paths of ScriptConfig.WatchPaths. Each process has
+// its own pathWatcher, separate from the Watcher of the scripts directory.
+type pathWatcher struct {
+	w *fsnotify.Watcher
+	// files contains the watched files, and dirs contains the watched paths
+	// that are directories.
+	files map[string]struct{}
+	dirs  map[string]struct{}
+}
+
+// newPathWatcher starts watching the given paths, which are relative to dir.
+func newPathWatcher(dir string, paths []string) (*pathWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create watcher")
+	}
+
+	pw := &pathWatcher{
+		w:     w,
+		files: map[string]struct{}{},
+		dirs:  map[string]struct{}{},
+	}
+
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		path = filepath.Clean(path)
+
+		watch := filepath.Dir(path)
+
+		if s, err := os.Stat(path); err == nil && s.IsDir() {
+			pw.dirs[path] = struct{}{}
+			watch = path
+		} else {
+			pw.files[path] = struct{}{}
+		}
+
+		if err := w.Add(watch); err != nil {
+			w.Close()
+			return nil, errors.Wrapf(err, "failed to watch %s", watch)
+		}
+	}
+
+	return pw, nil
+}
+
+// match returns the watched path that the given event concerns, or an empty
+// string if it concerns none.
+func (pw *pathWatcher) match(evt fsnotify.Event) string {
+	name := filepath.Clean(evt.Name)
+
+	if _, ok := pw.files[name]; ok {
+		return name
+	}
+	if _, ok := pw.dirs[filepath.Dir(name)]; ok {
+		return filepath.Dir(name)
+	}
+	if _, ok := pw.dirs[name]; ok {
+		return name
+	}
+
+	return ""
+}
+
+// watchPaths restarts the process once one of the watched paths changes, or it
+// sends the reload signal to it if one is configured. The exited channel must
+// be closed once the process exits.
+func (proc *Process) watchPaths(p exec.Process, exited <-chan struct{}, cfg ScriptConfig) {
+	pw, err := newPathWatcher(proc.dir, cfg.WatchPaths)
+	if err != nil {
+		proc.j.Write(&EventWarning{
+			Component: "process",
+			Error:     fmt.Sprintf("%s: not watching paths because: %v", proc.name, err),
+		})
+		return
+	}
+	defer pw.w.Close()
+
+	var changed string
+	var settle <-chan time.Time
+
+	for {
+		select {
+		case <-exited:
+			return
+
+		case err := <-pw.w.Errors:
+			proc.j.Write(&EventWarning{
+				Component: "process",
+				Error:     fmt.Sprintf("%s: path watcher error: %v", proc.name, err),
+			})
+
+		case evt := <-pw.w.Events:
+			if path := pw.match(evt); path != "" && changed == "" {
+				changed = path
+				settle = time.After(PathWatchSettle)
+			}
+
+		case <-settle:
+			if cfg.ReloadSignal != "" && proc.reload(cfg.ReloadSignal, changed) {
+				changed = ""
+				settle = nil
+				continue
+			}
+
+			proc.j.Write(&EventProcessPathChanged{
+				File: proc.name,
+				PID:  p.PID(),
+				Path: changed,
+			})
+
+			// Restarting gracefully stops the current process in the monitor
+			// routine, which closes exited.
+			proc.Start(true)
+			return
+		}
+	}
+}
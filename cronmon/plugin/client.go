@@ -0,0 +1,329 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	osexec "os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/pkg/errors"
+)
+
+// HandshakeTimeout is the duration to wait for a plugin to reply to the
+// handshake.
+var HandshakeTimeout = 10 * time.Second
+
+// CloseTimeout is the duration to wait for a plugin to exit once its stdin is
+// closed before it's killed.
+var CloseTimeout = 5 * time.Second
+
+// WriteTimeout is the duration to wait for a journaler plugin to write an
+// event. Events are dropped if the plugin doesn't write them in time, so that a
+// stuck plugin can't hold up cronmon.
+var WriteTimeout = 5 * time.Second
+
+// NotifyBuffer is the number of notifications that may be queued for a
+// notifier plugin. Notifications are dropped while the queue is full.
+var NotifyBuffer = 64
+
+// Client is a connection to a plugin.
+type Client struct {
+	// Info is the plugin's reply to the handshake.
+	Info HandshakeReply
+
+	rpc  *rpc.Client
+	cmd  *osexec.Cmd
+	done chan struct{}
+	once sync.Once
+}
+
+// Start starts the plugin at the given path and performs the handshake.
+func Start(path string) (*Client, error) {
+	cmd := osexec.Command(path)
+	cmd.Stderr = os.Stderr
+	// The plugin should exit once its stdin is closed, but make sure that it
+	// doesn't outlive cronmon.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "failed to start plugin")
+	}
+
+	c, err := NewClient(stdioConn{stdout, stdin})
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.Wrapf(err, "plugin %s", path)
+	}
+
+	c.cmd = cmd
+	return c, nil
+}
+
+// NewClient creates a client of the plugin on the other end of the given
+// connection and performs the handshake. It's mostly useful for testing; see
+// Start.
+func NewClient(conn io.ReadWriteCloser) (*Client, error) {
+	c := &Client{
+		rpc:  jsonrpc.NewClient(conn),
+		done: make(chan struct{}),
+	}
+
+	call := c.rpc.Go("Plugin.Handshake", HandshakeArgs{Version: Version}, &c.Info, nil)
+
+	timer := time.NewTimer(HandshakeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			c.rpc.Close()
+			return nil, errors.Wrap(call.Error, "handshake failed")
+		}
+	case <-timer.C:
+		c.rpc.Close()
+		return nil, errors.New("handshake timed out")
+	}
+
+	if c.Info.Version != Version {
+		c.rpc.Close()
+		return nil, fmt.Errorf("unsupported protocol version %d", c.Info.Version)
+	}
+	if c.Info.Name == "" {
+		c.rpc.Close()
+		return nil, errors.New("plugin has no name")
+	}
+
+	return c, nil
+}
+
+// Close closes the connection to the plugin and waits for it to exit. It's
+// killed if it doesn't exit in time.
+func (c *Client) Close() error {
+	var err error
+
+	c.once.Do(func() {
+		close(c.done)
+		err = c.rpc.Close()
+
+		if c.cmd == nil {
+			return
+		}
+
+		exited := make(chan error, 1)
+		go func() { exited <- c.cmd.Wait() }()
+
+		select {
+		case <-exited:
+		case <-time.After(CloseTimeout):
+			c.cmd.Process.Kill()
+			<-exited
+		}
+	})
+
+	return err
+}
+
+// Journaler returns the journaler that writes events to the plugin.
+func (c *Client) Journaler() cronmon.Journaler {
+	return pluginJournaler{c}
+}
+
+type pluginJournaler struct {
+	c *Client
+}
+
+func (j pluginJournaler) ID() string { return "plugin:" + j.c.Info.Name }
+
+func (j pluginJournaler) Write(ev cronmon.Event) error {
+	return j.WriteAt(ev, time.Now())
+}
+
+func (j pluginJournaler) WriteAt(ev cronmon.Event, t time.Time) error {
+	e, err := NewEvent(ev, t)
+	if err != nil {
+		return err
+	}
+
+	call := j.c.rpc.Go("Plugin.Write", e, &Empty{}, nil)
+
+	timer := time.NewTimer(WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return errors.Errorf("write timed out, dropping %s", ev.Type())
+	case <-j.c.done:
+		return rpc.ErrShutdown
+	}
+}
+
+// Notifier returns the journaler that notifies the plugin of the events that it
+// asked for in the background. Failures are written to the given journaler as
+// warnings, so it must not include the notifier itself.
+func (c *Client) Notifier(warn cronmon.Journaler) cronmon.Journaler {
+	n := &pluginNotifier{
+		c:      c,
+		warn:   warn,
+		queue:  make(chan Event, NotifyBuffer),
+		events: make(map[string]bool, len(c.Info.NotifyEvents)),
+	}
+	for _, typ := range c.Info.NotifyEvents {
+		n.events[typ] = true
+	}
+
+	go n.run()
+	return n
+}
+
+type pluginNotifier struct {
+	c      *Client
+	warn   cronmon.Journaler
+	queue  chan Event
+	events map[string]bool
+}
+
+func (n *pluginNotifier) ID() string { return "plugin:" + n.c.Info.Name }
+
+func (n *pluginNotifier) Write(ev cronmon.Event) error {
+	return n.WriteAt(ev, time.Now())
+}
+
+// WriteAt queues the event with the given time, so that the plugin gets the
+// time that the event happened rather than when it was dequeued.
+func (n *pluginNotifier) WriteAt(ev cronmon.Event, t time.Time) error {
+	if len(n.events) > 0 && !n.events[ev.Type()] {
+		return nil
+	}
+
+	e, err := NewEvent(ev, t)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case n.queue <- e:
+	default:
+		n.warning("notification queue is full, dropping " + ev.Type())
+	}
+
+	return nil
+}
+
+func (n *pluginNotifier) run() {
+	for {
+		select {
+		case e := <-n.queue:
+			if err := n.c.rpc.Call("Plugin.Notify", e, &Empty{}); err != nil {
+				n.warning("failed to notify: " + err.Error())
+			}
+		case <-n.c.done:
+			return
+		}
+	}
+}
+
+func (n *pluginNotifier) warning(msg string) {
+	n.warn.Write(&cronmon.EventWarning{
+		Component: "plugin " + n.c.Info.Name,
+		Error:     msg,
+	})
+}
+
+// Spawner returns the spawner that spawns processes through the plugin. The
+// processes' standard files are not passed to the plugin, so their output is
+// up to the plugin.
+func (c *Client) Spawner() cronmon.Spawner {
+	return pluginSpawner{c}
+}
+
+type pluginSpawner struct {
+	c *Client
+}
+
+func (s pluginSpawner) Spawn(path string, config json.RawMessage, opts exec.Options) (exec.Process, error) {
+	var reply SpawnReply
+
+	err := s.c.rpc.Call("Plugin.Spawn", SpawnArgs{
+		Path:   path,
+		Env:    opts.Env,
+		Config: config,
+	}, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return pluginProcess{s.c, reply.ID}, nil
+}
+
+// pluginProcess is a process spawned by a plugin.
+type pluginProcess struct {
+	c  *Client
+	id int
+}
+
+var _ exec.Process = pluginProcess{}
+
+func (p pluginProcess) PID() int { return p.id }
+
+func (p pluginProcess) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	return p.c.rpc.Call("Plugin.Signal", SignalArgs{ID: p.id, Signal: int(s)}, &Empty{})
+}
+
+func (p pluginProcess) Kill() error {
+	return p.Signal(syscall.SIGKILL)
+}
+
+// Wait waits for the process to exit. The process is considered killed if the
+// plugin goes away.
+func (p pluginProcess) Wait() exec.ExitStatus {
+	var reply WaitReply
+
+	if err := p.c.rpc.Call("Plugin.Wait", WaitArgs{ID: p.id}, &reply); err != nil {
+		return exec.ExitStatus{PID: p.id, Code: -1, Error: err}
+	}
+
+	status := exec.ExitStatus{PID: p.id, Code: reply.Code}
+	if reply.Error != "" {
+		status.Error = errors.New(reply.Error)
+	}
+
+	return status
+}
+
+// stdioConn combines the stdout and stdin of a process into a connection.
+type stdioConn struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (c stdioConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c stdioConn) Close() error {
+	err := c.w.Close()
+	c.ReadCloser.Close()
+	return err
+}
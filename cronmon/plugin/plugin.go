@@ -0,0 +1,128 @@
+// Package plugin implements cronmon plugins, which are external programs that
+// add journalers, notifiers and spawners to cronmon without forking it.
+//
+// A plugin is started by cronmon and speaks JSON-RPC 1.0, as implemented by
+// package net/rpc/jsonrpc, over its stdin and stdout; its stderr is passed
+// through to cronmon's. Each request is a single JSON object such as
+//
+//	{"method": "Plugin.Write", "params": [{...}], "id": 1}
+//
+// and requests may be outstanding concurrently. The methods of the "Plugin"
+// service are:
+//
+//	Handshake(HandshakeArgs) HandshakeReply  always called first
+//	Write(Event)                             journalers
+//	Notify(Event)                            notifiers
+//	Spawn(SpawnArgs) SpawnReply              spawners
+//	Signal(SignalArgs)                       spawners
+//	Wait(WaitArgs) WaitReply                 spawners; blocks until exit
+//
+// Plugins written in Go can use Serve instead of implementing the protocol.
+package plugin
+
+import (
+	"encoding/json"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+)
+
+// Version is the version of the plugin protocol. It's only changed when the
+// protocol changes incompatibly.
+const Version = 1
+
+// HandshakeArgs are the arguments of Plugin.Handshake.
+type HandshakeArgs struct {
+	// Version is the protocol version that cronmon speaks.
+	Version int `json:"version"`
+}
+
+// HandshakeReply describes a plugin and what it provides.
+type HandshakeReply struct {
+	// Version is the protocol version that the plugin speaks. It must match
+	// cronmon's.
+	Version int `json:"version"`
+	// Name is the name of the plugin. Scripts choose the plugin's spawner by
+	// this name.
+	Name string `json:"name"`
+	// Journaler, if true, makes cronmon write every event to the plugin with
+	// Plugin.Write. A failed write is a failed journal write.
+	Journaler bool `json:"journaler,omitempty"`
+	// Notifier, if true, makes cronmon send events to the plugin with
+	// Plugin.Notify. Notifications are sent in the background, so that a slow
+	// plugin doesn't hold up cronmon, and failures are journaled as warnings.
+	Notifier bool `json:"notifier,omitempty"`
+	// NotifyEvents are the types of events to notify of, such as "process
+	// exited". All events are sent if it's empty.
+	NotifyEvents []string `json:"notify_events,omitempty"`
+	// Spawner, if true, lets scripts choose the plugin to spawn them with
+	// Plugin.Spawn.
+	Spawner bool `json:"spawner,omitempty"`
+}
+
+// Event is a journaled event, in the same form as a line of the journal.
+type Event struct {
+	Time time.Time       `json:"time"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// NewEvent creates the Event of a cronmon event.
+func NewEvent(ev cronmon.Event, t time.Time) (Event, error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Time: t, Type: ev.Type(), Data: data}, nil
+}
+
+// Decode decodes the event into a cronmon event. A *journal.UnknownEventError
+// is returned for unknown event types.
+func (ev Event) Decode() (cronmon.Event, error) {
+	event := cronmon.NewEvent(ev.Type)
+	if event == nil {
+		return nil, &journal.UnknownEventError{Type: ev.Type}
+	}
+	if err := json.Unmarshal(ev.Data, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// SpawnArgs are the arguments of Plugin.Spawn.
+type SpawnArgs struct {
+	// Path is the path to the script.
+	Path string `json:"path"`
+	// Env is the environment of the process in the "key=value" form.
+	Env []string `json:"env"`
+	// Config is the script's "spawner_config" option, if any.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// SpawnReply is the reply of Plugin.Spawn.
+type SpawnReply struct {
+	// ID identifies the process in the other calls. It's shown as the PID of
+	// the process, so it should be the PID if there is one.
+	ID int `json:"id"`
+}
+
+// SignalArgs are the arguments of Plugin.Signal.
+type SignalArgs struct {
+	ID     int `json:"id"`
+	Signal int `json:"signal"` // Linux signal number, such as 15 for SIGTERM
+}
+
+// WaitArgs are the arguments of Plugin.Wait.
+type WaitArgs struct {
+	ID int `json:"id"`
+}
+
+// WaitReply is the reply of Plugin.Wait once the process has exited.
+type WaitReply struct {
+	Code  int    `json:"code"` // -1 if the process was killed by a signal
+	Error string `json:"error,omitempty"`
+}
+
+// Empty is the argument or reply of methods that have none.
+type Empty struct{}
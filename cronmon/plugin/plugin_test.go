@@ -0,0 +1,161 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []cronmon.Event
+	notify chan cronmon.Event
+}
+
+func (r *recorder) write(ev Event) error {
+	e, err := ev.Decode()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recorder) notified(ev Event) error {
+	e, err := ev.Decode()
+	if err != nil {
+		return err
+	}
+	r.notify <- e
+	return nil
+}
+
+func startPlugin(t *testing.T, p Plugin) *Client {
+	t.Helper()
+
+	server, client := net.Pipe()
+	go ServeConn(p, server)
+
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal("failed to connect to plugin:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestPlugin(t *testing.T) {
+	r := recorder{notify: make(chan cronmon.Event, 1)}
+
+	var spawnArgs SpawnArgs
+
+	c := startPlugin(t, Plugin{
+		Name:         "test",
+		Write:        r.write,
+		Notify:       r.notified,
+		NotifyEvents: []string{"process exited"},
+		Spawn: func(args SpawnArgs) (exec.Process, error) {
+			spawnArgs = args
+			return exec.NewSleepProcess(time.Hour, 0, 42), nil
+		},
+	})
+
+	if !c.Info.Journaler || !c.Info.Notifier || !c.Info.Spawner {
+		t.Fatalf("unexpected handshake: %#v", c.Info)
+	}
+
+	if err := c.Journaler().Write(&cronmon.EventAcquired{JournalID: "a"}); err != nil {
+		t.Fatal("failed to write:", err)
+	}
+	if len(r.events) != 1 || r.events[0].(*cronmon.EventAcquired).JournalID != "a" {
+		t.Fatalf("unexpected written events: %#v", r.events)
+	}
+
+	n := c.Notifier(cronmon.NewRingJournal(8))
+	n.Write(&cronmon.EventAcquired{})
+	n.Write(&cronmon.EventProcessExited{PID: 1, File: "a.sh", ExitCode: 2})
+
+	select {
+	case ev := <-r.notify:
+		if ev, ok := ev.(*cronmon.EventProcessExited); !ok || ev.ExitCode != 2 {
+			t.Fatalf("unexpected notification: %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+
+	config := json.RawMessage(`{"queue":"fast"}`)
+
+	p, err := c.Spawner().Spawn("/scripts/a.sh", config, exec.Options{Env: []string{"A=1"}})
+	if err != nil {
+		t.Fatal("failed to spawn:", err)
+	}
+	if p.PID() != 42 {
+		t.Errorf("unexpected PID %d", p.PID())
+	}
+	if spawnArgs.Path != "/scripts/a.sh" || string(spawnArgs.Config) != string(config) {
+		t.Errorf("unexpected spawn arguments: %#v", spawnArgs)
+	}
+
+	if err := p.Signal(syscall.SIGKILL); err != nil {
+		t.Fatal("failed to kill:", err)
+	}
+	if status := p.Wait(); status.Code != -1 || status.Error != nil {
+		t.Errorf("unexpected exit status: %#v", status)
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err == nil {
+		t.Error("signaled a process that was waited for")
+	}
+}
+
+func TestPluginUnsupported(t *testing.T) {
+	c := startPlugin(t, Plugin{Name: "empty"})
+
+	if c.Info.Journaler || c.Info.Notifier || c.Info.Spawner {
+		t.Fatalf("unexpected handshake: %#v", c.Info)
+	}
+
+	if err := c.Journaler().Write(&cronmon.EventAcquired{}); err == nil {
+		t.Error("wrote to a plugin that isn't a journaler")
+	}
+}
+
+func TestPluginWriteTimeout(t *testing.T) {
+	timeout := WriteTimeout
+	t.Cleanup(func() { WriteTimeout = timeout })
+	WriteTimeout = 10 * time.Millisecond
+
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+
+	c := startPlugin(t, Plugin{
+		Name: "stuck",
+		Write: func(Event) error {
+			<-stuck
+			return nil
+		},
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- c.Journaler().Write(&cronmon.EventAcquired{}) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("write to a stuck plugin succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a stuck plugin blocked")
+	}
+}
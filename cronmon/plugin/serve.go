@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync"
+	"syscall"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/pkg/errors"
+)
+
+// Plugin is a plugin implemented in Go. It provides whatever its non-nil
+// functions implement. See Serve.
+type Plugin struct {
+	// Name is the name of the plugin. It is required.
+	Name string
+	// Write, if not nil, makes the plugin a journaler.
+	Write func(Event) error
+	// Notify, if not nil, makes the plugin a notifier of NotifyEvents, or of
+	// all events if it's empty.
+	Notify       func(Event) error
+	NotifyEvents []string
+	// Spawn, if not nil, makes the plugin a spawner. The returned process is
+	// waited on the same goroutine that Spawn is called on, so it may be
+	// started with exec.StartProcess.
+	Spawn func(SpawnArgs) (exec.Process, error)
+}
+
+// Serve serves the plugin over stdin and stdout until cronmon closes them.
+func Serve(p Plugin) error {
+	return ServeConn(p, stdioConn{os.Stdin, os.Stdout})
+}
+
+// ServeConn serves the plugin over the given connection until it's closed.
+func ServeConn(p Plugin, conn io.ReadWriteCloser) error {
+	if p.Name == "" {
+		return errors.New("plugin has no name")
+	}
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Plugin", &service{p: p, procs: map[int]*spawned{}}); err != nil {
+		return err
+	}
+
+	srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
+
+// service is the RPC service of a Plugin. Its exported methods are the
+// methods of the protocol.
+type service struct {
+	p     Plugin
+	mu    sync.Mutex
+	procs map[int]*spawned
+}
+
+// spawned is a process spawned by a plugin.
+type spawned struct {
+	proc   exec.Process
+	done   chan struct{}
+	status exec.ExitStatus
+}
+
+var errUnsupported = errors.New("not supported by plugin")
+
+func (s *service) Handshake(args HandshakeArgs, reply *HandshakeReply) error {
+	if args.Version != Version {
+		return fmt.Errorf("unsupported protocol version %d", args.Version)
+	}
+
+	*reply = HandshakeReply{
+		Version:      Version,
+		Name:         s.p.Name,
+		Journaler:    s.p.Write != nil,
+		Notifier:     s.p.Notify != nil,
+		NotifyEvents: s.p.NotifyEvents,
+		Spawner:      s.p.Spawn != nil,
+	}
+	return nil
+}
+
+func (s *service) Write(ev Event, _ *Empty) error {
+	if s.p.Write == nil {
+		return errUnsupported
+	}
+	return s.p.Write(ev)
+}
+
+func (s *service) Notify(ev Event, _ *Empty) error {
+	if s.p.Notify == nil {
+		return errUnsupported
+	}
+	return s.p.Notify(ev)
+}
+
+func (s *service) Spawn(args SpawnArgs, reply *SpawnReply) error {
+	if s.p.Spawn == nil {
+		return errUnsupported
+	}
+
+	started := make(chan error, 1)
+	sp := &spawned{done: make(chan struct{})}
+
+	go func() {
+		proc, err := s.p.Spawn(args)
+		if err != nil {
+			started <- err
+			return
+		}
+
+		sp.proc = proc
+		started <- nil
+
+		sp.status = proc.Wait()
+		close(sp.done)
+	}()
+
+	if err := <-started; err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.procs[sp.proc.PID()] = sp
+	s.mu.Unlock()
+
+	reply.ID = sp.proc.PID()
+	return nil
+}
+
+func (s *service) process(id int) (*spawned, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown process %d", id)
+	}
+	return sp, nil
+}
+
+func (s *service) Signal(args SignalArgs, _ *Empty) error {
+	sp, err := s.process(args.ID)
+	if err != nil {
+		return err
+	}
+	return sp.proc.Signal(syscall.Signal(args.Signal))
+}
+
+func (s *service) Wait(args WaitArgs, reply *WaitReply) error {
+	sp, err := s.process(args.ID)
+	if err != nil {
+		return err
+	}
+
+	<-sp.done
+
+	s.mu.Lock()
+	delete(s.procs, args.ID)
+	s.mu.Unlock()
+
+	reply.Code = sp.status.Code
+	if sp.status.Error != nil {
+		reply.Error = sp.status.Error.Error()
+	}
+	return nil
+}
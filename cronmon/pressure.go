@@ -0,0 +1,163 @@
+package cronmon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PressureDir is the directory of the kernel's pressure stall information.
+var PressureDir = "/proc/pressure"
+
+// LoadAvgPath is the path to the kernel's load averages.
+var LoadAvgPath = "/proc/loadavg"
+
+// PressureCheckInterval is the interval at which the pressure of the host is
+// checked again while the restart of a process is deferred.
+var PressureCheckInterval = 10 * time.Second
+
+// PressureMaxDeferral is the longest that the restart of a process is deferred
+// for, after which it's restarted no matter the pressure, so that a host that's
+// always busy doesn't keep it down forever.
+var PressureMaxDeferral = 10 * time.Minute
+
+// PressureLimits are the limits of the host's pressure above which the restarts
+// of crashed processes are deferred, so that restarting them doesn't make an
+// overloaded host worse. A zero limit is disabled. Manual starts are never
+// deferred.
+type PressureLimits struct {
+	// CPU, Memory and IO are the percentages of time over the last 10 seconds
+	// in which some tasks were stalled on the resource, as reported by the
+	// kernel's pressure stall information. They're ignored on kernels without
+	// it.
+	CPU    float64 `json:"cpu,omitempty"`
+	Memory float64 `json:"memory,omitempty"`
+	IO     float64 `json:"io,omitempty"`
+	// Load is the 1-minute load average per CPU.
+	Load float64 `json:"load,omitempty"`
+}
+
+// ParsePressureLimits parses limits in the form of comma-separated key=value
+// pairs, such as "cpu=80,memory=20,load=2". The keys are cpu, memory, io and
+// load.
+func ParsePressureLimits(s string) (PressureLimits, error) {
+	var limits PressureLimits
+	if s == "" {
+		return limits, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return limits, errors.Errorf("invalid pressure limit %q, expected key=value", pair)
+		}
+
+		v, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil || v < 0 {
+			return limits, errors.Errorf("invalid value of pressure limit %q", pair)
+		}
+
+		switch key := pair[:i]; key {
+		case "cpu":
+			limits.CPU = v
+		case "memory":
+			limits.Memory = v
+		case "io":
+			limits.IO = v
+		case "load":
+			limits.Load = v
+		default:
+			return limits, errors.Errorf("unknown pressure limit %q", key)
+		}
+	}
+
+	return limits, nil
+}
+
+// IsZero returns true if all limits are disabled.
+func (l PressureLimits) IsZero() bool {
+	return l == PressureLimits{}
+}
+
+// exceeded returns the reason that the host is over the limits, or an empty
+// string if it isn't. Pressures that can't be read are ignored.
+func (l PressureLimits) exceeded() string {
+	resources := []struct {
+		name  string
+		limit float64
+	}{
+		{"cpu", l.CPU},
+		{"memory", l.Memory},
+		{"io", l.IO},
+	}
+
+	for _, res := range resources {
+		if res.limit <= 0 {
+			continue
+		}
+		avg, err := readPressure(filepath.Join(PressureDir, res.name))
+		if err == nil && avg > res.limit {
+			return fmt.Sprintf("%s pressure %.2f%% is over %g%%", res.name, avg, res.limit)
+		}
+	}
+
+	if l.Load > 0 {
+		load, err := readLoadAvg(LoadAvgPath)
+		if err == nil && load/float64(runtime.NumCPU()) > l.Load {
+			return fmt.Sprintf("load average %.2f is over %g per CPU", load, l.Load)
+		}
+	}
+
+	return ""
+}
+
+// readPressure returns the avg10 value of the "some" line of the given pressure
+// file.
+func readPressure(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "avg10=") {
+				return strconv.ParseFloat(strings.TrimPrefix(field, "avg10="), 64)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, errors.Errorf("no avg10 in %s", path)
+}
+
+// readLoadAvg returns the 1-minute load average in the given loadavg file.
+func readLoadAvg(path string) (float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, errors.Errorf("empty %s", path)
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
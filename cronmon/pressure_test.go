@@ -0,0 +1,101 @@
+package cronmon
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParsePressureLimits(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect PressureLimits
+		fail   bool
+	}{
+		{"", PressureLimits{}, false},
+		{"cpu=80,memory=20.5,io=50,load=2", PressureLimits{CPU: 80, Memory: 20.5, IO: 50, Load: 2}, false},
+		{"cpu", PressureLimits{}, true},
+		{"cpu=-1", PressureLimits{}, true},
+		{"cpu=a", PressureLimits{}, true},
+		{"swap=1", PressureLimits{}, true},
+	}
+
+	for _, test := range tests {
+		limits, err := ParsePressureLimits(test.in)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%q: expected error, got %#v", test.in, limits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.in, err)
+			continue
+		}
+		if limits != test.expect {
+			t.Errorf("%q: got %#v, expected %#v", test.in, limits, test.expect)
+		}
+	}
+}
+
+// fakePressure points PressureDir and LoadAvgPath to a temporary directory for
+// the duration of the test and returns it. See writePressure.
+func fakePressure(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	pressureDir, loadAvgPath := PressureDir, LoadAvgPath
+	t.Cleanup(func() { PressureDir, LoadAvgPath = pressureDir, loadAvgPath })
+	PressureDir = dir
+	LoadAvgPath = filepath.Join(dir, "loadavg")
+
+	return dir
+}
+
+// writePressure makes the given fakePressure directory report the given CPU
+// pressure and load average per CPU.
+func writePressure(t *testing.T, dir string, cpu, load float64) {
+	t.Helper()
+
+	cpuPressure := "some avg10=" + strconv.FormatFloat(cpu, 'f', 2, 64) + " avg60=0.00 avg300=0.00 total=0\n" +
+		"full avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"
+	loadAvg := strconv.FormatFloat(load*float64(runtime.NumCPU()), 'f', 2, 64) + " 0.00 0.00 1/100 1000\n"
+
+	// The files are replaced atomically, since processes may be reading them.
+	for name, content := range map[string]string{"cpu": cpuPressure, "loadavg": loadAvg} {
+		tmp := filepath.Join(dir, "."+name)
+		if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPressureLimitsExceeded(t *testing.T) {
+	writePressure(t, fakePressure(t), 12.5, 1.5)
+
+	tests := []struct {
+		limits PressureLimits
+		reason string
+	}{
+		{PressureLimits{CPU: 10}, "cpu pressure 12.50% is over 10%"},
+		{PressureLimits{CPU: 20}, ""},
+		{PressureLimits{Load: 1}, "load average"},
+		{PressureLimits{Load: 2}, ""},
+		// Pressures that can't be read are ignored.
+		{PressureLimits{Memory: 1, IO: 1}, ""},
+	}
+
+	for _, test := range tests {
+		reason := test.limits.exceeded()
+		if (reason == "") != (test.reason == "") || !strings.HasPrefix(reason, test.reason) {
+			t.Errorf("%#v: got reason %q, expected %q", test.limits, reason, test.reason)
+		}
+	}
+}
@@ -2,8 +2,16 @@ package cronmon
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,53 +32,227 @@ var ProcessRetryBackoff = []time.Duration{
 	time.Minute,
 }
 
+// ProcessSpawnErrorLimit is the default number of consecutive spawn errors with
+// the same reason after which a process is considered persistently failing.
+// The process is then only retried every ProcessSpawnProbeInterval, and its
+// spawn errors are no longer journaled until the reason changes.
+var ProcessSpawnErrorLimit = 5
+
+// ProcessSpawnProbeInterval is the default interval at which a persistently
+// failing process is retried. See ProcessSpawnErrorLimit.
+var ProcessSpawnProbeInterval = 10 * time.Minute
+
+// ProcessMinUptime is the default duration that a process must be up for to be
+// considered stably started, after which its backoff is reset.
+var ProcessMinUptime = 10 * time.Second
+
+// ProcessStartLimit is the default rate limit on process starts, independent of
+// the backoff. It prevents a storm of watcher events or commands from spawning
+// an unbounded number of processes.
+var ProcessStartLimit = StartLimit{
+	Burst: 10,
+	Every: time.Second,
+}
+
+// ProcessStdinTimeout is the time to wait for a process to accept a line
+// written to its stdin.
+var ProcessStdinTimeout = 5 * time.Second
+
 // Process monitors an individual process. It is capable of self-monitoring the
 // process, so any commanding operation simply cannot fail but only be delayed.
+//
+// All methods are safe to call concurrently. Commands are applied in the order
+// that the monitor routine receives them:
+//
+//	Start, Kick     start the process unless it's running; Start(true) also
+//	                restarts a running process
+//	Stop            stop the process for good; later calls return the same
+//	                error as the first one
+//	after Stop      Start and Kick return ErrProcessStopped, and
+//	                RecheckConditions does nothing
 type Process struct {
 	WaitTimeout  time.Duration
 	RetryBackoff []time.Duration
+	MinUptime    time.Duration
+	StartLimit   StartLimit
+	// Pressure are the limits of the host's pressure above which restarts
+	// after the process exits are deferred. See PressureLimits.
+	Pressure PressureLimits
+	// SpawnErrorLimit is the number of consecutive spawn errors with the same
+	// reason after which the process is only retried every
+	// SpawnProbeInterval. Zero disables the limit. See ProcessSpawnErrorLimit.
+	SpawnErrorLimit    int
+	SpawnProbeInterval time.Duration
+	// Output, if not nil, receives the stdout and stderr of the process line
+	// by line in addition to its log file.
+	Output *LogMux
+	// IsRunning, if not nil, returns true if the process of the given script
+	// is running. It is used to check "script:" start conditions.
+	IsRunning func(file string) bool
+	// DryRun, if true, makes the process only journal what it would spawn
+	// instead of spawning anything.
+	DryRun bool
+	// User, if not nil, is the user that the process runs as instead of
+	// cronmon's. See MonitorOptions.User.
+	User *user.User
+	// Fence, if not zero, is the fencing token that the process is given in
+	// FenceEnv. See MonitorOptions.Fence.
+	Fence uint64
+	// Spawn starts the process of the script. It may be replaced before the
+	// process is started, such as with a test double from package
+	// cronmontest.
+	Spawn func(opts exec.Options) (exec.Process, error)
+	// Spawners are the spawners that scripts can choose with their
+	// configuration instead of Spawn, keyed by name.
+	Spawners map[string]Spawner
 
-	j Journaler
+	j       Journaler
+	breaker *restartBreaker // shared by the monitor's processes, or nil
+	waiters *waiterSet      // shared by the monitor's processes, or nil
+	slots   chan struct{}   // the monitor's spawn slots, or nil if unlimited
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	dir  string
 	file string
+	name string // journal-facing name, see ParseScriptName
+	path string
+	hash atomic.Value // string
+	body atomic.Value // string, the hash of the script alone
 
-	startCmd chan bool     // monitor, start command, true for restart
-	exited   chan struct{} // process, process signal
-	finalize chan error    // monitor, dead routine signal
-
-	startProc func() (exec.Process, error)
+	startCmd chan bool         // monitor, start command, true for restart
+	kickCmd  chan struct{}     // monitor, start now without backoff
+	adoptCmd chan exec.Process // monitor, adopt a running process
+	recheck  chan struct{}     // monitor, re-evaluate start conditions
+	exited   chan struct{}     // process, process signal
+	stopped  chan struct{}     // monitor, closed once stopped for good
+	stopErr  error             // the error of stopping, set before stopped
 
 	// states
-	pmut sync.Mutex
-	proc exec.Process
+	pmut    sync.Mutex
+	proc    exec.Process
+	pending chan struct{} // closed to cancel a start waiting for a spawn slot
+
+	smut     sync.Mutex
+	state    ProcessState
+	attempt  chan struct{} // closed once the last start was attempted
+	pid      int
+	restarts int
+	spawned  bool        // true if the script was ever spawned, for restarts
+	spawns   []time.Time // within FlapWindow, oldest to newest
+	config   ScriptConfig
+	stdin    *os.File      // nil if not writable
+	waiting  string        // the unmet start condition, if any
+	next     time.Time     // when the process is restarted after a delay, if any
+	backoff  time.Duration // the delay before next
+
+	stable bool // true if the last process has been up for MinUptime
+	stale  bool // true if the script changed since the process was started
+
+	spawnErr     string // the reason of the last spawn errors, see spawnErrorKey
+	spawnErrs    int    // the number of consecutive spawn errors with spawnErr
+	spawnFailing bool   // true if spawnErrs reached SpawnErrorLimit
+	spawnHint    string // the hint of the last spawn error, see spawnHint
+
+	words *lastWords // the last output of the running process, if kept
+
+	exitWaiters []chan EventProcessExited
+}
+
+// ProcessStatus describes the current status of a process.
+type ProcessStatus struct {
+	// File is the name of the script as it appears in the journal. See
+	// ParseScriptName.
+	File string `json:"file"`
+	// State is the lifecycle state of the process.
+	State ProcessState `json:"state"`
+	// PID is the PID of the process, or 0 if it's not running.
+	PID int `json:"pid,omitempty"`
+	// Hash is the hash of the script when the process was last started.
+	Hash string `json:"hash,omitempty"`
+	// Restarts is the cumulative number of restarts of the script, which is
+	// persisted across cronmon restarts until it's explicitly reset.
+	Restarts int `json:"restarts"`
+	// FlapScore is the number of restarts per hour over the FlapWindow.
+	FlapScore float64 `json:"flap_score"`
+	// Flapping is true if FlapScore is at or above the FlapThreshold.
+	Flapping bool `json:"flapping,omitempty"`
+	// Waiting is the start condition that the process is waiting for, if
+	// any.
+	Waiting string `json:"waiting,omitempty"`
+	// NextRestart is when the process is started again, if it's down and
+	// waiting for its restart backoff or start rate limit to pass.
+	NextRestart *time.Time `json:"next_restart,omitempty"`
+	// Backoff is the full delay before NextRestart, if any.
+	Backoff time.Duration `json:"backoff,omitempty"`
+	// RestartNeeded is true if the script on disk no longer matches Hash, so
+	// the process is running stale code. See ScriptCheckInterval.
+	RestartNeeded bool `json:"restart_needed,omitempty"`
+	// Group is the group of the script, if any. See ScriptConfig.Group.
+	Group string `json:"group,omitempty"`
+	// Stopped is true if the script was manually stopped. See
+	// Monitor.StopProcess.
+	Stopped bool `json:"stopped,omitempty"`
+	// SpawnFailing is the reason that the script persistently fails to spawn,
+	// if it does. See ProcessSpawnErrorLimit.
+	SpawnFailing string `json:"spawn_failing,omitempty"`
+	// SpawnHint explains how to fix SpawnFailing, if possible.
+	SpawnHint string `json:"spawn_hint,omitempty"`
+	// Fence is the fencing token that the process is given, if any. See
+	// MonitorOptions.Fence.
+	Fence uint64 `json:"fence,omitempty"`
 }
 
 // NewProcess creates a new process and a background monitor. The process is
-// terminated once the context times out. Wait must be called once the context
+// terminated once the context times out. Stop must be called once the context
 // is canceled to wait for the background routine to exit.
 func NewProcess(ctx context.Context, dir, file string, j Journaler) *Process {
 	ctx, cancel := context.WithCancel(ctx)
 	arg0 := filepath.Join(dir, file)
+	name, _ := ParseScriptName(file)
+
+	j = limitJournaler{j}
 
 	proc := &Process{
 		WaitTimeout:  ProcessWaitTimeout,
 		RetryBackoff: ProcessRetryBackoff,
+		MinUptime:    ProcessMinUptime,
+		StartLimit:   ProcessStartLimit,
+
+		SpawnErrorLimit:    ProcessSpawnErrorLimit,
+		SpawnProbeInterval: ProcessSpawnProbeInterval,
+
+		Spawn: func(opts exec.Options) (exec.Process, error) {
+			path, err := resolveScript(arg0)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case opts.Container != nil:
+				return exec.StartContainer([]string{path}, opts)
+			case opts.Remote != nil:
+				return exec.StartRemote([]string{path}, opts)
+			}
+			return exec.StartProcess([]string{path}, opts)
+		},
 
 		ctx:    ctx,
 		cancel: cancel,
 
 		j:        j,
+		state:    ProcessIdle,
+		dir:      dir,
 		file:     file,
+		name:     name,
+		path:     arg0,
 		startCmd: make(chan bool),
+		kickCmd:  make(chan struct{}),
+		adoptCmd: make(chan exec.Process),
+		recheck:  make(chan struct{}, 1),
 		exited:   make(chan struct{}, 1), // 1-buffered to hold in same routine
-		finalize: make(chan error),
-
-		startProc: func() (exec.Process, error) {
-			return exec.StartProcess([]string{arg0})
-		},
+		stopped:  make(chan struct{}),
+		attempt:  make(chan struct{}),
 	}
 
 	go proc.startMonitor()
@@ -78,27 +260,228 @@ func NewProcess(ctx context.Context, dir, file string, j Journaler) *Process {
 	return proc
 }
 
-// Start starts a new process. If the process is already started, then it
-// restarts the existing process.
-func (proc *Process) Start(restart bool) {
+// DanglingSymlinkError is returned when a script is a symlink that points to a
+// file that does not exist.
+type DanglingSymlinkError struct {
+	Link   string
+	Target string
+}
+
+// Error implements error.
+func (err *DanglingSymlinkError) Error() string {
+	return fmt.Sprintf("dangling symlink %s -> %s", err.Link, err.Target)
+}
+
+// resolveScript resolves the given script path to the path that should be
+// executed. If the script is a symlink, then its target is returned. The path
+// is always absolute, since the process may run in another directory.
+func resolveScript(path string) (string, error) {
+	target, err := resolveSymlink(path)
+	if err != nil {
+		return "", err
+	}
+	if target == "" {
+		return filepath.Abs(path)
+	}
+	return target, nil
+}
+
+// resolveSymlink returns the fully resolved target of the given path if it is a
+// symlink. An empty string is returned if the path is not a symlink, and a
+// *DanglingSymlinkError is returned if the target does not exist.
+func resolveSymlink(path string) (string, error) {
+	s, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if s.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			link, _ := os.Readlink(path)
+			return "", &DanglingSymlinkError{Link: path, Target: link}
+		}
+		return "", err
+	}
+
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+
+	return abs, nil
+}
+
+// Start starts the process if it's not running. If restart is true, then a
+// running process is restarted. ErrProcessStopped is returned if the process
+// was stopped.
+func (proc *Process) Start(restart bool) error {
+	// Check first, since select picks a ready case at random.
+	if proc.ctx.Err() != nil {
+		return ErrProcessStopped
+	}
+
+	proc.smut.Lock()
+	select {
+	case <-proc.attempt:
+		proc.attempt = make(chan struct{})
+	default:
+	}
+	proc.smut.Unlock()
+
 	select {
 	case <-proc.ctx.Done():
+		proc.markAttempted()
+		return ErrProcessStopped
 	case proc.startCmd <- restart:
+		return nil
+	}
+}
+
+// attempted returns a channel that is closed once the start that was last
+// requested with Start has been attempted. See markAttempted.
+func (proc *Process) attempted() <-chan struct{} {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	return proc.attempt
+}
+
+// Kick starts the process immediately if it's down, cancelling its pending
+// backoff and resetting it, as if the process had never failed. Unlike Start,
+// it also ends the slow probing of a persistently failing process. Nothing is
+// done if the process is running. ErrProcessStopped is returned if the process
+// was stopped.
+func (proc *Process) Kick() error {
+	if proc.ctx.Err() != nil {
+		return ErrProcessStopped
+	}
+
+	select {
+	case <-proc.ctx.Done():
+		return ErrProcessStopped
+	case proc.kickCmd <- struct{}{}:
+		return nil
+	}
+}
+
+// Adopt makes the given running process the process of the script, such as a
+// process that a previous cronmon started and that outlived it, unless the
+// script already has one. The adopted process can be stopped and restarted like
+// any other, and the script is restarted once it exits. ErrProcessStopped is
+// returned if the process was stopped.
+func (proc *Process) Adopt(p exec.Process) error {
+	if proc.ctx.Err() != nil {
+		return ErrProcessStopped
+	}
+
+	select {
+	case <-proc.ctx.Done():
+		return ErrProcessStopped
+	case proc.adoptCmd <- p:
+		return nil
+	}
+}
+
+// adopt adopts the given process. See Adopt.
+func (proc *Process) adopt(p exec.Process) {
+	proc.pmut.Lock()
+	defer proc.pmut.Unlock()
+
+	if proc.State().HasProcess() {
+		return
+	}
+
+	// The adopted process may well run an older version of the script, but
+	// there's no telling, so it's assumed to run the current one.
+	hash, _ := hashScript(proc.dir, proc.file, proc.User)
+	proc.hash.Store(hash)
+	body, _ := hashScriptBody(proc.dir, proc.file, proc.User)
+	proc.body.Store(body)
+
+	cfg, _ := loadScriptConfig(proc.dir, proc.file, proc.User)
+
+	proc.proc = p
+
+	proc.smut.Lock()
+	proc.config = cfg
+	proc.spawned = true
+	proc.stale = false
+	proc.pid = p.PID()
+	proc.smut.Unlock()
+
+	proc.j.Write(&EventProcessAdopted{
+		File: proc.name,
+		PID:  p.PID(),
+	})
+
+	proc.setState(ProcessAdopted)
+
+	go func() {
+		defer func() { proc.exited <- struct{}{} }()
+		proc.exit(p.Wait(), cfg, time.Time{})
+	}()
+}
+
+// markAttempted marks that the requested start of the process was attempted,
+// which is once its process was spawned or failed to spawn, once it had to
+// wait for its start conditions or its start limit, or once it was stopped for
+// good. The monitor waits for this to start scripts in order. It may be called
+// any number of times.
+func (proc *Process) markAttempted() {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	select {
+	case <-proc.attempt:
+	default:
+		close(proc.attempt)
 	}
 }
 
 func (proc *Process) start(restart bool) {
 	proc.pmut.Lock()
 
-	if proc.proc != nil {
+	if proc.pending != nil {
+		// The last start is still waiting for a spawn slot, and it spawns the
+		// current script anyway, so it also takes care of this one.
+		proc.pmut.Unlock()
+		return
+	}
+
+	if proc.State().HasProcess() {
 		if !restart {
 			proc.pmut.Unlock()
+			proc.markAttempted()
 			return
 		}
 
 		// Guarantee that the current process is stopped before spawning. This
 		// prevents running two instances of the same process.
-		proc.stop(false)
+		proc.stop(false, ProcessStarting)
+	}
+
+	if proc.DryRun {
+		proc.dryRunSpawn()
+		proc.pmut.Unlock()
+		proc.markAttempted()
+		return
+	}
+
+	proc.setState(ProcessStarting)
+
+	// Without a limit on spawns, pmut is held until the process is spawned,
+	// so that it can't be stopped before then. Otherwise, the process waits
+	// for a spawn slot without it, and stop cancels the wait.
+	var pending chan struct{}
+	if proc.slots != nil {
+		pending = make(chan struct{})
+		proc.pending = pending
+		proc.pmut.Unlock()
 	}
 
 	// Spawn a monitoring goroutine to report to proc.dead.
@@ -107,68 +490,1084 @@ func (proc *Process) start(restart bool) {
 		// dead for it to be restarted if needed.
 		defer func() { proc.exited <- struct{}{} }()
 
-		p, err := proc.startProc()
-		if err != nil {
-			proc.j.Write(&EventProcessSpawnError{
-				File:   proc.file,
-				Reason: err.Error(),
-			})
+		if pending != nil {
+			if !proc.acquireSpawn(pending) {
+				// Canceled while waiting for a spawn slot.
+				proc.markAttempted()
+				return
+			}
+
+			proc.pmut.Lock()
+
+			if proc.pending != pending {
+				// Canceled right as the slot was free.
+				proc.pmut.Unlock()
+				proc.releaseSpawn()
+				proc.markAttempted()
+				return
+			}
+
+			proc.pending = nil
+		}
+
+		// Record the hash of the script that we're about to run. An empty
+		// hash is stored if that fails, which will force the next update.
+		hash, _ := hashScript(proc.dir, proc.file, proc.User)
+		proc.hash.Store(hash)
+		body, _ := hashScriptBody(proc.dir, proc.file, proc.User)
+		proc.body.Store(body)
+
+		proc.smut.Lock()
+		proc.stale = false
+		proc.smut.Unlock()
 
+		started := time.Now()
+
+		p, stdin, ready, err := proc.spawn()
+		proc.releaseSpawn()
+
+		if err != nil {
+			proc.spawnFailed(err)
+			proc.setState(proc.downState())
 			proc.pmut.Unlock()
+			proc.markAttempted()
 			return
 		}
 
 		proc.proc = p
 		proc.pmut.Unlock()
+		proc.markAttempted()
+
+		proc.smut.Lock()
+		proc.stdin = stdin
+		if proc.spawned {
+			proc.restarts++
+		}
+		proc.spawned = true
+		proc.stable = false
+		proc.spawnErr = ""
+		proc.spawnErrs = 0
+		proc.spawnFailing = false
+		proc.pid = p.PID()
+		proc.spawns = append(pruneSpawns(proc.spawns, time.Now()), time.Now())
+		restarts := proc.restarts
+		proc.smut.Unlock()
 
 		proc.j.Write(&EventProcessSpawned{
-			PID:  p.PID(),
-			File: proc.file,
+			PID:      p.PID(),
+			File:     proc.name,
+			Restarts: restarts,
+			Hash:     hash,
 		})
 
+		exited := make(chan struct{})
+		cfg := proc.Config()
+
+		if cfg.WaitReady {
+			go proc.awaitReady(p, ready, exited, time.Duration(cfg.StartTimeout))
+		} else {
+			proc.setState(ProcessRunning)
+		}
+		if cfg.MaxRuntime > 0 {
+			go proc.limitRuntime(p, exited, time.Duration(cfg.MaxRuntime))
+		}
+
+		minUptime := proc.MinUptime
+		if cfg.MinUptime > 0 {
+			minUptime = time.Duration(cfg.MinUptime)
+		}
+		go proc.awaitStable(p, ready, exited, minUptime)
+
+		if len(cfg.WatchPaths) > 0 {
+			go proc.watchPaths(p, exited, cfg)
+		}
+		if next := cfg.nextRestart(time.Now()); !next.IsZero() {
+			go proc.scheduleRestart(p, exited, next)
+		}
+
 		status := p.Wait()
+		close(exited)
 
-		ev := EventProcessExited{
-			File:     proc.file,
-			PID:      status.PID,
-			ExitCode: status.Code,
+		proc.exit(status, cfg, started)
+	}()
+}
+
+// exit journals that the process exited with the given status and wakes up the
+// routines waiting for it. The process was started with the given
+// configuration at the given time.
+func (proc *Process) exit(status exec.ExitStatus, cfg ScriptConfig, started time.Time) {
+	proc.smut.Lock()
+	proc.pid = 0
+	if proc.stdin != nil {
+		proc.stdin.Close()
+		proc.stdin = nil
+	}
+	proc.smut.Unlock()
+
+	ev := EventProcessExited{
+		File:     proc.name,
+		PID:      status.PID,
+		ExitCode: status.Code,
+	}
+
+	if status.Error != nil {
+		ev.Error = status.Error.Error()
+	}
+
+	proc.smut.Lock()
+	words := proc.words
+	proc.words = nil
+	proc.smut.Unlock()
+
+	if words != nil && status.Code != 0 {
+		ev.LastWords = words.String(ProcessLastWordsTimeout)
+	}
+
+	ev.CoreDumped = status.CoreDumped
+	if status.CoreDumped && cfg.CoreDump != nil {
+		core, err := collectCoreDump(
+			proc.dir, proc.name, *cfg.CoreDump,
+			resolvePath(proc.dir, cfg.Dir), status.PID, started,
+		)
+		if err != nil {
+			proc.j.Write(&EventWarning{
+				Component: "process",
+				Error:     proc.name + ": failed to collect core dump: " + err.Error(),
+			})
 		}
+		ev.CoreDump = core
+	}
+
+	// Write to the journal before signaling that the process is dead to
+	// ensure that the journal entry gets written.
+	proc.j.Write(&ev)
 
-		if status.Error != nil {
-			ev.Error = status.Error.Error()
+	proc.smut.Lock()
+	waiters := proc.exitWaiters
+	proc.exitWaiters = nil
+	proc.smut.Unlock()
+
+	for _, ch := range waiters {
+		ch <- ev
+	}
+}
+
+// spawn loads the script's configuration and starts the process. The returned
+// file is the writable end of the process' stdin, if any, and the returned
+// channel is closed once the process reports that it's ready if the script
+// waits for it.
+func (proc *Process) spawn() (exec.Process, *os.File, <-chan struct{}, error) {
+	cfg, err := loadScriptConfig(proc.dir, proc.file, proc.User)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	proc.smut.Lock()
+	proc.config = cfg
+	proc.smut.Unlock()
+
+	var cred *exec.User
+	if proc.User != nil {
+		if err := cfg.validateAsUser(proc.dir, proc.User); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkInHome(proc.path, proc.User); err != nil {
+			return nil, nil, nil, err
 		}
+		if cred, err = userCredential(proc.User); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	spawn, err := proc.spawnerOf(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		// Write to the journal before signaling that the process is dead to
-		// ensure that the journal entry gets written.
+	var groups []uint32
+	switch {
+	case cfg.ClearGroups:
+		groups = []uint32{}
+	case len(cfg.Groups) > 0:
+		if groups, err = lookupGroups(cfg.Groups); err != nil {
+			return nil, nil, nil, err
+		}
+	case proc.User != nil:
+		if groups, err = userGroups(proc.User); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	seccomp, err := loadSeccomp(proc.dir, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	out, err := openOutput(proc.dir, proc.name, cfg, proc.Output)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	secrets, err := resolveSecrets(proc.ctx, proc.dir, cfg)
+	if err != nil {
+		out.close()
+		return nil, nil, nil, err
+	}
+
+	child, writer, err := openStdin(proc.dir, cfg)
+	if err != nil {
+		out.close()
+		return nil, nil, nil, err
+	}
+
+	environ := os.Environ()
+	switch {
+	case proc.User != nil:
+		// Never leak cronmon's home and such to the user's processes.
+		environ = standardEnv(environ, proc.User)
+	case cfg.StandardEnv:
+		u, _ := user.Current()
+		environ = standardEnv(environ, u)
+	}
+
+	opts := exec.Options{
+		Stdin:  child,
+		Stdout: out.child,
+		Stderr: out.child,
+		Env:    withFence(processEnv(environ, cfg, secrets), proc.Fence),
+		Dir:    resolvePath(proc.dir, cfg.Dir),
+		TTY:    cfg.PTY,
+	}
+
+	// The configuration is validated, so the umask is too.
+	opts.Umask, _ = parseUmask(cfg.Umask)
+	opts.Groups = groups
+	opts.User = cred
+	opts.Seccomp = seccomp
+	opts.CoreDumps = cfg.CoreDump != nil
+
+	if cfg.Container != nil {
+		opts.Container = containerOf(proc.path, cfg, secrets)
+		if proc.Fence != 0 {
+			opts.Container.Env = append(opts.Container.Env, FenceEnv)
+		}
+	}
+	if cfg.Remote != nil {
+		opts.Remote = remoteOf(proc.path, cfg, secrets)
+		opts.Remote.Env = withFence(opts.Remote.Env, proc.Fence)
+	}
+
+	// Processes under a terminal read from it unless configured otherwise.
+	if cfg.PTY && cfg.Stdin == "" {
+		opts.Stdin = out.child
+	}
+
+	p, err := spawn(opts)
+	closeChildStdin(child, writer)
+	out.closeChild()
+
+	if err != nil {
+		if writer != nil {
+			writer.Close()
+		}
+		out.close()
+		return nil, nil, nil, err
+	}
+
+	ready := out.ready
+
+	proc.smut.Lock()
+	proc.words = out.words
+	proc.smut.Unlock()
+
+	out.capture(proc.j, proc.name, p.PID())
+
+	return p, writer, ready, nil
+}
+
+// acquireSpawn waits for one of the monitor's spawn slots. False is returned if
+// the given pending channel is closed in the meantime.
+func (proc *Process) acquireSpawn(pending <-chan struct{}) bool {
+	select {
+	case proc.slots <- struct{}{}:
+		return true
+	case <-pending:
+		return false
+	}
+}
+
+// releaseSpawn releases the spawn slot taken by acquireSpawn.
+func (proc *Process) releaseSpawn() {
+	if proc.slots != nil {
+		<-proc.slots
+	}
+}
+
+// spawnerOf returns the function that spawns the process with the given
+// configuration.
+func (proc *Process) spawnerOf(cfg ScriptConfig) (func(exec.Options) (exec.Process, error), error) {
+	if cfg.Spawner == "" {
+		return proc.Spawn, nil
+	}
+
+	s, ok := proc.Spawners[cfg.Spawner]
+	if !ok {
+		return nil, fmt.Errorf("unknown spawner %q", cfg.Spawner)
+	}
+
+	return func(opts exec.Options) (exec.Process, error) {
+		path, err := resolveScript(proc.path)
+		if err != nil {
+			return nil, err
+		}
+		return s.Spawn(path, cfg.SpawnerConfig, opts)
+	}, nil
+}
+
+// dryRunSpawn journals what spawn would spawn without spawning anything. The
+// process is never considered to have exited, so it's not restarted.
+func (proc *Process) dryRunSpawn() {
+	ev := EventDryRunSpawn{File: proc.name}
+
+	// Record the hash like a spawn would, so that unchanged scripts are not
+	// considered updated.
+	hash, _ := hashScript(proc.dir, proc.file, proc.User)
+	proc.hash.Store(hash)
+
+	cfg, err := loadScriptConfig(proc.dir, proc.file, proc.User)
+	if err != nil {
+		ev.Error = err.Error()
 		proc.j.Write(&ev)
-	}()
+		return
+	}
+
+	ev.Config = &cfg
+
+	path, err := resolveScript(proc.path)
+	if err != nil {
+		ev.Error = err.Error()
+		proc.j.Write(&ev)
+		return
+	}
+	ev.Path = path
+
+	if _, err := proc.spawnerOf(cfg); err != nil {
+		ev.Error = err.Error()
+		proc.j.Write(&ev)
+		return
+	}
+
+	// Only scripts that are executed locally have their interpreter here.
+	if cfg.Container == nil && cfg.Remote == nil && cfg.Spawner == "" {
+		if err := checkScript(path, proc.User); err != nil {
+			ev.Error = err.Error()
+		} else if _, err := loadSeccomp(proc.dir, cfg); err != nil {
+			ev.Error = err.Error()
+		}
+	}
+
+	proc.j.Write(&ev)
+}
+
+// checkScript checks that the script at the given resolved path could be
+// executed: it must be executable, and so must the interpreter of its shebang
+// line, if any.
+func checkScript(path string, u *user.User) error {
+	f, err := openScriptFile(path, u)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !s.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if s.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+
+	line := make([]byte, 256)
+	n, _ := io.ReadFull(f, line)
+	line = line[:n]
+
+	if !strings.HasPrefix(string(line), "#!") {
+		return nil
+	}
+
+	shebang := string(line[2:])
+	if i := strings.IndexByte(shebang, '\n'); i >= 0 {
+		shebang = shebang[:i]
+	}
+
+	fields := strings.Fields(shebang)
+	if len(fields) == 0 {
+		return errors.New("empty shebang line")
+	}
+
+	interp, err := os.Stat(fields[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid interpreter")
+	}
+	if interp.IsDir() || interp.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("interpreter %s is not executable", fields[0])
+	}
+
+	return nil
 }
 
-// Stop stops the process permanently.
+// awaitReady waits for the process to report that it's ready. If it doesn't
+// within the timeout, then it is killed, and its start is considered to have
+// failed. The exited channel must be closed once the process exits.
+func (proc *Process) awaitReady(
+	p exec.Process, ready, exited <-chan struct{}, timeout time.Duration) {
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	select {
+	case <-ready:
+		proc.j.Write(&EventProcessReady{
+			File: proc.name,
+			PID:  p.PID(),
+		})
+		proc.setState(ProcessRunning)
+		return
+	case <-exited:
+		return
+	case <-timedOut:
+	}
+
+	proc.j.Write(&EventProcessStartTimeout{
+		File:    proc.name,
+		PID:     p.PID(),
+		Timeout: timeout,
+	})
+
+	proc.terminate(p, exited)
+}
+
+// limitRuntime terminates the process once it has been running for longer than
+// the given duration. The exited channel must be closed once the process exits.
+func (proc *Process) limitRuntime(p exec.Process, exited <-chan struct{}, max time.Duration) {
+	timer := time.NewTimer(max)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return
+	case <-timer.C:
+	}
+
+	proc.j.Write(&EventProcessTimedOut{
+		File:       proc.name,
+		PID:        p.PID(),
+		MaxRuntime: max,
+	})
+
+	proc.terminate(p, exited)
+}
+
+// scheduleRestart restarts the process at the given time, unless it exits
+// before then. The exited channel must be closed once the process exits.
+func (proc *Process) scheduleRestart(p exec.Process, exited <-chan struct{}, at time.Time) {
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return
+	case <-timer.C:
+	}
+
+	proc.j.Write(&EventProcessRecycled{
+		File: proc.name,
+		PID:  p.PID(),
+	})
+
+	// Restarting gracefully stops the current process in the monitor routine.
+	proc.Start(true)
+}
+
+// terminate gracefully stops the given process, then kills it if it doesn't
+// exit within its stop timeout. The exited channel must be closed once the
+// process exits. Unlike stop, the process is restarted as usual afterwards.
+func (proc *Process) terminate(p exec.Process, exited <-chan struct{}) {
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		p.Kill()
+		return
+	}
+
+	proc.setState(ProcessStopping)
+
+	kill := time.NewTimer(proc.stopTimeout())
+	defer kill.Stop()
+
+	select {
+	case <-exited:
+	case <-kill.C:
+		p.Kill()
+	}
+}
+
+// awaitStable marks the process as stably started once it has been running for
+// the given minimum uptime. If ready is not nil, then the uptime is only counted
+// from when the process reports that it's ready. The exited channel must be
+// closed once the process exits.
+func (proc *Process) awaitStable(
+	p exec.Process, ready, exited <-chan struct{}, minUptime time.Duration) {
+
+	if ready != nil {
+		select {
+		case <-ready:
+		case <-exited:
+			return
+		}
+	}
+
+	timer := time.NewTimer(minUptime)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return
+	case <-timer.C:
+	}
+
+	proc.smut.Lock()
+	proc.stable = true
+	proc.smut.Unlock()
+
+	proc.j.Write(&EventProcessStable{
+		File:      proc.name,
+		PID:       p.PID(),
+		MinUptime: minUptime,
+	})
+}
+
+// takeStable returns true if the last started process has been stably started,
+// and clears it.
+func (proc *Process) takeStable() bool {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	stable := proc.stable
+	proc.stable = false
+	return stable
+}
+
+// Name returns the name of the process' script as it appears in the journal,
+// which is its file name without the priority prefix. See ParseScriptName.
+func (proc *Process) Name() string {
+	return proc.name
+}
+
+// Config returns the script configuration that the process was last started
+// with.
+func (proc *Process) Config() ScriptConfig {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	return proc.config
+}
+
+// stopTimeout returns the duration that the process has to exit within after
+// SIGTERM, which is either its configured stop timeout or WaitTimeout.
+func (proc *Process) stopTimeout() time.Duration {
+	if timeout := proc.Config().StopTimeout; timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return proc.WaitTimeout
+}
+
+// WriteStdin writes the given line to the stdin of the process. A new line is
+// appended if the line does not end with one. ErrNoStdin is returned if the
+// process is not running or if its stdin is not a pipe or a FIFO.
+func (proc *Process) WriteStdin(line string) error {
+	proc.smut.Lock()
+	stdin := proc.stdin
+	proc.smut.Unlock()
+
+	if stdin == nil {
+		return ErrNoStdin
+	}
+
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+
+	// Don't block forever if the process isn't reading its stdin.
+	stdin.SetWriteDeadline(time.Now().Add(ProcessStdinTimeout))
+
+	if _, err := io.WriteString(stdin, line); err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return ErrNoStdin
+		}
+		return errors.Wrap(err, "failed to write to stdin")
+	}
+
+	return nil
+}
+
+// Status returns the current status of the process.
+func (proc *Process) Status() ProcessStatus {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	flapScore := FlapScore(proc.spawns, time.Now())
+
+	var next *time.Time
+	if !proc.next.IsZero() {
+		t := proc.next
+		next = &t
+	}
+
+	return ProcessStatus{
+		File:      proc.name,
+		State:     proc.state,
+		PID:       proc.pid,
+		Hash:      proc.Hash(),
+		Restarts:  proc.restarts,
+		FlapScore: flapScore,
+		Flapping:  flapScore >= FlapThreshold,
+		Waiting:   proc.waiting,
+
+		RestartNeeded: proc.stale,
+		SpawnFailing:  proc.spawnFailingReason(),
+		SpawnHint:     proc.spawnFailingHint(),
+
+		NextRestart: next,
+		Backoff:     proc.backoff,
+
+		Fence: proc.Fence,
+	}
+}
+
+// setNextStart sets when the process is started again after the given delay.
+// A zero delay clears it.
+func (proc *Process) setNextStart(delay time.Duration) {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	if delay == 0 {
+		proc.next = time.Time{}
+		proc.backoff = 0
+		return
+	}
+
+	proc.next = time.Now().Add(delay)
+	proc.backoff = delay
+}
+
+func (proc *Process) spawnFailingReason() string {
+	if !proc.spawnFailing {
+		return ""
+	}
+	return proc.spawnErr
+}
+
+func (proc *Process) spawnFailingHint() string {
+	if !proc.spawnFailing {
+		return ""
+	}
+	return proc.spawnHint
+}
+
+// spawnFailed journals the given spawn error. Once SpawnErrorLimit consecutive
+// errors have the same reason, EventProcessSpawnFailing is journaled once, and
+// further errors with that reason are not journaled.
+func (proc *Process) spawnFailed(err error) {
+	key := spawnErrorKey(err)
+
+	path, perr := resolveScript(proc.path)
+	if perr != nil {
+		path = proc.path
+	}
+
+	proc.smut.Lock()
+	hint := spawnHint(path, proc.config, err, proc.User)
+	proc.spawnHint = hint
+	if proc.spawnErr == key {
+		proc.spawnErrs++
+	} else {
+		proc.spawnErr = key
+		proc.spawnErrs = 1
+		proc.spawnFailing = false
+	}
+	n := proc.spawnErrs
+	wasFailing := proc.spawnFailing
+	if proc.SpawnErrorLimit > 0 && n >= proc.SpawnErrorLimit {
+		proc.spawnFailing = true
+	}
+	proc.smut.Unlock()
+
+	if wasFailing {
+		return
+	}
+
+	proc.j.Write(&EventProcessSpawnError{
+		File:   proc.name,
+		Reason: err.Error(),
+		Errno:  spawnErrno(err),
+		Hint:   hint,
+	})
+
+	if proc.SpawnErrorLimit > 0 && n == proc.SpawnErrorLimit {
+		proc.j.Write(&EventProcessSpawnFailing{
+			File:          proc.name,
+			Reason:        err.Error(),
+			Hint:          hint,
+			Attempts:      n,
+			ProbeInterval: proc.SpawnProbeInterval,
+		})
+	}
+}
+
+// downState returns the state of the process once its process has exited or
+// failed to spawn: failed if it persistently fails to spawn, backoff otherwise.
+func (proc *Process) downState() ProcessState {
+	if proc.isSpawnFailing() {
+		return ProcessFailed
+	}
+	return ProcessBackoff
+}
+
+// isSpawnFailing returns true if the process persistently fails to spawn.
+func (proc *Process) isSpawnFailing() bool {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	return proc.spawnFailing
+}
+
+// spawnErrorKey returns the reason of a spawn error used to tell whether
+// consecutive errors are the same. Errors caused by the same errno, such as
+// ENOENT or EACCES, have the same reason even if their messages differ.
+func spawnErrorKey(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno.Error()
+	}
+	return err.Error()
+}
+
+// checkStale checks whether the script changed since the process was started.
+// EventProcessStale is journaled once when it first does.
+func (proc *Process) checkStale() {
+	hash := proc.Hash()
+	if hash == "" {
+		return
+	}
+
+	proc.smut.Lock()
+	pid := proc.pid
+	stale := proc.stale
+	proc.smut.Unlock()
+
+	if pid == 0 || stale {
+		return
+	}
+
+	newHash, err := hashScript(proc.dir, proc.file, proc.User)
+	if err != nil || newHash == hash {
+		return
+	}
+
+	proc.smut.Lock()
+	proc.stale = true
+	proc.smut.Unlock()
+
+	proc.j.Write(&EventProcessStale{
+		File:    proc.name,
+		PID:     pid,
+		Hash:    hash,
+		NewHash: newHash,
+	})
+}
+
+// IsFlapping returns true if the process is restarting at a rate at or above
+// the FlapThreshold.
+func (proc *Process) IsFlapping() bool {
+	return proc.Status().Flapping
+}
+
+// RecentSpawns returns the spawn times of the process within the FlapWindow,
+// sorted from oldest to newest.
+func (proc *Process) RecentSpawns() []time.Time {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	spawns := pruneSpawns(proc.spawns, time.Now())
+	return append([]time.Time(nil), spawns...)
+}
+
+// SetRecentSpawns sets the recent spawn times of the process, such as when
+// restoring it from a previous state. The times must be sorted from oldest to
+// newest.
+func (proc *Process) SetRecentSpawns(spawns []time.Time) {
+	proc.smut.Lock()
+	proc.spawns = append([]time.Time(nil), spawns...)
+	proc.smut.Unlock()
+}
+
+// SetRestarts sets the cumulative restart counter of the process, such as when
+// restoring it from a previous state or resetting it. The script is then
+// considered to have been spawned before, so its next spawn counts as a
+// restart.
+func (proc *Process) SetRestarts(n int) {
+	proc.smut.Lock()
+	proc.restarts = n
+	proc.spawned = true
+	proc.smut.Unlock()
+}
+
+// Hash returns the SHA-256 hash of the script and its configuration at the time
+// that the process was last started. An empty string is returned if the
+// process has not been started or if the script could not be read.
+func (proc *Process) Hash() string {
+	hash, _ := proc.hash.Load().(string)
+	return hash
+}
+
+// hashScript returns the hexadecimal SHA-256 hash of the given script in dir
+// and its configuration file, if any. Symlinks are followed.
+func hashScript(dir, file string, u *user.User) (string, error) {
+	h := sha256.New()
+
+	if err := hashFile(h, filepath.Join(dir, file), u); err != nil {
+		return "", err
+	}
+
+	if err := hashFile(h, ScriptConfigPath(dir, file), u); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashScriptBody returns the hash of the script itself without its
+// configuration.
+func hashScriptBody(dir, file string, u *user.User) (string, error) {
+	h := sha256.New()
+
+	if err := hashFile(h, filepath.Join(dir, file), u); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reloadConfig sends the reload signal of the script's new configuration to the
+// running process instead of restarting it, if only the configuration changed
+// and the signal is configured. The given hash is the new hash of the script.
+// False is returned if the process must be restarted instead.
+func (proc *Process) reloadConfig(hash string) bool {
+	body, _ := proc.body.Load().(string)
+	if newBody, err := hashScriptBody(proc.dir, proc.file, proc.User); err != nil || body == "" || newBody != body {
+		return false
+	}
+
+	cfg, err := loadScriptConfig(proc.dir, proc.file, proc.User)
+	if err != nil || cfg.ReloadSignal == "" {
+		return false
+	}
+
+	if !proc.reload(cfg.ReloadSignal, ScriptConfigPath(proc.dir, proc.file)) {
+		return false
+	}
+
+	proc.hash.Store(hash)
+
+	proc.smut.Lock()
+	proc.config = cfg
+	proc.stale = false
+	proc.smut.Unlock()
+
+	return true
+}
+
+// reload sends the given reload signal to the running process because the
+// given path changed. False is returned if there is no running process or if
+// the signal can't be sent.
+func (proc *Process) reload(signal, path string) bool {
+	sig, err := parseSignal(signal)
+	if err != nil || sig == 0 {
+		return false
+	}
+
+	proc.pmut.Lock()
+	defer proc.pmut.Unlock()
+
+	// A starting process may still be waiting for a spawn slot.
+	if proc.proc == nil {
+		return false
+	}
+
+	if err := proc.proc.Signal(sig); err != nil {
+		proc.j.Write(&EventWarning{
+			Component: "process",
+			Error:     fmt.Sprintf("%s: failed to send reload signal: %v", proc.name, err),
+		})
+		return false
+	}
+
+	proc.j.Write(&EventProcessReloaded{
+		File:   proc.name,
+		PID:    proc.proc.PID(),
+		Path:   path,
+		Signal: signal,
+	})
+
+	return true
+}
+
+// hashFile writes the file at path into w. If u isn't nil, then the file is
+// read as the user. See openScriptFile.
+func hashFile(w io.Writer, path string, u *user.User) error {
+	f, err := openScriptFile(path, u)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := hashBuffers.Get().(*[]byte)
+	defer hashBuffers.Put(buf)
+
+	// Hide the file's WriteTo, which would allocate its own buffer.
+	_, err = io.CopyBuffer(w, struct{ io.Reader }{f}, *buf)
+	return err
+}
+
+// hashBuffers contains the buffers of hashFile, since every script is hashed
+// at least once per spawn and update.
+var hashBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// WaitExit blocks until the process next exits or the context is canceled,
+// then returns the exit event. It is useful for waiting on oneshot scripts.
+func (proc *Process) WaitExit(ctx context.Context) (EventProcessExited, error) {
+	ch := make(chan EventProcessExited, 1)
+
+	proc.smut.Lock()
+	proc.exitWaiters = append(proc.exitWaiters, ch)
+	proc.smut.Unlock()
+
+	select {
+	case ev := <-ch:
+		return ev, nil
+	case <-ctx.Done():
+	case <-proc.ctx.Done():
+	}
+
+	proc.smut.Lock()
+	for i, waiter := range proc.exitWaiters {
+		if waiter == ch {
+			proc.exitWaiters = append(proc.exitWaiters[:i], proc.exitWaiters[i+1:]...)
+			break
+		}
+	}
+	proc.smut.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return EventProcessExited{}, err
+	}
+	return EventProcessExited{}, ErrProcessStopped
+}
+
+// ErrProcessStopped is returned when waiting on or commanding a process that is
+// stopped permanently, such as when its script is removed.
+var ErrProcessStopped = errors.New("process stopped")
+
+// RecheckConditions makes a waiting process re-evaluate its start conditions
+// immediately, such as when another process it may depend on is spawned. It
+// never blocks.
+func (proc *Process) RecheckConditions() {
+	select {
+	case proc.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// conditions returns the start conditions of the script. Configuration errors
+// are left for spawn to report.
+func (proc *Process) conditions() []string {
+	cfg, err := loadScriptConfig(proc.dir, proc.file, proc.User)
+	if err != nil {
+		return nil
+	}
+
+	return cfg.conditions()
+}
+
+// setWaiting sets the start condition that the process is waiting for. The
+// condition is journaled if it changed.
+func (proc *Process) setWaiting(cond string) {
+	proc.smut.Lock()
+	changed := proc.waiting != cond
+	proc.waiting = cond
+	proc.smut.Unlock()
+
+	proc.waiters.set(proc, cond != "")
+
+	if changed && cond != "" {
+		proc.j.Write(&EventProcessWaiting{
+			File:      proc.name,
+			Condition: cond,
+		})
+	}
+}
+
+// Stop stops the process permanently and waits for it to exit. It may be
+// called more than once, and every call returns the error of stopping it.
 func (proc *Process) Stop() error {
 	proc.cancel()
-	return <-proc.finalize
+	<-proc.stopped
+	return proc.stopErr
 }
 
-func (proc *Process) stop(acquire bool) error {
+// stop stops the process if it has one, then changes its state to the given
+// state. If acquire is false, then the caller must hold pmut.
+func (proc *Process) stop(acquire bool, state ProcessState) error {
 	if acquire {
 		proc.pmut.Lock()
 		defer proc.pmut.Unlock()
 	}
 
+	defer proc.setState(state)
+
 	if proc.proc == nil {
+		if proc.pending != nil {
+			// Cancel the start that's still waiting for a spawn slot.
+			close(proc.pending)
+			proc.pending = nil
+			proc.j.Write(&EventProcessSpawnCanceled{File: proc.name})
+		}
+
 		// already stopped
 		return nil
 	}
 
 	defer func() { proc.proc = nil }()
 
+	proc.setState(ProcessStopping)
+
 	if err := proc.proc.Signal(syscall.SIGTERM); err != nil {
 		// Try to SIGKILL if we can't SIGTERM as a fallback.
 		proc.proc.Kill()
 	}
 
-	after := time.NewTimer(proc.WaitTimeout)
+	after := time.NewTimer(proc.stopTimeout())
 	defer after.Stop()
 
 	select {
@@ -188,8 +1587,11 @@ func (proc *Process) stop(acquire bool) error {
 func (proc *Process) startMonitor() {
 	var start <-chan time.Time // start backoff
 	var timer *time.Timer
-	var resetTime time.Time // deadline to consider app successfully started
 	var restart bool
+	var limiter *tokenBucket
+	var crashed bool        // true if the start restarts the exited process
+	var deferred time.Time  // when the restart was first deferred, if it was
+	var checked chan string // the unmet condition, if a check is running
 
 	backoff := -1 // backoff counter
 
@@ -201,40 +1603,162 @@ func (proc *Process) startMonitor() {
 		timer.Stop()
 		timer = nil
 		start = nil
+		proc.setNextStart(0)
+	}
+
+	// startIfMet starts the process unless cond, its start condition that
+	// isn't met, is set, in which case it's checked again later.
+	startIfMet := func(cond string) {
+		if cond != "" {
+			proc.setWaiting(cond)
+			proc.markAttempted()
+
+			timer = time.NewTimer(ConditionCheckInterval)
+			start = timer.C
+			return
+		}
+
+		proc.setWaiting("")
+
+		if crashed && !proc.Pressure.IsZero() &&
+			(deferred.IsZero() || time.Since(deferred) < PressureMaxDeferral) {
+
+			if reason := proc.Pressure.exceeded(); reason != "" {
+				if deferred.IsZero() {
+					deferred = time.Now()
+					proc.j.Write(&EventProcessDeferred{
+						File:   proc.name,
+						Reason: reason,
+					})
+				}
+
+				timer = time.NewTimer(PressureCheckInterval)
+				start = timer.C
+				proc.setNextStart(PressureCheckInterval)
+				return
+			}
+		}
+
+		now := time.Now()
+		if limiter == nil {
+			limiter = newTokenBucket(proc.StartLimit, now)
+		}
+
+		if ok, wait := limiter.take(now); !ok {
+			proc.j.Write(&EventWarning{
+				Component: "process",
+				Error:     fmt.Sprintf("%s: start throttled, retrying in %v", proc.name, wait),
+			})
+			proc.markAttempted()
+
+			timer = time.NewTimer(wait)
+			start = timer.C
+			proc.setNextStart(wait)
+			return
+		}
+
+		proc.start(restart)
+		restart = false
+		crashed = false
+		deferred = time.Time{}
 	}
 
 	for {
 		select {
 		case <-proc.ctx.Done():
 			cleanupTimer()
-			proc.finalize <- proc.stop(true)
+			proc.waiters.set(proc, false)
+			proc.stopErr = proc.stop(true, ProcessStopped)
+			proc.markAttempted()
+			close(proc.stopped)
 			return
 
+		case p := <-proc.adoptCmd:
+			proc.adopt(p)
+
 		case restart = <-proc.startCmd:
 			start = dummyTimeCh()
+			crashed = false
+
+		case <-proc.kickCmd:
+			cleanupTimer()
+			backoff = -1
+			start = dummyTimeCh()
+			crashed = false
+
+			proc.smut.Lock()
+			proc.spawnErr = ""
+			proc.spawnErrs = 0
+			proc.spawnFailing = false
+			proc.smut.Unlock()
+
+		case <-proc.recheck:
+			proc.smut.Lock()
+			waiting := proc.waiting != ""
+			proc.smut.Unlock()
+
+			if waiting {
+				cleanupTimer()
+				start = dummyTimeCh()
+			}
 
 		case <-start:
-			proc.start(restart)
-			restart = false
 			cleanupTimer()
 
+			// Don't spawn anything once stopping, since select may pick this
+			// over the canceled context. A running check starts the process
+			// once it's done.
+			if proc.ctx.Err() != nil || checked != nil {
+				continue
+			}
+
+			conds := proc.conditions()
+			if len(conds) == 0 {
+				startIfMet("")
+				continue
+			}
+
+			// Conditions may wait on the network, so check them in the
+			// background to keep handling commands meanwhile.
+			checked = make(chan string, 1)
+			go func(checked chan<- string) {
+				checked <- unmetCondition(proc.dir, conds, proc.IsRunning)
+			}(checked)
+
+		case cond := <-checked:
+			checked = nil
+
+			if proc.ctx.Err() != nil {
+				continue
+			}
+
+			startIfMet(cond)
+
 		case <-proc.exited:
+			proc.pmut.Lock()
 			proc.proc = nil
-			cleanupTimer()
+			proc.setState(proc.downState())
+			proc.pmut.Unlock()
 
-			now := time.Now()
+			cleanupTimer()
 
-			// Check if we're past reset. If yes, then that means the process
-			// has started successfully, so we can reset the backoff. If not,
-			// then increment backoff and keep trying.
-			if now.After(resetTime) {
+			// Check if the process has been up for long enough. If yes, then
+			// that means the process has started successfully, so we can reset
+			// the backoff. If not, then increment backoff and keep trying.
+			if proc.takeStable() {
 				backoff = -1
 			}
 
-			startDura, resetDura := nextBackoff(proc.RetryBackoff, &backoff)
-			resetTime = now.Add(resetDura)
-			timer = time.NewTimer(startDura)
+			wait := nextBackoff(proc.RetryBackoff, &backoff)
+			if proc.isSpawnFailing() {
+				wait = proc.SpawnProbeInterval
+			}
+			wait = proc.breaker.restart(time.Now(), wait)
+			crashed = true
+
+			timer = time.NewTimer(wait)
 			start = timer.C
+			proc.setNextStart(wait)
 		}
 	}
 }
@@ -245,20 +1769,10 @@ func dummyTimeCh() <-chan time.Time {
 	return ch
 }
 
-func nextBackoff(backoffs []time.Duration, ix *int) (start, reset time.Duration) {
-	startIx := *ix
-	resetIx := startIx
-
-	if startIx < len(backoffs)-1 {
-		startIx++
-		resetIx++
-
-		*ix = startIx
-
-		if resetIx < len(backoffs)-2 {
-			resetIx++
-		}
+func nextBackoff(backoffs []time.Duration, ix *int) time.Duration {
+	if *ix < len(backoffs)-1 {
+		*ix++
 	}
 
-	return backoffs[startIx], backoffs[resetIx]
+	return backoffs[*ix]
 }
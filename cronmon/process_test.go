@@ -3,7 +3,12 @@ package cronmon
 import (
 	"context"
 	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -20,7 +25,7 @@ func TestProcess(t *testing.T) {
 
 		proc := NewProcess(context.Background(), "", "sleep", &j)
 		proc.RetryBackoff = []time.Duration{0} // no backoff
-		proc.startProc = func() (exec.Process, error) {
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
 			return exec.NewSleepProcess(forever, 0, nextPID()), nil
 		}
 		proc.Start(false)
@@ -32,11 +37,69 @@ func TestProcess(t *testing.T) {
 		}
 
 		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
 			&EventProcessSpawned{PID: 1, File: "sleep"},
+			stateChanged(ProcessStarting, ProcessRunning),
+			stateChanged(ProcessRunning, ProcessStopping),
 			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
 		})
 	})
 
+	t.Run("states", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		spawned := make(chan struct{})
+		var attempts uint32
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{0}
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			if atomic.AddUint32(&attempts, 1) == 1 {
+				return nil, errors.New("failed")
+			}
+			defer close(spawned)
+			return exec.NewSleepProcess(forever, 0, nextPID()), nil
+		}
+
+		if state := proc.Status().State; state != ProcessIdle {
+			t.Errorf("new process is %s", state)
+		}
+
+		proc.Start(false)
+		<-spawned
+
+		for proc.Status().State != ProcessRunning {
+			time.Sleep(time.Millisecond)
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		transitions := [][2]ProcessState{
+			{ProcessIdle, ProcessStarting},
+			{ProcessStarting, ProcessBackoff},
+			{ProcessBackoff, ProcessStarting},
+			{ProcessStarting, ProcessRunning},
+			{ProcessRunning, ProcessStopping},
+			{ProcessStopping, ProcessStopped},
+		}
+
+		states := j.States()
+		if len(states) != len(transitions) {
+			t.Fatalf("got %d state changes, expected %d", len(states), len(transitions))
+		}
+
+		for i, ev := range states {
+			if ev.File != "sleep" || ev.From != transitions[i][0] || ev.To != transitions[i][1] {
+				t.Errorf("state change %d is %s -> %s, expected %s -> %s",
+					i, ev.From, ev.To, transitions[i][0], transitions[i][1])
+			}
+		}
+	})
+
 	t.Run("kill timeout", func(t *testing.T) {
 		nextPID := newNextPID()
 		var j mockJournal
@@ -44,7 +107,7 @@ func TestProcess(t *testing.T) {
 		proc := NewProcess(context.Background(), "", "sleep", &j)
 		proc.WaitTimeout = time.Microsecond
 		proc.RetryBackoff = []time.Duration{0} // no backoff
-		proc.startProc = func() (exec.Process, error) {
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
 			return exec.NewSleepProcess(forever, forever, nextPID()), nil
 		}
 		proc.Start(false)
@@ -52,8 +115,431 @@ func TestProcess(t *testing.T) {
 		proc.Stop()
 
 		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
 			&EventProcessSpawned{PID: 1, File: "sleep"},
+			stateChanged(ProcessStarting, ProcessRunning),
+			stateChanged(ProcessRunning, ProcessStopping),
 			&EventProcessExited{PID: 1, File: "sleep", ExitCode: -1},
+			stateChanged(ProcessStopping, ProcessStopped),
+		})
+	})
+
+	t.Run("start timeout", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		dir := t.TempDir()
+		writeConfig(t, ScriptConfigPath(dir, "sleep"),
+			`{"events":true,"wait_ready":true,"start_timeout":"1ms"}`)
+
+		exited := make(chan struct{})
+
+		proc := NewProcess(context.Background(), dir, "sleep", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			p := exec.NewSleepProcess(forever, 0, nextPID())
+			go func() {
+				p.Wait()
+				close(exited)
+			}()
+			return p, nil
+		}
+		proc.Start(false)
+
+		<-exited
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep"},
+			&EventProcessStartTimeout{PID: 1, File: "sleep", Timeout: time.Millisecond},
+			stateChanged(ProcessStarting, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStopped),
+		})
+	})
+
+	t.Run("max runtime", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		dir := t.TempDir()
+		writeConfig(t, ScriptConfigPath(dir, "sleep"), `{"max_runtime":"1ms"}`)
+
+		exited := make(chan struct{})
+
+		proc := NewProcess(context.Background(), dir, "sleep", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			p := exec.NewSleepProcess(forever, 0, nextPID())
+			go func() {
+				p.Wait()
+				close(exited)
+			}()
+			return p, nil
+		}
+		proc.Start(false)
+
+		<-exited
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep"},
+			stateChanged(ProcessStarting, ProcessRunning),
+			&EventProcessTimedOut{PID: 1, File: "sleep", MaxRuntime: time.Millisecond},
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStopped),
+		})
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		var j mockJournal
+
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "10-sleep"), nil, 0755); err != nil {
+			t.Fatal("failed to create script:", err)
+		}
+
+		proc := NewProcess(context.Background(), dir, "10-sleep", &j)
+		proc.DryRun = true
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			t.Error("unexpected spawn in dry run")
+			return nil, errors.New("unexpected spawn")
+		}
+		proc.Start(false)
+
+		// Wait for the start to be handled before stopping.
+		for len(j.Journals()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Verify(t, true, []Event{
+			&EventDryRunSpawn{
+				File:   "sleep",
+				Path:   filepath.Join(dir, "10-sleep"),
+				Config: &ScriptConfig{},
+			},
+			stateChanged(ProcessIdle, ProcessStopped),
+		})
+	})
+
+	t.Run("dir and umask", func(t *testing.T) {
+		var j mockJournal
+
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "a"))
+		writeConfig(t, ScriptConfigPath(dir, "a"), `{"dir":"work","umask":"027"}`)
+
+		spawned := make(chan exec.Options, 1)
+
+		proc := NewProcess(context.Background(), dir, "a", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(opts exec.Options) (exec.Process, error) {
+			spawned <- opts
+			return exec.NewSleepProcess(forever, 0, 1), nil
+		}
+		proc.Start(false)
+		defer proc.Stop()
+
+		select {
+		case opts := <-spawned:
+			if opts.Dir != filepath.Join(dir, "work") {
+				t.Errorf("unexpected dir %q", opts.Dir)
+			}
+			if opts.Umask == nil || *opts.Umask != 027 {
+				t.Errorf("unexpected umask %v", opts.Umask)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for spawn")
+		}
+	})
+
+	t.Run("fence", func(t *testing.T) {
+		var j mockJournal
+
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "a"))
+		// The script can't forge the fencing token.
+		writeConfig(t, ScriptConfigPath(dir, "a"), `{"env":{"CRONMON_FENCE":"1"}}`)
+
+		spawned := make(chan exec.Options, 1)
+
+		proc := NewProcess(context.Background(), dir, "a", &j)
+		proc.Fence = 7
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(opts exec.Options) (exec.Process, error) {
+			spawned <- opts
+			return exec.NewSleepProcess(forever, 0, 1), nil
+		}
+		proc.Start(false)
+		defer proc.Stop()
+
+		select {
+		case opts := <-spawned:
+			var fences []string
+			for _, kv := range opts.Env {
+				if strings.HasPrefix(kv, FenceEnv+"=") {
+					fences = append(fences, kv)
+				}
+			}
+			if len(fences) != 1 || fences[0] != "CRONMON_FENCE=7" {
+				t.Errorf("unexpected fence env %q", fences)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for spawn")
+		}
+
+		if fence := proc.Status().Fence; fence != 7 {
+			t.Errorf("unexpected fence %d in status", fence)
+		}
+	})
+
+	t.Run("wait exit", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			return exec.NewSleepProcess(10*time.Millisecond, 0, nextPID()), nil
+		}
+
+		exited := make(chan EventProcessExited, 1)
+		go func() {
+			ev, err := proc.WaitExit(context.Background())
+			if err != nil {
+				t.Error("failed to wait:", err)
+			}
+			exited <- ev
+		}()
+
+		// Wait for the waiter to be registered.
+		for {
+			proc.smut.Lock()
+			n := len(proc.exitWaiters)
+			proc.smut.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		proc.Start(false)
+
+		select {
+		case ev := <-exited:
+			if ev.PID != 1 || ev.ExitCode != 0 {
+				t.Errorf("unexpected exit event %#v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for exit")
+		}
+
+		proc.Stop()
+
+		if _, err := proc.WaitExit(context.Background()); !errors.Is(err, ErrProcessStopped) {
+			t.Error("expected ErrProcessStopped after stop, got", err)
+		}
+	})
+
+	t.Run("stale script", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		dir := t.TempDir()
+		path := filepath.Join(dir, "sleep")
+		if err := os.WriteFile(path, []byte("v1"), 0755); err != nil {
+			t.Fatal("failed to create script:", err)
+		}
+
+		proc := NewProcess(context.Background(), dir, "sleep", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			return exec.NewSleepProcess(forever, 0, nextPID()), nil
+		}
+		proc.Start(false)
+
+		for proc.Status().PID == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		hash := proc.Hash()
+
+		// An unchanged script is not stale.
+		proc.checkStale()
+		if proc.Status().RestartNeeded {
+			t.Fatal("unchanged script is marked as stale")
+		}
+
+		if err := os.WriteFile(path, []byte("v2"), 0755); err != nil {
+			t.Fatal("failed to update script:", err)
+		}
+
+		proc.checkStale()
+		proc.checkStale() // journaled only once
+		if !proc.Status().RestartNeeded {
+			t.Fatal("changed script is not marked as stale")
+		}
+
+		newHash, _ := hashScript(dir, "sleep", nil)
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep", Hash: hash},
+			stateChanged(ProcessStarting, ProcessRunning),
+			&EventProcessStale{PID: 1, File: "sleep", Hash: hash, NewHash: newHash},
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
+		})
+	})
+
+	t.Run("watch paths", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		settle := PathWatchSettle
+		PathWatchSettle = 10 * time.Millisecond
+		defer func() { PathWatchSettle = settle }()
+
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "sleep"))
+		writeConfig(t, filepath.Join(dir, ".sleep.json"), `{"watch_paths": ["app.conf"]}`)
+		hash, _ := hashScript(dir, "sleep", nil)
+
+		spawned := make(chan struct{}, 2)
+
+		proc := NewProcess(context.Background(), dir, "sleep", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			spawned <- struct{}{}
+			return exec.NewSleepProcess(forever, 0, nextPID()), nil
+		}
+		proc.Start(false)
+
+		<-spawned
+		// Give the path watcher time to start.
+		time.Sleep(50 * time.Millisecond)
+
+		conf := filepath.Join(dir, "app.conf")
+		if err := os.WriteFile(conf, []byte("v2"), 0644); err != nil {
+			t.Fatal("failed to write watched file:", err)
+		}
+
+		select {
+		case <-spawned:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for restart")
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Finalize()
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep", Hash: hash},
+			stateChanged(ProcessStarting, ProcessRunning),
+			&EventProcessPathChanged{PID: 1, File: "sleep", Path: conf},
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStarting),
+			&EventProcessSpawned{PID: 2, File: "sleep", Restarts: 1, Hash: hash},
+			stateChanged(ProcessStarting, ProcessRunning),
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 2, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
+		})
+	})
+
+	t.Run("reload signal", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		settle := PathWatchSettle
+		PathWatchSettle = 10 * time.Millisecond
+		defer func() { PathWatchSettle = settle }()
+
+		dir := t.TempDir()
+		cfgPath := filepath.Join(dir, ".sleep.json")
+		writeScript(t, filepath.Join(dir, "sleep"))
+		writeConfig(t, cfgPath, `{"watch_paths": ["app.conf"], "reload_signal": "HUP"}`)
+		hash, _ := hashScript(dir, "sleep", nil)
+
+		proc := NewProcess(context.Background(), dir, "sleep", &j)
+		proc.RetryBackoff = []time.Duration{forever} // no restart
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			return exec.NewSleepProcess(forever, 0, nextPID()), nil
+		}
+		proc.Start(false)
+
+		for proc.Status().PID == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// Give the path watcher time to start.
+		time.Sleep(50 * time.Millisecond)
+
+		conf := filepath.Join(dir, "app.conf")
+		if err := os.WriteFile(conf, []byte("v2"), 0644); err != nil {
+			t.Fatal("failed to write watched file:", err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		// Only changing the configuration reloads the process as well.
+		writeConfig(t, cfgPath, `{"watch_paths": ["app.conf"], "reload_signal": "HUP", "env": {"A": "1"}}`)
+		newHash, _ := hashScript(dir, "sleep", nil)
+
+		if !proc.reloadConfig(newHash) {
+			t.Fatal("process was not reloaded on config change")
+		}
+		if proc.Hash() != newHash {
+			t.Error("hash was not updated after reloading")
+		}
+
+		// Changing the script itself requires a restart.
+		if err := os.WriteFile(filepath.Join(dir, "sleep"), []byte("#!/bin/sh\n# v2\n"), 0755); err != nil {
+			t.Fatal("failed to update script:", err)
+		}
+		newHash, _ = hashScript(dir, "sleep", nil)
+
+		if proc.reloadConfig(newHash) {
+			t.Error("process was reloaded on script change")
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Finalize()
+		j.Verify(t, false, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep", Hash: hash},
+			stateChanged(ProcessStarting, ProcessRunning),
+			&EventProcessReloaded{PID: 1, File: "sleep", Path: conf, Signal: "HUP"},
+			&EventProcessReloaded{PID: 1, File: "sleep", Path: cfgPath, Signal: "HUP"},
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
 		})
 	})
 
@@ -69,7 +555,7 @@ func TestProcess(t *testing.T) {
 			5 * time.Microsecond,
 			time.Second,
 		}
-		proc.startProc = func() (exec.Process, error) {
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
 			attempt := atomic.AddUint32(&attempts, 1)
 			if attempt > 3 {
 				return nil, errors.New("after")
@@ -78,7 +564,17 @@ func TestProcess(t *testing.T) {
 		}
 		proc.Start(false)
 
-		time.Sleep(time.Millisecond / 2)
+		// Wait for the 4th attempt to be journaled, after which the process
+		// backs off for a second.
+		timeout := time.After(5 * time.Second)
+		for countJournaled(&j, &EventProcessSpawnError{}) < 4 {
+			select {
+			case <-timeout:
+				t.Fatal("timed out waiting for spawn attempts")
+			default:
+				time.Sleep(time.Millisecond / 2)
+			}
+		}
 
 		if err := proc.Stop(); err != nil {
 			t.Error("failed to stop process:", err)
@@ -86,13 +582,390 @@ func TestProcess(t *testing.T) {
 
 		j.Finalize()
 		j.Verify(t, false, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
 			&EventProcessSpawnError{File: "sleep", Reason: "before"},
+			stateChanged(ProcessStarting, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
 			&EventProcessSpawnError{File: "sleep", Reason: "before"},
+			stateChanged(ProcessStarting, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
 			&EventProcessSpawnError{File: "sleep", Reason: "before"},
+			stateChanged(ProcessStarting, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
 			&EventProcessSpawnError{File: "sleep", Reason: "after"},
 		})
 	})
 
+	t.Run("pressure deferral", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		interval := PressureCheckInterval
+		t.Cleanup(func() { PressureCheckInterval = interval })
+		PressureCheckInterval = time.Millisecond
+
+		pressure := fakePressure(t)
+		writePressure(t, pressure, 90, 0)
+
+		deferred := make(chan struct{})
+		respawned := make(chan struct{})
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{0}
+		proc.StartLimit = StartLimit{} // no rate limit
+		proc.Pressure = PressureLimits{CPU: 50}
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			pid := nextPID()
+			if pid == 1 {
+				p := exec.NewSleepProcess(0, 0, pid)
+				go func() {
+					p.Wait()
+					// Give the restart the time to be deferred.
+					for !journaled(&j, &EventProcessDeferred{}) {
+						time.Sleep(time.Millisecond)
+					}
+					close(deferred)
+				}()
+				return p, nil
+			}
+			close(respawned)
+			return exec.NewSleepProcess(forever, 0, pid), nil
+		}
+		proc.Start(false)
+
+		<-deferred
+		writePressure(t, pressure, 0, 0)
+
+		select {
+		case <-respawned:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the deferred restart")
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep"},
+			stateChanged(ProcessStarting, ProcessRunning),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessRunning, ProcessBackoff),
+			&EventProcessDeferred{File: "sleep", Reason: "cpu pressure 90.00% is over 50%"},
+			stateChanged(ProcessBackoff, ProcessStarting),
+			&EventProcessSpawned{PID: 2, File: "sleep", Restarts: 1},
+			stateChanged(ProcessStarting, ProcessRunning),
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 2, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
+		})
+	})
+
+	t.Run("spawn error limit", func(t *testing.T) {
+		var j mockJournal
+
+		probed := make(chan struct{})
+		var attempts uint32
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{0}
+		proc.SpawnErrorLimit = 3
+		proc.SpawnProbeInterval = 10 * time.Millisecond
+		proc.StartLimit = StartLimit{} // no rate limit
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			if atomic.AddUint32(&attempts, 1) == 5 {
+				close(probed)
+			}
+			return nil, errors.Wrap(syscall.ENOENT, "fork/exec")
+		}
+		proc.Start(false)
+
+		select {
+		case <-probed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for probes")
+		}
+
+		if reason := proc.Status().SpawnFailing; reason != "no such file or directory" {
+			t.Errorf("unexpected spawn failing reason %q", reason)
+		}
+		if hint := proc.Status().SpawnHint; hint != "the script does not exist" {
+			t.Errorf("unexpected spawn failing hint %q", hint)
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		spawnErr := &EventProcessSpawnError{
+			File:   "sleep",
+			Reason: "fork/exec: no such file or directory",
+			Errno:  "ENOENT",
+			Hint:   "the script does not exist",
+		}
+
+		j.Finalize()
+		remaining := j.Verify(t, false, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			spawnErr,
+			stateChanged(ProcessStarting, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
+			spawnErr,
+			stateChanged(ProcessStarting, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
+			spawnErr,
+			&EventProcessSpawnFailing{
+				File:          "sleep",
+				Reason:        "fork/exec: no such file or directory",
+				Hint:          "the script does not exist",
+				Attempts:      3,
+				ProbeInterval: 10 * time.Millisecond,
+			},
+			stateChanged(ProcessStarting, ProcessFailed),
+		})
+
+		// Probes only go between failed and starting.
+		for _, ev := range remaining {
+			ev, ok := ev.(*EventProcessStateChanged)
+			if !ok {
+				t.Errorf("unexpected event %#v after failing", ev)
+				continue
+			}
+			if ev.From == ProcessBackoff || ev.To == ProcessBackoff {
+				t.Errorf("unexpected state change %s -> %s while failing", ev.From, ev.To)
+			}
+		}
+	})
+
+	t.Run("next restart", func(t *testing.T) {
+		var j mockJournal
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{time.Hour}
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			return nil, errors.New("fail")
+		}
+
+		before := time.Now()
+		proc.Start(false)
+
+		timeout := time.After(5 * time.Second)
+		for proc.Status().NextRestart == nil {
+			select {
+			case <-timeout:
+				t.Fatal("timed out waiting for the next restart")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		status := proc.Status()
+		if status.Backoff != time.Hour {
+			t.Errorf("unexpected backoff %v", status.Backoff)
+		}
+		if next := status.NextRestart.Sub(before); next < time.Hour || next > time.Hour+time.Minute {
+			t.Errorf("unexpected next restart in %v", next)
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+	})
+
+	t.Run("kick", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		var attempts uint32
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{time.Hour}
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			if atomic.AddUint32(&attempts, 1) == 1 {
+				return nil, errors.New("fail")
+			}
+			return exec.NewSleepProcess(forever, 0, nextPID()), nil
+		}
+		proc.Start(false)
+
+		for proc.Status().NextRestart == nil {
+			time.Sleep(time.Millisecond)
+		}
+
+		proc.Kick()
+
+		timeout := time.After(5 * time.Second)
+		for proc.Status().PID == 0 {
+			select {
+			case <-timeout:
+				t.Fatal("timed out waiting for the kicked process")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		if next := proc.Status().NextRestart; next != nil {
+			t.Error("next restart is still set after kick:", next)
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Finalize()
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawnError{File: "sleep", Reason: "fail"},
+			stateChanged(ProcessStarting, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep"},
+			stateChanged(ProcessStarting, ProcessRunning),
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
+		})
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		spawned := make(chan struct{})
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{0} // no backoff
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			defer close(spawned)
+			return exec.NewSleepProcess(forever, 0, nextPID()), nil
+		}
+
+		orphan := exec.NewSleepProcess(forever, 0, 42)
+		if err := proc.Adopt(orphan); err != nil {
+			t.Fatal("failed to adopt:", err)
+		}
+
+		for proc.Status().State != ProcessAdopted {
+			time.Sleep(time.Millisecond)
+		}
+
+		if pid := proc.Status().PID; pid != 42 {
+			t.Errorf("unexpected PID %d of the adopted process", pid)
+		}
+
+		// The script is started again once the adopted process exits.
+		orphan.Signal(os.Interrupt)
+
+		select {
+		case <-spawned:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the restart")
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Verify(t, true, []Event{
+			&EventProcessAdopted{PID: 42, File: "sleep"},
+			stateChanged(ProcessIdle, ProcessAdopted),
+			&EventProcessExited{PID: 42, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessAdopted, ProcessBackoff),
+			stateChanged(ProcessBackoff, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep", Restarts: 1},
+			stateChanged(ProcessStarting, ProcessRunning),
+			stateChanged(ProcessRunning, ProcessStopping),
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+			stateChanged(ProcessStopping, ProcessStopped),
+		})
+	})
+
+	t.Run("spawn slot", func(t *testing.T) {
+		var j mockJournal
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			t.Error("unexpected spawn without a slot")
+			return nil, errors.New("unexpected spawn")
+		}
+
+		// Take the only slot, so that the process waits for it forever.
+		proc.slots = make(chan struct{}, 1)
+		proc.slots <- struct{}{}
+
+		proc.Start(false)
+
+		for proc.Status().State != ProcessStarting {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The process isn't locked while it waits, so it can still be
+		// reloaded and stopped.
+		if proc.reload("SIGHUP", "config") {
+			t.Error("unexpected reload of a process that isn't spawned")
+		}
+
+		stopped := make(chan error)
+		go func() { stopped <- proc.Stop() }()
+
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Error("failed to stop process:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out stopping the process waiting for a slot")
+		}
+
+		j.Verify(t, true, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawnCanceled{File: "sleep"},
+			stateChanged(ProcessStarting, ProcessStopped),
+		})
+	})
+
+	t.Run("stable resets backoff", func(t *testing.T) {
+		nextPID := newNextPID()
+		var j mockJournal
+
+		spawned := make(chan struct{}, 3)
+
+		proc := NewProcess(context.Background(), "", "sleep", &j)
+		proc.RetryBackoff = []time.Duration{0, forever}
+		proc.MinUptime = time.Millisecond
+		proc.StartLimit = StartLimit{} // no rate limit
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			select {
+			case spawned <- struct{}{}:
+			default:
+			}
+			return exec.NewSleepProcess(10*time.Millisecond, 0, nextPID()), nil
+		}
+		proc.Start(false)
+
+		timeout := time.After(5 * time.Second)
+		for i := 0; i < 3; i++ {
+			select {
+			case <-spawned:
+			case <-timeout:
+				t.Fatal("timed out waiting for restarts, backoff was not reset")
+			}
+		}
+
+		if err := proc.Stop(); err != nil {
+			t.Error("failed to stop process:", err)
+		}
+
+		j.Finalize()
+		j.Verify(t, false, []Event{
+			stateChanged(ProcessIdle, ProcessStarting),
+			&EventProcessSpawned{PID: 1, File: "sleep"},
+			stateChanged(ProcessStarting, ProcessRunning),
+			&EventProcessStable{PID: 1, File: "sleep", MinUptime: time.Millisecond},
+			&EventProcessExited{PID: 1, File: "sleep", ExitCode: 0},
+		})
+	})
+
 	t.Run("autorestart", func(t *testing.T) {
 		nextPID := newNextPID()
 		var j mockJournal
@@ -101,7 +974,8 @@ func TestProcess(t *testing.T) {
 
 		proc := NewProcess(context.Background(), "", "sleep", &j)
 		proc.RetryBackoff = []time.Duration{0} // no backoff
-		proc.startProc = func() (exec.Process, error) {
+		proc.StartLimit = StartLimit{}         // no rate limit
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
 			select {
 			case newProcCh <- struct{}{}:
 			default:
@@ -122,11 +996,14 @@ func TestProcess(t *testing.T) {
 			t.Error("failed to stop process:", err)
 		}
 
-		expect := make([]Event, 0, 10)
+		expect := []Event{stateChanged(ProcessIdle, ProcessStarting)}
 		for i := 0; i < 5; i++ {
 			expect = append(expect,
-				&EventProcessSpawned{PID: i + 1, File: "sleep"},
+				&EventProcessSpawned{PID: i + 1, File: "sleep", Restarts: i},
+				stateChanged(ProcessStarting, ProcessRunning),
 				&EventProcessExited{PID: i + 1, File: "sleep", ExitCode: 0},
+				stateChanged(ProcessRunning, ProcessBackoff),
+				stateChanged(ProcessBackoff, ProcessStarting),
 			)
 		}
 
@@ -134,6 +1011,204 @@ func TestProcess(t *testing.T) {
 		remaining := j.Verify(t, false, expect)
 		t.Log("remaining journals:", remaining)
 	})
+
+	t.Run("blocked condition", func(t *testing.T) {
+		dir := t.TempDir()
+		writeConfig(t, ScriptConfigPath(dir, "sleep"), `{"conditions":["script:db"]}`)
+
+		checking := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+
+		var j mockJournal
+
+		proc := NewProcess(context.Background(), dir, "sleep", &j)
+		proc.RetryBackoff = []time.Duration{0}
+		proc.IsRunning = func(string) bool {
+			// Simulate a check that waits on the network.
+			close(checking)
+			<-release
+			return true
+		}
+		proc.Spawn = func(exec.Options) (exec.Process, error) {
+			t.Error("process spawned while its condition was being checked")
+			return nil, errors.New("unexpected spawn")
+		}
+		proc.Start(false)
+
+		select {
+		case <-checking:
+		case <-time.After(5 * time.Second):
+			t.Fatal("condition was never checked")
+		}
+
+		stopped := make(chan error, 1)
+		go func() { stopped <- proc.Stop() }()
+
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Error("failed to stop process:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stop blocked on the condition check")
+		}
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(StartLimit{Burst: 2, Every: time.Second}, now)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("take %d unexpectedly throttled", i)
+		}
+	}
+
+	ok, wait := b.take(now)
+	if ok {
+		t.Fatal("take after burst unexpectedly not throttled")
+	}
+	if wait != time.Second {
+		t.Fatalf("unexpected wait %v, expected 1s", wait)
+	}
+
+	if ok, _ := b.take(now.Add(time.Second)); !ok {
+		t.Fatal("take after refill unexpectedly throttled")
+	}
+}
+
+func TestCheckScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+		fail    bool
+	}{
+		{"binary", "\x7fELF", 0755, false},
+		{"shell", "#!/bin/sh\necho hi\n", 0755, false},
+		{"env", "#! /usr/bin/env sh\n", 0755, false},
+		{"not executable", "#!/bin/sh\n", 0644, true},
+		{"missing interpreter", "#!/nonexistent/sh\n", 0755, true},
+		{"directory interpreter", "#!/\n", 0755, true},
+		{"empty shebang", "#!\n", 0755, true},
+	}
+
+	dir := t.TempDir()
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), test.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		err := checkScript(path, nil)
+		if test.fail && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+		if !test.fail && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestProcessCommands(t *testing.T) {
+	commands := map[string]func(*Process) error{
+		"start":   func(proc *Process) error { return proc.Start(false) },
+		"restart": func(proc *Process) error { return proc.Start(true) },
+		"kick":    func(proc *Process) error { return proc.Kick() },
+		"recheck": func(proc *Process) error { proc.RecheckConditions(); return nil },
+		"stop":    func(proc *Process) error { return proc.Stop() },
+	}
+
+	for first, firstCmd := range commands {
+		for second, secondCmd := range commands {
+			first, firstCmd := first, firstCmd
+			second, secondCmd := second, secondCmd
+
+			t.Run(first+"/"+second, func(t *testing.T) {
+				nextPID := newNextPID()
+				var j mockJournal
+
+				var pmut sync.Mutex
+				var procs []exec.Process
+
+				proc := NewProcess(context.Background(), "", "sleep", &j)
+				proc.RetryBackoff = []time.Duration{0}
+				proc.StartLimit = StartLimit{} // no rate limit
+				proc.Spawn = func(exec.Options) (exec.Process, error) {
+					p := exec.NewSleepProcess(forever, 0, nextPID())
+					pmut.Lock()
+					procs = append(procs, p)
+					pmut.Unlock()
+					return p, nil
+				}
+				proc.Start(false)
+
+				// Run the commands both in order and concurrently.
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+
+					firstCmd(proc)
+					secondCmd(proc)
+
+					var wg sync.WaitGroup
+					wg.Add(2)
+					go func() { defer wg.Done(); firstCmd(proc) }()
+					go func() { defer wg.Done(); secondCmd(proc) }()
+					wg.Wait()
+				}()
+
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("commands deadlocked")
+				}
+
+				err := proc.Stop()
+				if again := proc.Stop(); again != err {
+					t.Errorf("second stop returned %v, expected %v", again, err)
+				}
+				if err := proc.Start(true); err != ErrProcessStopped {
+					t.Errorf("start after stop returned %v", err)
+				}
+				if err := proc.Kick(); err != ErrProcessStopped {
+					t.Errorf("kick after stop returned %v", err)
+				}
+				proc.RecheckConditions()
+
+				if state := proc.Status().State; state != ProcessStopped {
+					t.Errorf("process is %s after stop", state)
+				}
+
+				// No process may be left running after Stop.
+				pmut.Lock()
+				defer pmut.Unlock()
+
+				for _, p := range procs {
+					exited := make(chan struct{})
+					go func(p exec.Process) {
+						p.Wait()
+						close(exited)
+					}(p)
+
+					select {
+					case <-exited:
+					case <-time.After(time.Second):
+						t.Errorf("process %d is still running", p.PID())
+					}
+				}
+			})
+		}
+	}
+}
+
+// stateChanged returns the event of the sleep process changing from one state
+// to another.
+func stateChanged(from, to ProcessState) *EventProcessStateChanged {
+	return &EventProcessStateChanged{File: "sleep", From: from, To: to}
 }
 
 func newNextPID() func() int {
@@ -0,0 +1,91 @@
+package cronmon
+
+// ProcessState is the lifecycle state of a Process. A process goes through the
+// states as follows:
+//
+//	idle -> starting              the process is started for the first time
+//	idle -> adopted               the process of a previous cronmon is still
+//	                              running and is adopted instead
+//	starting -> running           the process is spawned, or it's ready if
+//	                              it waits for it
+//	starting -> backoff           the process failed to spawn
+//	starting -> failed            the process failed to spawn too many times
+//	running -> stopping           the process is being gracefully stopped
+//	                              or restarted
+//	adopted -> stopping           the adopted process is being stopped or
+//	                              restarted
+//	running, stopping, adopted    the process exited and will be restarted
+//	-> backoff
+//	stopping -> starting          the process is restarted
+//	backoff, failed -> starting   the process is started again
+//	any -> stopped                the process is stopped for good
+//
+// A process whose start conditions aren't met stays in its current state, and
+// ProcessStatus.Waiting says which condition it's waiting for.
+//
+// The state is what the process acts on: once spawned, a script has a process
+// that can be signaled, stopped or restarted exactly if its state is starting,
+// running, stopping or adopted. See ProcessState.HasProcess.
+type ProcessState string
+
+const (
+	// ProcessIdle is the state of a process that was never started.
+	ProcessIdle ProcessState = "idle"
+	// ProcessStarting is the state of a process that is being spawned, or
+	// that is waiting to become ready. See ScriptConfig.WaitReady.
+	ProcessStarting ProcessState = "starting"
+	// ProcessRunning is the state of a running process.
+	ProcessRunning ProcessState = "running"
+	// ProcessBackoff is the state of a process that exited or failed to spawn
+	// and is waiting for its restart backoff.
+	ProcessBackoff ProcessState = "backoff"
+	// ProcessStopping is the state of a process that was sent SIGTERM and is
+	// waiting to exit.
+	ProcessStopping ProcessState = "stopping"
+	// ProcessStopped is the state of a process that was stopped for good, such
+	// as when cronmon shuts down or the script is manually stopped.
+	ProcessStopped ProcessState = "stopped"
+	// ProcessFailed is the state of a process that persistently fails to spawn
+	// and is only retried every SpawnProbeInterval. See SpawnErrorLimit.
+	ProcessFailed ProcessState = "failed"
+	// ProcessAdopted is the state of a process that was started by a previous
+	// cronmon that exited without stopping it, such as by crashing. It's
+	// watched until it exits instead of spawning the script again. See
+	// Process.Adopt.
+	ProcessAdopted ProcessState = "adopted"
+)
+
+// HasProcess returns true if a process with this state has a running process,
+// or one that has just exited and is yet to be reaped.
+func (s ProcessState) HasProcess() bool {
+	switch s {
+	case ProcessStarting, ProcessRunning, ProcessStopping, ProcessAdopted:
+		return true
+	default:
+		return false
+	}
+}
+
+// State returns the current state of the process.
+func (proc *Process) State() ProcessState {
+	proc.smut.Lock()
+	defer proc.smut.Unlock()
+
+	return proc.state
+}
+
+// setState sets the state of the process and journals the change, if any.
+func (proc *Process) setState(state ProcessState) {
+	proc.smut.Lock()
+	from := proc.state
+	proc.state = state
+	proc.smut.Unlock()
+
+	if from != state {
+		proc.j.Write(&EventProcessStateChanged{
+			File: proc.name,
+			From: from,
+			To:   state,
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package cronmon
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StartLimit describes a token bucket rate limit on process starts. Up to Burst
+// starts may happen at once, after which one more start is allowed every
+// Every. A zero-value StartLimit disables rate limiting.
+type StartLimit struct {
+	Burst int
+	Every time.Duration
+}
+
+// IsZero returns true if the limit is disabled.
+func (l StartLimit) IsZero() bool {
+	return l.Burst <= 0 || l.Every <= 0
+}
+
+// tokenBucket is a simple token bucket rate limiter. It is not thread-safe.
+type tokenBucket struct {
+	limit  StartLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit StartLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+// take takes a token from the bucket. If there are no tokens left, then false
+// is returned along with the duration until the next token is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	if b.limit.IsZero() {
+		return true, 0
+	}
+
+	// Refill the bucket with the tokens earned since the last time.
+	b.tokens += float64(now.Sub(b.last)) / float64(b.limit.Every)
+	if burst := float64(b.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) * float64(b.limit.Every))
+	return false, wait
+}
+
+// RateLimiter is a journaler that rate limits the events with a key, each key
+// apart, such as the events of each type. Up to Burst events of a key are
+// written at once, after which one more is written every Every. The events
+// that are left out are summarized in an event that's written right before the
+// next event of the key that is written, or once the limiter is flushed.
+// Events without a key are passed through.
+type RateLimiter struct {
+	Journaler
+	limit     StartLimit
+	key       func(Event) (string, bool)
+	summarize func(key string, s Suppressed) Event
+
+	mutex sync.Mutex
+	keys  map[string]*rateLimited
+}
+
+var _ TimedJournaler = (*RateLimiter)(nil)
+
+// Suppressed describes the events of a key that a RateLimiter left out.
+type Suppressed struct {
+	Count int
+	First time.Time
+	Last  time.Time
+	// Event is the last event that was left out.
+	Event Event
+}
+
+// rateLimited is the state of the events of a key.
+type rateLimited struct {
+	bucket     *tokenBucket
+	suppressed Suppressed
+}
+
+// NewRateLimiter creates a new RateLimiter that writes into j. key returns the
+// key of an event and whether it's rate limited at all, and summarize returns
+// the event that summarizes the events of a key that were left out.
+func NewRateLimiter(
+	j Journaler, limit StartLimit,
+	key func(Event) (string, bool), summarize func(key string, s Suppressed) Event) *RateLimiter {
+
+	return &RateLimiter{
+		Journaler: j,
+		limit:     limit,
+		key:       key,
+		summarize: summarize,
+		keys:      map[string]*rateLimited{},
+	}
+}
+
+func (l *RateLimiter) Write(ev Event) error {
+	return l.WriteAt(ev, time.Now())
+}
+
+func (l *RateLimiter) WriteAt(ev Event, t time.Time) error {
+	key, ok := l.key(ev)
+	if !ok || l.limit.IsZero() {
+		return WriteAt(l.Journaler, ev, t)
+	}
+
+	l.mutex.Lock()
+
+	s, ok := l.keys[key]
+	if !ok {
+		s = &rateLimited{bucket: newTokenBucket(l.limit, t)}
+		l.keys[key] = s
+	}
+
+	if ok, _ := s.bucket.take(t); !ok {
+		if s.suppressed.Count == 0 {
+			s.suppressed.First = t
+		}
+		s.suppressed.Count++
+		s.suppressed.Last = t
+		s.suppressed.Event = ev
+
+		l.mutex.Unlock()
+		return nil
+	}
+
+	summary := l.takeSummary(key, s)
+
+	l.mutex.Unlock()
+
+	var summaryErr error
+	if summary != nil {
+		summaryErr = WriteAt(l.Journaler, summary, t)
+	}
+
+	if err := WriteAt(l.Journaler, ev, t); err != nil {
+		return err
+	}
+
+	return errors.Wrap(summaryErr, "failed to write summary of suppressed events")
+}
+
+// Flush writes the summaries of the events that were left out since the last
+// event of each key, such as before the journaler is closed. The first error
+// is returned.
+func (l *RateLimiter) Flush() error {
+	type flushed struct {
+		first time.Time
+		ev    Event
+	}
+
+	l.mutex.Lock()
+
+	var summaries []flushed
+	for key, s := range l.keys {
+		first := s.suppressed.First
+		if summary := l.takeSummary(key, s); summary != nil {
+			summaries = append(summaries, flushed{first, summary})
+		}
+	}
+
+	l.mutex.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].first.Before(summaries[j].first)
+	})
+
+	var firstErr error
+
+	now := time.Now()
+	for _, summary := range summaries {
+		if err := WriteAt(l.Journaler, summary.ev, now); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// takeSummary returns the summary of the events of the key that were left out
+// and resets them, or nil if there are none.
+func (l *RateLimiter) takeSummary(key string, s *rateLimited) Event {
+	if s.suppressed.Count == 0 {
+		return nil
+	}
+
+	summary := l.summarize(key, s.suppressed)
+	s.suppressed = Suppressed{}
+
+	return summary
+}
@@ -0,0 +1,25 @@
+package cronmon
+
+import "git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+
+// remoteOf returns the host that the script at the given path runs on with the
+// given configuration. Like containers, only the variables set by the
+// configuration and its secrets are set on the host.
+func remoteOf(path string, cfg ScriptConfig, secrets map[string]string) *exec.Remote {
+	env := make([]string, 0, len(cfg.Env)+len(secrets))
+	for k, v := range cfg.Env {
+		if _, ok := secrets[k]; !ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	for k, v := range secrets {
+		env = append(env, k+"="+v)
+	}
+
+	return &exec.Remote{
+		Host: cfg.Remote.Host,
+		Name: instanceName(path),
+		Args: cfg.Remote.Args,
+		Env:  env,
+	}
+}
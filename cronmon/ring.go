@@ -0,0 +1,128 @@
+package cronmon
+
+import (
+	"sync"
+	"time"
+)
+
+// JournalEntry is a journaled event along with the time it was written.
+type JournalEntry struct {
+	Time  time.Time
+	Event Event
+}
+
+// RingJournal is a Journaler that keeps the last N events in memory. It is
+// safe for concurrent use.
+type RingJournal struct {
+	mutex   sync.Mutex
+	buf     []JournalEntry
+	start   int
+	len     int
+	dropped int // number of overwritten events
+}
+
+var _ Journaler = (*RingJournal)(nil)
+
+// NewRingJournal creates a new RingJournal that keeps the last n events.
+func NewRingJournal(n int) *RingJournal {
+	return &RingJournal{buf: make([]JournalEntry, n)}
+}
+
+// ID returns "ring".
+func (r *RingJournal) ID() string { return "ring" }
+
+// Write writes the event into the ring, overwriting the oldest event if the
+// ring is full. It never fails.
+func (r *RingJournal) Write(ev Event) error {
+	return r.WriteAt(ev, time.Now())
+}
+
+// WriteAt writes the event into the ring like Write with the given time.
+func (r *RingJournal) WriteAt(ev Event, t time.Time) error {
+	entry := JournalEntry{Time: t, Event: ev}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.buf) == 0 {
+		r.dropped++
+		return nil
+	}
+
+	if r.len < len(r.buf) {
+		r.buf[(r.start+r.len)%len(r.buf)] = entry
+		r.len++
+		return nil
+	}
+
+	r.buf[r.start] = entry
+	r.start = (r.start + 1) % len(r.buf)
+	r.dropped++
+	return nil
+}
+
+// Peek returns the oldest event in the ring, or false if the ring is empty.
+func (r *RingJournal) Peek() (JournalEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.len == 0 {
+		return JournalEntry{}, false
+	}
+
+	return r.buf[r.start], true
+}
+
+// Pop removes the oldest event from the ring, if any.
+func (r *RingJournal) Pop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.len == 0 {
+		return
+	}
+
+	r.buf[r.start] = JournalEntry{}
+	r.start = (r.start + 1) % len(r.buf)
+	r.len--
+}
+
+// Dropped returns the number of events that were overwritten because the ring
+// was full.
+func (r *RingJournal) Dropped() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.dropped
+}
+
+// Snapshot returns a copy of the events in the ring, from oldest to newest.
+func (r *RingJournal) Snapshot() []JournalEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entries := make([]JournalEntry, r.len)
+	for i := range entries {
+		entries[i] = r.buf[(r.start+i)%len(r.buf)]
+	}
+
+	return entries
+}
+
+// teeJournaler writes to the main journaler, the given RingJournal and the
+// given EventBus. Its ID is the main journaler's.
+type teeJournaler struct {
+	Journaler
+	ring *RingJournal
+	bus  *EventBus
+}
+
+func (t teeJournaler) Write(ev Event) error {
+	return t.WriteAt(ev, time.Now())
+}
+
+func (t teeJournaler) WriteAt(ev Event, at time.Time) error {
+	t.ring.WriteAt(ev, at)
+	t.bus.WriteAt(ev, at)
+	return WriteAt(t.Journaler, ev, at)
+}
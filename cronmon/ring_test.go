@@ -0,0 +1,50 @@
+package cronmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingJournal(t *testing.T) {
+	r := NewRingJournal(2)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		r.WriteAt(&EventWarning{Component: "test", Error: string(rune('a' + i))}, now.Add(time.Duration(i)))
+	}
+
+	entries := r.Snapshot()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	for i, expect := range []string{"b", "c"} {
+		if ev := entries[i].Event.(*EventWarning); ev.Error != expect {
+			t.Errorf("entry %d is %q, expected %q", i, ev.Error, expect)
+		}
+	}
+
+	if dropped := r.Dropped(); dropped != 1 {
+		t.Errorf("expected 1 dropped event, got %d", dropped)
+	}
+
+	for _, expect := range []string{"b", "c"} {
+		entry, ok := r.Peek()
+		if !ok {
+			t.Fatal("ring is empty too early")
+		}
+		if ev := entry.Event.(*EventWarning); ev.Error != expect {
+			t.Errorf("peeked %q, expected %q", ev.Error, expect)
+		}
+		r.Pop()
+	}
+
+	if _, ok := r.Peek(); ok {
+		t.Error("ring is not empty after popping every event")
+	}
+
+	// An empty ring can still be written into.
+	r.Write(&EventWarning{Component: "test", Error: "d"})
+	if entries := r.Snapshot(); len(entries) != 1 {
+		t.Errorf("expected 1 entry after popping, got %d", len(entries))
+	}
+}
@@ -0,0 +1,93 @@
+package cronmon
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SecretTimeout is the duration that an "exec:" secret command has to print
+// the secret within.
+var SecretTimeout = 10 * time.Second
+
+// secretMode is the mode of a ScriptConfig.Secrets reference.
+type secretMode string
+
+const (
+	secretFile secretMode = "file"
+	secretExec secretMode = "exec"
+)
+
+func parseSecret(ref string) (secretMode, string, error) {
+	i := strings.IndexByte(ref, ':')
+	if i < 0 || i == len(ref)-1 {
+		return "", "", errors.Errorf("invalid secret %q", ref)
+	}
+
+	mode, arg := secretMode(ref[:i]), ref[i+1:]
+
+	switch mode {
+	case secretFile, secretExec:
+		return mode, arg, nil
+	default:
+		return "", "", errors.Errorf("unknown secret mode %q", mode)
+	}
+}
+
+// resolveSecrets resolves the secret references of the configuration into
+// their values. Errors only ever mention the variable names, never the values.
+func resolveSecrets(ctx context.Context, dir string, cfg ScriptConfig) (map[string]string, error) {
+	if len(cfg.Secrets) == 0 {
+		return nil, nil
+	}
+
+	secrets := make(map[string]string, len(cfg.Secrets))
+
+	for k, ref := range cfg.Secrets {
+		v, err := resolveSecret(ctx, dir, ref)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve secret %s", k)
+		}
+		secrets[k] = v
+	}
+
+	return secrets, nil
+}
+
+func resolveSecret(ctx context.Context, dir, ref string) (string, error) {
+	mode, arg, err := parseSecret(ref)
+	if err != nil {
+		return "", err
+	}
+
+	var b []byte
+
+	switch mode {
+	case secretFile:
+		b, err = os.ReadFile(resolvePath(dir, arg))
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read file")
+		}
+
+	case secretExec:
+		ctx, cancel := context.WithTimeout(ctx, SecretTimeout)
+		defer cancel()
+
+		// The stderr of the command is discarded rather than put into the
+		// error, since the error is journaled and the command may well print
+		// the secret or parts of it there.
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", arg)
+		cmd.Dir = dir
+
+		b, err = cmd.Output()
+		if err != nil {
+			return "", errors.Wrap(err, "command failed")
+		}
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,19 @@
+package cronmon
+
+import (
+	"encoding/json"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+)
+
+// Spawner starts the processes of the scripts that choose it by name with their
+// "spawner" option, such as a plugin that runs them somewhere other than the
+// local host. The returned process is supervised like any other: it's signaled
+// to be stopped and restarted once it exits. See MonitorOptions.Spawners.
+type Spawner interface {
+	// Spawn starts the script at the given path. Config is the script's
+	// "spawner_config" option, if any. Spawners that don't use the standard
+	// files in opts must document so, since the script's output and stdin
+	// options don't apply then.
+	Spawn(path string, config json.RawMessage, opts exec.Options) (exec.Process, error)
+}
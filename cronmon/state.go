@@ -0,0 +1,208 @@
+package cronmon
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/exec"
+	"github.com/pkg/errors"
+)
+
+// StateSnapshotVersion is the version of the StateSnapshot format.
+const StateSnapshotVersion = 1
+
+// StateSnapshot is a self-contained snapshot of a monitor's state, used for
+// migrating to another host or for debugging. See Monitor.ExportState.
+type StateSnapshot struct {
+	Version    int           `json:"version"`
+	Host       string        `json:"host"`
+	ExportedAt time.Time     `json:"exported_at"`
+	ScriptsDir string        `json:"scripts_dir"`
+	Scripts    []ScriptState `json:"scripts"`
+}
+
+// ScriptState is the state of a single script in a StateSnapshot.
+type ScriptState struct {
+	// File is the file name of the script in the scripts directory.
+	File string `json:"file"`
+	// Name is the name of the script as it appears in the journal.
+	Name         string        `json:"name"`
+	PID          int           `json:"pid,omitempty"`
+	Hash         string        `json:"hash,omitempty"`
+	Restarts     int           `json:"restarts"`
+	RecentSpawns []time.Time   `json:"recent_spawns,omitempty"`
+	Stopped      bool          `json:"stopped,omitempty"`
+	Config       *ScriptConfig `json:"config,omitempty"`
+	// ConfigError is the reason that the configuration couldn't be loaded.
+	ConfigError string `json:"config_error,omitempty"`
+}
+
+// ExportState returns a snapshot of the monitor's state.
+func (m *Monitor) ExportState() (*StateSnapshot, error) {
+	host, _ := os.Hostname()
+
+	snap := StateSnapshot{
+		Version:    StateSnapshotVersion,
+		Host:       host,
+		ExportedAt: time.Now(),
+		ScriptsDir: m.dir,
+	}
+
+	ok := m.do(func() {
+		for file, proc := range m.procs {
+			status := proc.Status()
+			snap.Scripts = append(snap.Scripts, m.scriptState(file, ScriptState{
+				PID:          status.PID,
+				Hash:         status.Hash,
+				Restarts:     status.Restarts,
+				RecentSpawns: proc.RecentSpawns(),
+			}))
+		}
+		for file := range m.stopped {
+			name, _ := ParseScriptName(file)
+			snap.Scripts = append(snap.Scripts, m.scriptState(file, ScriptState{
+				Restarts:     m.restarts[name],
+				RecentSpawns: m.spawns[name],
+				Stopped:      true,
+			}))
+		}
+	})
+	if !ok {
+		return nil, ErrMonitorStopped
+	}
+
+	sort.Slice(snap.Scripts, func(i, j int) bool {
+		return snap.Scripts[i].File < snap.Scripts[j].File
+	})
+
+	return &snap, nil
+}
+
+func (m *Monitor) scriptState(file string, state ScriptState) ScriptState {
+	state.File = file
+	state.Name, _ = ParseScriptName(file)
+
+	cfg, err := loadScriptConfig(m.dir, file, m.user)
+	if err != nil {
+		state.ConfigError = err.Error()
+	} else {
+		state.Config = &cfg
+	}
+
+	return state
+}
+
+// ImportReport describes the result of validating or importing a
+// StateSnapshot.
+type ImportReport struct {
+	// Imported is true if the state was applied.
+	Imported bool           `json:"imported"`
+	Scripts  []ScriptImport `json:"scripts"`
+}
+
+// ScriptImport is the result of validating a single script of a StateSnapshot.
+type ScriptImport struct {
+	File string `json:"file"`
+	// OK is true if the script's statistics can be imported.
+	OK bool `json:"ok"`
+	// Problems are the differences between the snapshot and the live system.
+	// A script with problems may still be OK.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// ImportState validates the given snapshot against the live system and, unless
+// dryRun is true, imports the statistics of the scripts that are valid. Only
+// restart counters, recent spawns and manually stopped states are imported.
+// Processes are never adopted: a script whose process from the snapshot is
+// still running is reported and skipped, since adopting it could run it twice.
+func (m *Monitor) ImportState(snap *StateSnapshot, dryRun bool) (*ImportReport, error) {
+	if snap.Version != StateSnapshotVersion {
+		return nil, errors.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	host, _ := os.Hostname()
+	sameHost := snap.Host == host
+
+	report := ImportReport{Imported: !dryRun}
+
+	ok := m.do(func() {
+		for _, script := range snap.Scripts {
+			result := m.validateScriptState(script, sameHost)
+			report.Scripts = append(report.Scripts, result)
+
+			if dryRun || !result.OK {
+				continue
+			}
+
+			m.importScriptState(script)
+		}
+
+		if !dryRun {
+			m.j.Write(&EventStatsSnapshot{Restarts: m.statsRestarts()})
+		}
+	})
+	if !ok {
+		return nil, ErrMonitorStopped
+	}
+
+	return &report, nil
+}
+
+// validateScriptState validates the given script state against the live
+// system. It must only be called in the monitor goroutine.
+func (m *Monitor) validateScriptState(script ScriptState, sameHost bool) ScriptImport {
+	result := ScriptImport{File: script.File, OK: true}
+
+	problemf := func(ok bool, f string, v ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(f, v...))
+		result.OK = result.OK && ok
+	}
+
+	if _, ok := m.procs[script.File]; !ok {
+		if _, ok := m.stopped[script.File]; !ok {
+			problemf(false, "script does not exist in %s", m.dir)
+			return result
+		}
+	}
+
+	if script.PID != 0 && sameHost && exec.ProcessExists(script.PID) {
+		if proc := m.procs[script.File]; proc == nil || proc.Status().PID != script.PID {
+			problemf(false, "process %d from the snapshot is still running", script.PID)
+		}
+	}
+
+	if script.Hash != "" {
+		if hash, err := hashScript(m.dir, script.File, m.user); err == nil && hash != script.Hash {
+			problemf(true, "script differs from the snapshot")
+		}
+	}
+
+	if script.ConfigError != "" {
+		problemf(true, "snapshot has an invalid config: %s", script.ConfigError)
+	}
+
+	return result
+}
+
+// importScriptState imports the statistics of the given valid script state. It
+// must only be called in the monitor goroutine.
+func (m *Monitor) importScriptState(script ScriptState) {
+	proc := m.procs[script.File]
+
+	if script.Stopped && proc != nil {
+		m.detachProc(script.File)
+		go proc.Stop()
+		proc = nil
+	}
+
+	if proc != nil {
+		proc.SetRestarts(script.Restarts)
+		proc.SetRecentSpawns(script.RecentSpawns)
+		return
+	}
+
+	m.restarts[script.Name] = script.Restarts
+	m.spawns[script.Name] = script.RecentSpawns
+}
@@ -0,0 +1,169 @@
+package cronmon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStateMonitor creates a dry-run monitor of the given scripts and waits
+// for it to know all of them.
+func newStateMonitor(t *testing.T, j Journaler, files ...string) *Monitor {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, file := range files {
+		writeScript(t, filepath.Join(dir, file))
+	}
+
+	m, err := NewMonitorWithOptions(context.Background(), dir, j, MonitorOptions{DryRun: true})
+	if err != nil {
+		t.Fatal("failed to create monitor:", err)
+	}
+	t.Cleanup(func() { m.Stop() })
+
+	select {
+	case <-m.Scanned():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the scan")
+	}
+
+	return m
+}
+
+// scriptStatuses returns the statuses of the monitor's scripts by name.
+func scriptStatuses(t *testing.T, m *Monitor) map[string]ProcessStatus {
+	t.Helper()
+
+	statuses, err := m.Snapshot()
+	if err != nil {
+		t.Fatal("failed to get snapshot:", err)
+	}
+
+	byName := make(map[string]ProcessStatus, len(statuses))
+	for _, status := range statuses {
+		byName[status.File] = status
+	}
+	return byName
+}
+
+func TestStateExportImport(t *testing.T) {
+	var j mockJournal
+
+	src := newStateMonitor(t, &j, "10-a", "20-b")
+
+	if err := src.StopProcess("20-b"); err != nil {
+		t.Fatal("failed to stop script:", err)
+	}
+
+	snap, err := src.ExportState()
+	if err != nil {
+		t.Fatal("failed to export state:", err)
+	}
+
+	if len(snap.Scripts) != 2 {
+		t.Fatalf("expected 2 scripts, got %#v", snap.Scripts)
+	}
+	a, b := snap.Scripts[0], snap.Scripts[1]
+	if a.File != "10-a" || a.Name != "a" || a.Stopped || a.Hash == "" {
+		t.Errorf("unexpected state of a: %#v", a)
+	}
+	if b.File != "20-b" || b.Name != "b" || !b.Stopped {
+		t.Errorf("unexpected state of b: %#v", b)
+	}
+
+	snap.Scripts[0].Restarts = 3
+	snap.Scripts = append(snap.Scripts, ScriptState{File: "30-c", Name: "c"})
+
+	dst := newStateMonitor(t, &j, "10-a", "20-b")
+
+	// A dry run only validates.
+	report, err := dst.ImportState(snap, true)
+	if err != nil {
+		t.Fatal("failed to validate state:", err)
+	}
+
+	if report.Imported || len(report.Scripts) != 3 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+	for _, script := range report.Scripts {
+		if ok := script.File != "30-c"; script.OK != ok {
+			t.Errorf("%s: expected OK=%v, got %#v", script.File, ok, script)
+		}
+	}
+	if problems := report.Scripts[2].Problems; len(problems) != 1 || !strings.Contains(problems[0], "does not exist") {
+		t.Errorf("unexpected problems of the missing script: %q", problems)
+	}
+
+	statuses := scriptStatuses(t, dst)
+	if statuses["a"].Restarts != 0 || statuses["b"].Stopped {
+		t.Fatalf("dry run imported the state: %#v", statuses)
+	}
+
+	report, err = dst.ImportState(snap, false)
+	if err != nil {
+		t.Fatal("failed to import state:", err)
+	}
+	if !report.Imported {
+		t.Error("state was not imported")
+	}
+
+	statuses = scriptStatuses(t, dst)
+	if statuses["a"].Restarts != 3 {
+		t.Errorf("restarts were not imported: %#v", statuses["a"])
+	}
+	if !statuses["b"].Stopped {
+		t.Errorf("stopped state was not imported: %#v", statuses["b"])
+	}
+}
+
+func TestStateImportProblems(t *testing.T) {
+	var j mockJournal
+
+	m := newStateMonitor(t, &j, "10-a", "20-b")
+
+	host, _ := os.Hostname()
+
+	// The test's own process stands in for a process from the snapshot that's
+	// still running.
+	snap := &StateSnapshot{
+		Version: StateSnapshotVersion,
+		Host:    host,
+		Scripts: []ScriptState{
+			{File: "10-a", Name: "a", PID: os.Getpid()},
+			{File: "20-b", Name: "b", Hash: "stale"},
+		},
+	}
+
+	report, err := m.ImportState(snap, true)
+	if err != nil {
+		t.Fatal("failed to validate state:", err)
+	}
+
+	a, b := report.Scripts[0], report.Scripts[1]
+	if a.OK || len(a.Problems) != 1 || !strings.Contains(a.Problems[0], "still running") {
+		t.Errorf("running process was not reported: %#v", a)
+	}
+	if !b.OK || len(b.Problems) != 1 || !strings.Contains(b.Problems[0], "differs") {
+		t.Errorf("changed script was not reported: %#v", b)
+	}
+
+	// Processes of other hosts can't be checked.
+	snap.Host = "elsewhere"
+
+	report, err = m.ImportState(snap, true)
+	if err != nil {
+		t.Fatal("failed to validate state:", err)
+	}
+	if !report.Scripts[0].OK {
+		t.Errorf("process of another host was checked: %#v", report.Scripts[0])
+	}
+
+	snap.Version++
+	if _, err := m.ImportState(snap, true); err == nil {
+		t.Error("imported a snapshot of an unsupported version")
+	}
+}
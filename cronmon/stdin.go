@@ -0,0 +1,78 @@
+package cronmon
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoStdin is returned when writing to the stdin of a process that is not
+// running or whose stdin is not a pipe.
+var ErrNoStdin = errors.New("process has no writable stdin")
+
+// openStdin opens the stdin of a process for the given configuration. The
+// returned child file is passed to the process, while the returned writer, if
+// any, is kept by cronmon to write to the process' stdin. The child file is
+// nil for /dev/null. The caller must call closeChildStdin once the process has
+// started, and the writer must be closed once it has exited.
+func openStdin(dir string, cfg ScriptConfig) (child, writer *os.File, err error) {
+	mode, path, err := parseStdin(cfg.Stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch mode {
+	case stdinNull:
+		return nil, nil, nil
+
+	case stdinPipe:
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create stdin pipe")
+		}
+		return r, w, nil
+
+	case stdinFIFO:
+		path = resolvePath(dir, path)
+
+		if err := unix.Mkfifo(path, 0600); err != nil && !os.IsExist(err) {
+			return nil, nil, errors.Wrap(err, "failed to create stdin fifo")
+		}
+
+		s, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to stat stdin fifo")
+		}
+		if s.Mode()&os.ModeNamedPipe == 0 {
+			return nil, nil, errors.Errorf("stdin %s is not a fifo", path)
+		}
+
+		// Open the FIFO for both reading and writing, so that opening it does
+		// not block, and so that the process does not see an EOF when other
+		// writers close their ends.
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to open stdin fifo")
+		}
+		return f, f, nil
+
+	case stdinFile:
+		f, err := os.Open(resolvePath(dir, path))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to open stdin file")
+		}
+		return f, nil, nil
+
+	default:
+		return nil, nil, errors.Errorf("unknown stdin mode %q", mode)
+	}
+}
+
+// closeChildStdin closes the child end of the stdin files returned by openStdin. The
+// writer is left open if it is shared with the child.
+func closeChildStdin(child, writer *os.File) {
+	if child != nil && child != writer {
+		child.Close()
+	}
+}
@@ -0,0 +1,198 @@
+package cronmon
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// UptimeWindow is the window that uptimes are computed over by default, which
+// is the usual period of an SLA.
+var UptimeWindow = 30 * 24 * time.Hour
+
+// UptimeReport is the availability of a script over a window of time, such as
+// to check it against an SLA.
+type UptimeReport struct {
+	File  string    `json:"file"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// Availability is the percentage of the known time in the window that the
+	// script was running, from 0 to 100. It is 0 if nothing is known.
+	Availability float64 `json:"availability"`
+	// Uptime and Downtime are how long the script was running and down for.
+	// Their sum is less than the window if the state of the script is unknown
+	// for part of it, such as before it was first spawned.
+	Uptime   time.Duration `json:"uptime"`
+	Downtime time.Duration `json:"downtime"`
+	// Downtimes are the intervals that the script was down for in
+	// chronological order.
+	Downtimes []DowntimeInterval `json:"downtimes"`
+}
+
+// DowntimeInterval is an interval of time that a script was down for.
+type DowntimeInterval struct {
+	Start time.Time `json:"start"`
+	// End is the end of the window if the script is still down.
+	End time.Time `json:"end"`
+	// Reason is why the script went down, such as its exit code or spawn
+	// error.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Duration returns how long the interval is.
+func (i DowntimeInterval) Duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// ComputeUptime computes the availability of the given script over the last
+// window from its spawns, exits and spawn errors in the journal. The script is
+// considered down from the time that the monitor quits until it's spawned
+// again. Its state at the start of the window is taken from the last event
+// before it, so the journal is read past the window until one is found.
+func ComputeUptime(r JournalReader, file string, window time.Duration) (*UptimeReport, error) {
+	until := time.Now()
+	since := until.Add(-window)
+
+	var events []digestEvent
+	var before Event
+
+	err := ReadJournal(context.Background(), r, func(ev Event, t time.Time) error {
+		switch ev.(type) {
+		case *EventProcessSpawned, *EventProcessExited, *EventProcessSpawnError:
+			if ev.(ProcessEvent).ProcessFile() != file {
+				return nil
+			}
+		case *EventQuit:
+		default:
+			return nil
+		}
+
+		if t.Before(since) {
+			before = ev
+			return ErrStopReading
+		}
+		if !t.After(until) {
+			events = append(events, digestEvent{t, ev})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Go through the events from oldest to newest.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	u := uptimeBuilder{
+		report: UptimeReport{
+			File:      file,
+			Since:     since,
+			Until:     until,
+			Downtimes: []DowntimeInterval{},
+		},
+	}
+
+	switch before.(type) {
+	case nil:
+		// Nothing is known before the first event, unless it's an exit.
+		if len(events) > 0 {
+			if _, ok := events[0].ev.(*EventProcessExited); ok {
+				u.up(since)
+			}
+		}
+	case *EventProcessSpawned:
+		u.up(since)
+	default:
+		u.down(since, downReason(before))
+	}
+
+	for _, ev := range events {
+		switch ev.ev.(type) {
+		case *EventProcessSpawned:
+			u.up(ev.t)
+		default:
+			u.down(ev.t, downReason(ev.ev))
+		}
+	}
+
+	return u.finish(until), nil
+}
+
+// uptimeBuilder builds an UptimeReport from chronological changes of state.
+type uptimeBuilder struct {
+	report  UptimeReport
+	since   time.Time // the start of the current state
+	running bool
+	known   bool
+}
+
+// up marks the script as running from t.
+func (u *uptimeBuilder) up(t time.Time) {
+	if u.known && u.running {
+		return
+	}
+	u.end(t)
+	u.since = t
+	u.running = true
+	u.known = true
+}
+
+// down marks the script as down from t for the given reason.
+func (u *uptimeBuilder) down(t time.Time, reason string) {
+	if u.known && !u.running {
+		return
+	}
+	u.end(t)
+	u.since = t
+	u.running = false
+	u.known = true
+
+	u.report.Downtimes = append(u.report.Downtimes, DowntimeInterval{
+		Start:  t,
+		Reason: reason,
+	})
+}
+
+// end ends the current state at t.
+func (u *uptimeBuilder) end(t time.Time) {
+	if !u.known {
+		return
+	}
+
+	if u.running {
+		u.report.Uptime += t.Sub(u.since)
+		return
+	}
+
+	u.report.Downtime += t.Sub(u.since)
+	u.report.Downtimes[len(u.report.Downtimes)-1].End = t
+}
+
+func (u *uptimeBuilder) finish(until time.Time) *UptimeReport {
+	u.end(until)
+
+	if known := u.report.Uptime + u.report.Downtime; known > 0 {
+		u.report.Availability = 100 * float64(u.report.Uptime) / float64(known)
+	}
+
+	return &u.report
+}
+
+// downReason describes why the event took its script down.
+func downReason(ev Event) string {
+	switch ev := ev.(type) {
+	case *EventProcessExited:
+		if ev.Error != "" {
+			return ev.Error
+		}
+		return fmt.Sprintf("exit code %d", ev.ExitCode)
+	case *EventProcessSpawnError:
+		return ev.Reason
+	case *EventQuit:
+		return "cronmon quit"
+	default:
+		return ""
+	}
+}
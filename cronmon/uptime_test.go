@@ -0,0 +1,70 @@
+package cronmon
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeUptime(t *testing.T) {
+	now := time.Now()
+	ago := func(hours int) time.Time { return now.Add(-time.Duration(hours) * time.Hour) }
+
+	// From newest to oldest, like journals are read.
+	r := mockReader{events: []mockEvent{
+		{&EventProcessSpawned{PID: 4, File: "a"}, ago(3)},
+		{&EventQuit{}, ago(4)},
+		{&EventProcessSpawned{PID: 3, File: "a"}, ago(6)},
+		{&EventProcessSpawned{PID: 2, File: "b"}, ago(7)},
+		{&EventProcessExited{PID: 1, File: "a", ExitCode: 1}, ago(8)},
+		{&EventProcessSpawned{PID: 1, File: "a"}, ago(12)},
+	}}
+
+	u, err := ComputeUptime(&r, "a", 10*time.Hour)
+	if err != nil {
+		t.Fatal("failed to compute uptime:", err)
+	}
+
+	expect := []DowntimeInterval{
+		{Start: ago(8), End: ago(6), Reason: "exit code 1"},
+		{Start: ago(4), End: ago(3), Reason: "cronmon quit"},
+	}
+
+	if !reflect.DeepEqual(u.Downtimes, expect) {
+		t.Fatalf("unexpected downtimes:\n"+
+			"got      %+v\n"+
+			"expected %+v", u.Downtimes, expect)
+	}
+
+	if u.Downtime != 3*time.Hour {
+		t.Errorf("unexpected downtime %v", u.Downtime)
+	}
+
+	// The uptime runs until the report is computed, which is slightly after
+	// now.
+	if d := u.Uptime - 7*time.Hour; d < 0 || d > time.Minute {
+		t.Errorf("unexpected uptime %v", u.Uptime)
+	}
+
+	if math.Abs(u.Availability-70) > 0.1 {
+		t.Errorf("unexpected availability %f", u.Availability)
+	}
+
+	// Nothing is known of b before it was first spawned, and it's down since
+	// the monitor quit.
+	r.cursor = 0
+
+	u, err = ComputeUptime(&r, "b", 10*time.Hour)
+	if err != nil {
+		t.Fatal("failed to compute uptime:", err)
+	}
+
+	if d := u.Downtime - 4*time.Hour; u.Uptime != 3*time.Hour || d < 0 || d > time.Minute {
+		t.Errorf("unexpected uptime %v and downtime %v", u.Uptime, u.Downtime)
+	}
+
+	if math.Abs(u.Availability-300.0/7) > 0.1 {
+		t.Errorf("unexpected availability %f", u.Availability)
+	}
+}
@@ -0,0 +1,152 @@
+package cronmon
+
+import (
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// openScriptFile opens the regular file at path for reading, such as a script
+// or its configuration. Other files, such as FIFOs and devices, are refused, so
+// that reading them can't block cronmon.
+//
+// If u isn't nil, then the file must be in the home directory of the user, and
+// it's opened with the file system credentials of the user instead of
+// cronmon's, so that a user can't have cronmon read files for them that only
+// root may read. See MonitorOptions.User.
+func openScriptFile(path string, u *user.User) (*os.File, error) {
+	// Don't block on opening a FIFO without a writer.
+	flags := os.O_RDONLY | syscall.O_NONBLOCK
+
+	var f *os.File
+	var err error
+
+	if u == nil {
+		f, err = os.OpenFile(path, flags, 0)
+	} else {
+		f, err = openAsUser(path, flags, u)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !s.Mode().IsRegular() {
+		f.Close()
+		return nil, errors.Errorf("%s is not a regular file", path)
+	}
+
+	return f, nil
+}
+
+// readScriptFile reads the file at path like os.ReadFile, except that it's
+// opened with openScriptFile.
+func readScriptFile(path string, u *user.User) ([]byte, error) {
+	f, err := openScriptFile(path, u)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// checkInHome returns an error if the path, with its symlinks resolved, isn't
+// in the home directory of the user. The error of a missing file is returned
+// as-is.
+func checkInHome(path string, u *user.User) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	if !inHome(resolved, u) {
+		return errors.Errorf("%s is outside of the home directory of %s", path, u.Username)
+	}
+
+	return nil
+}
+
+// checkUserPath returns an error if the path isn't in the home directory of
+// the user, and neither is its target if it's an existing symlink.
+func checkUserPath(path string, u *user.User) error {
+	if !inHome(path, u) {
+		return errors.Errorf("%s is outside of the home directory of %s", path, u.Username)
+	}
+
+	if err := checkInHome(path, u); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// inHome returns true if the path is lexically in the home directory of the
+// user.
+func inHome(path string, u *user.User) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	home := filepath.Clean(u.HomeDir) + string(filepath.Separator)
+	return strings.HasPrefix(abs, home)
+}
+
+// openAsUser opens the file in the home directory of the user with the user's
+// file system credentials, which are only changed for the calling thread.
+func openAsUser(path string, flags int, u *user.User) (*os.File, error) {
+	if err := checkInHome(path, u); err != nil {
+		return nil, err
+	}
+
+	cred, err := userCredential(u)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid := int(cred.UID), int(cred.GID)
+	if uid == os.Geteuid() && gid == os.Getegid() {
+		return os.OpenFile(path, flags, 0)
+	}
+
+	runtime.LockOSThread()
+
+	// setfsuid(2) and setfsgid(2) don't report failing, so the credentials
+	// are set twice to read them back.
+	unix.SetfsgidRetGid(gid)
+	unix.SetfsuidRetUid(uid)
+	oldGID, _ := unix.SetfsgidRetGid(gid)
+	oldUID, _ := unix.SetfsuidRetUid(uid)
+
+	var f *os.File
+	if oldUID == uid && oldGID == gid {
+		f, err = os.OpenFile(path, flags, 0)
+	} else {
+		err = errors.Errorf("cannot open files as user %s", u.Username)
+	}
+
+	unix.SetfsuidRetUid(os.Geteuid())
+	unix.SetfsgidRetGid(os.Getegid())
+
+	// The thread is only reused if its credentials were restored. Otherwise,
+	// it's thrown away once the goroutine exits.
+	if restoredUID, _ := unix.SetfsuidRetUid(os.Geteuid()); restoredUID == os.Geteuid() {
+		if restoredGID, _ := unix.SetfsgidRetGid(os.Getegid()); restoredGID == os.Getegid() {
+			runtime.UnlockOSThread()
+		}
+	}
+
+	return f, err
+}
@@ -0,0 +1,74 @@
+package cronmon
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenScriptFile(t *testing.T) {
+	home := t.TempDir()
+
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("no current user:", err)
+	}
+	u := *current
+	u.HomeDir = home
+
+	script := filepath.Join(home, "script")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fifo := filepath.Join(home, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"outside": "/etc/passwd",
+		"zero":    "/dev/zero",
+		"inside":  "script",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(home, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path   string
+		user   *user.User
+		expect bool
+	}{
+		{script, nil, true},
+		{script, &u, true},
+		{filepath.Join(home, "inside"), &u, true},
+		{filepath.Join(home, "outside"), nil, true},
+		{filepath.Join(home, "outside"), &u, false},
+		{filepath.Join(home, "zero"), nil, false},
+		{fifo, nil, false},
+		{fifo, &u, false},
+	}
+
+	for _, test := range tests {
+		done := make(chan error, 1)
+		go func() {
+			_, err := readScriptFile(test.path, test.user)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if ok := err == nil; ok != test.expect {
+				t.Errorf("%s as %v: got ok %v, expected %v (%v)", test.path, test.user != nil, ok, test.expect, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: reading blocked", test.path)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package cronmon
+
+import "time"
+
+// MonitorWarningLimit is the default rate limit of the warnings of each
+// component of a monitor. See MonitorOptions.WarningLimit.
+var MonitorWarningLimit = StartLimit{Burst: 5, Every: time.Minute}
+
+// newWarningLimiter creates a RateLimiter that rate limits the EventWarnings of
+// each component apart, so that a component that keeps failing, such as a
+// broken watcher, neither floods the journal nor drowns out the warnings of the
+// others. The warnings that are left out are summarized in an
+// EventWarningsSuppressed. Other events are passed through.
+func newWarningLimiter(j Journaler, limit StartLimit) *RateLimiter {
+	return NewRateLimiter(j, limit, warningComponent, summarizeWarnings)
+}
+
+func warningComponent(ev Event) (string, bool) {
+	warning, ok := ev.(*EventWarning)
+	if !ok {
+		return "", false
+	}
+	return warning.Component, true
+}
+
+func summarizeWarnings(component string, s Suppressed) Event {
+	return &EventWarningsSuppressed{
+		Component: component,
+		Count:     s.Count,
+		Error:     s.Event.(*EventWarning).Error,
+		First:     s.First,
+		Last:      s.Last,
+	}
+}
@@ -0,0 +1,69 @@
+package cronmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarningLimiter(t *testing.T) {
+	ring := NewRingJournal(64)
+	l := newWarningLimiter(ring, StartLimit{Burst: 2, Every: time.Minute})
+
+	start := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	// A broken watcher warns every second, drowning out nobody else.
+	for i := 0; i < 10; i++ {
+		l.WriteAt(&EventWarning{Component: "watcher", Error: "broken"}, start.Add(time.Duration(i)*time.Second))
+	}
+	l.WriteAt(&EventWarning{Component: "process", Error: "a: oops"}, start.Add(10*time.Second))
+	l.WriteAt(&EventProcessSpawned{File: "a", PID: 1}, start.Add(11*time.Second))
+
+	// The next warning of the watcher once it may warn again carries the
+	// summary of the ones left out.
+	l.WriteAt(&EventWarning{Component: "watcher", Error: "still broken"}, start.Add(2*time.Minute))
+
+	var types []string
+	for _, entry := range ring.Snapshot() {
+		types = append(types, entry.Event.Type())
+	}
+
+	expect := []string{
+		eventWarning, eventWarning, // burst of the watcher
+		eventWarning, // process
+		eventProcessSpawned,
+		eventWarningsSuppressed, eventWarning,
+	}
+	if len(types) != len(expect) {
+		t.Fatalf("got events %q, expected %q", types, expect)
+	}
+	for i := range expect {
+		if types[i] != expect[i] {
+			t.Fatalf("got events %q, expected %q", types, expect)
+		}
+	}
+
+	summary := ring.Snapshot()[4].Event.(*EventWarningsSuppressed)
+	if summary.Component != "watcher" || summary.Count != 8 || summary.Error != "broken" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if !summary.First.Equal(start.Add(2*time.Second)) || !summary.Last.Equal(start.Add(9*time.Second)) {
+		t.Errorf("unexpected summary times %v to %v", summary.First, summary.Last)
+	}
+	if err := ValidateEvent(summary); err != nil {
+		t.Errorf("invalid summary: %v", err)
+	}
+
+	// Warnings left out once the failure stops are summarized on flush.
+	l.WriteAt(&EventWarning{Component: "watcher", Error: "flaky"}, start.Add(2*time.Minute+time.Second))
+	l.WriteAt(&EventWarning{Component: "watcher", Error: "flaky"}, start.Add(2*time.Minute+2*time.Second))
+	l.Flush()
+	l.Flush()
+
+	entries := ring.Snapshot()
+	if len(entries) != len(expect)+2 {
+		t.Fatalf("got %d events after flushing, expected %d", len(entries), len(expect)+2)
+	}
+	if summary, ok := entries[len(entries)-1].Event.(*EventWarningsSuppressed); !ok || summary.Count != 1 {
+		t.Errorf("unexpected flushed event %+v", entries[len(entries)-1].Event)
+	}
+}
@@ -5,19 +5,43 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 )
 
+// WatcherRenameGrace is the duration that the watcher waits after a file is
+// renamed away before treating it as removed. If a file with the same name is
+// created within this duration, then the pair is treated as a single update.
+var WatcherRenameGrace = 250 * time.Millisecond
+
 // Watcher is a cronmon watcher that watches the configuration directory
 // for new processes.
 type Watcher struct {
 	Events chan EventProcessListModify
+	// Artifacts receives a value whenever the artifact manifest changes. See
+	// ArtifactManifest.
+	Artifacts chan struct{}
 
 	w   *fsnotify.Watcher
 	j   Journaler
 	dir string
+
+	// links maps a symlink's resolved target path to the names of the links in
+	// dir that point to it. targets is its inverse, and linkDirs holds the
+	// reference count of each extra directory watched for the targets.
+	links    map[string][]string
+	targets  map[string]string
+	linkDirs map[string]int
+
+	// known contains the files known to exist in dir. renamed contains the
+	// files that were renamed away mapped to the deadline of their removal.
+	known   map[string]struct{}
+	renamed map[string]time.Time
+
+	watching chan struct{}
+	done     chan struct{}
 }
 
 // TryWatch attempts to watch the given directory asynchronously, but it will
@@ -31,9 +55,11 @@ func TryWatch(ctx context.Context, dir string, j Journaler) *Watcher {
 				Component: "watcher",
 				Error:     fmt.Sprintf("not watching dir because: %v", err),
 			})
+			close(w.done)
 			return
 		}
 
+		close(w.watching)
 		w.watch(ctx)
 	}()
 
@@ -48,17 +74,59 @@ func NewWatcher(ctx context.Context, dir string, j Journaler) (*Watcher, error)
 		return nil, err
 	}
 
+	close(w.watching)
 	go w.watch(ctx)
 	return w, nil
 }
 
 func newWatcher(dir string, j Journaler) *Watcher {
+	// Use the absolute path, since symlink targets are resolved to absolute
+	// paths and must be comparable against the directory.
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
 	return &Watcher{
-		Events: make(chan EventProcessListModify),
-		w:      nil,
-		j:      j,
-		dir:    dir,
+		Events:    make(chan EventProcessListModify),
+		Artifacts: make(chan struct{}, 1),
+		w:         nil,
+		j:         j,
+		dir:       filepath.Clean(dir),
+
+		links:    map[string][]string{},
+		targets:  map[string]string{},
+		linkDirs: map[string]int{},
+
+		known:   map[string]struct{}{},
+		renamed: map[string]time.Time{},
+
+		watching: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Watching returns true if the watcher is watching the directory, which is
+// false until TryWatch has started watching it and after the watcher stopped.
+func (w *Watcher) Watching() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
 	}
+
+	select {
+	case <-w.watching:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that's closed once the watcher has stopped, either
+// because its context was canceled or because it failed to watch the directory.
+// Events is never sent to after that.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
 }
 
 func (w *Watcher) init() error {
@@ -68,17 +136,41 @@ func (w *Watcher) init() error {
 	}
 
 	if err := watcher.Add(w.dir); err != nil {
+		watcher.Close()
 		return errors.Wrap(err, "failed to watch dir")
 	}
 
 	w.w = watcher
+
+	// Start watching the targets of symlinks that already exist.
+	files, _ := os.ReadDir(w.dir)
+	for _, file := range files {
+		if !isScriptName(file.Name()) || !isScriptMode(file.Type()) {
+			continue
+		}
+		w.known[file.Name()] = struct{}{}
+		w.trackLink(file.Name())
+	}
+
 	return nil
 }
 
 func (w *Watcher) watch(ctx context.Context) {
+	defer close(w.done)
 	defer w.w.Close()
 
+	var renameTimer *time.Timer
+	var renameTimeout <-chan time.Time
+
+	defer func() {
+		if renameTimer != nil {
+			renameTimer.Stop()
+		}
+	}()
+
 	for {
+		var events []EventProcessListModify
+
 		select {
 		case <-ctx.Done():
 			return
@@ -89,20 +181,44 @@ func (w *Watcher) watch(ctx context.Context) {
 				Error:     "inotify error: " + err.Error(),
 			})
 
+		case <-renameTimeout:
+			renameTimer = nil
+			renameTimeout = nil
+			events = w.expireRenamed(time.Now())
+
 		case evt := <-w.w.Events:
-			event := translateFsnotifyEvt(evt, w.dir)
-			if event.Op == "" {
-				w.j.Write(&EventWarning{
-					Component: "watcher",
-					Error:     fmt.Sprintf("skipped unknown %s event at %s", evt.Op, evt.Name),
-				})
-
-				continue
+			events = w.linkTargetEvents(evt)
+
+			if filepath.Dir(evt.Name) == w.dir {
+				if name := filepath.Base(evt.Name); name == ArtifactManifest {
+					select {
+					case w.Artifacts <- struct{}{}:
+					default:
+					}
+				} else if !isScriptName(name) {
+					events = append(events, w.configEvents(name)...)
+				} else if isSpecialFile(evt.Name) {
+					// Skip FIFOs and such, which may be a script's stdin.
+				} else if event := translateFsnotifyEvt(evt, w.dir); event.Op == "" {
+					w.j.Write(&EventWarning{
+						Component: "watcher",
+						Error:     fmt.Sprintf("skipped unknown %s event at %s", evt.Op, evt.Name),
+					})
+				} else if event, ok := w.coalesceRename(evt, event); ok {
+					w.updateLink(event)
+					events = append(events, event)
+				}
 			}
+		}
+
+		if renameTimeout == nil && len(w.renamed) > 0 {
+			renameTimer = time.NewTimer(WatcherRenameGrace)
+			renameTimeout = renameTimer.C
+		}
 
+		for _, event := range events {
 			select {
 			case w.Events <- event:
-				continue
 			case <-ctx.Done():
 				return
 			}
@@ -110,6 +226,186 @@ func (w *Watcher) watch(ctx context.Context) {
 	}
 }
 
+// isSpecialFile returns true if the file at the given path exists and is not a
+// possible script. See isScriptMode.
+func isSpecialFile(path string) bool {
+	s, err := os.Lstat(path)
+	return err == nil && !isScriptMode(s.Mode())
+}
+
+// configEvents returns the events for a change of the given hidden file. A
+// change of a script's configuration file updates the script if it is known;
+// other hidden files are ignored.
+func (w *Watcher) configEvents(name string) []EventProcessListModify {
+	file := scriptOfConfig(name)
+	if file == "" {
+		return nil
+	}
+
+	if _, ok := w.known[file]; !ok {
+		return nil
+	}
+
+	return []EventProcessListModify{{Op: ProcessListUpdate, File: file}}
+}
+
+// coalesceRename keeps track of the known files in the directory to turn the
+// common pattern of renaming a new file over an old one into a single Update
+// event. False is returned if the event should be held back for now.
+func (w *Watcher) coalesceRename(
+	evt fsnotify.Event, event EventProcessListModify) (EventProcessListModify, bool) {
+
+	switch event.Op {
+	case ProcessListAdd:
+		if evt.Op&fsnotify.Create == 0 {
+			// Chmod events are not file replacements.
+			w.known[event.File] = struct{}{}
+			return event, true
+		}
+
+		_, wasRenamed := w.renamed[event.File]
+		_, wasKnown := w.known[event.File]
+
+		delete(w.renamed, event.File)
+		w.known[event.File] = struct{}{}
+
+		if wasRenamed || wasKnown {
+			// The file was replaced, either by renaming another file over it or
+			// by renaming it away and creating a new one in its place.
+			event.Op = ProcessListUpdate
+		}
+
+		return event, true
+
+	case ProcessListRemove:
+		if evt.Op&fsnotify.Rename != 0 {
+			if _, ok := w.known[event.File]; ok {
+				// Hold back the removal in case the file is replaced shortly.
+				w.renamed[event.File] = time.Now().Add(WatcherRenameGrace)
+				return event, false
+			}
+		}
+
+		delete(w.renamed, event.File)
+		delete(w.known, event.File)
+		return event, true
+
+	default:
+		return event, true
+	}
+}
+
+// expireRenamed returns the Remove events for all renamed files whose grace
+// period is over. Renamed files that are not expired yet are kept.
+func (w *Watcher) expireRenamed(now time.Time) []EventProcessListModify {
+	var events []EventProcessListModify
+
+	for file, deadline := range w.renamed {
+		if now.Before(deadline) {
+			continue
+		}
+
+		delete(w.renamed, file)
+		delete(w.known, file)
+
+		event := EventProcessListModify{Op: ProcessListRemove, File: file}
+		w.updateLink(event)
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// linkTargetEvents returns the Update events for all symlinks whose target is
+// the file affected by the given fsnotify event.
+func (w *Watcher) linkTargetEvents(evt fsnotify.Event) []EventProcessListModify {
+	names := w.links[filepath.Clean(evt.Name)]
+	if len(names) == 0 || evt.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) == 0 {
+		return nil
+	}
+
+	events := make([]EventProcessListModify, len(names))
+	for i, name := range names {
+		events[i] = EventProcessListModify{Op: ProcessListUpdate, File: name}
+	}
+
+	return events
+}
+
+// updateLink updates the symlink target tracking state from the given event.
+func (w *Watcher) updateLink(event EventProcessListModify) {
+	switch event.Op {
+	case ProcessListAdd, ProcessListUpdate:
+		w.trackLink(event.File)
+	case ProcessListRemove:
+		w.untrackLink(event.File)
+	}
+}
+
+// trackLink starts watching the target of the given file if it's a symlink.
+// The target's parent directory is watched instead of the target itself, so
+// that the target being atomically replaced is still caught.
+func (w *Watcher) trackLink(name string) {
+	w.untrackLink(name)
+
+	target, err := resolveSymlink(filepath.Join(w.dir, name))
+	if err != nil || target == "" {
+		// Not a symlink, or a dangling one. The latter will be reported when
+		// the process is spawned.
+		return
+	}
+
+	targetDir := filepath.Dir(target)
+	if targetDir != w.dir && w.linkDirs[targetDir] == 0 {
+		if err := w.w.Add(targetDir); err != nil {
+			w.j.Write(&EventWarning{
+				Component: "watcher",
+				Error:     fmt.Sprintf("failed to watch symlink target of %s: %v", name, err),
+			})
+			return
+		}
+	}
+
+	w.linkDirs[targetDir]++
+	w.links[target] = append(w.links[target], name)
+	w.targets[name] = target
+}
+
+// untrackLink stops watching the target of the given symlink name, if any.
+func (w *Watcher) untrackLink(name string) {
+	target, ok := w.targets[name]
+	if !ok {
+		return
+	}
+
+	delete(w.targets, name)
+
+	names := w.links[target]
+	for i, n := range names {
+		if n == name {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+
+	if len(names) == 0 {
+		delete(w.links, target)
+	} else {
+		w.links[target] = names
+	}
+
+	targetDir := filepath.Dir(target)
+	if w.linkDirs[targetDir]--; w.linkDirs[targetDir] > 0 {
+		return
+	}
+
+	delete(w.linkDirs, targetDir)
+
+	if targetDir != w.dir {
+		w.w.Remove(targetDir)
+	}
+}
+
 // translateFsnotifyEvt translates an fsnotify event into a list of
 // EventProcessListModify events.
 func translateFsnotifyEvt(evt fsnotify.Event, dir string) EventProcessListModify {
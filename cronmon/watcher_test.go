@@ -0,0 +1,128 @@
+package cronmon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	t.Run("rename over", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "a"))
+
+		w := newTestWatcher(t, dir)
+
+		// Write to a temporary file outside of the directory, then rename it
+		// over the script.
+		tmp := filepath.Join(t.TempDir(), "a.tmp")
+		writeScript(t, tmp)
+
+		if err := os.Rename(tmp, filepath.Join(dir, "a")); err != nil {
+			t.Fatal("failed to rename:", err)
+		}
+
+		expectWatcherEvent(t, w, EventProcessListModify{Op: ProcessListUpdate, File: "a"})
+	})
+
+	t.Run("rename away and back", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "a"))
+
+		w := newTestWatcher(t, dir)
+
+		backup := filepath.Join(t.TempDir(), "a~")
+		if err := os.Rename(filepath.Join(dir, "a"), backup); err != nil {
+			t.Fatal("failed to rename:", err)
+		}
+		writeScript(t, filepath.Join(dir, "a"))
+
+		expectWatcherEvent(t, w, EventProcessListModify{Op: ProcessListUpdate, File: "a"})
+	})
+
+	t.Run("rename away", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "a"))
+
+		w := newTestWatcher(t, dir)
+
+		if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(t.TempDir(), "a")); err != nil {
+			t.Fatal("failed to rename:", err)
+		}
+
+		expectWatcherEvent(t, w, EventProcessListModify{Op: ProcessListRemove, File: "a"})
+	})
+
+	t.Run("symlink target", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(t.TempDir(), "target")
+		writeScript(t, target)
+
+		if err := os.Symlink(target, filepath.Join(dir, "a")); err != nil {
+			t.Fatal("failed to symlink:", err)
+		}
+
+		w := newTestWatcher(t, dir)
+		writeScript(t, target)
+
+		expectWatcherEvent(t, w, EventProcessListModify{Op: ProcessListUpdate, File: "a"})
+	})
+
+	t.Run("config", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, filepath.Join(dir, "a"))
+
+		w := newTestWatcher(t, dir)
+
+		// A configuration file of an unknown script is ignored.
+		writeConfig(t, ScriptConfigPath(dir, "b"), `{"stdin":"pipe"}`)
+		writeConfig(t, ScriptConfigPath(dir, "a"), `{"stdin":"pipe"}`)
+
+		expectWatcherEvent(t, w, EventProcessListModify{Op: ProcessListUpdate, File: "a"})
+	})
+}
+
+func newTestWatcher(t *testing.T, dir string) *Watcher {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	w, err := NewWatcher(ctx, dir, &mockJournal{})
+	if err != nil {
+		t.Fatal("failed to create watcher:", err)
+	}
+
+	return w
+}
+
+func writeScript(t testing.TB, path string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal("failed to write script:", err)
+	}
+}
+
+func writeConfig(t *testing.T, path, config string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal("failed to write config:", err)
+	}
+}
+
+func expectWatcherEvent(t *testing.T, w *Watcher, expect EventProcessListModify) {
+	t.Helper()
+
+	select {
+	case ev := <-w.Events:
+		if ev != expect {
+			t.Fatalf("unexpected event %#v, expected %#v", ev, expect)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for event %#v", expect)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/daemon"
+)
+
+// withFlags runs parseFlags with the given arguments on a fresh copy of the
+// command line flags, which are reset to their defaults before and after.
+func withFlags(t *testing.T, args ...string) {
+	t.Helper()
+
+	commandLine := flag.CommandLine
+	osArgs := os.Args
+
+	fs := flag.NewFlagSet("cronmon", flag.ContinueOnError)
+	commandLine.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "test.") {
+			f.Value.Set(f.DefValue)
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	journalFile, scriptsDir, socketFile = "", "", ""
+
+	reset := func() {
+		flag.CommandLine = commandLine
+		os.Args = osArgs
+
+		commandLine.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		journalFile, scriptsDir, socketFile = "", "", ""
+	}
+	t.Cleanup(reset)
+
+	flag.CommandLine = fs
+	os.Args = append([]string{"cronmon"}, args...)
+
+	parseFlags()
+}
+
+func TestParseFlagsSystem(t *testing.T) {
+	tmp := t.TempDir()
+	system := daemon.SystemDirs()
+
+	tests := []struct {
+		name    string
+		args    []string
+		journal string
+		scripts string
+		socket  string
+	}{
+		{
+			name:    "system",
+			args:    []string{"-system"},
+			journal: "/var/lib/cronmon/journal.json",
+			scripts: "/etc/cronmon/scripts",
+			socket:  "/run/cronmon/control.sock",
+		},
+		{
+			name:    "directory flags win",
+			args:    []string{"-system", "-state-dir", tmp, "-runtime-dir", tmp},
+			journal: filepath.Join(tmp, "journal.json"),
+			scripts: system.ScriptsDir(),
+			socket:  filepath.Join(tmp, "control.sock"),
+		},
+		{
+			name:    "path flags win",
+			args:    []string{"-j", "/srv/journal.json", "-system", "-s", "/srv/scripts", "-c", "/srv/control.sock"},
+			journal: "/srv/journal.json",
+			scripts: "/srv/scripts",
+			socket:  "/srv/control.sock",
+		},
+		{
+			name:    "directories without system",
+			args:    []string{"-config-dir", tmp, "-state-dir", tmp, "-runtime-dir", tmp},
+			journal: filepath.Join(tmp, "journal.json"),
+			scripts: filepath.Join(tmp, "scripts"),
+			socket:  filepath.Join(tmp, "control.sock"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFlags(t, test.args...)
+
+			if journalFile != test.journal {
+				t.Errorf("expected journal %q, got %q", test.journal, journalFile)
+			}
+			if scriptsDir != test.scripts {
+				t.Errorf("expected scripts %q, got %q", test.scripts, scriptsDir)
+			}
+			if socketFile != test.socket {
+				t.Errorf("expected socket %q, got %q", test.socket, socketFile)
+			}
+		})
+	}
+}
+
+func TestParseFlagsSystemLegacy(t *testing.T) {
+	config := t.TempDir()
+	state := t.TempDir()
+
+	legacy := filepath.Join(config, "journal.json")
+	if err := os.WriteFile(legacy, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// A per-user cronmon still uses the journal in the config directory.
+	withFlags(t, "-config-dir", config, "-state-dir", state, "status")
+	if journalFile != legacy {
+		t.Errorf("expected legacy journal %q, got %q", legacy, journalFile)
+	}
+
+	// A system cronmon never had one there.
+	withFlags(t, "-system", "-config-dir", config, "-state-dir", state, "status")
+	if expect := filepath.Join(state, "journal.json"); journalFile != expect {
+		t.Errorf("expected journal %q, got %q", expect, journalFile)
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	withFlags(t, "-config-dir", "/config")
+
+	dirs := daemon.Dirs{Config: "/config", State: "/state", Runtime: "/runtime"}
+	setDefaults(&dirs, daemon.SystemDirs())
+
+	expect := daemon.Dirs{Config: "/config", State: "/var/lib/cronmon", Runtime: "/run/cronmon"}
+	if dirs != expect {
+		t.Errorf("expected %+v, got %+v", expect, dirs)
+	}
+}
+
+func TestCronLinesSystem(t *testing.T) {
+	withFlags(t, "-system", "-users")
+
+	for _, line := range cronLines("/usr/bin/cronmon", "* * * * *") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasSuffix(line, ` -j "/var/lib/cronmon/journal.json" -s "/etc/cronmon/scripts/" -system -users`) {
+			t.Errorf("unexpected cron line %q", line)
+		}
+	}
+}
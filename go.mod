@@ -3,10 +3,11 @@ module git.unix.lgbt/diamondburned/cronmon
 go 1.16
 
 require (
-	github.com/diamondburned/backwardio v0.0.0-20210413053500-d9cf8f22162e // indirect
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/gofrs/flock v0.8.0
 	github.com/pkg/errors v0.9.1
-	golang.org/x/sys v0.0.0-20210403161142-5e06dd20ab57 // indirect
+	go.uber.org/goleak v1.0.0
+	golang.org/x/sys v0.0.0-20210403161142-5e06dd20ab57
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
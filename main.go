@@ -2,48 +2,162 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/control"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/daemon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/gitsync"
 	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
 	"github.com/pkg/errors"
 )
 
 var (
-	journalFile string
-	scriptsDir  string
+	journalFile  string
+	scriptsDir   string
+	socketFile   string
+	healthAddr   string
+	system       bool
+	users        bool
+	dashAddr     string
+	debug        bool
+	splitJournal bool
+	aggregate    bool
+	dryRun       bool
+	mirror       bool
+	stealLock    bool
+	leaseFile    string
+	quiet        bool
+	watchBinary  bool
+	dedup        bool
+	quietFlaps   bool
+	settle       time.Duration
+	restartLimit int
+	spawnLimit   int
+	pressure     string
+	fsync        string
+	journalMax   int64
+	journalKeep  int
+	errPolicy    string
+	instance     string
+	digestTo     string
+	digestAt     string
+	logFormat    string
+	pluginsDir   string
+	gitRepo      string
+	gitBranch    string
+	gitSubdir    string
+	gitInterval  time.Duration
+	gitVerify    bool
 )
 
+// flagDirs are the directories that the paths which weren't given are resolved
+// from.
+var flagDirs daemon.Dirs
+
 func init() {
-	configDir, err := os.UserConfigDir()
-	if err == nil {
-		scriptsDir = filepath.Join(configDir, "cronmon", "scripts")
-		journalFile = filepath.Join(configDir, "cronmon", "journal.json")
-	}
+	flagDirs, _ = daemon.DefaultDirs()
 
-	flag.StringVar(&journalFile, "j", journalFile, "journal file path")
-	flag.StringVar(&scriptsDir, "s", scriptsDir, "scripts directory path")
+	flag.BoolVar(&system, "system", system, "run system-wide with the directories in /etc/cronmon, /var/lib/cronmon and /run/cronmon")
+	flag.BoolVar(&users, "users", users, "also run the scripts in every /home/*/.config/cronmon/scripts as their owner, usually with -system")
+	flag.StringVar(&flagDirs.Config, "config-dir", flagDirs.Config, "directory of the scripts directory by default")
+	flag.StringVar(&flagDirs.State, "state-dir", flagDirs.State, "directory of the journal by default")
+	flag.StringVar(&flagDirs.Runtime, "runtime-dir", flagDirs.Runtime, "directory of the control socket by default")
+	flag.StringVar(&journalFile, "j", "", "journal file path (default <state-dir>/journal.json)")
+	flag.StringVar(&scriptsDir, "s", "", "scripts directory path (default <config-dir>/scripts)")
+	flag.StringVar(&socketFile, "c", "", "control socket path (default <runtime-dir>/control.sock)")
+	flag.StringVar(&healthAddr, "health-addr", healthAddr, "TCP address to serve /healthz and /readyz on, such as :8080")
+	flag.StringVar(&dashAddr, "dashboard-addr", dashAddr, "TCP address to serve the web dashboard on, such as localhost:8080; anyone who can reach it can act on the scripts")
+	flag.BoolVar(&debug, "debug", debug, "serve pprof and the debug dump on the control socket")
+	flag.BoolVar(&splitJournal, "split-journal", splitJournal, "write each script's events into journal.d/<script>.json")
+	flag.BoolVar(&aggregate, "aggregate", aggregate, "print the output of all scripts to stdout prefixed with their names")
+	flag.BoolVar(&dryRun, "n", dryRun, "only log what would be spawned without spawning anything")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "same as -n")
+	flag.BoolVar(&mirror, "mirror", mirror, "run and journal like usual, but only validate scripts and journal what would be spawned")
+	flag.BoolVar(&stealLock, "steal-lock", stealLock, "break the journal lock if its holder no longer exists")
+	flag.StringVar(&leaseFile, "lease", leaseFile, "lease file on shared storage to elect a single active host with")
+	flag.BoolVar(&watchBinary, "watch-binary", watchBinary, "restart cronmon and its scripts when its binary is upgraded")
+	flag.DurationVar(&settle, "settle", cronmon.DirSettle, "how long changes in the scripts directory must be quiet for before they're applied, or negative to apply them immediately")
+	flag.IntVar(&spawnLimit, "spawn-concurrency", cronmon.MonitorSpawnConcurrency, "scripts spawned at the same time, or negative for no limit")
+	flag.IntVar(&restartLimit, "restart-limit", cronmon.MonitorRestartLimit, "restarts per minute across all scripts above which restarts are throttled, or negative to never throttle")
+	flag.StringVar(&pressure, "defer-pressure", pressure, "defer restarts of crashed scripts while the host is over these limits, such as cpu=80,memory=20,io=50,load=2")
+	flag.BoolVar(&dedup, "dedup", dedup, "collapse runs of identical events in the journal into a single event")
+	flag.StringVar(&logFormat, "log-format", "human", "what to print the journal as: human to stderr, json to stdout, or both")
+	flag.StringVar(&instance, "instance", "", "name of this instance, which is journaled with the hostname, boot ID and cronmon version alongside every event, for aggregating the journals of several hosts")
+	flag.StringVar(&digestTo, "digest-to", "", "comma-separated http(s) URLs to post and mailto: URLs to mail a daily digest of the scripts to")
+	flag.StringVar(&digestAt, "digest-at", "00:00", "local time of day at which the digest is sent")
+	flag.StringVar(&errPolicy, "journal-policy", string(journal.ErrorAll), "when writing into the journal and its copies (stderr, stdout, plugins) fails: all, fail-fast, best-effort or quorum")
+	flag.StringVar(&fsync, "fsync", string(journal.SyncAlways), "when to sync the journal to disk: always, interval (every second) or critical (after spawns, exits and stats)")
+	flag.Int64Var(&journalMax, "journal-max-size", journalMax, "size in bytes above which the journal is rotated into a compressed segment, or 0 to never rotate it")
+	flag.IntVar(&journalKeep, "journal-keep", daemon.DefaultJournalKeep, "rotated journal segments to keep")
+	flag.StringVar(&pluginsDir, "plugins", pluginsDir, "directory of plugins to start, which may add journalers, notifiers and spawners")
+	flag.BoolVar(&quietFlaps, "quiet-flapping", quietFlaps, "don't send notifier plugins the events of flapping scripts")
+	flag.StringVar(&gitRepo, "git", gitRepo, "git repository to keep the scripts directory in sync with")
+	flag.StringVar(&gitBranch, "git-branch", gitBranch, "branch of the -git repository to sync instead of its default branch")
+	flag.StringVar(&gitSubdir, "git-subdir", gitSubdir, "directory of the scripts in the -git repository")
+	flag.DurationVar(&gitInterval, "git-interval", gitsync.DefaultInterval, "how often to fetch the -git repository")
+	flag.BoolVar(&gitVerify, "git-verify", gitVerify, "only sync commits of the -git repository with valid signatures")
+	flag.BoolVar(&quiet, "q", quiet, "do not report that cronmon is already running, such as when run from cron")
 	flag.Usage = func() {
 		f := func(f string, v ...interface{}) {
 			fmt.Fprintf(flag.CommandLine.Output(), f, v...)
 		}
 
 		f("Usage:\n")
-		f("  %s -j <journal> -s <scripts> [|cron]\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> -s <scripts> [-n]\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> -s <scripts> cron [-every <interval>] [-install|-remove] [-user <user>]\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> status\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> status -journal\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> status -groups\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> reset-stats <script>\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> start|stop|restart <script|group/>\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> kick <script>\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> stdin <script> <line>\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> wait <script>\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> health [-ready]\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> dump\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> -j <journal> top [-interval <duration>]\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> history [-json] <script>\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> sla [-json] [-window <duration>] <script>\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> digest [-json] [-period <duration>]\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> migrate -to <file:path|split:path>\n", filepath.Base(os.Args[0]))
+		f("  %s -j <journal> convert-journal [-format json|cbor] <file>\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> reconcile\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> export-state\n", filepath.Base(os.Args[0]))
+		f("  %s -c <socket> import-state [-n] <file>\n", filepath.Base(os.Args[0]))
+		f("  %s -s <scripts> logs [-prune [-all]]\n", filepath.Base(os.Args[0]))
+		f("  %s selftest [-dir <path>]\n", filepath.Base(os.Args[0]))
 		f("\n")
 		f("Flags:\n")
 		flag.PrintDefaults()
 	}
+}
+
+// parseFlags parses the flags and resolves the paths that weren't given.
+func parseFlags() {
 	flag.Parse()
 
+	if system {
+		setDefaults(&flagDirs, daemon.SystemDirs())
+	}
+
+	resolvePaths(flagDirs)
+
 	if journalFile == "" {
 		log.Fatalln("missing -j path to journal file")
 	}
@@ -58,11 +172,139 @@ func init() {
 	}
 }
 
+// setDefaults replaces the directories that weren't given as flags with the
+// given ones.
+func setDefaults(dirs *daemon.Dirs, defaults daemon.Dirs) {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	if !given["config-dir"] {
+		dirs.Config = defaults.Config
+	}
+	if !given["state-dir"] {
+		dirs.State = defaults.State
+	}
+	if !given["runtime-dir"] {
+		dirs.Runtime = defaults.Runtime
+	}
+}
+
+// resolvePaths fills in the paths that weren't given from the directories.
+// Journals and sockets that are still in the configuration directory, where
+// they used to be kept, are used until cronmon is restarted, which moves the
+// journal into the state directory.
+func resolvePaths(dirs daemon.Dirs) {
+	if dirs.Config != "" && scriptsDir == "" {
+		scriptsDir = dirs.ScriptsDir()
+	}
+
+	// legacy is true if the journal is still in the config directory, where
+	// per-user cronmons used to keep it.
+	var legacy bool
+	hasLegacy := dirs.Config != "" && !system
+
+	if dirs.State != "" && journalFile == "" {
+		journalFile = dirs.JournalFile()
+
+		if hasLegacy && flag.Arg(0) == "" {
+			moved, err := daemon.RelocateJournal(dirs.LegacyJournalFile(), journalFile)
+			if err != nil && !quiet {
+				log.Println("failed to move the journal out of the config directory, using it there:", err)
+			}
+			if moved {
+				log.Println("moved the journal from", dirs.LegacyJournalFile(), "to", journalFile)
+			}
+		}
+
+		if hasLegacy && !fileExists(journalFile) && fileExists(dirs.LegacyJournalFile()) {
+			journalFile = dirs.LegacyJournalFile()
+			legacy = true
+		}
+	}
+
+	if dirs.Runtime != "" && socketFile == "" {
+		socketFile = dirs.SocketFile()
+
+		// A cronmon that still uses the legacy journal serves its socket
+		// there as well.
+		if legacy {
+			socketFile = dirs.LegacySocketFile()
+		}
+
+		// Clients look for the socket of a cronmon that was started without
+		// a runtime directory or that still uses the legacy one.
+		if hasLegacy && flag.Arg(0) != "" && !fileExists(socketFile) && dirs.State != "" {
+			for _, path := range []string{filepath.Join(dirs.State, "control.sock"), dirs.LegacySocketFile()} {
+				if fileExists(path) {
+					socketFile = path
+					break
+				}
+			}
+		}
+
+		// Clients of a user whose scripts are run by a system cronmon with
+		// -users use the socket that it serves them.
+		if !system && flag.Arg(0) != "" && !fileExists(socketFile) {
+			if u, err := user.Current(); err == nil {
+				path := daemon.UserSocketFile(daemon.SystemDirs().SocketFile(), u.Username)
+				if fileExists(path) {
+					socketFile = path
+				}
+			}
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func main() {
+	parseFlags()
+
 	var err error
 	switch flag.Arg(0) {
 	case "cron":
-		cron()
+		err = cron(flag.Args()[1:])
+	case "status":
+		err = status(flag.Args()[1:])
+	case "reset-stats":
+		err = resetStats(flag.Arg(1))
+	case "start", "stop", "restart":
+		err = processAction(flag.Arg(0), flag.Arg(1))
+	case "kick":
+		err = kick(flag.Arg(1))
+	case "stdin":
+		err = writeStdin(flag.Arg(1), strings.Join(flag.Args()[2:], " "))
+	case "wait":
+		err = waitExit(flag.Arg(1))
+	case "health":
+		err = health(flag.Args()[1:])
+	case "dump":
+		err = dump()
+	case "top":
+		err = top(flag.Args()[1:])
+	case "history":
+		err = history(flag.Args()[1:])
+	case "sla":
+		err = sla(flag.Args()[1:])
+	case "digest":
+		err = digest(flag.Args()[1:])
+	case "migrate":
+		err = migrate(flag.Args()[1:])
+	case "convert-journal":
+		err = convertJournal(flag.Args()[1:])
+	case "reconcile":
+		err = reconcile()
+	case "export-state":
+		err = exportState()
+	case "import-state":
+		err = importState(flag.Args()[1:])
+	case "logs":
+		err = logs(flag.Args()[1:])
+	case "selftest":
+		err = selftest(flag.Args()[1:])
 	case "":
 		err = start()
 	default:
@@ -74,53 +316,943 @@ func main() {
 	}
 }
 
-func cron() {
+func cron(args []string) error {
+	fs := flag.NewFlagSet("cron", flag.ExitOnError)
+	install := fs.Bool("install", false, "install the cron lines into the crontab")
+	remove := fs.Bool("remove", false, "remove the installed cron lines from the crontab")
+	user := fs.String("user", "", "edit the crontab of this user instead, which requires root")
+	every := fs.Duration("every", time.Minute, "interval at which cron checks that cronmon is running")
+	fs.Parse(args)
+
+	schedule, err := cronSchedule(*every)
+	if err != nil {
+		return err
+	}
+
+	if !*install && !*remove {
+		for _, line := range cronLines(os.Args[0], schedule) {
+			fmt.Println(line)
+		}
+		return nil
+	}
+
+	if *install && *remove {
+		return errors.New("-install and -remove are mutually exclusive")
+	}
+
+	crontab, err := readCrontab(*user)
+	if err != nil {
+		return err
+	}
+
+	var block []string
+	if *install {
+		exe, err := os.Executable()
+		if err != nil {
+			return errors.Wrap(err, "failed to find executable")
+		}
+		block = cronLines(exe, schedule)
+	}
+
+	updated, err := replaceCronBlock(crontab, block)
+	if err != nil {
+		return err
+	}
+	if updated == crontab {
+		return nil
+	}
+
+	return writeCrontab(*user, updated)
+}
+
+const (
+	cronBlockBegin = "# BEGIN cronmon"
+	cronBlockEnd   = "# END cronmon"
+)
+
+// cronSchedule returns the cron schedule that runs every given interval. Only
+// intervals that evenly divide an hour or a day are supported.
+func cronSchedule(every time.Duration) (string, error) {
+	switch {
+	case every == time.Minute:
+		return "* * * * *", nil
+	case every%time.Minute != 0 || every <= 0:
+		return "", errors.Errorf("interval %v is not in whole minutes", every)
+	case every < time.Hour && time.Hour%every == 0:
+		return fmt.Sprintf("*/%d * * * *", every/time.Minute), nil
+	case every == time.Hour:
+		return "0 * * * *", nil
+	case every%time.Hour == 0 && 24*time.Hour%every == 0:
+		return fmt.Sprintf("0 */%d * * *", every/time.Hour), nil
+	default:
+		return "", errors.Errorf("interval %v does not evenly divide an hour or a day", every)
+	}
+}
+
+// cronLines returns the cron lines that run the cronmon executable at the given
+// path, checking that it's running on the given schedule.
+func cronLines(exe, schedule string) []string {
 	crontimes := [...]string{
 		"# Start cronmon immediately on startup.",
 		"@reboot",
-		"# Monitor cronmon's status every minute.",
-		"* * * * *",
+		"# Restart cronmon if it's not running.",
+		schedule,
 	}
 
 	j := strconv.Quote(journalFile)
 	s := strconv.Quote(scriptsDir + "/")
 
+	lines := make([]string, 0, len(crontimes))
+
 	for _, crontime := range crontimes {
 		if strings.HasPrefix(crontime, "#") {
-			fmt.Println(crontime)
+			lines = append(lines, crontime)
 			continue
 		}
 
-		fmt.Println(crontime, os.Args[0], "-j", j, "-s", s)
+		args := []string{crontime, exe, "-q", "-j", j, "-s", s}
+		if system {
+			// Keep the socket in /run/cronmon.
+			args = append(args, "-system")
+		}
+		if users {
+			args = append(args, "-users")
+		}
+
+		lines = append(lines, strings.Join(args, " "))
+	}
+
+	return lines
+}
+
+// replaceCronBlock replaces the marked cronmon block in the given crontab with
+// the given lines, or appends the block if there is none yet. The block is
+// removed if lines is nil. Everything outside of the block is kept as-is, and
+// crontabs with unmatched or repeated markers are refused rather than guessed
+// at.
+func replaceCronBlock(crontab string, lines []string) (string, error) {
+	var block strings.Builder
+	if lines != nil {
+		block.WriteString(cronBlockBegin + "\n")
+		for _, line := range lines {
+			block.WriteString(line + "\n")
+		}
+		block.WriteString(cronBlockEnd + "\n")
+	}
+
+	begin, end := -1, -1
+	offset := 0
+
+	for _, line := range strings.SplitAfter(crontab, "\n") {
+		switch strings.TrimSuffix(line, "\n") {
+		case cronBlockBegin:
+			if begin != -1 {
+				return "", errors.Errorf("crontab has more than one %q line", cronBlockBegin)
+			}
+			begin = offset
+		case cronBlockEnd:
+			if begin == -1 || end != -1 {
+				return "", errors.Errorf("crontab has a %q line without a matching %q line", cronBlockEnd, cronBlockBegin)
+			}
+			end = offset + len(line)
+		}
+		offset += len(line)
+	}
+
+	if begin != -1 && end == -1 {
+		return "", errors.Errorf("crontab has a %q line without a matching %q line", cronBlockBegin, cronBlockEnd)
+	}
+
+	if begin == -1 {
+		if block.Len() == 0 {
+			return crontab, nil
+		}
+		if crontab != "" && !strings.HasSuffix(crontab, "\n") {
+			crontab += "\n"
+		}
+		return crontab + block.String(), nil
+	}
+
+	return crontab[:begin] + block.String() + crontab[end:], nil
+}
+
+func crontabArgs(user string, args ...string) []string {
+	if user != "" {
+		return append([]string{"-u", user}, args...)
+	}
+	return args
+}
+
+// readCrontab reads the crontab of the given user, or of the current user if
+// it's empty. An empty crontab is returned if the user has none.
+func readCrontab(user string) (string, error) {
+	var stderr strings.Builder
+
+	cmd := exec.Command("crontab", crontabArgs(user, "-l")...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// crontab exits with 1 if the user has no crontab.
+		if strings.Contains(stderr.String(), "no crontab") {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to read crontab: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
+
+// writeCrontab replaces the crontab of the given user, or of the current user if
+// it's empty.
+func writeCrontab(user, crontab string) error {
+	var stderr strings.Builder
+
+	cmd := exec.Command("crontab", crontabArgs(user, "-")...)
+	cmd.Stdin = strings.NewReader(crontab)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "failed to write crontab: %s", strings.TrimSpace(stderr.String()))
 	}
+
+	return nil
 }
 
 func start() error {
-	j, err := journal.NewFileLockJournaler(journalFile)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	syncPolicy, err := journal.ParseSyncPolicy(fsync)
+	if err != nil {
+		return err
+	}
+
+	journalPolicy, err := journal.ParseErrorPolicy(errPolicy)
 	if err != nil {
-		if errors.Is(err, journal.ErrLockedElsewhere) {
-			// Non-fatal error.
-			log.Println("cronmon is already running")
+		return err
+	}
+
+	pressureLimits, err := cronmon.ParsePressureLimits(pressure)
+	if err != nil {
+		return err
+	}
+
+	if journalMax < 0 || journalKeep < 1 {
+		return errors.New("-journal-max-size must not be negative and -journal-keep must be at least 1")
+	}
+
+	cfg := daemon.Config{
+		JournalFile:   journalFile,
+		ScriptsDir:    scriptsDir,
+		SocketFile:    socketFile,
+		HealthAddr:    healthAddr,
+		DashboardAddr: dashAddr,
+		Debug:         debug,
+		SplitJournal:  splitJournal,
+		DryRun:        dryRun,
+		Mirror:        mirror,
+		StealLock:     stealLock,
+		LeaseFile:     leaseFile,
+		WatchBinary:   watchBinary,
+		Dedup:         dedup,
+		Settle:        settle,
+		RestartLimit:  restartLimit,
+		Pressure:      pressureLimits,
+		Sync:          syncPolicy,
+		PluginsDir:    pluginsDir,
+		QuietFlapping: quietFlaps,
+		Users:         users,
+
+		SpawnConcurrency: spawnLimit,
+		JournalPolicy:    journalPolicy,
+		JournalMaxSize:   journalMax,
+		JournalKeep:      journalKeep,
+	}
+
+	if instance != "" {
+		cfg.Host = journal.CurrentHost(instance)
+	}
+
+	if digestTo != "" {
+		cfg.Digest = &daemon.DigestConfig{
+			At: digestAt,
+			To: strings.Split(digestTo, ","),
+		}
+	}
+
+	if gitRepo != "" {
+		cfg.GitSync = &gitsync.Config{
+			Repository:       gitRepo,
+			Branch:           gitBranch,
+			Subdir:           gitSubdir,
+			Interval:         gitInterval,
+			VerifySignatures: gitVerify,
+		}
+	}
+
+	switch logFormat {
+	case "human":
+		cfg.Log = os.Stderr
+	case "json":
+		cfg.Stream = os.Stdout
+	case "both":
+		cfg.Log = os.Stderr
+		cfg.Stream = os.Stdout
+	default:
+		return errors.Errorf("unknown log format %q", logFormat)
+	}
+
+	if aggregate {
+		// Keep stdout machine-readable.
+		if cfg.Stream != nil {
+			return errors.New("-aggregate cannot be used with -log-format json or both")
+		}
+		cfg.Output = cronmon.NewLogMux(os.Stdout)
+	}
+
+	// Resolve the binary before it may be replaced.
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find executable")
+	}
+
+	if err := daemon.Run(ctx, cfg); err != nil {
+		if errors.Is(err, daemon.ErrBinaryChanged) {
+			// Everything has been stopped and the lock released, so the new
+			// binary can take over right away.
+			log.Println("cronmon was upgraded, restarting")
+			return syscall.Exec(exe, os.Args, os.Environ())
+		}
+
+		if errors.Is(err, daemon.ErrAlreadyRunning) {
+			// Non-fatal error. Stay quiet when run from cron, so that it
+			// doesn't mail this every interval.
+			if !quiet {
+				log.Println("cronmon is already running")
+			}
 			return nil
 		}
 
-		return errors.Wrap(err, "failed to acquire journal lock")
+		return err
 	}
-	defer j.Close()
 
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	return nil
+}
+
+func status(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fromJournal := fs.Bool("journal", false, "read the last known status from the journal instead of the control socket")
+	groups := fs.Bool("groups", false, "show the rolled up status of each group")
+	fs.Parse(args)
+
+	if *fromJournal {
+		return journalStatus()
+	}
+	if *groups {
+		return groupStatus()
+	}
+
+	statuses, err := control.NewClient(socketFile).Processes(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// Every process of a leader shares the fencing token of its term.
+	for _, status := range statuses {
+		if status.Fence != 0 {
+			fmt.Printf("fencing token: %d\n\n", status.Fence)
+			break
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "SCRIPT\tSTATE\tPID\tRESTARTS\tFLAP/H\tWAITING FOR\tRESTART IN\tNOTE")
+	for _, status := range statuses {
+		pid := "-"
+		if status.PID != 0 {
+			pid = strconv.Itoa(status.PID)
+		}
+
+		flap := strconv.FormatFloat(status.FlapScore, 'f', 2, 64)
+		if status.Flapping {
+			flap += " (flapping)"
+		}
+
+		var note string
+		switch {
+		case status.Stopped:
+			note = "stopped"
+		case status.SpawnFailing != "":
+			note = "spawn failing: " + status.SpawnFailing
+			if status.SpawnHint != "" {
+				note += " (" + status.SpawnHint + ")"
+			}
+		case status.RestartNeeded:
+			note = "restart needed"
+		}
+
+		var restartIn string
+		if status.NextRestart != nil {
+			restartIn = time.Until(*status.NextRestart).Round(time.Second).String()
+			restartIn += " of " + status.Backoff.String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			status.File, orDash(status.State != "", string(status.State)), pid, status.Restarts, flap,
+			orDash(status.Waiting != "", status.Waiting),
+			orDash(restartIn != "", restartIn),
+			orDash(note != "", note),
+		)
+	}
+
+	return nil
+}
+
+// openJournalReadOnly opens the journal for reading only, along with the
+// journals of each script if the journal is split.
+func openJournalReadOnly() (control.JournalReadCloser, error) {
+	if splitJournal {
+		return journal.OpenSplitReadOnly(journalFile, daemon.SplitJournalDir(journalFile))
+	}
+	return journal.OpenReadOnly(journalFile)
+}
+
+// journalStatus prints the last known status of each script from the journal.
+// It only needs read access to the journal, so it works for other users and
+// when the control socket is unavailable.
+func journalStatus() error {
+	r, err := openJournalReadOnly()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	state, err := cronmon.ReadPreviousState(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to read journal")
+	}
+
+	files := make([]string, 0, len(state.Restarts))
+	for file := range state.Restarts {
+		files = append(files, file)
+	}
+	for file := range state.Processes {
+		if _, ok := state.Restarts[file]; !ok {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "SCRIPT\tPID\tRESTARTS\tFLAP/H")
+	for _, file := range files {
+		pid := state.Processes[file]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n",
+			file,
+			orDash(pid != 0, strconv.Itoa(pid)),
+			state.Restarts[file],
+			strconv.FormatFloat(state.Flapping[file], 'f', 2, 64),
+		)
+	}
+
+	return nil
+}
+
+func groupStatus() error {
+	statuses, err := control.NewClient(socketFile).Groups(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "GROUP\tSCRIPTS\tRUNNING\tWAITING\tSTOPPED\tFLAPPING\tRESTARTS")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s/\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			status.Group, len(status.Scripts), status.Running, status.Waiting,
+			status.Stopped, status.Flapping, status.Restarts)
+	}
+
+	return nil
+}
+
+// processAction does the given action on a script, or on a group if the target
+// ends with a slash.
+func processAction(action, target string) error {
+	if target == "" {
+		return errors.New("missing script or group name")
+	}
+
+	client := control.NewClient(socketFile)
+	ctx := context.Background()
+
+	if group := strings.TrimSuffix(target, "/"); group != target {
+		return client.GroupAction(ctx, group, action)
+	}
+
+	switch action {
+	case "start":
+		return client.StartProcess(ctx, target)
+	case "stop":
+		return client.StopProcess(ctx, target)
+	default:
+		return client.RestartProcess(ctx, target)
+	}
+}
+
+func resetStats(script string) error {
+	if script == "" {
+		return errors.New("missing script name")
+	}
+
+	return control.NewClient(socketFile).ResetStats(context.Background(), script)
+}
+
+func kick(script string) error {
+	if script == "" {
+		return errors.New("missing script name")
+	}
+
+	return control.NewClient(socketFile).KickProcess(context.Background(), script)
+}
+
+func writeStdin(script, line string) error {
+	if script == "" {
+		return errors.New("missing script name")
+	}
+
+	return control.NewClient(socketFile).WriteStdin(context.Background(), script, line)
+}
+
+func waitExit(script string) error {
+	if script == "" {
+		return errors.New("missing script name")
+	}
+
+	ev, err := control.NewClient(socketFile).WaitExit(context.Background(), script)
+	if err != nil {
+		return err
+	}
+
+	if ev.Error != "" {
+		log.Println("process exited with error:", ev.Error)
+	}
+
+	if !ev.IsGraceful() {
+		// The process was killed by a signal, which has no exit code.
+		log.Println("process was terminated")
+		os.Exit(1)
+	}
+
+	os.Exit(ev.ExitCode)
+	return nil
+}
+
+// health prints the health of the running cronmon and fails if it's unhealthy,
+// or not ready if ready is true, such as for a container health check.
+func health(args []string) error {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	ready := fs.Bool("ready", false, "also fail if cronmon isn't ready, such as when it's not watching the scripts directory")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*control.HealthTimeout)
 	defer cancel()
 
-	// Beware: changing the combination of these writers will break existing
-	// status directories.
-	journaler := journal.MultiWriter(j, journal.NewHumanWriter("stderr", os.Stderr))
+	h, err := control.NewClient(socketFile).Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("responsive:", h.Responsive)
+	fmt.Println("watching:  ", h.Watching)
+	if h.JournalError != "" {
+		fmt.Println("journal:   ", h.JournalError)
+	}
+
+	switch {
+	case !h.Healthy():
+		return errors.New("cronmon is unhealthy")
+	case *ready && !h.Ready():
+		return errors.New("cronmon is not ready")
+	}
+
+	return nil
+}
+
+// dump prints the debugging dump of the running cronmon, which must have been
+// started with -debug.
+func dump() error {
+	return control.NewClient(socketFile).Dump(context.Background(), os.Stdout)
+}
+
+// migrate replays the journal into a new journal backend, keeping the times
+// and order of all events.
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.String("to", "", "backend to migrate into, either file:<path> or split:<path>")
+	fs.Parse(args)
+
+	if *to == "" {
+		return errors.New("missing -to backend")
+	}
+
+	scheme, path := "file", *to
+	if parts := strings.SplitN(*to, ":", 2); len(parts) == 2 {
+		scheme, path = parts[0], parts[1]
+	}
+
+	if path == "" {
+		return errors.New("missing path in -to backend")
+	}
+
+	// Never mix the migrated history into an existing journal.
+	if s, err := os.Stat(path); err == nil && s.Size() > 0 {
+		return errors.Errorf("%s already exists and is not empty", path)
+	}
+
+	var w cronmon.Journaler
+
+	switch scheme {
+	case "file", "split":
+		j, err := journal.NewFileLockJournaler(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to open destination")
+		}
+		defer j.Close()
+		w = j
+
+		if scheme == "split" {
+			split, err := journal.NewSplitJournaler(j, daemon.SplitJournalDir(path))
+			if err != nil {
+				return errors.Wrap(err, "failed to open split destination")
+			}
+			defer split.Close()
+			split.Format = j.Format()
+			w = split
+		}
+	default:
+		return errors.Errorf("unsupported backend %q", scheme)
+	}
+
+	r, err := openJournalReadOnly()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-	m, err := cronmon.NewMonitor(ctx, scriptsDir, journaler)
+	n, err := journal.Migrate(context.Background(), r, w)
 	if err != nil {
-		return errors.Wrap(err, "failed to create monitor")
+		return errors.Wrapf(err, "migrated %d events before failing", n)
 	}
-	defer m.Stop()
 
-	<-ctx.Done()
+	log.Printf("migrated %d events into %s\n", n, w.ID())
 	return nil
 }
+
+// convertJournal converts the journal into a new journal file in another format,
+// keeping the times and order of all events.
+func convertJournal(args []string) error {
+	fs := flag.NewFlagSet("convert-journal", flag.ExitOnError)
+	formatName := fs.String("format", "", "format to convert into, either json or cbor (default: cbor if the file name ends with .cbor, json otherwise)")
+	fs.Parse(args)
+
+	dst := fs.Arg(0)
+	if dst == "" {
+		return errors.New("missing destination file")
+	}
+
+	format := journal.FormatForPath(dst)
+	if *formatName != "" {
+		f, err := journal.ParseFormat(*formatName)
+		if err != nil {
+			return err
+		}
+		format = f
+	}
+
+	r, err := journal.OpenReadOnly(journalFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Never mix the converted history into an existing journal.
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create destination")
+	}
+
+	n, err := journal.Migrate(context.Background(), r, journal.NewFormatWriter("file:"+dst, f, format))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+
+	if err != nil {
+		os.Remove(dst)
+		return errors.Wrapf(err, "failed after converting %d events", n)
+	}
+
+	log.Printf("converted %d events into %s as %s\n", n, dst, format)
+	return nil
+}
+
+func reconcile() error {
+	ev, err := control.NewClient(socketFile).Reconcile(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(ev.Added)+len(ev.Updated)+len(ev.Removed) == 0 {
+		fmt.Println("nothing to reconcile")
+		return nil
+	}
+
+	for _, change := range []struct {
+		verb  string
+		files []string
+	}{
+		{"started", ev.Added},
+		{"restarted", ev.Updated},
+		{"stopped", ev.Removed},
+	} {
+		for _, file := range change.files {
+			fmt.Println(change.verb, file)
+		}
+	}
+
+	return nil
+}
+
+func exportState() error {
+	snap, err := control.NewClient(socketFile).ExportState(context.Background())
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+func importState(args []string) error {
+	fs := flag.NewFlagSet("import-state", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "only validate the snapshot against the live system")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var snap cronmon.StateSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return errors.Wrap(err, "failed to decode snapshot")
+	}
+
+	report, err := control.NewClient(socketFile).ImportState(context.Background(), &snap, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "SCRIPT\tRESULT\tPROBLEMS")
+	for _, script := range report.Scripts {
+		result := "skipped"
+		switch {
+		case script.OK && report.Imported:
+			result = "imported"
+		case script.OK:
+			result = "ok"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n",
+			script.File, result, orDash(len(script.Problems) > 0, strings.Join(script.Problems, "; ")))
+	}
+
+	return nil
+}
+
+func history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the history as JSON")
+	fs.Parse(args)
+
+	script := fs.Arg(0)
+	if script == "" {
+		return errors.New("missing script name")
+	}
+
+	path := journalFile
+	if splitJournal {
+		path = journal.SplitJournalPath(daemon.SplitJournalDir(journalFile), script)
+	}
+
+	r, err := journal.OpenReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	entries, err := cronmon.ReadHistory(context.Background(), r, script)
+	if err != nil {
+		return errors.Wrap(err, "failed to read history")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "TIME\tEVENT\tPID\tEXIT\tDURATION\tGAP\tERROR")
+	for _, entry := range entries {
+		exit := "-"
+		if entry.ExitCode != nil {
+			exit = strconv.Itoa(*entry.ExitCode)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Time.Local().Format(time.RFC3339),
+			entry.Type,
+			orDash(entry.PID != 0, strconv.Itoa(entry.PID)),
+			exit,
+			orDash(entry.Duration > 0, entry.Duration.Round(time.Millisecond).String()),
+			orDash(entry.Gap > 0, entry.Gap.Round(time.Millisecond).String()),
+			entry.Error,
+		)
+	}
+
+	return nil
+}
+
+func sla(args []string) error {
+	fs := flag.NewFlagSet("sla", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the uptime as JSON")
+	window := fs.Duration("window", cronmon.UptimeWindow, "how far back the uptime is computed over")
+	fs.Parse(args)
+
+	script := fs.Arg(0)
+	if script == "" {
+		return errors.New("missing script name")
+	}
+
+	path := journalFile
+	if splitJournal {
+		path = journal.SplitJournalPath(daemon.SplitJournalDir(journalFile), script)
+	}
+
+	r, err := journal.OpenReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	u, err := cronmon.ComputeUptime(r, script, *window)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute uptime")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(u)
+	}
+
+	fmt.Printf("%s was up %.3f%% of the last %s (up %s, down %s)\n\n",
+		script, u.Availability, *window,
+		u.Uptime.Round(time.Second), u.Downtime.Round(time.Second))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "DOWN SINCE\tUNTIL\tDURATION\tREASON")
+	for _, down := range u.Downtimes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			down.Start.Local().Format(time.RFC3339),
+			down.End.Local().Format(time.RFC3339),
+			down.Duration().Round(time.Second),
+			down.Reason,
+		)
+	}
+
+	return nil
+}
+
+func digest(args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the digest as JSON")
+	period := fs.Duration("period", cronmon.DigestPeriod, "how far back the digest goes")
+	fs.Parse(args)
+
+	until := time.Now()
+
+	d, err := daemon.ReadDigest(context.Background(), daemon.Config{
+		JournalFile:  journalFile,
+		SplitJournal: splitJournal,
+	}, until.Add(-*period), until)
+	if err != nil {
+		return errors.Wrap(err, "failed to read digest")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+
+	return d.WriteText(os.Stdout)
+}
+
+func logs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	prune := fs.Bool("prune", false, "remove rotated logs beyond each script's log_max_files")
+	all := fs.Bool("all", false, "with -prune, remove all rotated logs")
+	fs.Parse(args)
+
+	if *prune {
+		removed, err := cronmon.PruneLogs(scriptsDir, *all)
+		for _, path := range removed {
+			fmt.Println("removed", path)
+		}
+		return err
+	}
+
+	logs, err := cronmon.ListLogs(scriptsDir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "SCRIPT\tLOG\tROTATED\tSIZE")
+	for _, log := range logs {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", log.File, log.Path, len(log.Rotated), log.Size)
+	}
+
+	return nil
+}
+
+func orDash(ok bool, s string) string {
+	if !ok {
+		return "-"
+	}
+	return s
+}
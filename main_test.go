@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplaceCronBlock(t *testing.T) {
+	block := []string{"@reboot cronmon", "* * * * * cronmon"}
+
+	tests := []struct {
+		name    string
+		crontab string
+		lines   []string
+		expect  string
+		err     bool
+	}{
+		{
+			name:   "install into empty",
+			lines:  block,
+			expect: "# BEGIN cronmon\n@reboot cronmon\n* * * * * cronmon\n# END cronmon\n",
+		},
+		{
+			name:    "install after existing lines",
+			crontab: "\n\nMAILTO=\"\"\n0 * * * * backup",
+			lines:   block,
+			expect:  "\n\nMAILTO=\"\"\n0 * * * * backup\n# BEGIN cronmon\n@reboot cronmon\n* * * * * cronmon\n# END cronmon\n",
+		},
+		{
+			name:    "replace in place",
+			crontab: "\n# jobs\n# BEGIN cronmon\n@reboot old\n# END cronmon\n\n0 * * * * backup\n",
+			lines:   block,
+			expect:  "\n# jobs\n# BEGIN cronmon\n@reboot cronmon\n* * * * * cronmon\n# END cronmon\n\n0 * * * * backup\n",
+		},
+		{
+			name:    "remove",
+			crontab: "\n# jobs\n# BEGIN cronmon\n@reboot old\n# END cronmon\n\n0 * * * * backup\n",
+			expect:  "\n# jobs\n\n0 * * * * backup\n",
+		},
+		{
+			name:    "remove without block",
+			crontab: "\n0 * * * * backup",
+			expect:  "\n0 * * * * backup",
+		},
+		{
+			name:    "begin without end",
+			crontab: "# BEGIN cronmon\n@reboot old\n0 * * * * backup\n",
+			lines:   block,
+			err:     true,
+		},
+		{
+			name:    "remove begin without end",
+			crontab: "# BEGIN cronmon\n@reboot old\n0 * * * * backup\n",
+			err:     true,
+		},
+		{
+			name:    "end without begin",
+			crontab: "0 * * * * backup\n# END cronmon\n",
+			lines:   block,
+			err:     true,
+		},
+		{
+			name:    "two blocks",
+			crontab: "# BEGIN cronmon\n# END cronmon\n# BEGIN cronmon\n# END cronmon\n",
+			lines:   block,
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := replaceCronBlock(test.crontab, test.lines)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got crontab %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if got != test.expect {
+				t.Errorf("expected crontab %q, got %q", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	tests := []struct {
+		every  time.Duration
+		expect string
+	}{
+		{time.Minute, "* * * * *"},
+		{5 * time.Minute, "*/5 * * * *"},
+		{30 * time.Minute, "*/30 * * * *"},
+		{time.Hour, "0 * * * *"},
+		{6 * time.Hour, "0 */6 * * *"},
+		{90 * time.Second, ""},
+		{7 * time.Minute, ""},
+		{5 * time.Hour, ""},
+		{0, ""},
+		{-time.Minute, ""},
+	}
+
+	for _, test := range tests {
+		schedule, err := cronSchedule(test.every)
+		if test.expect == "" {
+			if err == nil {
+				t.Errorf("%v: expected error, got schedule %q", test.every, schedule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.every, err)
+			continue
+		}
+		if schedule != test.expect {
+			t.Errorf("%v: expected schedule %q, got %q", test.every, test.expect, schedule)
+		}
+	}
+}
+
+func TestCronLines(t *testing.T) {
+	withFlags(t, "-j", "/srv/journal.json", "-s", "/srv/scripts")
+
+	expect := []string{
+		"# Start cronmon immediately on startup.",
+		`@reboot /usr/bin/cronmon -q -j "/srv/journal.json" -s "/srv/scripts/"`,
+		"# Restart cronmon if it's not running.",
+		`*/5 * * * * /usr/bin/cronmon -q -j "/srv/journal.json" -s "/srv/scripts/"`,
+	}
+
+	lines := cronLines("/usr/bin/cronmon", "*/5 * * * *")
+	if len(lines) != len(expect) {
+		t.Fatalf("expected %d lines, got %q", len(expect), lines)
+	}
+	for i := range expect {
+		if lines[i] != expect[i] {
+			t.Errorf("line %d:\nexpected %q\ngot      %q", i, expect[i], lines[i])
+		}
+	}
+}
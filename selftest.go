@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"github.com/pkg/errors"
+)
+
+// selftestTimeout is the time that each self-test check has to pass.
+const selftestTimeout = 5 * time.Second
+
+// selftestScripts are the synthetic scripts that the self-test runs.
+var selftestScripts = map[string]string{
+	// long keeps running and leaves behind a disowned child, which must be
+	// reparented to cronmon.
+	"long": "(sleep 60 & echo $! > \"$(dirname \"$0\")/orphan.pid\")\nexec sleep 60\n",
+	// fast exits successfully right away.
+	"fast": "exit 0\n",
+	// crash exits with an error right away.
+	"crash": "exit 3\n",
+	// hang ignores SIGTERM, so it must be killed.
+	"hang": "trap '' TERM\nexec sleep 60\n",
+}
+
+// selftestCheck is the result of a single self-test check.
+type selftestCheck struct {
+	name   string
+	err    error
+	detail string
+}
+
+// selftest runs a monitor against synthetic scripts in a temporary directory to
+// catch problems with the environment, such as missing permissions or noexec
+// mounts, before they bite real scripts.
+func selftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to create the temporary scripts directory in, such as next to the real one")
+	fs.Parse(args)
+
+	tmp, err := os.MkdirTemp(*dir, "cronmon-selftest-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	// Make the checks fast. This only affects this cronmon process.
+	cronmon.ProcessRetryBackoff = []time.Duration{0, 100 * time.Millisecond}
+	cronmon.ProcessWaitTimeout = 500 * time.Millisecond
+	cronmon.DirSettle = -1
+
+	checks := runSelftest(tmp)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+
+	var failed int
+	for _, check := range checks {
+		result := "pass"
+		detail := check.detail
+		if check.err != nil {
+			result = "FAIL"
+			detail = check.err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.name, result, orDash(detail != "", detail))
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+func runSelftest(tmp string) []selftestCheck {
+	var checks []selftestCheck
+	check := func(name string, fn func() (string, error)) bool {
+		detail, err := fn()
+		checks = append(checks, selftestCheck{name, err, detail})
+		return err == nil
+	}
+
+	scripts := filepath.Join(tmp, "scripts")
+	var j *journal.FileLockJournaler
+
+	ok := check("journal", func() (string, error) {
+		var err error
+		j, err = journal.NewFileLockJournaler(filepath.Join(tmp, "journal.json"))
+		if err != nil {
+			return "", err
+		}
+		return "created and locked " + j.ID(), nil
+	})
+	if !ok {
+		return checks
+	}
+	defer j.Close()
+
+	ok = check("scripts", func() (string, error) {
+		if err := os.Mkdir(scripts, 0750); err != nil {
+			return "", err
+		}
+		for name, body := range selftestScripts {
+			path := filepath.Join(scripts, name)
+			if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0750); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("wrote %d scripts into %s", len(selftestScripts), scripts), nil
+	})
+	if !ok {
+		return checks
+	}
+
+	events := &selftestJournal{}
+
+	m, err := cronmon.NewMonitor(context.Background(), scripts, journal.MultiWriter(j, events))
+	if err != nil {
+		checks = append(checks, selftestCheck{name: "monitor", err: err})
+		return checks
+	}
+	defer m.Stop()
+
+	ok = check("spawn", func() (string, error) {
+		ev, err := events.wait(func(ev cronmon.Event) bool {
+			switch ev := ev.(type) {
+			case *cronmon.EventProcessSpawned:
+				return ev.File == "long"
+			case *cronmon.EventProcessSpawnError:
+				return ev.File == "long"
+			}
+			return false
+		})
+		if err != nil {
+			return "", err
+		}
+		if ev, ok := ev.(*cronmon.EventProcessSpawnError); ok {
+			return "", spawnErrorHint(ev.Reason)
+		}
+		return fmt.Sprintf("spawned PID %d", ev.(*cronmon.EventProcessSpawned).PID), nil
+	})
+	if !ok {
+		return checks
+	}
+
+	check("subreaper", func() (string, error) {
+		pidFile := filepath.Join(scripts, "orphan.pid")
+
+		var pid int
+		deadline := time.Now().Add(selftestTimeout)
+		for pid == 0 {
+			b, _ := os.ReadFile(pidFile)
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+			if pid == 0 && time.Now().After(deadline) {
+				return "", errors.New("timed out waiting for the disowned child")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		defer syscall.Kill(pid, syscall.SIGKILL)
+
+		// Give the kernel a moment to reparent the child.
+		time.Sleep(100 * time.Millisecond)
+
+		ppid, err := parentPID(pid)
+		if err != nil {
+			return "", err
+		}
+		if ppid != os.Getpid() {
+			return "", errors.Errorf("disowned child was reparented to PID %d instead of cronmon", ppid)
+		}
+		return "disowned children are reparented to cronmon", nil
+	})
+
+	check("restart", func() (string, error) {
+		if err := events.waitSpawns("fast", 2); err != nil {
+			return "", err
+		}
+		return "exited script was restarted", nil
+	})
+
+	check("backoff", func() (string, error) {
+		_, err := events.wait(func(ev cronmon.Event) bool {
+			exited, ok := ev.(*cronmon.EventProcessExited)
+			return ok && exited.File == "crash" && exited.ExitCode == 3
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := events.waitSpawns("crash", 2); err != nil {
+			return "", err
+		}
+		return "crashed script was restarted after a backoff", nil
+	})
+
+	check("stop", func() (string, error) {
+		took, err := stopSelftest(m, events, "long")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("stopped in %v", took), nil
+	})
+
+	check("kill", func() (string, error) {
+		took, err := stopSelftest(m, events, "hang")
+		if err == nil {
+			return "", errors.New("process ignoring SIGTERM exited without being killed")
+		}
+		if took >= selftestTimeout {
+			return "", err
+		}
+		return fmt.Sprintf("killed after ignoring SIGTERM for %v", took), nil
+	})
+
+	return checks
+}
+
+// stopSelftest stops the given script and returns how long stopping it took.
+// If stopping it hangs, then the self-test timeout is returned.
+func stopSelftest(m *cronmon.Monitor, events *selftestJournal, file string) (time.Duration, error) {
+	if err := events.waitSpawns(file, 1); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() { done <- m.StopProcess(file) }()
+
+	select {
+	case err := <-done:
+		return time.Since(start).Round(time.Millisecond), err
+	case <-time.After(selftestTimeout):
+		return selftestTimeout, errors.New("timed out stopping the process")
+	}
+}
+
+// spawnErrorHint returns the spawn error with a hint of its likely cause.
+func spawnErrorHint(reason string) error {
+	switch {
+	case strings.Contains(reason, "permission denied"):
+		return errors.Errorf("%s (is the directory mounted noexec?)", reason)
+	case strings.Contains(reason, "subreaper"):
+		return errors.Errorf("%s (is prctl allowed, such as by seccomp?)", reason)
+	default:
+		return errors.New(reason)
+	}
+}
+
+// parentPID returns the parent PID of the given process.
+func parentPID(pid int) (int, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read process status")
+	}
+
+	// The command name may contain spaces, so skip past its closing paren.
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 2 {
+		return 0, errors.New("malformed process status")
+	}
+
+	return strconv.Atoi(fields[1])
+}
+
+// selftestJournal keeps all journaled events so that the self-test can wait
+// for them.
+type selftestJournal struct {
+	mutex  sync.Mutex
+	events []cronmon.Event
+}
+
+func (j *selftestJournal) ID() string { return "selftest" }
+
+func (j *selftestJournal) Write(ev cronmon.Event) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.events = append(j.events, ev)
+	return nil
+}
+
+// wait waits for the first event matching fn.
+func (j *selftestJournal) wait(fn func(cronmon.Event) bool) (cronmon.Event, error) {
+	var found cronmon.Event
+
+	err := j.until(func(events []cronmon.Event) bool {
+		for _, ev := range events {
+			if fn(ev) {
+				found = ev
+				return true
+			}
+		}
+		return false
+	})
+
+	return found, err
+}
+
+// waitSpawns waits until the given script has been spawned n times.
+func (j *selftestJournal) waitSpawns(file string, n int) error {
+	err := j.until(func(events []cronmon.Event) bool {
+		var spawns int
+		for _, ev := range events {
+			if ev, ok := ev.(*cronmon.EventProcessSpawned); ok && ev.File == file {
+				spawns++
+			}
+		}
+		return spawns >= n
+	})
+	if err != nil {
+		return errors.Wrapf(err, "%s was not spawned %d times", file, n)
+	}
+
+	return nil
+}
+
+// until polls the journaled events until fn returns true or the self-test
+// times out.
+func (j *selftestJournal) until(fn func([]cronmon.Event) bool) error {
+	deadline := time.Now().Add(selftestTimeout)
+
+	for time.Now().Before(deadline) {
+		j.mutex.Lock()
+		done := fn(j.events)
+		j.mutex.Unlock()
+
+		if done {
+			return nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return errors.New("timed out waiting for the expected events")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+func TestSelftest(t *testing.T) {
+	defer func(backoff []time.Duration, timeout, settle time.Duration) {
+		cronmon.ProcessRetryBackoff = backoff
+		cronmon.ProcessWaitTimeout = timeout
+		cronmon.DirSettle = settle
+	}(cronmon.ProcessRetryBackoff, cronmon.ProcessWaitTimeout, cronmon.DirSettle)
+
+	cronmon.ProcessRetryBackoff = []time.Duration{0, 100 * time.Millisecond}
+	cronmon.ProcessWaitTimeout = 500 * time.Millisecond
+	cronmon.DirSettle = -1
+
+	checks := runSelftest(t.TempDir())
+
+	names := make([]string, len(checks))
+	for i, check := range checks {
+		names[i] = check.name
+		if check.err != nil {
+			t.Errorf("check %s failed: %v", check.name, check.err)
+		}
+	}
+
+	expect := "journal scripts spawn subreaper restart backoff stop kill"
+	if got := strings.Join(names, " "); got != expect {
+		t.Errorf("expected checks %q, got %q", expect, got)
+	}
+}
+
+func TestSpawnErrorHint(t *testing.T) {
+	tests := map[string]string{
+		"fork/exec scripts/a: permission denied": "noexec",
+		"failed to become subreaper":             "prctl",
+		"no such file or directory":              "",
+	}
+
+	for reason, hint := range tests {
+		err := spawnErrorHint(reason).Error()
+		if !strings.HasPrefix(err, reason) {
+			t.Errorf("%q: hint %q lost the reason", reason, err)
+		}
+		if hint != "" && !strings.Contains(err, hint) {
+			t.Errorf("%q: expected a hint about %s, got %q", reason, hint, err)
+		}
+		if hint == "" && err != reason {
+			t.Errorf("%q: unexpected hint %q", reason, err)
+		}
+	}
+}
+
+func TestParentPID(t *testing.T) {
+	ppid, err := parentPID(os.Getpid())
+	if err != nil {
+		t.Fatal("failed to get parent PID:", err)
+	}
+	if ppid != os.Getppid() {
+		t.Errorf("expected parent PID %d, got %d", os.Getppid(), ppid)
+	}
+}
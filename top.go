@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/control"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/daemon"
+	"git.unix.lgbt/diamondburned/cronmon/cronmon/journal"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// topFeedSize is the number of events that top keeps in its event feed.
+const topFeedSize = 200
+
+// topClockTicks is the number of clock ticks per second that CPU times are
+// counted in by /proc, which is 100 on practically every Linux system.
+const topClockTicks = 100
+
+// top shows a live view of the processes and the journal of a running cronmon
+// until q is pressed.
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "how often to refresh")
+	fs.Parse(args)
+
+	fd := int(os.Stdin.Fd())
+
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return errors.New("top needs a terminal")
+	}
+
+	raw := *old
+	// Keep ^C from killing top before it restores the terminal; it quits
+	// like q instead.
+	raw.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return errors.Wrap(err, "failed to set up terminal")
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, old)
+
+	// Switch to the alternate screen and hide the cursor, then undo both.
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	defer os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+
+	t := topView{
+		client:  control.NewClient(socketFile),
+		sampler: procSampler{last: map[int]procSample{}},
+		seen:    map[string]time.Time{},
+	}
+
+	keys := make(chan byte)
+	go func() {
+		var b [1]byte
+		for {
+			if _, err := os.Stdin.Read(b[:]); err != nil {
+				close(keys)
+				return
+			}
+			keys <- b[0]
+		}
+	}()
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	t.refresh()
+	t.draw()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.refresh()
+		case <-resized:
+		case key, ok := <-keys:
+			if !ok || !t.key(key) {
+				return nil
+			}
+		}
+
+		t.draw()
+	}
+}
+
+// topView is the state of top.
+type topView struct {
+	client  *control.Client
+	sampler procSampler
+
+	statuses []cronmon.ProcessStatus
+	usage    map[int]procUsage
+	selected int
+	scroll   int
+	err      error
+	message  string
+
+	feed []topEvent
+	seen map[string]time.Time // the newest event read from each journal
+	esc  []byte               // a partial escape sequence
+}
+
+// topEvent is an event in the feed.
+type topEvent struct {
+	t  time.Time
+	ev cronmon.Event
+}
+
+// key handles a key press. It returns false if top should quit.
+func (t *topView) key(key byte) bool {
+	// Arrow keys are sent as "ESC [ A" and so on.
+	if key == 0x1b || len(t.esc) > 0 {
+		t.esc = append(t.esc, key)
+		if len(t.esc) < 3 {
+			return true
+		}
+
+		switch string(t.esc) {
+		case "\x1b[A":
+			key = 'k'
+		case "\x1b[B":
+			key = 'j'
+		}
+		t.esc = t.esc[:0]
+	}
+
+	switch key {
+	case 'q', 3: // ^C
+		return false
+	case 'k':
+		t.selected--
+	case 'j':
+		t.selected++
+	case 'r':
+		t.act("restart", "restarted", t.client.RestartProcess)
+	case 's':
+		t.act("stop", "stopped", t.client.StopProcess)
+	case 't':
+		t.act("start", "started", t.client.StartProcess)
+	}
+
+	t.clamp()
+	return true
+}
+
+// clamp keeps the selection within the processes.
+func (t *topView) clamp() {
+	if t.selected >= len(t.statuses) {
+		t.selected = len(t.statuses) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+}
+
+// act runs the given action on the selected script and refreshes.
+func (t *topView) act(name, done string, fn func(context.Context, string) error) {
+	if t.selected >= len(t.statuses) {
+		return
+	}
+
+	file := t.statuses[t.selected].File
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := fn(ctx, file); err != nil {
+		t.message = fmt.Sprintf("failed to %s %s: %v", name, file, err)
+	} else {
+		t.message = done + " " + file
+	}
+
+	t.refresh()
+}
+
+// refresh fetches the statuses and reads the new events.
+func (t *topView) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	statuses, err := t.client.Processes(ctx)
+	t.err = err
+	if err == nil {
+		t.statuses = statuses
+		t.clamp()
+	}
+
+	pids := make([]int, 0, len(t.statuses))
+	for _, status := range t.statuses {
+		if status.PID != 0 {
+			pids = append(pids, status.PID)
+		}
+	}
+	t.usage = t.sampler.sample(pids)
+
+	// The events of the processes aren't in the main journal if it's split,
+	// so read the journal of the selected script as well.
+	paths := []string{journalFile}
+	if splitJournal && t.selected < len(t.statuses) {
+		dir := daemon.SplitJournalDir(journalFile)
+		paths = append(paths, journal.SplitJournalPath(dir, t.statuses[t.selected].File))
+	}
+
+	for _, path := range paths {
+		t.readFeed(path)
+	}
+}
+
+// readFeed adds the events of the journal at the given path that are newer
+// than the newest one read from it before to the feed.
+func (t *topView) readFeed(path string) {
+	r, err := journal.OpenReadOnly(path)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	seen := t.seen[path]
+	var events []topEvent
+
+	cronmon.ReadJournal(context.Background(), r, func(ev cronmon.Event, at time.Time) error {
+		if !at.After(seen) || len(events) == topFeedSize {
+			return cronmon.ErrStopReading
+		}
+		events = append(events, topEvent{at, ev})
+		return nil
+	})
+
+	if len(events) == 0 {
+		return
+	}
+
+	t.seen[path] = events[0].t
+	t.addFeed(events)
+}
+
+// addFeed merges the events into the feed, which is kept in chronological
+// order and to the newest topFeedSize events.
+func (t *topView) addFeed(events []topEvent) {
+	t.feed = append(t.feed, events...)
+
+	sort.SliceStable(t.feed, func(i, j int) bool { return t.feed[i].t.Before(t.feed[j].t) })
+	if len(t.feed) > topFeedSize {
+		t.feed = t.feed[len(t.feed)-topFeedSize:]
+	}
+}
+
+// draw redraws the whole screen.
+func (t *topView) draw() {
+	width, height := 80, 24
+	if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil {
+		width, height = int(ws.Col), int(ws.Row)
+	}
+
+	os.Stdout.Write(t.render(width, height, time.Now()))
+}
+
+// render renders the whole screen of the given size at the given time.
+func (t *topView) render(width, height int, now time.Time) []byte {
+	var running int
+	for _, status := range t.statuses {
+		if status.PID != 0 {
+			running++
+		}
+	}
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("cronmon top - %d scripts, %d running - %s",
+		len(t.statuses), running, now.Format("15:04:05")))
+
+	// Give the processes two thirds of the screen without the title, the two
+	// headers and the footer, and the feed the rest.
+	rows := (height - 4) * 2 / 3
+	feed := height - 4 - rows
+	if rows < 1 {
+		rows = 1
+	}
+
+	table := t.table()
+	lines = append(lines, "\x1b[1m"+table[0]+"\x1b[0m")
+
+	if t.selected < t.scroll {
+		t.scroll = t.selected
+	}
+	if t.selected >= t.scroll+rows {
+		t.scroll = t.selected - rows + 1
+	}
+
+	for i := 0; i < rows; i++ {
+		row := t.scroll + i
+		switch {
+		case row >= len(t.statuses):
+			lines = append(lines, "")
+		case row == t.selected:
+			lines = append(lines, "\x1b[7m"+pad(table[row+1], width)+"\x1b[0m")
+		default:
+			lines = append(lines, table[row+1])
+		}
+	}
+
+	lines = append(lines, "\x1b[1mEVENTS\x1b[0m")
+
+	events := t.feed
+	if feed < 0 {
+		feed = 0
+	}
+	if len(events) > feed {
+		events = events[len(events)-feed:]
+	}
+	for _, ev := range events {
+		b, _ := json.Marshal(ev.ev)
+		lines = append(lines, fmt.Sprintf("%s %s: %s", ev.t.Local().Format("15:04:05"), ev.ev.Type(), b))
+	}
+	for i := len(events); i < feed; i++ {
+		lines = append(lines, "")
+	}
+
+	footer := "j/k select  r restart  s stop  t start  q quit"
+	switch {
+	case t.err != nil:
+		footer = "error: " + t.err.Error()
+	case t.message != "":
+		footer = t.message + " - " + footer
+	}
+	lines = append(lines, footer)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i == height {
+			break
+		}
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(truncate(line, width))
+		buf.WriteString("\x1b[K")
+	}
+	buf.WriteString("\x1b[J")
+
+	return buf.Bytes()
+}
+
+// table returns the header and the rows of the process table.
+func (t *topView) table() []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "SCRIPT\tSTATE\tPID\tCPU%\tRSS\tRESTARTS\tNOTE")
+	for _, status := range t.statuses {
+		pid, cpu, rss := "-", "-", "-"
+		if status.PID != 0 {
+			pid = strconv.Itoa(status.PID)
+		}
+		if usage, ok := t.usage[status.PID]; ok && status.PID != 0 {
+			cpu = strconv.FormatFloat(usage.cpu, 'f', 1, 64)
+			rss = formatBytes(usage.rss)
+		}
+
+		var note string
+		switch {
+		case status.Stopped:
+			note = "stopped"
+		case status.SpawnFailing != "":
+			note = "spawn failing: " + status.SpawnFailing
+		case status.NextRestart != nil:
+			note = "restart in " + time.Until(*status.NextRestart).Round(time.Second).String()
+		case status.Waiting != "":
+			note = "waiting for " + status.Waiting
+		case status.RestartNeeded:
+			note = "restart needed"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			status.File, orDash(status.State != "", string(status.State)),
+			pid, cpu, rss, status.Restarts, note)
+	}
+
+	w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// truncate cuts the line to the given width. Escape sequences don't count
+// towards the width, and the attributes are reset if the line is cut.
+func truncate(line string, width int) string {
+	var n int
+	var esc bool
+
+	for i, r := range line {
+		switch {
+		case esc:
+			// Sequences end with a letter, such as "\x1b[7m".
+			esc = !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+		case r == '\x1b':
+			esc = true
+		case n == width:
+			return line[:i] + "\x1b[0m"
+		default:
+			n++
+		}
+	}
+
+	return line
+}
+
+// pad pads the line with spaces to the given width.
+func pad(line string, width int) string {
+	if n := utf8.RuneCountInString(line); n < width {
+		return line + strings.Repeat(" ", width-n)
+	}
+	return line
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for n/div >= unit && exp < 3 {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// procSampler samples the CPU and memory usage of processes from /proc.
+type procSampler struct {
+	last map[int]procSample
+}
+
+type procSample struct {
+	ticks uint64
+	at    time.Time
+}
+
+// procUsage is the usage of a process.
+type procUsage struct {
+	cpu float64 // percent of a CPU since the last sample
+	rss uint64  // bytes
+}
+
+// sample samples the given processes. The CPU usage of processes that weren't
+// sampled before is 0.
+func (s *procSampler) sample(pids []int) map[int]procUsage {
+	usages := make(map[int]procUsage, len(pids))
+	samples := make(map[int]procSample, len(pids))
+
+	now := time.Now()
+
+	for _, pid := range pids {
+		b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			continue
+		}
+
+		// The command may contain spaces and parentheses, so skip past its
+		// last parenthesis. The fields after it start from the state.
+		i := bytes.LastIndexByte(b, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(b[i+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		pages, _ := strconv.ParseUint(fields[21], 10, 64)
+
+		sample := procSample{ticks: utime + stime, at: now}
+		samples[pid] = sample
+
+		usage := procUsage{rss: pages * uint64(os.Getpagesize())}
+		if last, ok := s.last[pid]; ok && sample.ticks >= last.ticks {
+			if elapsed := now.Sub(last.at).Seconds(); elapsed > 0 {
+				usage.cpu = float64(sample.ticks-last.ticks) / topClockTicks / elapsed * 100
+			}
+		}
+		usages[pid] = usage
+	}
+
+	s.last = samples
+	return usages
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"git.unix.lgbt/diamondburned/cronmon/cronmon"
+)
+
+// newTestTop returns a top with a fixed snapshot of statuses, as sorted by the
+// monitor.
+func newTestTop() *topView {
+	return &topView{
+		statuses: []cronmon.ProcessStatus{
+			{File: "backup", State: cronmon.ProcessRunning, PID: 10, Restarts: 2},
+			{File: "mirror", State: cronmon.ProcessStopped, Stopped: true},
+			{File: "sync", State: cronmon.ProcessBackoff, SpawnFailing: "exec format error", Restarts: 7},
+			{File: "vpn", State: cronmon.ProcessIdle, Waiting: "network"},
+		},
+		usage: map[int]procUsage{10: {cpu: 12.5, rss: 3 << 20}},
+		seen:  map[string]time.Time{},
+	}
+}
+
+func TestTopTable(t *testing.T) {
+	expect := []string{
+		"SCRIPT  STATE    PID  CPU%  RSS   RESTARTS  NOTE",
+		"backup  running  10   12.5  3.0M  2         ",
+		"mirror  stopped  -    -     -     0         stopped",
+		"sync    backoff  -    -     -     7         spawn failing: exec format error",
+		"vpn     idle     -    -     -     0         waiting for network",
+	}
+
+	table := newTestTop().table()
+	if len(table) != len(expect) {
+		t.Fatalf("expected %d lines, got %q", len(expect), table)
+	}
+	for i := range expect {
+		if table[i] != expect[i] {
+			t.Errorf("line %d:\nexpected %q\ngot      %q", i, expect[i], table[i])
+		}
+	}
+}
+
+var escapeRegex = regexp.MustCompile("\x1b\\[[0-9;?]*[a-zA-Z]")
+
+// screenLines splits a rendered screen into its lines without escape
+// sequences.
+func screenLines(screen []byte) []string {
+	return strings.Split(escapeRegex.ReplaceAllString(string(screen), ""), "\r\n")
+}
+
+func TestTopRender(t *testing.T) {
+	top := newTestTop()
+	top.selected = 3
+	top.message = "restarted sync"
+
+	now := time.Date(2021, 4, 1, 12, 30, 0, 0, time.Local)
+	top.addFeed([]topEvent{
+		{now.Add(-time.Minute), &cronmon.EventWarning{Component: "test", Error: "old"}},
+		{now, &cronmon.EventWarning{Component: "test", Error: "new"}},
+	})
+
+	// 8 lines leave 2 rows for the 4 scripts and 2 for the feed.
+	screen := top.render(40, 8, now)
+	lines := screenLines(screen)
+
+	if len(lines) != 8 {
+		t.Fatalf("expected 8 lines, got %q", lines)
+	}
+
+	// The title is cut to the width.
+	if expect := "cronmon top - 4 scripts, 1 running - 12:"; lines[0] != expect {
+		t.Errorf("unexpected title %q", lines[0])
+	}
+
+	// The table scrolls down to the selected script, which is highlighted.
+	if !strings.HasPrefix(lines[2], "sync ") || !strings.HasPrefix(lines[3], "vpn ") {
+		t.Errorf("table did not scroll to the selection: %q", lines[1:4])
+	}
+	if !strings.Contains(string(screen), "\x1b[7mvpn ") {
+		t.Error("selected script is not highlighted")
+	}
+
+	if lines[4] != "EVENTS" {
+		t.Errorf("unexpected feed header %q", lines[4])
+	}
+	if !strings.HasPrefix(lines[5], "12:29:00 warning: ") || !strings.HasPrefix(lines[6], "12:30:00 warning: ") {
+		t.Errorf("unexpected feed %q", lines[5:7])
+	}
+
+	if !strings.HasPrefix(lines[7], "restarted sync - ") {
+		t.Errorf("unexpected footer %q", lines[7])
+	}
+
+	for i, line := range lines {
+		if n := utf8.RuneCountInString(line); n > 40 {
+			t.Errorf("line %d is %d wide: %q", i, n, line)
+		}
+	}
+}
+
+func TestTopFeed(t *testing.T) {
+	top := newTestTop()
+
+	base := time.Now()
+	event := func(sec int) topEvent {
+		return topEvent{base.Add(time.Duration(sec) * time.Second), &cronmon.EventWarning{}}
+	}
+
+	// Events are read from each journal from newest to oldest, and the
+	// journals interleave.
+	top.addFeed([]topEvent{event(5), event(3), event(1)})
+	top.addFeed([]topEvent{event(4), event(2)})
+
+	for i, ev := range top.feed {
+		if expect := base.Add(time.Duration(i+1) * time.Second); !ev.t.Equal(expect) {
+			t.Fatalf("event %d is at %v, expected %v", i, ev.t.Sub(base), expect.Sub(base))
+		}
+	}
+
+	// Only the newest events are kept.
+	var many []topEvent
+	for i := 0; i < topFeedSize; i++ {
+		many = append(many, event(10+i))
+	}
+	top.addFeed(many)
+
+	if len(top.feed) != topFeedSize {
+		t.Fatalf("expected %d events, got %d", topFeedSize, len(top.feed))
+	}
+	if first := top.feed[0].t.Sub(base); first != 10*time.Second {
+		t.Errorf("oldest kept event is at %v", first)
+	}
+}
+
+func TestTopKey(t *testing.T) {
+	top := newTestTop()
+
+	// Arrow keys are escape sequences.
+	for _, key := range "\x1b[B\x1b[Bj" {
+		if !top.key(byte(key)) {
+			t.Fatal("top quit on an arrow key")
+		}
+	}
+	if top.selected != 3 {
+		t.Errorf("expected selection 3, got %d", top.selected)
+	}
+
+	// The selection stays within the scripts.
+	top.key('j')
+	if top.selected != 3 {
+		t.Errorf("selection went past the last script: %d", top.selected)
+	}
+	for i := 0; i < 5; i++ {
+		top.key('k')
+	}
+	if top.selected != 0 {
+		t.Errorf("selection went past the first script: %d", top.selected)
+	}
+
+	if top.key('q') || top.key(3) {
+		t.Error("top did not quit")
+	}
+}